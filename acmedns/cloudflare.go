@@ -0,0 +1,125 @@
+package acmedns
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const cloudflareAPI = "https://api.cloudflare.com/client/v4"
+
+// Cloudflare is a Provider that manages challenge records through the Cloudflare API. The token needs the Zone:Read
+// and DNS:Edit permissions for the zone containing the domain.
+type Cloudflare struct {
+	APIToken string
+	Client   *http.Client
+
+	// BaseURL is the API endpoint to call instead of the public Cloudflare API, if set
+	BaseURL string
+}
+
+// Present creates the TXT record in the Cloudflare zone containing fqdn
+func (c *Cloudflare) Present(ctx context.Context, fqdn, value string) error {
+	zone, err := c.zoneID(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+	body, _ := json.Marshal(map[string]interface{}{
+		"type":    "TXT",
+		"name":    fqdn,
+		"content": value,
+		"ttl":     120,
+	})
+	return c.do(ctx, http.MethodPost, "/zones/"+zone+"/dns_records", body, nil)
+}
+
+// CleanUp deletes the TXT record created by Present
+func (c *Cloudflare) CleanUp(ctx context.Context, fqdn, value string) error {
+	zone, err := c.zoneID(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+	var records []struct {
+		ID string `json:"id"`
+	}
+	q := url.Values{"type": {"TXT"}, "name": {fqdn}, "content": {value}}
+	if err := c.do(ctx, http.MethodGet, "/zones/"+zone+"/dns_records?"+q.Encode(), nil, &records); err != nil {
+		return err
+	}
+	for _, r := range records {
+		if err := c.do(ctx, http.MethodDelete, "/zones/"+zone+"/dns_records/"+r.ID, nil, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// zoneID finds the zone for fqdn by looking up each of its parent domains in turn, most specific first
+func (c *Cloudflare) zoneID(ctx context.Context, fqdn string) (string, error) {
+	labels := strings.Split(strings.TrimSuffix(fqdn, "."), ".")
+	for i := 0; i < len(labels)-1; i++ {
+		var zones []struct {
+			ID string `json:"id"`
+		}
+		name := strings.Join(labels[i:], ".")
+		if err := c.do(ctx, http.MethodGet, "/zones?name="+url.QueryEscape(name), nil, &zones); err != nil {
+			return "", err
+		}
+		if len(zones) > 0 {
+			return zones[0].ID, nil
+		}
+	}
+	return "", fmt.Errorf("cloudflare: no zone found for %s", fqdn)
+}
+
+// do calls the Cloudflare API, decoding the result field of the response into result if it is non-nil
+func (c *Cloudflare) do(ctx context.Context, method, path string, body []byte, result interface{}) error {
+	base := c.BaseURL
+	if base == "" {
+		base = cloudflareAPI
+	}
+	req, err := http.NewRequestWithContext(ctx, method, base+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.APIToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var envelope struct {
+		Success bool                       `json:"success"`
+		Errors  []struct{ Message string } `json:"errors"`
+		Result  json.RawMessage            `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+		return fmt.Errorf("cloudflare: %s %s: %s", method, path, resp.Status)
+	}
+	if !envelope.Success {
+		msgs := make([]string, len(envelope.Errors))
+		for i, e := range envelope.Errors {
+			msgs[i] = e.Message
+		}
+		if len(msgs) == 0 {
+			msgs = append(msgs, resp.Status)
+		}
+		return errors.New("cloudflare: " + strings.Join(msgs, "; "))
+	}
+	if result != nil {
+		return json.Unmarshal(envelope.Result, result)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package acmedns
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeCloudflare is an httptest server standing in for the Cloudflare API, with the zone example.com holding the TXT
+// records created through it
+type fakeCloudflare struct {
+	*httptest.Server
+	mu      sync.Mutex
+	records map[string]map[string]string // record ID to the record's fields
+	nextID  int
+}
+
+func newFakeCloudflare(t *testing.T) *fakeCloudflare {
+	f := &fakeCloudflare{records: map[string]map[string]string{}}
+	reply := func(w http.ResponseWriter, result interface{}) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "result": result})
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /zones", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer token", r.Header.Get("Authorization"), "the API token should be sent")
+		zones := []map[string]string{}
+		if r.URL.Query().Get("name") == "example.com" {
+			zones = append(zones, map[string]string{"id": "zone1"})
+		}
+		reply(w, zones)
+	})
+	mux.HandleFunc("POST /zones/zone1/dns_records", func(w http.ResponseWriter, r *http.Request) {
+		var record map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&record)
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.nextID++
+		id := fmt.Sprint(f.nextID)
+		f.records[id] = map[string]string{"type": fmt.Sprint(record["type"]), "name": fmt.Sprint(record["name"]), "content": fmt.Sprint(record["content"])}
+		reply(w, map[string]string{"id": id})
+	})
+	mux.HandleFunc("GET /zones/zone1/dns_records", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		found := []map[string]string{}
+		for id, record := range f.records {
+			if record["type"] == r.URL.Query().Get("type") && record["name"] == r.URL.Query().Get("name") && record["content"] == r.URL.Query().Get("content") {
+				found = append(found, map[string]string{"id": id})
+			}
+		}
+		reply(w, found)
+	})
+	mux.HandleFunc("DELETE /zones/zone1/dns_records/{id}", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		delete(f.records, r.PathValue("id"))
+		reply(w, map[string]string{"id": r.PathValue("id")})
+	})
+	f.Server = httptest.NewServer(mux)
+	return f
+}
+
+// TestCloudflare tests that Present creates the TXT record in the zone containing the name and CleanUp deletes it
+// again, leaving other records alone
+func TestCloudflare(t *testing.T) {
+	api := newFakeCloudflare(t)
+	defer api.Close()
+	c := &Cloudflare{APIToken: "token", BaseURL: api.URL}
+	ctx := context.Background()
+
+	assert.Nil(t, c.Present(ctx, "_acme-challenge.www.example.com.", "one"), "error should be nil")
+	assert.Nil(t, c.Present(ctx, "_acme-challenge.www.example.com.", "two"), "error should be nil")
+	assert.Len(t, api.records, 2, "a record should be created for each value")
+	assert.Equal(t, map[string]string{"type": "TXT", "name": "_acme-challenge.www.example.com.", "content": "one"}, api.records["1"], "the TXT record should be created")
+
+	assert.Nil(t, c.CleanUp(ctx, "_acme-challenge.www.example.com.", "one"), "error should be nil")
+	assert.Len(t, api.records, 1, "the record should be deleted")
+	assert.Equal(t, "two", api.records["2"]["content"], "other records should be kept")
+
+	err := c.Present(ctx, "_acme-challenge.example.org.", "one")
+	assert.EqualError(t, err, "cloudflare: no zone found for _acme-challenge.example.org.", "a name outside every zone should fail")
+}
@@ -0,0 +1,318 @@
+// Package acmedns obtains and renews certificates from an ACME CA such as LetsEncrypt using the DNS-01 challenge,
+// which unlike the HTTP-01 and TLS-ALPN-01 challenges used by autocert can issue wildcard certificates.
+package acmedns
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/snewstv/ssl-proxy/logging"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// Provider creates and removes the DNS TXT records used to answer DNS-01 challenges
+type Provider interface {
+	// Present creates a TXT record named fqdn with the given value
+	Present(ctx context.Context, fqdn, value string) error
+	// CleanUp removes the TXT record created by Present
+	CleanUp(ctx context.Context, fqdn, value string) error
+}
+
+// renewBefore is how long before expiry a certificate is renewed
+const renewBefore = 30 * 24 * time.Hour
+
+// Manager obtains a single certificate covering Domains, which may include wildcards like *.example.com, and keeps
+// it renewed. Its zero value is not usable; Domains, Provider and Cache must be set.
+type Manager struct {
+	Domains  []string
+	Provider Provider
+	Cache    autocert.Cache
+
+	// Client is the ACME client used to talk to the CA. If nil, a client for the LetsEncrypt production directory
+	// is used.
+	Client *acme.Client
+	// Email is the optional contact address registered with the CA for expiry notices
+	Email string
+	// PropagationTimeout is how long to wait for a challenge record to become visible in DNS before asking the CA to
+	// validate it anyway. Defaults to 2 minutes.
+	PropagationTimeout time.Duration
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+// Start loads the cached certificate or obtains a new one, then renews it in the background until ctx is done
+func (m *Manager) Start(ctx context.Context) error {
+	if err := m.loadOrObtain(ctx); err != nil {
+		return err
+	}
+	go m.renewLoop(ctx)
+	return nil
+}
+
+// GetCertificate returns the managed certificate, for use as tls.Config.GetCertificate
+func (m *Manager) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.cert == nil {
+		return nil, errors.New("acmedns: no certificate obtained yet")
+	}
+	return m.cert, nil
+}
+
+// TLSConfig returns a tls.Config serving the managed certificate
+func (m *Manager) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: m.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+}
+
+func (m *Manager) loadOrObtain(ctx context.Context) error {
+	if b, err := m.Cache.Get(ctx, m.certKey()); err == nil {
+		cert, err := tls.X509KeyPair(b, b)
+		if err == nil && !needsRenewal(&cert) {
+			logging.Infof("Loaded cached certificate for %s", strings.Join(m.Domains, ", "))
+			m.setCert(&cert)
+			return nil
+		}
+	} else if err != autocert.ErrCacheMiss {
+		return err
+	}
+	return m.obtain(ctx)
+}
+
+func (m *Manager) renewLoop(ctx context.Context) {
+	ticker := time.NewTicker(12 * time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		m.mu.RLock()
+		renew := needsRenewal(m.cert)
+		m.mu.RUnlock()
+		if !renew {
+			continue
+		}
+		logging.Infof("Renewing certificate for %s", strings.Join(m.Domains, ", "))
+		if err := m.obtain(ctx); err != nil {
+			logging.Warnf("Unable to renew certificate for %s, will retry: %v", strings.Join(m.Domains, ", "), err)
+		}
+	}
+}
+
+// obtain runs a full ACME order for m.Domains, answering every authorization with a DNS-01 challenge, then caches and
+// serves the resulting certificate
+func (m *Manager) obtain(ctx context.Context) error {
+	client, err := m.client(ctx)
+	if err != nil {
+		return err
+	}
+
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(m.Domains...))
+	if err != nil {
+		return fmt.Errorf("acmedns: unable to create order: %v", err)
+	}
+	for _, u := range order.AuthzURLs {
+		if err := m.authorize(ctx, client, u); err != nil {
+			return err
+		}
+	}
+	order, err = client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return fmt.Errorf("acmedns: order failed: %v", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: m.Domains[0]},
+		DNSNames: m.Domains,
+	}, key)
+	if err != nil {
+		return err
+	}
+	der, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return fmt.Errorf("acmedns: unable to finalize order: %v", err)
+	}
+
+	// Cache the key and chain together as PEM, the same layout autocert uses
+	var buf bytes.Buffer
+	keyBytes, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	pem.Encode(&buf, &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes})
+	for _, b := range der {
+		pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: b})
+	}
+	cert, err := tls.X509KeyPair(buf.Bytes(), buf.Bytes())
+	if err != nil {
+		return err
+	}
+	if err := m.Cache.Put(ctx, m.certKey(), buf.Bytes()); err != nil {
+		logging.Errorf("Unable to cache certificate: %v", err)
+	}
+	m.setCert(&cert)
+	logging.Infof("Obtained certificate for %s, valid until %s", strings.Join(m.Domains, ", "), cert.Leaf.NotAfter)
+	return nil
+}
+
+// authorize satisfies a single authorization using its DNS-01 challenge
+func (m *Manager) authorize(ctx context.Context, client *acme.Client, authzURL string) error {
+	authz, err := client.GetAuthorization(ctx, authzURL)
+	if err != nil {
+		return err
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+
+	var chal *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == "dns-01" {
+			chal = c
+			break
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("acmedns: no dns-01 challenge offered for %s", authz.Identifier.Value)
+	}
+
+	value, err := client.DNS01ChallengeRecord(chal.Token)
+	if err != nil {
+		return err
+	}
+	fqdn := "_acme-challenge." + authz.Identifier.Value
+	if err := m.Provider.Present(ctx, fqdn, value); err != nil {
+		return fmt.Errorf("acmedns: unable to create TXT record %s: %v", fqdn, err)
+	}
+	defer func() {
+		if err := m.Provider.CleanUp(context.Background(), fqdn, value); err != nil {
+			logging.Warnf("Unable to remove TXT record %s: %v", fqdn, err)
+		}
+	}()
+	m.waitForPropagation(ctx, fqdn, value)
+
+	if _, err := client.Accept(ctx, chal); err != nil {
+		return fmt.Errorf("acmedns: unable to accept challenge for %s: %v", authz.Identifier.Value, err)
+	}
+	if _, err := client.WaitAuthorization(ctx, authz.URI); err != nil {
+		return fmt.Errorf("acmedns: authorization for %s failed: %v", authz.Identifier.Value, err)
+	}
+	return nil
+}
+
+// waitForPropagation polls DNS until the TXT record is visible or PropagationTimeout passes. This is best effort;
+// the local resolver may not see what the CA sees, so the challenge is attempted regardless.
+func (m *Manager) waitForPropagation(ctx context.Context, fqdn, value string) {
+	timeout := m.PropagationTimeout
+	if timeout <= 0 {
+		timeout = 2 * time.Minute
+	}
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		records, _ := net.DefaultResolver.LookupTXT(ctx, fqdn)
+		for _, r := range records {
+			if r == value {
+				return
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+	logging.Warnf("TXT record %s not visible after %s, attempting the challenge anyway", fqdn, timeout)
+}
+
+// client returns the ACME client with a registered account, creating and caching the account key if needed
+func (m *Manager) client(ctx context.Context) (*acme.Client, error) {
+	client := m.Client
+	if client == nil {
+		client = &acme.Client{DirectoryURL: autocert.DefaultACMEDirectory}
+	}
+	if client.Key == nil {
+		key, err := m.accountKey(ctx)
+		if err != nil {
+			return nil, err
+		}
+		client.Key = key
+	}
+	m.Client = client
+
+	var contact []string
+	if m.Email != "" {
+		contact = []string{"mailto:" + m.Email}
+	}
+	_, err := client.Register(ctx, &acme.Account{Contact: contact}, acme.AcceptTOS)
+	if err != nil && err != acme.ErrAccountAlreadyExists {
+		return nil, fmt.Errorf("acmedns: unable to register account: %v", err)
+	}
+	return client, nil
+}
+
+func (m *Manager) accountKey(ctx context.Context) (crypto.Signer, error) {
+	const name = "acme_account+key"
+	if b, err := m.Cache.Get(ctx, name); err == nil {
+		block, _ := pem.Decode(b)
+		if block == nil {
+			return nil, errors.New("acmedns: invalid cached account key")
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	} else if err != autocert.ErrCacheMiss {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	b, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.Cache.Put(ctx, name, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b})); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (m *Manager) setCert(cert *tls.Certificate) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cert = cert
+}
+
+// certKey is the cache key for the certificate, distinct from the per-host keys autocert uses
+func (m *Manager) certKey() string {
+	return strings.ReplaceAll(strings.Join(m.Domains, ","), "*", "_") + "+dns01"
+}
+
+// needsRenewal reports whether cert is missing or expires within renewBefore
+func needsRenewal(cert *tls.Certificate) bool {
+	return cert == nil || cert.Leaf == nil || time.Until(cert.Leaf.NotAfter) < renewBefore
+}
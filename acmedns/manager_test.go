@@ -0,0 +1,22 @@
+package acmedns
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestNeedsRenewal tests that certificates are renewed once they are missing or within renewBefore of expiring
+func TestNeedsRenewal(t *testing.T) {
+	expiring := func(in time.Duration) *tls.Certificate {
+		return &tls.Certificate{Leaf: &x509.Certificate{NotAfter: time.Now().Add(in)}}
+	}
+	assert.True(t, needsRenewal(nil), "a missing certificate should be renewed")
+	assert.True(t, needsRenewal(&tls.Certificate{}), "a certificate without a parsed leaf should be renewed")
+	assert.True(t, needsRenewal(expiring(-time.Hour)), "an expired certificate should be renewed")
+	assert.True(t, needsRenewal(expiring(renewBefore-time.Hour)), "a certificate expiring soon should be renewed")
+	assert.False(t, needsRenewal(expiring(renewBefore+time.Hour)), "a certificate far from expiring should be kept")
+}
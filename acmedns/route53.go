@@ -0,0 +1,94 @@
+package acmedns
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/route53"
+	"github.com/aws/aws-sdk-go-v2/service/route53/types"
+)
+
+// Route53 is a Provider that manages challenge records in AWS Route 53. Credentials come from the standard AWS
+// sources: environment variables, the shared config files or an instance role.
+type Route53 struct {
+	// HostedZoneID is the zone to create records in. If empty it is looked up from the record name.
+	HostedZoneID string
+
+	client *route53.Client
+}
+
+// Present upserts the TXT record and waits for Route 53 to report the change as in sync
+func (r *Route53) Present(ctx context.Context, fqdn, value string) error {
+	return r.change(ctx, types.ChangeActionUpsert, fqdn, value, true)
+}
+
+// CleanUp deletes the TXT record created by Present
+func (r *Route53) CleanUp(ctx context.Context, fqdn, value string) error {
+	return r.change(ctx, types.ChangeActionDelete, fqdn, value, false)
+}
+
+func (r *Route53) change(ctx context.Context, action types.ChangeAction, fqdn, value string, wait bool) error {
+	if r.client == nil {
+		cfg, err := config.LoadDefaultConfig(ctx)
+		if err != nil {
+			return fmt.Errorf("route53: unable to load AWS config: %v", err)
+		}
+		r.client = route53.NewFromConfig(cfg)
+	}
+	zone, err := r.zoneID(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+
+	out, err := r.client.ChangeResourceRecordSets(ctx, &route53.ChangeResourceRecordSetsInput{
+		HostedZoneId: aws.String(zone),
+		ChangeBatch: &types.ChangeBatch{
+			Changes: []types.Change{{
+				Action: action,
+				ResourceRecordSet: &types.ResourceRecordSet{
+					Name:            aws.String(fqdn),
+					Type:            types.RRTypeTxt,
+					TTL:             aws.Int64(60),
+					ResourceRecords: []types.ResourceRecord{{Value: aws.String(`"` + value + `"`)}},
+				},
+			}},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("route53: %v", err)
+	}
+	if !wait {
+		return nil
+	}
+	waiter := route53.NewResourceRecordSetsChangedWaiter(r.client)
+	return waiter.Wait(ctx, &route53.GetChangeInput{Id: out.ChangeInfo.Id}, 5*time.Minute)
+}
+
+// zoneID returns the configured hosted zone, or the public zone whose name is the longest suffix of fqdn
+func (r *Route53) zoneID(ctx context.Context, fqdn string) (string, error) {
+	if r.HostedZoneID != "" {
+		return r.HostedZoneID, nil
+	}
+	name := strings.TrimSuffix(fqdn, ".") + "."
+	labels := strings.Split(name, ".")
+	for i := 0; i < len(labels)-2; i++ {
+		candidate := strings.Join(labels[i:], ".")
+		out, err := r.client.ListHostedZonesByName(ctx, &route53.ListHostedZonesByNameInput{
+			DNSName:  aws.String(candidate),
+			MaxItems: aws.Int32(1),
+		})
+		if err != nil {
+			return "", fmt.Errorf("route53: %v", err)
+		}
+		for _, z := range out.HostedZones {
+			if aws.ToString(z.Name) == candidate && (z.Config == nil || !z.Config.PrivateZone) {
+				return strings.TrimPrefix(aws.ToString(z.Id), "/hostedzone/"), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("route53: no hosted zone found for %s", fqdn)
+}
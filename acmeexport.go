@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/snewstv/ssl-proxy/logging"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// exportCache is an ACME cache that also writes every certificate passing through it, whether just obtained or read
+// back from the cache, to dir as PEM files that other processes can use. Each certificate gets a directory named
+// after its first domain, holding its full chain in fullchain.pem and its private key in privkey.pem, with the modes
+// and owner in perms.
+type exportCache struct {
+	autocert.Cache
+	dir   string
+	perms filePerms
+}
+
+func (c exportCache) Get(ctx context.Context, name string) ([]byte, error) {
+	data, err := c.Cache.Get(ctx, name)
+	if err == nil {
+		c.export(name, data)
+	}
+	return data, err
+}
+
+func (c exportCache) Put(ctx context.Context, name string, data []byte) error {
+	if err := c.Cache.Put(ctx, name, data); err != nil {
+		return err
+	}
+	c.export(name, data)
+	return nil
+}
+
+// export writes data to dir if it is a certificate and its key, as cached by autocert and acmedns, and differs from
+// what was last exported. Anything else in the cache, such as the ACME account key, is ignored.
+func (c exportCache) export(name string, data []byte) {
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil || len(cert.Leaf.DNSNames) == 0 {
+		return
+	}
+	var chain, key bytes.Buffer
+	for rest := data; ; {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			pem.Encode(&chain, block)
+		} else {
+			pem.Encode(&key, block)
+		}
+	}
+
+	// autocert caches an RSA certificate alongside the ECDSA one for clients that need it
+	base := strings.ReplaceAll(cert.Leaf.DNSNames[0], "*", "_")
+	if strings.HasSuffix(name, "+rsa") {
+		base += "+rsa"
+	}
+	dir := filepath.Join(c.dir, base)
+	if old, err := os.ReadFile(filepath.Join(dir, "fullchain.pem")); err == nil && bytes.Equal(old, chain.Bytes()) {
+		return
+	}
+	// The key is written first, so that a process noticing the new chain finds its key in place
+	if err := writeFileAtomic(filepath.Join(dir, "privkey.pem"), key.Bytes(), c.perms.keyMode, c.perms, true); err != nil {
+		logging.Errorf("Unable to export certificate for %s: %v", base, err)
+		return
+	}
+	if err := writeFileAtomic(filepath.Join(dir, "fullchain.pem"), chain.Bytes(), c.perms.certMode, c.perms, true); err != nil {
+		logging.Errorf("Unable to export certificate for %s: %v", base, err)
+		return
+	}
+	logging.Infof("Exported certificate for %s to %s, valid until %s", base, dir, cert.Leaf.NotAfter)
+}
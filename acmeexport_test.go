@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/snewstv/ssl-proxy/gen"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// TestExportCache tests that certificates put in or read from the ACME cache are written out as PEM files, and that
+// the rest of the cache isn't
+func TestExportCache(t *testing.T) {
+	dir := t.TempDir()
+	cache := exportCache{Cache: autocert.DirCache(t.TempDir()), dir: dir, perms: filePerms{certMode: 0644, keyMode: 0600, uid: -1, gid: -1}}
+	cert, key, _, err := gen.Keys(time.Hour, []string{"example.com"}, gen.ECDSAP256)
+	if !assert.Nil(t, err, "error should be nil") {
+		return
+	}
+	ctx := context.Background()
+	assert.Nil(t, cache.Put(ctx, "acme_account+key", key.Bytes()), "error should be nil")
+	assert.Nil(t, cache.Put(ctx, "example.com", append(key.Bytes(), cert.Bytes()...)), "error should be nil")
+
+	entries, _ := os.ReadDir(dir)
+	assert.Len(t, entries, 1, "only the certificate should be exported")
+	chain, err := os.ReadFile(filepath.Join(dir, "example.com", "fullchain.pem"))
+	assert.Nil(t, err, "error should be nil")
+	assert.Equal(t, cert.Bytes(), chain, "the chain should be exported")
+	exported, err := os.ReadFile(filepath.Join(dir, "example.com", "privkey.pem"))
+	assert.Nil(t, err, "error should be nil")
+	assert.Equal(t, key.Bytes(), exported, "the key should be exported")
+	if info, err := os.Stat(filepath.Join(dir, "example.com", "privkey.pem")); assert.Nil(t, err, "error should be nil") {
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm(), "the key should be private")
+	}
+
+	// A certificate already in the cache is exported when it is read back, such as on startup
+	assert.Nil(t, os.RemoveAll(filepath.Join(dir, "example.com")), "error should be nil")
+	_, err = cache.Get(ctx, "example.com")
+	assert.Nil(t, err, "error should be nil")
+	assert.FileExists(t, filepath.Join(dir, "example.com", "fullchain.pem"), "the cached certificate should be exported")
+}
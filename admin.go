@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/snewstv/ssl-proxy/logging"
+	"github.com/snewstv/ssl-proxy/reverseproxy"
+)
+
+// readiness is the JSON body of the /ready probe
+type readiness struct {
+	Ready       bool              `json:"ready"`
+	Maintenance bool              `json:"maintenance,omitempty"`
+	Backends    []backendStatus   `json:"backends"`
+	Certificate *certificateState `json:"certificate,omitempty"`
+}
+
+type backendStatus struct {
+	URL      string `json:"url"`
+	Healthy  bool   `json:"healthy"`
+	Draining bool   `json:"draining,omitempty"`
+}
+
+type certificateState struct {
+	NotAfter  time.Time `json:"not_after"`
+	ExpiresIn string    `json:"expires_in"`
+}
+
+// adminHandler serves the probes and backend controls of the -admin-addr listener. /live always answers 200, while
+// /ready answers 200 only while at least one backend is healthy and not draining and maintenance mode is off, and 503
+// otherwise, describing the backends and, if cert returns one, the certificate being served. GET /backends lists the
+// backends, and POST /backends/{addr}/drain and /undrain take a backend out of rotation and put it back. POST /reload
+// reloads the config file, answering 400 with the error if it is invalid. The POST endpoints need token as a bearer
+// token if it is set, and are otherwise only served to clients on the loopback interface.
+func adminHandler(rt *router, cert func() *x509.Certificate, maint *maintenance, token string) http.Handler {
+	backends := func() []backendStatus {
+		var list []backendStatus
+		for _, p := range rt.Proxies() {
+			for _, b := range p.Backends() {
+				list = append(list, backendStatus{
+					URL:      b.URL.String(),
+					Healthy:  b.Healthy() && b.BreakerState() == reverseproxy.BreakerClosed,
+					Draining: b.Draining(),
+				})
+			}
+		}
+		return list
+	}
+	status := func() readiness {
+		r := readiness{Backends: backends()}
+		for _, b := range r.Backends {
+			r.Ready = r.Ready || (b.Healthy && !b.Draining)
+		}
+		if maint.On() {
+			r.Ready, r.Maintenance = false, true
+		}
+		if c := cert(); c != nil {
+			r.Certificate = &certificateState{
+				NotAfter:  c.NotAfter,
+				ExpiresIn: time.Until(c.NotAfter).Round(time.Second).String(),
+			}
+		}
+		return r
+	}
+	write := func(w http.ResponseWriter, code int, body interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(body)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/live", func(w http.ResponseWriter, r *http.Request) {
+		write(w, http.StatusOK, map[string]bool{"live": true})
+	})
+	mux.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
+		s := status()
+		code := http.StatusOK
+		if !s.Ready {
+			code = http.StatusServiceUnavailable
+		}
+		write(w, code, s)
+	})
+	mux.HandleFunc("GET /backends", func(w http.ResponseWriter, r *http.Request) {
+		write(w, http.StatusOK, backends())
+	})
+	authorized := func(h http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if token == "" {
+				if host, _, err := net.SplitHostPort(r.RemoteAddr); err != nil || !net.ParseIP(host).IsLoopback() {
+					write(w, http.StatusForbidden, map[string]string{"error": "set -admin-token to use this endpoint from other hosts"})
+					return
+				}
+			} else {
+				given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+				if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+					w.Header().Set("WWW-Authenticate", "Bearer")
+					write(w, http.StatusUnauthorized, map[string]string{"error": "missing or wrong admin token"})
+					return
+				}
+			}
+			h(w, r)
+		}
+	}
+	drain := func(drain bool) http.HandlerFunc {
+		return authorized(func(w http.ResponseWriter, r *http.Request) {
+			addr := r.PathValue("addr")
+			found := false
+			for _, p := range rt.Proxies() {
+				for _, b := range p.Backends() {
+					if b.URL.Host != addr && b.URL.String() != addr {
+						continue
+					}
+					found = true
+					if drain && b.Drain() {
+						logging.Infof("Draining backend %s", b.URL)
+					} else if !drain && b.Undrain() {
+						logging.Infof("Backend %s is back in rotation", b.URL)
+					}
+				}
+			}
+			if !found {
+				write(w, http.StatusNotFound, map[string]string{"error": "no backend " + addr})
+				return
+			}
+			write(w, http.StatusOK, backends())
+		})
+	}
+	mux.HandleFunc("POST /backends/{addr}/drain", drain(true))
+	mux.HandleFunc("POST /backends/{addr}/undrain", drain(false))
+	mux.HandleFunc("POST /reload", authorized(func(w http.ResponseWriter, r *http.Request) {
+		if err := rt.reload(); err != nil {
+			logging.Errorf("Unable to reload config file: %v", err)
+			write(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		write(w, http.StatusOK, map[string]bool{"reloaded": true})
+	}))
+	return mux
+}
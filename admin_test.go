@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/snewstv/ssl-proxy/reverseproxy"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestAdminHandler tests that the readiness probe follows backend health, cert expiry and maintenance mode, while the
+// liveness probe always succeeds
+func TestAdminHandler(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	u, err := url.Parse(backend.URL)
+	assert.Nil(t, err, "error should be nil")
+	proxy := reverseproxy.Build([]reverseproxy.Target{{URL: u, Weight: 1}}, reverseproxy.Options{})
+	notAfter := time.Now().Add(time.Hour).Truncate(time.Second)
+	handler := adminHandler(newRouter("", reverseproxy.Options{}, nil, []*reverseproxy.Proxy{proxy}), func() *x509.Certificate {
+		return &x509.Certificate{NotAfter: notAfter}
+	}, nil, "")
+	ready := func() (int, readiness) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/ready", nil))
+		var body readiness
+		assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &body), "the readiness probe should answer JSON")
+		return rec.Code, body
+	}
+
+	code, body := ready()
+	assert.Equal(t, http.StatusOK, code, "the proxy should be ready with a healthy backend")
+	assert.True(t, body.Backends[0].Healthy, "the backend should be reported healthy")
+	assert.True(t, notAfter.Equal(body.Certificate.NotAfter), "the cert expiry should be reported")
+
+	// A refused connection marks the backend down
+	backend.Close()
+	proxy.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	code, body = ready()
+	assert.Equal(t, http.StatusServiceUnavailable, code, "the proxy should not be ready without a healthy backend")
+	assert.False(t, body.Backends[0].Healthy, "the backend should be reported down")
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/live", nil))
+	assert.Equal(t, http.StatusOK, rec.Code, "the proxy should always be live")
+
+	file := filepath.Join(t.TempDir(), "maintenance")
+	assert.Nil(t, os.WriteFile(file, nil, 0644), "error should be nil")
+	handler = adminHandler(newRouter("", reverseproxy.Options{}, nil, nil), func() *x509.Certificate { return nil }, newMaintenance(file, reverseproxy.ErrorHTML), "")
+	code, body = ready()
+	assert.Equal(t, http.StatusServiceUnavailable, code, "the proxy should not be ready during maintenance")
+	assert.True(t, body.Maintenance, "maintenance mode should be reported")
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/live", nil))
+	assert.Equal(t, http.StatusOK, rec.Code, "the proxy should always be live")
+}
+
+// TestAdminHandler_Drain tests that backends can be listed, drained and undrained by their address or URL through the
+// admin API
+func TestAdminHandler_Drain(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	u, err := url.Parse(backend.URL)
+	assert.Nil(t, err, "error should be nil")
+	proxy := reverseproxy.Build([]reverseproxy.Target{{URL: u, Weight: 1}}, reverseproxy.Options{})
+	rt := newRouter("", reverseproxy.Options{}, nil, []*reverseproxy.Proxy{proxy})
+	handler := adminHandler(rt, func() *x509.Certificate { return nil }, nil, "secret")
+	do := func(method, path string) (int, []backendStatus) {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		handler.ServeHTTP(rec, req)
+		var body []backendStatus
+		json.Unmarshal(rec.Body.Bytes(), &body)
+		return rec.Code, body
+	}
+
+	code, body := do("GET", "/backends")
+	assert.Equal(t, http.StatusOK, code, "the backends should be listed")
+	assert.Equal(t, []backendStatus{{URL: backend.URL, Healthy: true}}, body, "the backend should be listed")
+
+	code, body = do("POST", "/backends/"+u.Host+"/drain")
+	assert.Equal(t, http.StatusOK, code, "the backend should be drained")
+	assert.True(t, body[0].Draining, "the backend should be reported draining")
+	assert.True(t, proxy.Backends()[0].Draining(), "the backend should be draining")
+	code, _ = do("GET", "/ready")
+	assert.Equal(t, http.StatusServiceUnavailable, code, "the proxy should not be ready with only a draining backend")
+
+	code, _ = do("POST", "/backends/"+url.PathEscape(backend.URL)+"/undrain")
+	assert.Equal(t, http.StatusOK, code, "the backend should be undrained by its URL")
+	assert.False(t, proxy.Backends()[0].Draining(), "the backend should be back in rotation")
+
+	code, _ = do("POST", "/backends/127.0.0.1:1/drain")
+	assert.Equal(t, http.StatusNotFound, code, "an unknown backend should not be found")
+	code, _ = do("GET", "/backends/"+u.Host+"/drain")
+	assert.Equal(t, http.StatusMethodNotAllowed, code, "draining should require POST")
+}
+
+// TestAdminHandler_Auth tests that the admin endpoints changing state need the admin token if one is set, and are
+// otherwise only served to clients on loopback, while the probes stay open to everyone
+func TestAdminHandler_Auth(t *testing.T) {
+	u, err := url.Parse("http://127.0.0.1:8000")
+	assert.Nil(t, err, "error should be nil")
+	proxy := reverseproxy.Build([]reverseproxy.Target{{URL: u, Weight: 1}}, reverseproxy.Options{})
+	defer proxy.Close()
+	rt := newRouter("", reverseproxy.Options{}, nil, []*reverseproxy.Proxy{proxy})
+	do := func(token, remoteAddr, method, path, auth string) int {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, nil)
+		req.RemoteAddr = remoteAddr
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		adminHandler(rt, func() *x509.Certificate { return nil }, nil, token).ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	drain := "/backends/127.0.0.1:8000/drain"
+	assert.Equal(t, http.StatusForbidden, do("", "192.0.2.1:1234", "POST", drain, ""), "other hosts should need a token")
+	assert.Equal(t, http.StatusOK, do("", "127.0.0.1:1234", "POST", drain, ""), "loopback clients should not need a token")
+	assert.Equal(t, http.StatusOK, do("", "[::1]:1234", "POST", "/backends/127.0.0.1:8000/undrain", ""), "loopback clients should not need a token")
+	assert.Equal(t, http.StatusUnauthorized, do("secret", "127.0.0.1:1234", "POST", drain, ""), "a set token should be needed from loopback too")
+	assert.Equal(t, http.StatusUnauthorized, do("secret", "192.0.2.1:1234", "POST", drain, "Bearer wrong"), "a wrong token should be refused")
+	assert.Equal(t, http.StatusOK, do("secret", "192.0.2.1:1234", "POST", drain, "Bearer secret"), "the right token should be accepted")
+	assert.Equal(t, http.StatusOK, do("secret", "192.0.2.1:1234", "GET", "/backends", ""), "the backends should be listed without a token")
+	assert.Equal(t, http.StatusOK, do("secret", "192.0.2.1:1234", "GET", "/live", ""), "the probes should not need a token")
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/snewstv/ssl-proxy/gen"
+	"github.com/snewstv/ssl-proxy/logging"
+)
+
+// certReloader serves the cert and key in a pair of files, which can be reloaded while serving. Connections that are
+// already established keep the cert they were handshaken with.
+type certReloader struct {
+	certFile, keyFile string
+	cert              atomic.Pointer[tls.Certificate]
+
+	// stapleOCSP staples an OCSP response from the cert's issuer to it, which is refreshed at nextStaple (in Unix
+	// seconds) by refreshOCSP
+	stapleOCSP bool
+	nextStaple atomic.Int64
+}
+
+// newCertReloader loads the cert and key from certFile and keyFile, stapling an OCSP response to the cert if
+// stapleOCSP is set
+func newCertReloader(certFile, keyFile string, stapleOCSP bool) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile, stapleOCSP: stapleOCSP}
+	if _, err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload loads the cert and key from disk again and starts serving them, returning the new cert. If they can't be
+// loaded the previous cert keeps being served. With stapleOCSP, the new cert is served without a staple until its OCSP
+// response has been fetched in the background, so that a slow responder doesn't hold up startup or a reload.
+func (c *certReloader) Reload() (*tls.Certificate, error) {
+	cert, err := loadKeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return nil, err
+	}
+	c.cert.Store(&cert)
+	if c.stapleOCSP {
+		// Keep refreshOCSP from fetching a response of its own meanwhile
+		c.nextStaple.Store(time.Now().Add(ocspRetry).Unix())
+		go c.restaple()
+	}
+	return &cert, nil
+}
+
+// loadKeyPair loads a cert and key like tls.LoadX509KeyPair, but with errors saying what is wrong with which file
+func loadKeyPair(certFile, keyFile string) (tls.Certificate, error) {
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("unable to read certificate: %w", err)
+	}
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("unable to read private key: %w", err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return tls.Certificate{}, keyPairError(certPEM, keyPEM, certFile, keyFile, err)
+	}
+	return cert, nil
+}
+
+// keyPairError works out what is wrong with a cert and key that tls.X509KeyPair failed to load with err, by decoding
+// them itself rather than relying on the wording of err
+func keyPairError(certPEM, keyPEM []byte, certFile, keyFile string, err error) error {
+	certBlock := findPEMBlock(certPEM, func(typ string) bool { return typ == "CERTIFICATE" })
+	if certBlock == nil {
+		return fmt.Errorf("no PEM certificate found in %s: %w", certFile, err)
+	}
+	keyBlock := findPEMBlock(keyPEM, func(typ string) bool { return typ == "PRIVATE KEY" || strings.HasSuffix(typ, " PRIVATE KEY") })
+	if keyBlock == nil {
+		return fmt.Errorf("no PEM private key found in %s: %w", keyFile, err)
+	}
+	leaf, certErr := x509.ParseCertificate(certBlock.Bytes)
+	key, keyErr := parsePrivateKey(keyBlock.Bytes)
+	if certErr != nil || keyErr != nil {
+		return err
+	}
+	if pub, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool }); ok && !pub.Equal(leaf.PublicKey) {
+		return errors.New("certificate and private key do not match, check that -key is the key of -cert")
+	}
+	return err
+}
+
+// findPEMBlock returns the first PEM block in data whose type is accepted by match, or nil if there is none
+func findPEMBlock(data []byte, match func(typ string) bool) *pem.Block {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil || match(block.Type) {
+			return block
+		}
+	}
+}
+
+// parsePrivateKey parses a DER private key in any of the encodings tls.X509KeyPair accepts
+func parsePrivateKey(der []byte) (crypto.Signer, error) {
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		if signer, ok := key.(crypto.Signer); ok {
+			return signer, nil
+		}
+		return nil, errors.New("unsupported private key type")
+	}
+	return x509.ParseECPrivateKey(der)
+}
+
+// chainWarning describes what is wrong with the chain of cert, which should run from the leaf through every
+// intermediate certificate, each issued by the next, for clients to be able to verify it. The root may be left out.
+// A leaf alone is only fine if it is self-signed or issued directly by one of roots (the system's if nil). It returns
+// "" if the chain looks right.
+func chainWarning(cert *tls.Certificate, roots *x509.CertPool) string {
+	chain := make([]*x509.Certificate, len(cert.Certificate))
+	for i, der := range cert.Certificate {
+		c, err := x509.ParseCertificate(der)
+		if err != nil {
+			return fmt.Sprintf("certificate %d of the chain can't be parsed: %v", i+1, err)
+		}
+		chain[i] = c
+	}
+	leaf := chain[0]
+	for i := 1; i < len(chain); i++ {
+		if err := chain[i-1].CheckSignatureFrom(chain[i]); err != nil {
+			return fmt.Sprintf("certificate %d of the chain (%s) is not the issuer of the one before it (%s), so clients may reject the chain. List the leaf first, then each intermediate after the certificate it issued",
+				i+1, chain[i].Subject, chain[i-1].Subject)
+		}
+	}
+	if len(chain) > 1 {
+		return ""
+	}
+	selfSigned := bytes.Equal(leaf.RawIssuer, leaf.RawSubject) &&
+		leaf.CheckSignature(leaf.SignatureAlgorithm, leaf.RawTBSCertificate, leaf.Signature) == nil
+	if selfSigned {
+		return ""
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{Roots: roots}); err == nil {
+		return ""
+	}
+	return fmt.Sprintf("the file holds only the leaf certificate, issued by %s, so clients without that intermediate will reject it. Append the intermediate certificates after the leaf (e.g. use fullchain.pem rather than cert.pem)", leaf.Issuer)
+}
+
+// GetCertificate returns the current cert, for use as tls.Config.GetCertificate
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.cert.Load(), nil
+}
+
+// certSet serves several certReloaders from one listener, choosing between them by the server name clients ask for
+type certSet []*certReloader
+
+// newCertSet loads each pair of certFiles and keyFiles, which must be of the same length
+func newCertSet(certFiles, keyFiles []string, stapleOCSP bool) (certSet, error) {
+	var s certSet
+	for i := range certFiles {
+		c, err := newCertReloader(certFiles[i], keyFiles[i], stapleOCSP)
+		if err != nil {
+			return nil, fmt.Errorf("%s and %s: %w", certFiles[i], keyFiles[i], err)
+		}
+		s = append(s, c)
+	}
+	return s, nil
+}
+
+// GetCertificate returns the first cert that is valid for the server name in hello and supported by the client, or
+// the first cert of all if none is, for use as tls.Config.GetCertificate
+func (s certSet) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	for _, c := range s {
+		if cert := c.cert.Load(); hello.SupportsCertificate(cert) == nil {
+			return cert, nil
+		}
+	}
+	return s[0].cert.Load(), nil
+}
+
+// reloadAndLog reloads every cert and key, logging the outcomes
+func (s certSet) reloadAndLog() {
+	for _, c := range s {
+		c.reloadAndLog()
+	}
+}
+
+// refreshOCSP keeps the OCSP response stapled to the cert up to date until stop is closed
+func (c *certReloader) refreshOCSP(stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		if time.Now().Unix() < c.nextStaple.Load() {
+			continue
+		}
+		c.restaple()
+	}
+}
+
+// restaple staples a freshly fetched OCSP response to the current cert, unless it is reloaded in the meantime, which
+// fetches a response of its own
+func (c *certReloader) restaple() {
+	current := c.cert.Load()
+	cert := *current
+	next := staple(&cert)
+	if c.cert.CompareAndSwap(current, &cert) {
+		c.nextStaple.Store(next.Unix())
+	}
+}
+
+// reloadAndLog reloads the cert and key, logging the outcome
+func (c *certReloader) reloadAndLog() {
+	logging.Debugf("Reloading %s and %s", c.certFile, c.keyFile)
+	cert, err := c.Reload()
+	if err != nil {
+		logging.Errorf("Unable to reload %s and %s, still serving the previous cert: %v", c.certFile, c.keyFile, err)
+		return
+	}
+	logging.Infof("Reloaded certificate: %s", gen.DescribeCertificate(cert.Leaf))
+	if w := chainWarning(cert, nil); w != "" {
+		logging.Warnf("%s: %s", c.certFile, w)
+	}
+}
+
+// watch reloads the cert and key whenever either file changes, until stop is closed. Reloading waits until no change
+// has been seen for debounce, so that files still being written aren't loaded, and a cert and key that don't match yet
+// because only one has been replaced are rejected by Reload. ready, if non-nil, is closed once the files are being
+// watched.
+func (c *certReloader) watch(debounce time.Duration, stop <-chan struct{}, ready chan<- struct{}) error {
+	return watchFiles([]string{c.certFile, c.keyFile}, debounce, c.reloadAndLog, stop, ready)
+}
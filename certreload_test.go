@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/snewstv/ssl-proxy/gen"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeKeys(t *testing.T, certFile, keyFile string) [32]byte {
+	cert, key, fingerprint, err := gen.Keys(time.Hour, []string{"localhost"}, gen.ECDSAP256)
+	assert.Nil(t, err, "error should be nil")
+	assert.Nil(t, os.WriteFile(certFile, cert.Bytes(), 0644), "error should be nil")
+	assert.Nil(t, os.WriteFile(keyFile, key.Bytes(), 0600), "error should be nil")
+	return fingerprint
+}
+
+func servedFingerprint(c *certReloader) [32]byte {
+	cert, _ := c.GetCertificate(nil)
+	return sha256.Sum256(cert.Certificate[0])
+}
+
+// TestCertReloader_Reload tests that a reloaded cert is served, and that the previous one is kept when the new one is
+// invalid
+func TestCertReloader_Reload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	first := writeKeys(t, certFile, keyFile)
+	c, err := newCertReloader(certFile, keyFile, false)
+	assert.Nil(t, err, "error should be nil")
+	assert.Equal(t, first, servedFingerprint(c), "the initial cert should be served")
+
+	second := writeKeys(t, certFile, keyFile)
+	_, err = c.Reload()
+	assert.Nil(t, err, "error should be nil")
+	assert.Equal(t, second, servedFingerprint(c), "the reloaded cert should be served")
+
+	assert.Nil(t, os.WriteFile(certFile, []byte("garbage"), 0644), "error should be nil")
+	_, err = c.Reload()
+	assert.NotNil(t, err, "an invalid cert should fail to reload")
+	assert.Equal(t, second, servedFingerprint(c), "the previous cert should still be served")
+}
+
+// TestCertReloader_Watch tests that a cert changed on disk is picked up by the watcher and served
+func TestCertReloader_Watch(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	first := writeKeys(t, certFile, keyFile)
+	c, err := newCertReloader(certFile, keyFile, false)
+	assert.Nil(t, err, "error should be nil")
+
+	stop := make(chan struct{})
+	defer close(stop)
+	ready, failed := make(chan struct{}), make(chan error, 1)
+	go func() { failed <- c.watch(50*time.Millisecond, stop, ready) }()
+	select {
+	case <-ready:
+	case err := <-failed:
+		assert.Fail(t, "the watcher should start", "%v", err)
+		return
+	}
+
+	second := writeKeys(t, certFile, keyFile)
+	assert.NotEqual(t, first, second, "generated certs should differ")
+	assert.Eventually(t, func() bool { return servedFingerprint(c) == second }, 2*time.Second, 10*time.Millisecond,
+		"the changed cert should be served")
+}
+
+// TestCertSet_GetCertificate tests that the cert matching the SNI name is served, case insensitively, with the first
+// cert as the fallback
+func TestCertSet_GetCertificate(t *testing.T) {
+	dir := t.TempDir()
+	var certFiles, keyFiles []string
+	fingerprints := make(map[string][32]byte)
+	for _, name := range []string{"a.example", "b.example"} {
+		cert, key, fingerprint, err := gen.Keys(time.Hour, []string{name}, gen.ECDSAP256)
+		assert.Nil(t, err, "error should be nil")
+		certFile, keyFile := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+		assert.Nil(t, os.WriteFile(certFile, cert.Bytes(), 0644), "error should be nil")
+		assert.Nil(t, os.WriteFile(keyFile, key.Bytes(), 0600), "error should be nil")
+		certFiles, keyFiles = append(certFiles, certFile), append(keyFiles, keyFile)
+		fingerprints[name] = fingerprint
+	}
+	s, err := newCertSet(certFiles, keyFiles, false)
+	assert.Nil(t, err, "error should be nil")
+
+	for serverName, expected := range map[string]string{
+		"a.example":       "a.example",
+		"B.EXAMPLE":       "b.example",
+		"unknown.example": "a.example",
+		"":                "a.example",
+	} {
+		hello := &tls.ClientHelloInfo{
+			ServerName:        serverName,
+			SupportedVersions: []uint16{tls.VersionTLS13},
+			SignatureSchemes:  []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+		}
+		cert, err := s.GetCertificate(hello)
+		assert.Nil(t, err, "error should be nil")
+		assert.Equal(t, fingerprints[expected], sha256.Sum256(cert.Certificate[0]), "unexpected cert for %q", serverName)
+	}
+
+	_, err = newCertSet([]string{certFiles[0], filepath.Join(dir, "missing.crt")}, keyFiles, false)
+	assert.NotNil(t, err, "a missing cert should fail to load")
+}
+
+// TestLoadKeyPair tests that mismatched, swapped, keyless and missing files are reported with a helpful error
+func TestLoadKeyPair(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	otherCert, otherKey := filepath.Join(dir, "other-cert.pem"), filepath.Join(dir, "other-key.pem")
+	writeKeys(t, certFile, keyFile)
+	writeKeys(t, otherCert, otherKey)
+
+	_, err := loadKeyPair(certFile, keyFile)
+	assert.Nil(t, err, "a matching pair should load")
+	_, err = loadKeyPair(certFile, otherKey)
+	assert.ErrorContains(t, err, "certificate and private key do not match", "a mismatched pair should be reported")
+	_, err = loadKeyPair(keyFile, certFile)
+	assert.ErrorContains(t, err, "no PEM certificate found in "+keyFile, "swapped files should be reported")
+	_, err = loadKeyPair(certFile, certFile)
+	assert.ErrorContains(t, err, "no PEM private key found in "+certFile, "a key file without a key should be reported")
+	_, err = loadKeyPair(certFile, filepath.Join(dir, "missing.pem"))
+	assert.ErrorContains(t, err, "unable to read private key", "a missing key should be reported")
+}
+
+// TestChainWarning tests that chains missing their issuer or out of order are warned about, while complete, self-signed
+// and directly trusted ones are not
+func TestChainWarning(t *testing.T) {
+	chain, ca, _ := ocspChain(t, "http://127.0.0.1")
+	roots := x509.NewCertPool()
+	assert.Equal(t, "", chainWarning(&chain, roots), "a leaf followed by its issuer should be fine")
+
+	// A cert file holding the chain is served whole
+	dir := t.TempDir()
+	var certPEM bytes.Buffer
+	for _, der := range chain.Certificate {
+		pem.Encode(&certPEM, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(chain.PrivateKey)
+	assert.Nil(t, err, "error should be nil")
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "fullchain.pem"), certPEM.Bytes(), 0644), "error should be nil")
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "key.pem"), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600), "error should be nil")
+	loaded, err := loadKeyPair(filepath.Join(dir, "fullchain.pem"), filepath.Join(dir, "key.pem"))
+	assert.Nil(t, err, "error should be nil")
+	assert.Equal(t, chain.Certificate, loaded.Certificate, "every certificate in the file should be served, in order")
+
+	leafOnly := tls.Certificate{Certificate: chain.Certificate[:1]}
+	assert.Contains(t, chainWarning(&leafOnly, roots), "only the leaf certificate, issued by CN=test CA", "a leaf without its issuer should be warned about")
+	roots.AddCert(ca)
+	assert.Equal(t, "", chainWarning(&leafOnly, roots), "a leaf issued directly by a trusted root needs no chain")
+
+	other, _, _ := ocspChain(t, "http://127.0.0.1")
+	misordered := tls.Certificate{Certificate: [][]byte{chain.Certificate[0], other.Certificate[1]}}
+	assert.Contains(t, chainWarning(&misordered, roots), "certificate 2 of the chain (CN=test CA) is not the issuer", "a chain out of order should be warned about")
+
+	selfSigned, err := gen.KeyPair(time.Hour, []string{"localhost"}, gen.ECDSAP256)
+	assert.Nil(t, err, "error should be nil")
+	assert.Equal(t, "", chainWarning(&selfSigned, x509.NewCertPool()), "a self-signed cert needs no chain")
+}
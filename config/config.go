@@ -0,0 +1,222 @@
+package config
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// File is the parsed contents of a YAML config file. Apart from the sections below, every top level key names a
+// command line flag, and its value is applied as though it had been passed on the command line.
+type File struct {
+	// Hosts routes requests for each host name to its own backends, given in the same syntax as -to. Requests for
+	// any other host go to the -to backends, or get a 404 if -to is empty.
+	Hosts map[string]List `yaml:"hosts"`
+
+	// Paths routes requests whose path starts with each prefix to their own backends
+	Paths map[string]Route `yaml:"paths"`
+
+	// Patterns routes requests whose path matches a regular expression to their own backends. The first pattern
+	// matching a request wins, and patterns are checked before the Paths prefixes.
+	Patterns []Pattern `yaml:"patterns"`
+
+	Flags map[string]interface{} `yaml:",inline"`
+}
+
+// List is a list of strings that may be written in YAML either as a sequence or as a single comma separated string
+type List []string
+
+// UnmarshalYAML accepts either a scalar or a sequence of scalars
+func (l *List) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*l = List{value.Value}
+		return nil
+	}
+	var list []string
+	if err := value.Decode(&list); err != nil {
+		return err
+	}
+	*l = list
+	return nil
+}
+
+// String joins the list with commas
+func (l List) String() string {
+	return strings.Join(l, ",")
+}
+
+// Route sends requests under a path prefix to its own backends. It may be written in YAML either as a mapping or as
+// just the backends.
+type Route struct {
+	// To lists the backends in the same syntax as -to
+	To List `yaml:"to"`
+	// StripPrefix removes the prefix from the request path before it is forwarded
+	StripPrefix bool `yaml:"strip-prefix"`
+}
+
+// UnmarshalYAML accepts either a mapping or the backends alone
+func (r *Route) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind != yaml.MappingNode {
+		return value.Decode(&r.To)
+	}
+	// Node.Decode doesn't inherit KnownFields from the Decoder, so reject typos here
+	for i := 0; i < len(value.Content); i += 2 {
+		if key := value.Content[i].Value; key != "to" && key != "strip-prefix" {
+			return fmt.Errorf("line %d: unknown route key %q", value.Content[i].Line, key)
+		}
+	}
+	type plain Route
+	return value.Decode((*plain)(r))
+}
+
+// Pattern sends requests whose path matches a regular expression to its own backends
+type Pattern struct {
+	// Match is the regular expression, in Go syntax, matched against the request path. It isn't anchored, so most
+	// patterns should start with ^.
+	Match string `yaml:"match"`
+	// To lists the backends in the same syntax as -to
+	To List `yaml:"to"`
+	// Rewrite, if set, replaces the part of the path Match matched before the request is forwarded. $1 or ${name} in
+	// it is replaced by the text of that capture group.
+	Rewrite string `yaml:"rewrite"`
+
+	// Regexp is Match compiled when the file is parsed
+	Regexp *regexp.Regexp `yaml:"-"`
+}
+
+// UnmarshalYAML compiles the pattern, so that an invalid one fails when the config file is parsed
+func (p *Pattern) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind != yaml.MappingNode {
+		return fmt.Errorf("line %d: a pattern route must be a mapping with match and to keys", value.Line)
+	}
+	for i := 0; i < len(value.Content); i += 2 {
+		if key := value.Content[i].Value; key != "match" && key != "to" && key != "rewrite" {
+			return fmt.Errorf("line %d: unknown pattern route key %q", value.Content[i].Line, key)
+		}
+	}
+	type plain Pattern
+	if err := value.Decode((*plain)(p)); err != nil {
+		return err
+	}
+	if p.Match == "" {
+		return fmt.Errorf("line %d: a pattern route needs a match", value.Line)
+	}
+	re, err := regexp.Compile(p.Match)
+	if err != nil {
+		return fmt.Errorf("line %d: invalid pattern %q: %v", value.Line, p.Match, err)
+	}
+	p.Regexp = re
+	return nil
+}
+
+// Repeatable is implemented by flag values that may be given more than once. A YAML list for such a flag sets it once
+// per element; lists for any other flag are joined with commas.
+type Repeatable interface {
+	flag.Value
+	Repeatable()
+}
+
+// Load reads and parses the YAML config file at path
+func Load(path string) (*File, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(b)
+}
+
+// Parse parses YAML config file contents
+func Parse(b []byte) (*File, error) {
+	f := &File{}
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(f); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("invalid config file: %v", err)
+	}
+	return f, nil
+}
+
+// Apply sets every flag in fs named by the config file, skipping those in explicit (usually the flags that were passed
+// on the command line) so that they take precedence. Keys that don't name a flag in fs, or name one listed in ignore,
+// are reported as an error. Flags the file doesn't mention keep their defaults.
+func (f *File) Apply(fs *flag.FlagSet, explicit map[string]bool, ignore ...string) error {
+	var unknown []string
+	for name := range f.Flags {
+		if fs.Lookup(name) == nil || contains(ignore, name) {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown key(s) in config file: %s", strings.Join(unknown, ", "))
+	}
+
+	names := make([]string, 0, len(f.Flags))
+	for name := range f.Flags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if explicit[name] {
+			continue
+		}
+		if err := set(fs.Lookup(name), f.Flags[name]); err != nil {
+			return fmt.Errorf("invalid value for %s in config file: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// set applies a single decoded YAML value to a flag
+func set(fl *flag.Flag, value interface{}) error {
+	list, ok := value.([]interface{})
+	if !ok {
+		return fl.Value.Set(scalar(value))
+	}
+
+	if _, repeatable := fl.Value.(Repeatable); repeatable {
+		for _, v := range list {
+			if err := fl.Value.Set(scalar(v)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	parts := make([]string, len(list))
+	for i, v := range list {
+		parts[i] = scalar(v)
+	}
+	return fl.Value.Set(strings.Join(parts, ","))
+}
+
+func scalar(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Explicit returns the set of flags in fs that were set on the command line
+func Explicit(fs *flag.FlagSet) map[string]bool {
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	return explicit
+}
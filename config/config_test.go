@@ -0,0 +1,130 @@
+package config
+
+import (
+	"flag"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type repeatable []string
+
+func (r *repeatable) String() string     { return "" }
+func (r *repeatable) Set(s string) error { *r = append(*r, s); return nil }
+func (r *repeatable) Repeatable()        {}
+
+func newFlagSet() (*flag.FlagSet, *string, *time.Duration, *repeatable) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	to := fs.String("to", "http://127.0.0.1:80", "")
+	interval := fs.Duration("interval", time.Second, "")
+	headers := &repeatable{}
+	fs.Var(headers, "header", "")
+	return fs, to, interval, headers
+}
+
+// TestApply tests that config file values are applied to flags, lists are handled, and defaults are kept
+func TestApply(t *testing.T) {
+	f, err := Parse([]byte("to: [http://a, http://b]\nheader:\n  - 'A: 1'\n  - 'B: 2'\n"))
+	assert.Nil(t, err, "error should be nil")
+
+	fs, to, interval, headers := newFlagSet()
+	assert.Nil(t, f.Apply(fs, nil), "error should be nil")
+	assert.Equal(t, "http://a,http://b", *to, "lists should be joined for non-repeatable flags")
+	assert.Equal(t, time.Second, *interval, "missing keys should keep their defaults")
+	assert.Equal(t, repeatable{"A: 1", "B: 2"}, *headers, "lists should set repeatable flags once per element")
+}
+
+// TestApply_CommandLineWins tests that flags set on the command line are not overridden by the config file
+func TestApply_CommandLineWins(t *testing.T) {
+	f, err := Parse([]byte("to: http://file\ninterval: 5s\n"))
+	assert.Nil(t, err, "error should be nil")
+
+	fs, to, interval, _ := newFlagSet()
+	assert.Nil(t, fs.Parse([]string{"-to", "http://cli"}), "error should be nil")
+	assert.Nil(t, f.Apply(fs, Explicit(fs)), "error should be nil")
+	assert.Equal(t, "http://cli", *to, "command line flag should take precedence")
+	assert.Equal(t, 5*time.Second, *interval, "config file value should be applied")
+}
+
+// TestApply_UnknownKeys tests that typos in the config file are caught
+func TestApply_UnknownKeys(t *testing.T) {
+	f, err := Parse([]byte("too: http://file\n"))
+	assert.Nil(t, err, "error should be nil")
+
+	fs, _, _, _ := newFlagSet()
+	err = f.Apply(fs, nil)
+	assert.NotNil(t, err, "unknown keys should be an error")
+	assert.Contains(t, err.Error(), "too", "error should name the unknown key")
+}
+
+// TestParse_Hosts tests that host routes are parsed from either a string or a list, separately from the flags
+func TestParse_Hosts(t *testing.T) {
+	f, err := Parse([]byte("to: http://default\nhosts:\n  api.example.com: http://a\n  app.example.com: [http://b, http://c]\n"))
+	assert.Nil(t, err, "error should be nil")
+	assert.Equal(t, "http://a", f.Hosts["api.example.com"].String(), "string host route should be parsed")
+	assert.Equal(t, "http://b,http://c", f.Hosts["app.example.com"].String(), "list host route should be parsed")
+	assert.NotContains(t, f.Flags, "hosts", "hosts section should not be treated as a flag")
+}
+
+// TestParse_Paths tests that path routes are parsed from either a mapping or a list of backends, and unknown route keys
+// are rejected
+func TestParse_Paths(t *testing.T) {
+	f, err := Parse([]byte("paths:\n  /api/:\n    to: http://a\n    strip-prefix: true\n  /static/: [http://b, http://c]\n"))
+	assert.Nil(t, err, "error should be nil")
+	assert.Equal(t, Route{To: List{"http://a"}, StripPrefix: true}, f.Paths["/api/"], "mapping path route should be parsed")
+	assert.Equal(t, Route{To: List{"http://b", "http://c"}}, f.Paths["/static/"], "list path route should be parsed")
+
+	_, err = Parse([]byte("paths:\n  /api/:\n    to: http://a\n    strip: true\n"))
+	assert.NotNil(t, err, "unknown route keys should be rejected")
+}
+
+// TestParse_Patterns tests that pattern routes are parsed with their regular expression compiled, and invalid patterns
+// or unknown keys are rejected
+func TestParse_Patterns(t *testing.T) {
+	f, err := Parse([]byte("patterns:\n  - match: ^/v\\d+/users\n    to: http://a\n    rewrite: /users\n  - match: ^/ws/\n    to: [http://b, http://c]\n"))
+	if !assert.Nil(t, err, "error should be nil") || !assert.Len(t, f.Patterns, 2, "every pattern should be parsed") {
+		return
+	}
+	assert.Equal(t, List{"http://a"}, f.Patterns[0].To, "the backends should be parsed")
+	assert.Equal(t, "/users", f.Patterns[0].Rewrite, "the rewrite should be parsed")
+	assert.True(t, f.Patterns[0].Regexp.MatchString("/v2/users"), "the pattern should be compiled")
+	assert.Equal(t, List{"http://b", "http://c"}, f.Patterns[1].To, "list backends should be parsed")
+
+	_, err = Parse([]byte("patterns:\n  - match: ^/v(\\d+/users\n    to: http://a\n"))
+	assert.ErrorContains(t, err, `invalid pattern "^/v(\\d+/users"`, "invalid regular expressions should be rejected")
+	_, err = Parse([]byte("patterns:\n  - match: ^/api\n    to: http://a\n    strip: true\n"))
+	assert.ErrorContains(t, err, `unknown pattern route key "strip"`, "unknown pattern keys should be rejected")
+}
+
+// TestApplyEnv tests that flags are set from environment variables unless given on the command line, and that unknown
+// variables are found
+func TestApplyEnv(t *testing.T) {
+	fs, to, interval, headers := newFlagSet()
+	assert.Nil(t, fs.Parse([]string{"-interval", "2s"}), "error should be nil")
+	set, err := ApplyEnv(fs, "SSL_PROXY_", []string{
+		"SSL_PROXY_TO=http://env",
+		"SSL_PROXY_INTERVAL=5s",
+		"SSL_PROXY_HEADER=A: 1, 2\nB: 3\n",
+		"PATH=/bin",
+	})
+	assert.Nil(t, err, "error should be nil")
+	assert.Equal(t, []string{"header", "to"}, set, "the flags set from the environment should be returned")
+	assert.Equal(t, "http://env", *to, "flags should be set from the environment")
+	assert.Equal(t, 2*time.Second, *interval, "flags given on the command line should win")
+	assert.Equal(t, repeatable{"A: 1, 2", "B: 3"}, *headers, "repeatable flags should be set once per line")
+	assert.True(t, Explicit(fs)["to"], "flags set from the environment should count as explicit")
+
+	unknown := UnknownEnv(fs, "SSL_PROXY_", []string{"SSL_PROXY_TO=http://env", "SSL_PROXY_T0=http://typo", "PATH=/bin"})
+	assert.Equal(t, []string{"SSL_PROXY_T0"}, unknown, "variables not naming a flag should be found")
+	fs, _, _, _ = newFlagSet()
+	_, err = ApplyEnv(fs, "SSL_PROXY_", []string{"SSL_PROXY_INTERVAL=soon"})
+	assert.NotNil(t, err, "invalid values should be rejected")
+}
+
+// TestEnvName tests that flag names are turned into upper cased, underscore separated environment variable names
+func TestEnvName(t *testing.T) {
+	assert.Equal(t, "SSL_PROXY_TO", EnvName("SSL_PROXY_", "to"), "names should be upper cased")
+	assert.Equal(t, "SSL_PROXY_MAX_BODY_SIZE", EnvName("SSL_PROXY_", "max-body-size"), "dashes should become underscores")
+	assert.Equal(t, "SSL_PROXY_REDIRECT_HTTP", EnvName("SSL_PROXY_", "redirectHTTP"), "camel case should be split")
+}
@@ -0,0 +1,89 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// EnvName returns the environment variable for the flag name: prefix followed by the name in upper case, with dashes
+// and the word breaks of camel case names turned into underscores, e.g. SSL_PROXY_REDIRECT_HTTP for redirectHTTP
+func EnvName(prefix, name string) string {
+	var b strings.Builder
+	b.WriteString(prefix)
+	prev := rune(0)
+	for _, r := range name {
+		switch {
+		case r == '-':
+			b.WriteByte('_')
+		case unicode.IsUpper(r) && unicode.IsLower(prev):
+			b.WriteByte('_')
+			b.WriteRune(r)
+		default:
+			b.WriteRune(unicode.ToUpper(r))
+		}
+		prev = r
+	}
+	return b.String()
+}
+
+// ApplyEnv sets every flag in fs that wasn't set on the command line from its environment variable as named by
+// EnvName, if it is set in environ (usually os.Environ()). Flags are set as though they had been passed on the command
+// line, so Explicit includes them afterwards and a config file doesn't override them. Repeatable flags are set once per
+// line of their variable. ApplyEnv returns the names of the flags it set.
+func ApplyEnv(fs *flag.FlagSet, prefix string, environ []string) ([]string, error) {
+	vars := envVars(prefix, environ)
+	explicit := Explicit(fs)
+	var set []string
+	var err error
+	fs.VisitAll(func(fl *flag.Flag) {
+		k := EnvName(prefix, fl.Name)
+		v, ok := vars[k]
+		if !ok || explicit[fl.Name] || err != nil {
+			return
+		}
+		values := []string{v}
+		if _, repeatable := fl.Value.(Repeatable); repeatable {
+			values = strings.Split(strings.TrimRight(v, "\n"), "\n")
+		}
+		for _, v := range values {
+			if err = fs.Set(fl.Name, v); err != nil {
+				err = fmt.Errorf("invalid value for %s in environment variable %s: %v", fl.Name, k, err)
+				return
+			}
+		}
+		set = append(set, fl.Name)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
+// UnknownEnv returns the variables in environ starting with prefix that don't name a flag in fs, which are likely
+// misspelt, in sorted order
+func UnknownEnv(fs *flag.FlagSet, prefix string, environ []string) []string {
+	vars := envVars(prefix, environ)
+	fs.VisitAll(func(fl *flag.Flag) {
+		delete(vars, EnvName(prefix, fl.Name))
+	})
+	unknown := make([]string, 0, len(vars))
+	for k := range vars {
+		unknown = append(unknown, k)
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+// envVars returns the variables in environ starting with prefix
+func envVars(prefix string, environ []string) map[string]string {
+	vars := make(map[string]string)
+	for _, kv := range environ {
+		if k, v, ok := strings.Cut(kv, "="); ok && strings.HasPrefix(k, prefix) {
+			vars[k] = v
+		}
+	}
+	return vars
+}
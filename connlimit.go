@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net"
+	"sync"
+
+	"golang.org/x/net/netutil"
+)
+
+// limitConns returns ln accepting at most max connections at once. Once the limit is reached, further connections
+// wait to be accepted until another one closes, or with reject are closed as soon as they arrive, calling rejected for
+// each.
+func limitConns(ln net.Listener, max int, reject bool, rejected func()) net.Listener {
+	if !reject {
+		return netutil.LimitListener(ln, max)
+	}
+	return &rejectListener{Listener: ln, sem: make(chan struct{}, max), rejected: rejected}
+}
+
+// rejectListener is a net.Listener closing connections over its limit instead of keeping them waiting
+type rejectListener struct {
+	net.Listener
+	sem      chan struct{}
+	rejected func()
+}
+
+func (l *rejectListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		select {
+		case l.sem <- struct{}{}:
+			return &releaseConn{Conn: c, release: func() { <-l.sem }}, nil
+		default:
+			c.Close()
+			if l.rejected != nil {
+				l.rejected()
+			}
+		}
+	}
+}
+
+// countConns returns ln calling opened for each connection it accepts, and closed the first time that connection is
+// closed
+func countConns(ln net.Listener, opened, closed func()) net.Listener {
+	return &countingListener{Listener: ln, opened: opened, closed: closed}
+}
+
+// countingListener is a net.Listener telling opened and closed about the connections it accepts
+type countingListener struct {
+	net.Listener
+	opened, closed func()
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.opened()
+	return &releaseConn{Conn: c, release: l.closed}, nil
+}
+
+// releaseConn is a net.Conn calling release the first time it is closed
+type releaseConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *releaseConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
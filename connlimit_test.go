@@ -0,0 +1,149 @@
+package main
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/snewstv/ssl-proxy/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestLimitConns_Reject tests that connections over the limit are closed straight away, and accepted again once an
+// earlier one closes
+func TestLimitConns_Reject(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.Nil(t, err, "error should be nil") {
+		return
+	}
+	var rejected atomic.Int32
+	limited := limitConns(ln, 1, true, func() { rejected.Add(1) })
+	defer limited.Close()
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			c, err := limited.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- c
+		}
+	}()
+	dial := func() net.Conn {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		assert.Nil(t, err, "error should be nil")
+		return c
+	}
+
+	first := dial()
+	defer first.Close()
+	conn := <-accepted
+
+	second := dial()
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = second.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err, "a connection over the limit should be closed")
+	assert.Equal(t, int32(1), rejected.Load(), "the rejected connection should be reported")
+
+	conn.Close()
+	third := dial()
+	defer third.Close()
+	select {
+	case c := <-accepted:
+		c.Close()
+	case <-time.After(time.Second):
+		t.Error("a connection should be accepted once another closes")
+	}
+}
+
+// TestLimitConns_Wait tests that connections over the limit are kept waiting, rather than closed, until an earlier
+// one closes
+func TestLimitConns_Wait(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.Nil(t, err, "error should be nil") {
+		return
+	}
+	limited := limitConns(ln, 1, false, func() { t.Error("no connection should be rejected") })
+	defer limited.Close()
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			c, err := limited.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- c
+		}
+	}()
+
+	for i := 0; i < 2; i++ {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if !assert.Nil(t, err, "error should be nil") {
+			return
+		}
+		defer c.Close()
+	}
+	conn := <-accepted
+	select {
+	case c := <-accepted:
+		c.Close()
+		t.Error("a connection over the limit should wait to be accepted")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	conn.Close()
+	select {
+	case c := <-accepted:
+		c.Close()
+	case <-time.After(time.Second):
+		t.Error("the waiting connection should be accepted once another closes")
+	}
+}
+
+// TestCountConns tests that the ssl_proxy_client_connections gauge follows the connections accepted and closed, a
+// connection closed twice only being uncounted once
+func TestCountConns(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m := metrics.New(reg, reg)
+	gauge := func() float64 {
+		families, err := reg.Gather()
+		assert.Nil(t, err, "error should be nil")
+		for _, f := range families {
+			if f.GetName() == "ssl_proxy_client_connections" {
+				return f.GetMetric()[0].GetGauge().GetValue()
+			}
+		}
+		t.Error("the gauge should be registered")
+		return 0
+	}
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.Nil(t, err, "error should be nil") {
+		return
+	}
+	ln := countConns(inner, m.ConnectionOpened, m.ConnectionClosed)
+	defer ln.Close()
+
+	var accepted []net.Conn
+	for i := 0; i < 2; i++ {
+		client, err := net.Dial("tcp", ln.Addr().String())
+		if !assert.Nil(t, err, "error should be nil") {
+			return
+		}
+		defer client.Close()
+		conn, err := ln.Accept()
+		if !assert.Nil(t, err, "error should be nil") {
+			return
+		}
+		accepted = append(accepted, conn)
+	}
+	assert.Equal(t, 2.0, gauge(), "open connections should be counted")
+	accepted[0].Close()
+	accepted[0].Close()
+	assert.Equal(t, 1.0, gauge(), "a closed connection should only stop being counted once")
+	accepted[1].Close()
+	assert.Equal(t, 0.0, gauge(), "no connections should be counted once all are closed")
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/snewstv/ssl-proxy/reverseproxy"
+)
+
+// dryRun checks that the proxy could start without binding any ports: that the listen addresses are valid, that the
+// certs and keys load, if they are served from files, and that every backend accepts TCP connections. Each check is
+// reported to out, and the returned error says how many failed. Backends are connected to with dialer.
+func dryRun(out io.Writer, addrs []string, certFiles, keyFiles []string, proxies []*reverseproxy.Proxy, dialer *net.Dialer) error {
+	failed := 0
+	report := func(err error, format string, args ...interface{}) {
+		if err != nil {
+			failed++
+			fmt.Fprintf(out, "FAIL %s: %v\n", fmt.Sprintf(format, args...), err)
+			return
+		}
+		fmt.Fprintf(out, "OK   %s\n", fmt.Sprintf(format, args...))
+	}
+
+	for _, addr := range addrs {
+		_, err := net.ResolveTCPAddr(listenNetwork("tcp", addr), addr)
+		report(err, "listen address %s", addr)
+	}
+
+	for i := range certFiles {
+		_, err := loadKeyPair(certFiles[i], keyFiles[i])
+		report(err, "cert %s and key %s", certFiles[i], keyFiles[i])
+	}
+
+	seen := make(map[string]bool)
+	for _, p := range proxies {
+		for _, b := range p.Backends() {
+			if seen[b.URL.String()] {
+				continue
+			}
+			seen[b.URL.String()] = true
+			network, address := dialAddress(b.URL)
+			conn, err := dialer.Dial(network, address)
+			if err == nil {
+				conn.Close()
+			}
+			report(err, "backend %s", b.URL)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d check(s) failed", failed)
+	}
+	return nil
+}
+
+// dialAddress returns the network and address to connect to for a backend URL
+func dialAddress(u *url.URL) (network, address string) {
+	if u.Scheme == "unix" {
+		return "unix", u.Path
+	}
+	if u.Port() != "" {
+		return "tcp", u.Host
+	}
+	port := "80"
+	if strings.EqualFold(u.Scheme, "https") {
+		port = "443"
+	}
+	return "tcp", net.JoinHostPort(u.Hostname(), port)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/snewstv/ssl-proxy/reverseproxy"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestDryRun tests that a dry run passes when the listen addresses, cert and backends are all usable, and reports each
+// check that fails otherwise, including a backend that can't be reached
+func TestDryRun(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeKeys(t, certFile, keyFile)
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.Nil(t, err, "error should be nil") {
+		return
+	}
+	defer backend.Close()
+	// A port that was just free, so that nothing accepts connections on it
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.Nil(t, err, "error should be nil") {
+		return
+	}
+	closed.Close()
+	build := func(addrs ...string) []*reverseproxy.Proxy {
+		var targets []reverseproxy.Target
+		for _, addr := range addrs {
+			u, err := url.Parse("http://" + addr)
+			assert.Nil(t, err, "error should be nil")
+			targets = append(targets, reverseproxy.Target{URL: u, Weight: 1})
+		}
+		p := reverseproxy.Build(targets, reverseproxy.Options{})
+		t.Cleanup(p.Close)
+		return []*reverseproxy.Proxy{p}
+	}
+	dialer := &net.Dialer{Timeout: time.Second}
+
+	var out bytes.Buffer
+	err = dryRun(&out, []string{"127.0.0.1:4430", ":8443"}, []string{certFile}, []string{keyFile},
+		build(backend.Addr().String()), dialer)
+	assert.Nil(t, err, "a dry run with everything usable should succeed")
+	assert.NotContains(t, out.String(), "FAIL", "every check should pass")
+	assert.Contains(t, out.String(), "OK   backend http://"+backend.Addr().String(), "the backend check should be reported")
+
+	out.Reset()
+	err = dryRun(&out, []string{"127.0.0.1:4430"}, []string{certFile}, []string{keyFile},
+		build(backend.Addr().String(), closed.Addr().String()), dialer)
+	assert.EqualError(t, err, "1 check(s) failed", "an unreachable backend should fail the dry run")
+	assert.Contains(t, out.String(), "FAIL backend http://"+closed.Addr().String(), "the unreachable backend should be reported")
+
+	out.Reset()
+	err = dryRun(&out, []string{"127.0.0.1:http-nope"}, []string{certFile}, []string{filepath.Join(dir, "missing.pem")},
+		nil, dialer)
+	assert.EqualError(t, err, "2 check(s) failed", "a bad listen address and a missing key should each fail")
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"flag"
+	"regexp"
+	"slices"
+
+	"github.com/snewstv/ssl-proxy/config"
+	"github.com/snewstv/ssl-proxy/logging"
+)
+
+// envPrefix starts the environment variable that can set each flag, e.g. SSL_PROXY_TO for -to
+const envPrefix = "SSL_PROXY_"
+
+// secretFlags are the flags whose values are never logged
+var secretFlags = map[string]bool{
+	"admin-token":          true,
+	"basic-auth":           true,
+	"cloudflare-api-token": true,
+	"set-request-header":   true,
+}
+
+// urlPassword matches the password in the userinfo of URLs, such as that of an -upstream-proxy
+var urlPassword = regexp.MustCompile(`(://[^:/@\s]*):[^@/\s]*@`)
+
+// logEffectiveConfig logs every flag that isn't at its default, along with where its value came from: the command
+// line if it is in cmdline, the environment if it is in env, or else the config file cfg. Secrets are redacted.
+func logEffectiveConfig(cmdline map[string]bool, env []string, cfg *config.File) {
+	fromEnv := make(map[string]bool, len(env))
+	for _, name := range env {
+		fromEnv[name] = true
+	}
+	var fromFile map[string]interface{}
+	if cfg != nil {
+		fromFile = cfg.Flags
+	}
+	var lines [][3]string
+	flag.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if value == f.DefValue {
+			return
+		}
+		_, inFile := fromFile[f.Name]
+		source := ""
+		switch {
+		case cmdline[f.Name]:
+			source = "command line"
+		case fromEnv[f.Name]:
+			source = config.EnvName(envPrefix, f.Name)
+		case inFile:
+			source = "config file"
+		default:
+			return
+		}
+		if secretFlags[f.Name] {
+			value = "[redacted]"
+		} else {
+			value = urlPassword.ReplaceAllString(value, "$1:xxxxx@")
+		}
+		lines = append(lines, [3]string{f.Name, value, source})
+	})
+	if len(lines) == 0 {
+		return
+	}
+	logging.Infof("Effective configuration, apart from defaults:")
+	for _, l := range lines {
+		logging.Infof("  -%s=%s (%s)", l[0], l[1], l[2])
+	}
+}
+
+// warnUnknownEnv warns about environment variables that look like they are meant to set a flag but don't name one.
+// The variables named by -cert-env and -key-env are expected.
+func warnUnknownEnv(environ []string, expected ...string) {
+	for _, name := range config.UnknownEnv(flag.CommandLine, envPrefix, environ) {
+		if !slices.Contains(expected, name) {
+			logging.Warnf("Ignoring environment variable %s, which doesn't name a flag", name)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/snewstv/ssl-proxy/middleware"
+)
+
+// days matches a number of days in a duration string, e.g. the 90d in 90d or 1d12h
+var days = regexp.MustCompile(`(\d+(?:\.\d+)?)d`)
+
+// parseDuration is like time.ParseDuration but also accepts a d suffix for days
+func parseDuration(s string) (time.Duration, error) {
+	s = days.ReplaceAllStringFunc(s, func(d string) string {
+		n, _ := strconv.ParseFloat(d[:len(d)-1], 64)
+		return strconv.FormatFloat(n*24, 'f', -1, 64) + "h"
+	})
+	return time.ParseDuration(s)
+}
+
+// durationValue is a flag.Value for durations that accepts day suffixes via parseDuration
+type durationValue time.Duration
+
+func (d *durationValue) Set(s string) error {
+	v, err := parseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = durationValue(v)
+	return nil
+}
+
+func (d *durationValue) String() string {
+	return time.Duration(*d).String()
+}
+
+// durationFlag defines a duration flag that, unlike flag.Duration, also accepts a number of days such as 90d
+func durationFlag(name string, value time.Duration, usage string) *time.Duration {
+	p := new(time.Duration)
+	*p = value
+	flag.Var((*durationValue)(p), name, usage)
+	return p
+}
+
+// flushValue is a flag.Value for durations that also accepts -1, meaning flush after every write
+type flushValue time.Duration
+
+func (f *flushValue) Set(s string) error {
+	if s == "-1" {
+		*f = -1
+		return nil
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*f = flushValue(v)
+	return nil
+}
+
+func (f *flushValue) String() string {
+	if *f < 0 {
+		return "-1"
+	}
+	return time.Duration(*f).String()
+}
+
+// flushFlag defines a flag for a flush interval, which is either a duration or -1
+func flushFlag(name string, value time.Duration, usage string) *time.Duration {
+	p := new(time.Duration)
+	*p = value
+	flag.Var((*flushValue)(p), name, usage)
+	return p
+}
+
+// modeValue is a flag.Value for file modes given in octal, e.g. 0640
+type modeValue os.FileMode
+
+func (m *modeValue) Set(s string) error {
+	v, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || v > 0777 {
+		return fmt.Errorf("invalid file mode %q, expected permission bits in octal such as 0640", s)
+	}
+	*m = modeValue(v)
+	return nil
+}
+
+func (m *modeValue) String() string {
+	return fmt.Sprintf("%#o", uint32(*m))
+}
+
+// modeFlag defines a flag for the permission bits of a file, given in octal
+func modeFlag(name string, value os.FileMode, usage string) *os.FileMode {
+	p := new(os.FileMode)
+	*p = value
+	flag.Var((*modeValue)(p), name, usage)
+	return p
+}
+
+// size matches a byte size such as 512, 64KB or 10MiB
+var size = regexp.MustCompile(`(?i)^\s*(\d+)\s*([kmgt]?)(i?b)?\s*$`)
+
+// parseSize parses a number of bytes with an optional K, M, G or T suffix, each 1024 times the last. The suffix may be
+// followed by B or iB, so 10M, 10MB and 10MiB are the same.
+func parseSize(s string) (int64, error) {
+	m := size.FindStringSubmatch(s)
+	if m == nil {
+		return 0, fmt.Errorf("invalid size %q, expected a number of bytes optionally followed by KB, MB, GB or TB", s)
+	}
+	n, err := strconv.ParseInt(m[1], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	var shift uint
+	if m[2] != "" {
+		shift = uint(strings.Index("kmgt", strings.ToLower(m[2]))+1) * 10
+	}
+	if n > math.MaxInt64>>shift {
+		return 0, fmt.Errorf("size %q is too large", s)
+	}
+	return n << shift, nil
+}
+
+// sizeValue is a flag.Value for byte sizes parsed with parseSize
+type sizeValue int64
+
+func (v *sizeValue) Set(s string) error {
+	n, err := parseSize(s)
+	if err != nil {
+		return err
+	}
+	*v = sizeValue(n)
+	return nil
+}
+
+func (v *sizeValue) String() string {
+	return strconv.FormatInt(int64(*v), 10)
+}
+
+// sizeFlag defines a flag for a number of bytes that accepts suffixes such as 10MB
+func sizeFlag(name string, value int64, usage string) *int64 {
+	p := new(int64)
+	*p = value
+	flag.Var((*sizeValue)(p), name, usage)
+	return p
+}
+
+// stringsValue is a flag.Value collecting every value of a flag that may be given more than once
+type stringsValue []string
+
+func (s *stringsValue) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+func (s *stringsValue) String() string {
+	return strings.Join(*s, ", ")
+}
+
+// Repeatable marks stringsValue as settable once per element of a config file list
+func (s *stringsValue) Repeatable() {}
+
+// stringsFlag defines a flag that may be given more than once, returning every value in order
+func stringsFlag(name string, usage string) *[]string {
+	p := new([]string)
+	flag.Var((*stringsValue)(p), name, usage)
+	return p
+}
+
+// aclValue is a flag.Value adding the networks it is set to as rules to a shared ACL, so that rules given with
+// different flags keep the order they were given in
+type aclValue struct {
+	rules *[]middleware.ACLRule
+	allow bool
+}
+
+func (v aclValue) Set(s string) error {
+	nets, err := parseCIDRs(s)
+	if err != nil {
+		return err
+	}
+	for _, n := range nets {
+		*v.rules = append(*v.rules, middleware.ACLRule{Allow: v.allow, Net: n})
+	}
+	return nil
+}
+
+func (v aclValue) String() string {
+	if v.rules == nil {
+		return ""
+	}
+	var nets []string
+	for _, rule := range *v.rules {
+		if rule.Allow == v.allow {
+			nets = append(nets, rule.Net.String())
+		}
+	}
+	return strings.Join(nets, ",")
+}
+
+// Repeatable marks aclValue as settable once per element of a config file list
+func (v aclValue) Repeatable() {}
+
+// aclFlags defines a pair of flags adding allow and deny rules respectively to the returned ACL, in the order they are
+// given
+func aclFlags(allowName, allowUsage, denyName, denyUsage string) *[]middleware.ACLRule {
+	rules := new([]middleware.ACLRule)
+	flag.Var(aclValue{rules: rules, allow: true}, allowName, allowUsage)
+	flag.Var(aclValue{rules: rules, allow: false}, denyName, denyUsage)
+	return rules
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestParseDuration tests that durations may be given in days as well as anything time.ParseDuration accepts, and that
+// invalid durations are rejected
+func TestParseDuration(t *testing.T) {
+	for s, want := range map[string]time.Duration{
+		"90d":    90 * 24 * time.Hour,
+		"1.5d":   36 * time.Hour,
+		"1d12h":  36 * time.Hour,
+		"8760h":  8760 * time.Hour,
+		"30m10s": 30*time.Minute + 10*time.Second,
+		"0":      0,
+	} {
+		d, err := parseDuration(s)
+		assert.Nil(t, err, "%q should parse", s)
+		assert.Equal(t, want, d, "unexpected duration for %q", s)
+	}
+	for _, s := range []string{"", "d", "90", "ninety days", "1w", "5dd"} {
+		_, err := parseDuration(s)
+		assert.NotNil(t, err, "%q should be rejected", s)
+	}
+}
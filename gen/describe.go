@@ -0,0 +1,65 @@
+package gen
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// CertInfo summarizes a certificate so that operators can check which one is being served
+type CertInfo struct {
+	Fingerprint [32]byte // SHA256 of the DER encoding
+	Subject     string
+	DNSNames    []string
+	IPAddresses []net.IP
+	NotAfter    time.Time
+}
+
+// String formats the summary on a single line for logging
+func (c CertInfo) String() string {
+	sans := append([]string(nil), c.DNSNames...)
+	for _, ip := range c.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	return fmt.Sprintf("subject %q, SANs [%s], expires %s, SHA256 fingerprint % X",
+		c.Subject, strings.Join(sans, ", "), c.NotAfter.Format(time.RFC3339), c.Fingerprint)
+}
+
+// Describe summarizes the first certificate in the PEM file at certPath, which is the leaf for a file holding a chain
+func Describe(certPath string) (CertInfo, error) {
+	b, err := os.ReadFile(certPath)
+	if err != nil {
+		return CertInfo{}, err
+	}
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			return CertInfo{}, fmt.Errorf("no certificate found in %s", certPath)
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return CertInfo{}, fmt.Errorf("unable to parse certificate in %s: %v", certPath, err)
+		}
+		return DescribeCertificate(cert), nil
+	}
+}
+
+// DescribeCertificate summarizes cert
+func DescribeCertificate(cert *x509.Certificate) CertInfo {
+	return CertInfo{
+		Fingerprint: sha256.Sum256(cert.Raw),
+		Subject:     cert.Subject.String(),
+		DNSNames:    cert.DNSNames,
+		IPAddresses: cert.IPAddresses,
+		NotAfter:    cert.NotAfter,
+	}
+}
@@ -2,27 +2,61 @@ package gen
 
 import (
 	"bytes"
+	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/rsa"
 	"crypto/sha256"
+	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
 	"fmt"
-	"log"
 	"math/big"
+	"net"
 	"os"
+	"strings"
 	"time"
 )
 
-// Keys generates a new P256 ECDSA public private key pair for TLS.
+// KeyType identifies the kind of private key generated for a certificate
+type KeyType string
+
+// Supported key types
+const (
+	RSA2048   KeyType = "rsa2048"
+	RSA4096   KeyType = "rsa4096"
+	ECDSAP256 KeyType = "ecdsa-p256"
+	ECDSAP384 KeyType = "ecdsa-p384"
+	Ed25519   KeyType = "ed25519"
+)
+
+// KeyTypes lists every supported KeyType
+var KeyTypes = []KeyType{RSA2048, RSA4096, ECDSAP256, ECDSAP384, Ed25519}
+
+// ParseKeyType returns the KeyType named by s, or an error listing the valid names
+func ParseKeyType(s string) (KeyType, error) {
+	for _, t := range KeyTypes {
+		if string(t) == s {
+			return t, nil
+		}
+	}
+	names := make([]string, len(KeyTypes))
+	for i, t := range KeyTypes {
+		names[i] = string(t)
+	}
+	return "", fmt.Errorf("unknown key type %q, must be one of %s", s, strings.Join(names, ", "))
+}
+
+// Keys generates a new public private key pair of the given type for TLS, along with a self-signed certificate.
+// Altnames that parse as IP addresses become IP SANs, and the rest DNS SANs.
 // It returns a bytes buffer for the PEM encoded private key and certificate.
-func Keys(validFor time.Duration, altnames []string) (cert, key *bytes.Buffer, fingerprint [32]byte, err error) {
-	privKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+func Keys(validFor time.Duration, altnames []string, keyType KeyType) (cert, key *bytes.Buffer, fingerprint [32]byte, err error) {
+	privKey, sigAlg, err := generateKey(keyType)
 	if err != nil {
-		log.Fatalf("failed to generate private key: %s", err)
-		return nil, nil, fingerprint, err
+		return nil, nil, fingerprint, fmt.Errorf("failed to generate private key: %w", err)
 	}
 
 	notBefore := time.Now()
@@ -31,8 +65,17 @@ func Keys(validFor time.Duration, altnames []string) (cert, key *bytes.Buffer, f
 	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
 	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
 	if err != nil {
-		log.Fatalf("failed to generate serial number: %s", err)
-		return nil, nil, fingerprint, err
+		return nil, nil, fingerprint, fmt.Errorf("failed to generate serial number: %w", err)
+	}
+
+	var dnsNames []string
+	var ipAddresses []net.IP
+	for _, name := range altnames {
+		if ip := net.ParseIP(name); ip != nil {
+			ipAddresses = append(ipAddresses, ip)
+		} else {
+			dnsNames = append(dnsNames, name)
+		}
 	}
 
 	template := x509.Certificate{
@@ -44,16 +87,17 @@ func Keys(validFor time.Duration, altnames []string) (cert, key *bytes.Buffer, f
 		NotBefore: notBefore,
 		NotAfter:  notAfter,
 
+		SignatureAlgorithm:    sigAlg,
 		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
-		DNSNames:              altnames,
+		DNSNames:              dnsNames,
+		IPAddresses:           ipAddresses,
 		BasicConstraintsValid: true,
 	}
 
-	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &privKey.PublicKey, privKey)
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, privKey.Public(), privKey)
 	if err != nil {
-		log.Fatalf("Failed to create certificate: %s", err)
-		return nil, nil, fingerprint, err
+		return nil, nil, fingerprint, fmt.Errorf("failed to create certificate: %w", err)
 	}
 
 	// Encode and write certificate and key to bytes.Buffer
@@ -68,11 +112,54 @@ func Keys(validFor time.Duration, altnames []string) (cert, key *bytes.Buffer, f
 	return cert, key, fingerprint, nil //TODO: maybe return a struct instead of 4 multiple return items
 }
 
-func pemBlockForKey(key *ecdsa.PrivateKey) *pem.Block {
-	b, err := x509.MarshalECPrivateKey(key)
+// KeyPair is like Keys but returns the generated key and self-signed certificate as a tls.Certificate ready to serve,
+// so that nothing needs to be written to disk
+func KeyPair(validFor time.Duration, altnames []string, keyType KeyType) (tls.Certificate, error) {
+	cert, key, _, err := Keys(validFor, altnames, keyType)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.X509KeyPair(cert.Bytes(), key.Bytes())
+}
+
+// generateKey creates a private key of the given type along with the signature algorithm the self-signed certificate
+// should be signed with
+func generateKey(keyType KeyType) (crypto.Signer, x509.SignatureAlgorithm, error) {
+	switch keyType {
+	case RSA2048:
+		k, err := rsa.GenerateKey(rand.Reader, 2048)
+		return k, x509.SHA256WithRSA, err
+	case RSA4096:
+		k, err := rsa.GenerateKey(rand.Reader, 4096)
+		return k, x509.SHA256WithRSA, err
+	case ECDSAP256:
+		k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		return k, x509.ECDSAWithSHA256, err
+	case ECDSAP384:
+		k, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+		return k, x509.ECDSAWithSHA384, err
+	case Ed25519:
+		_, k, err := ed25519.GenerateKey(rand.Reader)
+		return k, x509.PureEd25519, err
+	}
+	return nil, x509.UnknownSignatureAlgorithm, fmt.Errorf("unknown key type %q", keyType)
+}
+
+func pemBlockForKey(key crypto.Signer) *pem.Block {
+	// ECDSA keys keep using the SEC 1 encoding they always have; everything else is PKCS #8
+	if k, ok := key.(*ecdsa.PrivateKey); ok {
+		b, err := x509.MarshalECPrivateKey(k)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to marshal ECDSA private key: %v", err)
+			os.Exit(2)
+		}
+		return &pem.Block{Type: "EC PRIVATE KEY", Bytes: b}
+	}
+
+	b, err := x509.MarshalPKCS8PrivateKey(key)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Unable to marshal ECDSA private key: %v", err)
+		fmt.Fprintf(os.Stderr, "Unable to marshal private key: %v", err)
 		os.Exit(2)
 	}
-	return &pem.Block{Type: "EC PRIVATE KEY", Bytes: b}
+	return &pem.Block{Type: "PRIVATE KEY", Bytes: b}
 }
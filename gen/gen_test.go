@@ -0,0 +1,104 @@
+package gen
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestParseKeyType tests that every key type is parsed by name and that unknown names are rejected
+func TestParseKeyType(t *testing.T) {
+	for _, keyType := range KeyTypes {
+		parsed, err := ParseKeyType(string(keyType))
+		assert.Nil(t, err, "error should be nil")
+		assert.Equal(t, keyType, parsed, "%s should parse", keyType)
+	}
+	for _, s := range []string{"", "rsa", "RSA2048", "ecdsa-p521"} {
+		_, err := ParseKeyType(s)
+		assert.ErrorContains(t, err, "must be one of rsa2048,", "%q should be rejected", s)
+	}
+}
+
+// TestKeyPair tests that a usable cert and key of each type are generated. RSA4096 is left out, since it only differs
+// from RSA2048 in size and is slow to generate. It also tests that an unknown key type is returned as an error.
+func TestKeyPair(t *testing.T) {
+	for keyType, want := range map[KeyType]string{
+		RSA2048:   "RSA 2048",
+		ECDSAP256: "ECDSA P-256",
+		ECDSAP384: "ECDSA P-384",
+		Ed25519:   "Ed25519",
+	} {
+		cert, err := KeyPair(time.Hour, []string{"localhost"}, keyType)
+		if !assert.Nil(t, err, "a %s key pair should be generated", keyType) {
+			continue
+		}
+		var got string
+		switch key := cert.PrivateKey.(type) {
+		case *rsa.PrivateKey:
+			got = fmt.Sprintf("RSA %d", key.N.BitLen())
+		case *ecdsa.PrivateKey:
+			got = "ECDSA " + key.Curve.Params().Name
+		case ed25519.PrivateKey:
+			got = "Ed25519"
+		}
+		assert.Equal(t, want, got, "unexpected key for %s", keyType)
+		assert.Nil(t, cert.Leaf.CheckSignatureFrom(cert.Leaf), "the %s cert should be self-signed", keyType)
+	}
+	_, err := KeyPair(time.Hour, []string{"localhost"}, "dsa")
+	assert.ErrorContains(t, err, `unknown key type "dsa"`, "an unknown key type should be returned as an error")
+}
+
+// TestKeys_SANs tests that altnames parsing as IP addresses become IP SANs and the rest DNS SANs, and that the cert is
+// valid for validFor
+func TestKeys_SANs(t *testing.T) {
+	cert, err := KeyPair(90*24*time.Hour, []string{"localhost", "127.0.0.1", "*.example.com", "::1", "10.0.0.1.nip.io"}, ECDSAP256)
+	if !assert.Nil(t, err, "error should be nil") {
+		return
+	}
+	assert.Equal(t, []string{"localhost", "*.example.com", "10.0.0.1.nip.io"}, cert.Leaf.DNSNames, "host names should be DNS SANs")
+	if assert.Len(t, cert.Leaf.IPAddresses, 2, "IP addresses should be IP SANs") {
+		assert.True(t, cert.Leaf.IPAddresses[0].Equal(net.ParseIP("127.0.0.1")), "unexpected IP SAN %s", cert.Leaf.IPAddresses[0])
+		assert.True(t, cert.Leaf.IPAddresses[1].Equal(net.ParseIP("::1")), "unexpected IP SAN %s", cert.Leaf.IPAddresses[1])
+	}
+	assert.Nil(t, cert.Leaf.VerifyHostname("127.0.0.1"), "the cert should be valid for its IP SAN")
+	assert.WithinDuration(t, time.Now().Add(90*24*time.Hour), cert.Leaf.NotAfter, time.Minute, "the cert should be valid for validFor")
+}
+
+// TestDescribe tests that the leaf of a PEM file is summarized, and that files without a certificate are rejected
+func TestDescribe(t *testing.T) {
+	cert, key, fingerprint, err := Keys(time.Hour, []string{"localhost", "127.0.0.1"}, ECDSAP256)
+	if !assert.Nil(t, err, "error should be nil") {
+		return
+	}
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	// A key before the cert, as in a combined file, should be skipped over
+	assert.Nil(t, os.WriteFile(certFile, append(key.Bytes(), cert.Bytes()...), 0600), "error should be nil")
+
+	info, err := Describe(certFile)
+	if assert.Nil(t, err, "error should be nil") {
+		assert.Equal(t, fingerprint, info.Fingerprint, "the fingerprint should be that of the cert")
+		assert.Equal(t, sha256.Size, len(info.Fingerprint), "the fingerprint should be a SHA256")
+		assert.Equal(t, "O=ssl-proxy", info.Subject, "unexpected subject")
+		assert.Equal(t, []string{"localhost"}, info.DNSNames, "unexpected DNS names")
+		assert.Len(t, info.IPAddresses, 1, "unexpected IP addresses")
+		assert.WithinDuration(t, time.Now().Add(time.Hour), info.NotAfter, time.Minute, "unexpected expiry")
+		assert.Contains(t, info.String(), "SANs [localhost, 127.0.0.1]", "the summary should list every SAN")
+	}
+
+	keyFile := filepath.Join(dir, "key.pem")
+	assert.Nil(t, os.WriteFile(keyFile, key.Bytes(), 0600), "error should be nil")
+	_, err = Describe(keyFile)
+	assert.ErrorContains(t, err, "no certificate found", "a file without a cert should be rejected")
+	_, err = Describe(filepath.Join(dir, "missing.pem"))
+	assert.NotNil(t, err, "a missing file should be rejected")
+}
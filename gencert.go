@@ -0,0 +1,73 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/snewstv/ssl-proxy/gen"
+)
+
+// gencert implements the gencert subcommand, which generates a self-signed cert and key without starting the proxy
+func gencert(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("gencert", flag.ContinueOnError)
+	fs.SetOutput(out)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: ssl-proxy gencert [flags]\n\nGenerates a self-signed certificate and key and exits.\n\nFlags:")
+		fs.PrintDefaults()
+	}
+	certFile := fs.String("cert", "cert.pem", "path to write the PEM encoded certificate to")
+	keyFile := fs.String("key", "key.pem", "path to write the PEM encoded private key to")
+	altnames := fs.String("altnames", "localhost", "comma separated altnames for the certificate. IP addresses become IP SANs, anything else a DNS SAN")
+	keyType := fs.String("key-type", string(gen.ECDSAP256), "type of key to generate: rsa2048, rsa4096, ecdsa-p256, ecdsa-p384 or ed25519")
+	validity := 365 * 24 * time.Hour
+	fs.Var((*durationValue)(&validity), "validity", "how long the certificate is valid for, e.g. 8760h or 90d")
+	certMode, keyMode := os.FileMode(0644), os.FileMode(0600)
+	fs.Var((*modeValue)(&certMode), "cert-file-mode", "permission bits of the cert file, in octal")
+	fs.Var((*modeValue)(&keyMode), "key-file-mode", "permission bits of the key file, in octal")
+	owner := fs.String("file-owner", "", "user[:group] to own the cert and key files and any directories created for them, by name or ID")
+	noOverwrite := fs.Bool("no-overwrite", false, "refuse to overwrite the cert and key files if they already exist, unless -force is also given")
+	force := fs.Bool("force", false, "overwrite existing cert and key files even with -no-overwrite")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+
+	kt, err := gen.ParseKeyType(*keyType)
+	if err != nil {
+		return err
+	}
+	if validity <= 0 {
+		return fmt.Errorf("invalid -validity %s, must be positive", validity)
+	}
+	names := splitList(*altnames)
+	if len(names) == 0 {
+		return fmt.Errorf("-altnames must list at least one name")
+	}
+
+	perms := filePerms{certMode: certMode, keyMode: keyMode}
+	if perms.uid, perms.gid, err = parseOwner(*owner); err != nil {
+		return fmt.Errorf("invalid -file-owner: %w", err)
+	}
+
+	replace := *force || !*noOverwrite
+	if !replace {
+		if err := checkNotExist(*certFile, *keyFile); err != nil {
+			return fmt.Errorf("%w, use -force to overwrite it", err)
+		}
+	}
+
+	cert, key, fingerprint, err := gen.Keys(validity, names, kt)
+	if err != nil {
+		return err
+	}
+	if err := saveKeyPair(*certFile, *keyFile, cert.Bytes(), key.Bytes(), perms, replace); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Wrote %s and %s\nSHA256 Fingerprint: % X\n", *certFile, *keyFile, fingerprint)
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/snewstv/ssl-proxy/gen"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestGencert tests that the gencert subcommand writes a cert with the requested SANs and file modes, and returns flag
+// errors instead of exiting
+func TestGencert(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "certs", "cert.pem"), filepath.Join(dir, "certs", "key.pem")
+	var out bytes.Buffer
+	err := gencert([]string{"-cert", certFile, "-key", keyFile, "-altnames", "example.com,10.0.0.1", "-validity", "30d", "-cert-file-mode", "0640"}, &out)
+	assert.Nil(t, err, "error should be nil")
+
+	_, err = tls.LoadX509KeyPair(certFile, keyFile)
+	assert.Nil(t, err, "the written cert and key should load")
+	info, err := gen.Describe(certFile)
+	assert.Nil(t, err, "error should be nil")
+	assert.Equal(t, []string{"example.com"}, info.DNSNames, "DNS altnames should become DNS SANs")
+	assert.True(t, info.IPAddresses[0].Equal(net.ParseIP("10.0.0.1")), "IP altnames should become IP SANs")
+	assert.Contains(t, out.String(), fmt.Sprintf("% X", info.Fingerprint), "the fingerprint should be printed")
+
+	stat, err := os.Stat(keyFile)
+	assert.Nil(t, err, "error should be nil")
+	assert.Equal(t, os.FileMode(0600), stat.Mode().Perm(), "the key should only be readable by its owner")
+	stat, err = os.Stat(certFile)
+	assert.Nil(t, err, "error should be nil")
+	assert.Equal(t, os.FileMode(0640), stat.Mode().Perm(), "the cert should have the requested mode")
+
+	assert.NotNil(t, gencert([]string{"-validity", "0"}, &out), "a zero validity should be rejected")
+	assert.NotNil(t, gencert([]string{"-no-such-flag"}, &out), "unknown flags should be returned as an error")
+	assert.Equal(t, flag.ErrHelp, gencert([]string{"-h"}, &out), "asking for help should be returned as flag.ErrHelp")
+}
+
+// TestGencert_Overwrite tests that existing files are replaced, unless -no-overwrite is given without -force
+func TestGencert_Overwrite(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	assert.Nil(t, os.WriteFile(certFile, []byte("placed by hand"), 0644), "error should be nil")
+	var out bytes.Buffer
+	err := gencert([]string{"-cert", certFile, "-key", keyFile, "-no-overwrite"}, &out)
+	assert.EqualError(t, err, certFile+" already exists, use -force to overwrite it", "an existing cert should be refused")
+	_, err = os.Stat(keyFile)
+	assert.True(t, os.IsNotExist(err), "nothing should be written when refusing")
+
+	assert.Nil(t, gencert([]string{"-cert", certFile, "-key", keyFile, "-no-overwrite", "-force"}, &out), "error should be nil")
+	_, err = tls.LoadX509KeyPair(certFile, keyFile)
+	assert.Nil(t, err, "-force should replace the existing cert")
+
+	before, err := os.ReadFile(certFile)
+	assert.Nil(t, err, "error should be nil")
+	assert.Nil(t, gencert([]string{"-cert", certFile, "-key", keyFile}, &out), "error should be nil")
+	after, err := os.ReadFile(certFile)
+	assert.Nil(t, err, "error should be nil")
+	assert.NotEqual(t, before, after, "existing files should be replaced without -no-overwrite")
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// newHTTP3Server returns an HTTP/3 server sharing handler and the certificates of tlsConfig with a TLS listener. The
+// server's own TLS config, which quic-go copies when it starts serving, defers to tlsConfig on every handshake. Changes
+// to tlsConfig such as rotated session ticket keys therefore apply to QUIC connections too, while changes to the
+// server's TLS config don't.
+func newHTTP3Server(handler http.Handler, tlsConfig *tls.Config) *http3.Server {
+	return &http3.Server{
+		Handler:     handler,
+		IdleTimeout: *idleTimeout,
+		TLSConfig: &tls.Config{
+			MinVersion: tls.VersionTLS13,
+			GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+				return tlsConfig, nil
+			},
+		},
+	}
+}
+
+// altSvc wraps next so that its responses advertise the HTTP/3 server h3 with an Alt-Svc header, letting clients
+// switch to it for later requests
+func altSvc(next http.Handler, h3 *http3.Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Only fails until the server is listening
+		h3.SetQUICHeaders(w.Header())
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/snewstv/ssl-proxy/gen"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestHTTP3Server tests that an HTTP/3 server serves handler over QUIC with the certificates of a TLS config
+func TestHTTP3Server(t *testing.T) {
+	cert, err := gen.KeyPair(time.Hour, []string{"localhost"}, gen.ECDSAP256)
+	assert.Nil(t, err, "error should be nil")
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Proto)
+	})
+	h3 := newHTTP3Server(handler, &tls.Config{Certificates: []tls.Certificate{cert}})
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err, "error should be nil")
+	defer pc.Close()
+	go h3.Serve(pc)
+	defer h3.Close()
+
+	client := &http.Client{Transport: &http3.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	resp, err := client.Get("https://" + pc.LocalAddr().String() + "/")
+	if assert.Nil(t, err, "error should be nil") {
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, "HTTP/3.0", string(body), "the request should be served over HTTP/3")
+	}
+
+	rec := httptest.NewRecorder()
+	altSvc(handler, h3).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	port := pc.LocalAddr().(*net.UDPAddr).Port
+	assert.Contains(t, rec.Header().Get("Alt-Svc"), fmt.Sprintf(`h3=":%d"`, port), "responses should advertise HTTP/3")
+}
+
+// TestHTTP3Server_TicketRotation tests that rotating the session ticket keys of the TLS config an HTTP/3 server was
+// created with applies to its QUIC connections
+func TestHTTP3Server_TicketRotation(t *testing.T) {
+	cert, err := gen.KeyPair(time.Hour, []string{"localhost"}, gen.ECDSAP256)
+	assert.Nil(t, err, "error should be nil")
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+	tickets := &ticketKeys{configs: []*tls.Config{tlsConfig}}
+	tickets.rotate()
+	h3 := newHTTP3Server(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), tlsConfig)
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err, "error should be nil")
+	defer pc.Close()
+	go h3.Serve(pc)
+	defer h3.Close()
+
+	cache := tls.NewLRUClientSessionCache(1)
+	resumed := func() bool {
+		// dial without 0-RTT, which a server rejecting the ticket would fail the request for
+		transport := &http3.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true, ClientSessionCache: cache},
+			Dial: quic.DialAddr}
+		defer transport.Close()
+		resp, err := (&http.Client{Transport: transport}).Get("https://" + pc.LocalAddr().String() + "/")
+		if !assert.Nil(t, err, "error should be nil") {
+			return false
+		}
+		io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp.TLS.DidResume
+	}
+
+	assert.False(t, resumed(), "the first connection should be a new session")
+	assert.True(t, resumed(), "the session should be resumed")
+	tickets.rotate()
+	assert.True(t, resumed(), "a session from before a rotation should still be resumed")
+	tickets.rotate()
+	tickets.rotate()
+	assert.False(t, resumed(), "a session from two rotations ago should not be resumed, so rotations reach QUIC")
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// filePerms controls the modes and ownership of generated cert and key files
+type filePerms struct {
+	certMode, keyMode os.FileMode
+	// uid and gid own the files and any directories created for them, or -1 to leave the owner unchanged
+	uid, gid int
+}
+
+// saveKeyPair writes a PEM encoded cert and key with the modes and owner in perms, creating their directories if
+// needed. Unless replace is set, it fails rather than replace either file if it already exists, even if it is created
+// while the pair is being written, leaving no new cert behind.
+func saveKeyPair(certFile, keyFile string, cert, key []byte, perms filePerms, replace bool) error {
+	if err := writeFileAtomic(certFile, cert, perms.certMode, perms, replace); err != nil {
+		return fmt.Errorf("unable to write the cert file: %w", err)
+	}
+	if err := writeFileAtomic(keyFile, key, perms.keyMode, perms, replace); err != nil {
+		if !replace {
+			os.Remove(certFile)
+		}
+		return fmt.Errorf("unable to write the key file: %w", err)
+	}
+	return nil
+}
+
+// checkNotExist returns an error naming the first of files that already exists
+func checkNotExist(files ...string) error {
+	for _, f := range files {
+		if _, err := os.Lstat(f); err == nil {
+			return fmt.Errorf("%s already exists", f)
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeFileAtomic writes data to name with mode, even if the file already exists with another mode or the umask would
+// restrict it. The data is written to a temporary file that gets its mode and owner before it is renamed over name,
+// so readers never see a partly written file and a key is never readable with an existing file's looser mode. A
+// missing directory is created accessible only to the owner and group. Unless replace is set, the temporary file is
+// linked to name instead, which fails if name exists by then.
+func writeFileAtomic(name string, data []byte, mode os.FileMode, perms filePerms, replace bool) error {
+	dir := filepath.Dir(name)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		if err := os.MkdirAll(dir, 0750); err != nil {
+			return err
+		}
+		if err := chown(dir, perms); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.CreateTemp(dir, "."+filepath.Base(name)+"-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), mode); err != nil {
+		return err
+	}
+	if err := chown(f.Name(), perms); err != nil {
+		return err
+	}
+	if !replace {
+		err := os.Link(f.Name(), name)
+		if errors.Is(err, fs.ErrExist) {
+			return fmt.Errorf("%s already exists", name)
+		}
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
+
+func chown(name string, perms filePerms) error {
+	if perms.uid == -1 && perms.gid == -1 {
+		return nil
+	}
+	return os.Chown(name, perms.uid, perms.gid)
+}
+
+// parseOwner parses a user[:group] owner, each given by name or numeric ID, returning -1 for anything not given. A
+// user without a group keeps the file's group.
+func parseOwner(s string) (uid, gid int, err error) {
+	if s == "" {
+		return -1, -1, nil
+	}
+	if runtime.GOOS == "windows" {
+		return 0, 0, fmt.Errorf("file owners can't be set on %s", runtime.GOOS)
+	}
+	u, g, _ := strings.Cut(s, ":")
+	uid, gid = -1, -1
+	if u != "" {
+		if uid, err = strconv.Atoi(u); err != nil {
+			found, err := user.Lookup(u)
+			if err != nil {
+				return 0, 0, err
+			}
+			uid, _ = strconv.Atoi(found.Uid)
+		}
+	}
+	if g != "" {
+		if gid, err = strconv.Atoi(g); err != nil {
+			found, err := user.LookupGroup(g)
+			if err != nil {
+				return 0, 0, err
+			}
+			gid, _ = strconv.Atoi(found.Gid)
+		}
+	}
+	return uid, gid, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestSaveKeyPair_ExistingFiles tests that existing files are replaced with the requested modes, without the key ever
+// being written into a file with looser permissions
+func TestSaveKeyPair_ExistingFiles(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file modes aren't enforced on windows")
+	}
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	assert.Nil(t, os.WriteFile(keyFile, []byte("old key"), 0666), "error should be nil")
+	assert.Nil(t, os.Chmod(keyFile, 0666), "error should be nil")
+	before, err := os.Stat(keyFile)
+	assert.Nil(t, err, "error should be nil")
+
+	perms := filePerms{certMode: 0644, keyMode: 0600, uid: -1, gid: -1}
+	assert.Nil(t, saveKeyPair(certFile, keyFile, []byte("cert"), []byte("new key"), perms, true), "error should be nil")
+	after, err := os.Stat(keyFile)
+	assert.Nil(t, err, "error should be nil")
+	assert.Equal(t, os.FileMode(0600), after.Mode().Perm(), "the key should get its own mode")
+	assert.False(t, os.SameFile(before, after), "the key should be written to a new file rather than into the old one")
+	data, _ := os.ReadFile(keyFile)
+	assert.Equal(t, "new key", string(data), "the key should be replaced")
+	entries, _ := os.ReadDir(dir)
+	assert.Len(t, entries, 2, "no temporary files should be left behind")
+}
+
+// TestSaveKeyPair_NoReplace tests that without replace, an existing key is left alone, along with no new cert
+func TestSaveKeyPair_NoReplace(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	assert.Nil(t, os.WriteFile(keyFile, []byte("old key"), 0600), "error should be nil")
+
+	perms := filePerms{certMode: 0644, keyMode: 0600, uid: -1, gid: -1}
+	err := saveKeyPair(certFile, keyFile, []byte("cert"), []byte("new key"), perms, false)
+	assert.EqualError(t, err, "unable to write the key file: "+keyFile+" already exists", "an existing key should be refused")
+	data, _ := os.ReadFile(keyFile)
+	assert.Equal(t, "old key", string(data), "the existing key should be kept")
+	entries, _ := os.ReadDir(dir)
+	assert.Len(t, entries, 1, "neither the new cert nor temporary files should be left behind")
+
+	assert.Nil(t, os.Remove(keyFile), "error should be nil")
+	assert.Nil(t, saveKeyPair(certFile, keyFile, []byte("cert"), []byte("new key"), perms, false), "error should be nil")
+	data, _ = os.ReadFile(keyFile)
+	assert.Equal(t, "new key", string(data), "the key should be written once it doesn't exist")
+}
+
+// TestParseOwner tests that owners are parsed by ID or name, with missing parts left unchanged
+func TestParseOwner(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		_, _, err := parseOwner("0")
+		assert.NotNil(t, err, "owners should be rejected on windows")
+		return
+	}
+	cases := []struct {
+		owner    string
+		uid, gid int
+	}{
+		{"", -1, -1},
+		{"1000", 1000, -1},
+		{"1000:50", 1000, 50},
+		{":50", -1, 50},
+	}
+	for _, c := range cases {
+		uid, gid, err := parseOwner(c.owner)
+		assert.Nil(t, err, "error should be nil for %q", c.owner)
+		assert.Equal(t, c.uid, uid, "unexpected uid for %q", c.owner)
+		assert.Equal(t, c.gid, gid, "unexpected gid for %q", c.owner)
+	}
+
+	if current, err := user.Current(); err == nil {
+		uid, _, err := parseOwner(current.Username)
+		assert.Nil(t, err, "error should be nil")
+		assert.Equal(t, current.Uid, strconv.Itoa(uid), "users should be looked up by name")
+	}
+	_, _, err := parseOwner("no-such-user-ssl-proxy")
+	assert.NotNil(t, err, "unknown users should be rejected")
+	_, _, err = parseOwner("0:no-such-group-ssl-proxy")
+	assert.NotNil(t, err, "unknown groups should be rejected")
+}
+
+// TestModeValue tests that file modes are parsed in octal and limited to permission bits
+func TestModeValue(t *testing.T) {
+	var m modeValue
+	assert.Nil(t, m.Set("0640"), "error should be nil")
+	assert.Equal(t, modeValue(0640), m, "modes should be parsed in octal")
+	assert.Equal(t, "0640", m.String(), "modes should be printed in octal")
+	assert.Nil(t, m.Set("600"), "error should be nil")
+	assert.Equal(t, modeValue(0600), m, "the leading zero should be optional")
+	for _, s := range []string{"", "0999", "1777", "rw-r--r--"} {
+		assert.NotNil(t, m.Set(s), "%q should be rejected", s)
+	}
+}
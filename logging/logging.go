@@ -0,0 +1,98 @@
+// Package logging writes leveled log messages through the standard log package, so that -log-level can silence the
+// startup banner and routine messages or turn on detailed ones for debugging.
+package logging
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// Level is the severity of a log message. Messages below the current level are discarded.
+type Level int32
+
+const (
+	Debug Level = iota
+	Info
+	Warn
+	Error
+)
+
+var (
+	names = [...]string{Debug: "debug", Info: "info", Warn: "warn", Error: "error"}
+	// prefixes keeps the WARN: prefix that messages have always had, and marks the other levels likewise
+	prefixes = [...]string{Debug: "DEBUG: ", Info: "", Warn: "WARN: ", Error: "ERROR: "}
+)
+
+func (l Level) String() string {
+	if l < Debug || l > Error {
+		return fmt.Sprintf("Level(%d)", int32(l))
+	}
+	return names[l]
+}
+
+// ParseLevel returns the level named s: debug, info, warn or error
+func ParseLevel(s string) (Level, error) {
+	for l, name := range names {
+		if strings.EqualFold(s, name) {
+			return Level(l), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown level %q, must be one of debug, info, warn or error", s)
+}
+
+var level atomic.Int32
+
+func init() {
+	level.Store(int32(Info))
+}
+
+// SetLevel discards messages below l from now on
+func SetLevel(l Level) {
+	level.Store(int32(l))
+}
+
+// Enabled reports whether messages at l are logged, for callers that would otherwise do work to build them
+func Enabled(l Level) bool {
+	return l >= Level(level.Load())
+}
+
+// Debugf logs detailed messages for troubleshooting, such as which backend each request went to
+func Debugf(format string, v ...any) {
+	output(Debug, format, v...)
+}
+
+// Infof logs routine messages, such as what the proxy is listening on and serving
+func Infof(format string, v ...any) {
+	output(Info, format, v...)
+}
+
+// Warnf logs problems that the proxy works around, and settings that are likely mistakes
+func Warnf(format string, v ...any) {
+	output(Warn, format, v...)
+}
+
+// Errorf logs failures, such as a backend error or a server that stopped
+func Errorf(format string, v ...any) {
+	output(Error, format, v...)
+}
+
+func output(l Level, format string, v ...any) {
+	if Enabled(l) {
+		log.Output(3, prefixes[l]+fmt.Sprintf(format, v...))
+	}
+}
+
+// NewLogger returns a logger writing at l, for libraries such as net/http that take a *log.Logger
+func NewLogger(l Level) *log.Logger {
+	return log.New(writer(l), "", 0)
+}
+
+// writer writes each message it is given to the standard logger at its level
+type writer Level
+
+func (w writer) Write(b []byte) (int, error) {
+	output(Level(w), "%s", strings.TrimSuffix(string(b), "\n"))
+	return len(b), nil
+}
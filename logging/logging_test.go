@@ -0,0 +1,41 @@
+package logging
+
+import (
+	"bytes"
+	"log"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestLevels tests that level names are parsed, and that messages below the level are discarded, including those from
+// library loggers
+func TestLevels(t *testing.T) {
+	var out bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	defer log.SetFlags(log.Flags())
+	log.SetOutput(&out)
+	log.SetFlags(0)
+	defer SetLevel(Info)
+
+	for _, name := range []string{"debug", "info", "WARN", "error"} {
+		_, err := ParseLevel(name)
+		assert.Nil(t, err, "%s should be a level", name)
+	}
+	_, err := ParseLevel("verbose")
+	assert.NotNil(t, err, "unknown levels should be rejected")
+
+	SetLevel(Warn)
+	Debugf("debug %d", 1)
+	Infof("info %d", 2)
+	Warnf("warn %d", 3)
+	Errorf("error %d", 4)
+	NewLogger(Info).Println("ignored")
+	NewLogger(Error).Println("from a library")
+	assert.Equal(t, "WARN: warn 3\nERROR: error 4\nERROR: from a library\n", out.String(), "messages below the level should be discarded")
+
+	out.Reset()
+	SetLevel(Debug)
+	Debugf("picked %s", "backend")
+	assert.Equal(t, "DEBUG: picked backend\n", out.String(), "debug messages should be logged at debug level")
+}
@@ -1,30 +1,171 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"flag"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"syscall"
+	"text/template"
 	"time"
 
+	"github.com/pires/go-proxyproto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/snewstv/ssl-proxy/acmedns"
+	"github.com/snewstv/ssl-proxy/config"
 	"github.com/snewstv/ssl-proxy/gen"
+	"github.com/snewstv/ssl-proxy/logging"
+	"github.com/snewstv/ssl-proxy/metrics"
+	"github.com/snewstv/ssl-proxy/middleware"
 	"github.com/snewstv/ssl-proxy/reverseproxy"
+	"golang.org/x/crypto/acme"
 	"golang.org/x/crypto/acme/autocert"
 )
 
 var (
-	to              = flag.String("to", "http://127.0.0.1:80", "the address and port for which to proxy requests to")
-	fromURL         = flag.String("from", "127.0.0.1:443", "the tcp address and port this proxy should listen for requests on")
-	certFile        = flag.String("cert", "", "path to a tls certificate file. If not provided, ssl-proxy will generate one for you in ~/.ssl-proxy/")
-	keyFile         = flag.String("key", "", "path to a private key file. If not provided, ssl-proxy will generate one for you in ~/.ssl-proxy/")
-	domain          = flag.String("domain", "", "domain to mint letsencrypt certificates for. Usage of this parameter implies acceptance of the LetsEncrypt terms of service.")
+	configFile      = flag.String("config", "", "path to a YAML config file setting any of the other flags by name. Flags given on the command line take precedence")
+	strictToURL     = flag.Bool("strict-to-url", false, "refuse to start if a backend address has no http://, https:// or unix:// scheme, instead of assuming http://")
+	to              = flag.String("to", "http://127.0.0.1:80", "the address and port for which to proxy requests to (empty to 404 requests for hosts not routed by -config), or a comma separated list of them to round-robin between. Append =N to an address to give it weight N (default 1, 0 excludes it)")
+	fromURL         = flag.String("from", "127.0.0.1:443", "the tcp address and port this proxy should listen for requests on, or a comma separated list of them to listen on all at once")
+	network         = flag.String("network", "tcp", "the IP family to listen with: tcp to follow each -from address, so [::]:443 is IPv6 only and :443 is both, tcp4 for IPv4 only or tcp6 for IPv6 only")
+	systemdSocket   = flag.Bool("systemd-socket", false, "serve on the listening sockets passed by systemd socket activation instead of binding -from")
+	certFiles       = stringsFlag("cert", "path to a tls certificate file. If not provided, ssl-proxy will generate one for you in ~/.ssl-proxy/. May be repeated along with -key to serve several certs, chosen by the server name clients ask for (the first is the default)")
+	keyFiles        = stringsFlag("key", "path to a private key file. If not provided, ssl-proxy will generate one for you in ~/.ssl-proxy/. Repeat once for each -cert, in the same order")
+	domain          = flag.String("domain", "", "domain (or comma separated domains) to mint letsencrypt certificates for. Usage of this parameter implies acceptance of the LetsEncrypt terms of service.")
+	dnsProvider     = flag.String("dns-provider", "", "answer LetsEncrypt challenges for -domain via DNS-01 using this provider (cloudflare or route53), which is required for wildcard domains like *.example.com")
+	cfToken         = flag.String("cloudflare-api-token", "", "Cloudflare API token with Zone:Read and DNS:Edit permissions, for -dns-provider cloudflare. Defaults to $CLOUDFLARE_API_TOKEN")
+	route53Zone     = flag.String("route53-hosted-zone-id", "", "Route 53 hosted zone to create challenge records in, for -dns-provider route53. Looked up from -domain if empty; credentials come from the standard AWS sources")
 	redirectHTTP    = flag.Int("redirectHTTP", 0, "if set, redirects http requests from provided port to https at your fromURL (0 disable)")
-	altnames        = flag.String("altnames", "localhost", "comma separated altnames for the certificate DNS field")
+	redirectStatus  = flag.Int("redirect-status", http.StatusTemporaryRedirect, "the status of -redirectHTTP redirects: 301 or 308 for permanent redirects, or 302 or 307 for temporary ones. 307 and 308 keep the method and body of non-GET requests")
+	hstsMaxAge      = durationFlag("hsts-max-age", 0, "if set, send a Strict-Transport-Security header on every response telling browsers to only use HTTPS for this long, e.g. 365d (0 disables)")
+	hstsSubdomains  = flag.Bool("hsts-include-subdomains", false, "extend -hsts-max-age to every subdomain of the host")
+	hstsPreload     = flag.Bool("hsts-preload", false, "ask for the host to be added to browsers' HSTS preload lists, which requires -hsts-include-subdomains and an -hsts-max-age of at least 365d")
+	wsDrainTimeout  = flag.Duration("ws-drain-timeout", 10*time.Second, "how long to wait on shutdown for WebSockets and other upgraded connections to close before closing them, sending WebSocket clients a close frame (0 closes them at once)")
+	shutdownTimeout = flag.Duration("shutdown-timeout", 30*time.Second, "how long to wait for in-flight requests to finish when shutting down on SIGINT/SIGTERM")
+	healthPath      = flag.String("healthcheck-path", "", "if set, periodically GET this path on every backend and only proxy to those responding with a 2xx status")
+	healthInterval  = flag.Duration("healthcheck-interval", 10*time.Second, "how often to run backend health checks when -healthcheck-path is set")
+	adminAddr       = flag.String("admin-addr", "", "if set, serve /live and /ready probes for orchestrators on this address (e.g. :8081), separately from the TLS listener")
+	adminToken      = flag.String("admin-token", "", "bearer token required by the -admin-addr endpoints that change state, such as draining a backend. Without it they only answer clients connecting from loopback")
+	pprofAddr       = flag.String("pprof-addr", "", "if set, serve net/http/pprof profiles at /debug/pprof/ on this address for debugging. Binds to localhost unless a host is given (e.g. :6060 is localhost:6060). Never expose it publicly")
+	metricsAddr     = flag.String("metrics-addr", "", "if set, serve Prometheus metrics at /metrics on this address (e.g. :9090), separately from the TLS listener")
+	requestIDHeader = flag.String("request-id-header", "X-Request-ID", "header identifying each request, which is generated if the client didn't send one, forwarded to the backend, echoed in the response and logged (empty disables)")
+	logFormat       = flag.String("log-format", "text", "format of the per-request access log: text (no access log) or json (one JSON object per request on stdout)")
+	logLevel        = flag.String("log-level", "info", "the least severe messages to log: debug (adds backend selection, backend connections and cert reloads), info, warn or error")
+	logTemplate     = flag.String("log-template", "", "write a per-request access log line on stdout formatted by this Go text/template, e.g. '{{.RemoteIP}} {{.Method}} {{.Status}} {{.Duration}}', or a preset: common or combined")
+	slowThreshold   = flag.Duration("slow-threshold", 0, "log a warning for every request taking longer than this to serve, including the time the backend takes to respond, e.g. 2s (0 disables)")
+	keyType         = flag.String("key-type", string(gen.ECDSAP256), "type of key to generate for self-signed certs: rsa2048, rsa4096, ecdsa-p256, ecdsa-p384 or ed25519")
+	certValidity    = durationFlag("cert-validity", 365*24*time.Hour, "how long generated self-signed certs are valid for, e.g. 8760h or 90d")
+	preserveHost    = flag.Bool("preserve-host", true, "send backends the Host header the client sent. With -preserve-host=false each backend is sent the host of its own address in -to instead")
+	upstreamHost    = flag.String("upstream-host", "", "if set, the Host header to send backends instead of the client's, e.g. for backends doing name-based virtual hosting")
+	unixSocketHost  = flag.String("unix-socket-host", "localhost", "the Host header sent to unix:// backends (e.g. -to unix:///var/run/app.sock)")
+	trustedProxies  = flag.String("trusted-proxies", "", "comma separated CIDRs (or IPs) of proxies in front of ssl-proxy whose X-Forwarded-For chain is trusted and extended rather than reset")
+	xffMaxHops      = flag.Int("xff-max-hops", 0, "the most addresses to send backends in X-Forwarded-For, including the client's. Chains from -trusted-proxies are also trimmed to the trusted hops and the address before them (0 no limit)")
+	realIPHeader    = flag.String("real-ip-header", "", "header carrying the real client IP, e.g. CF-Connecting-IP, to use for logging, rate limiting and -allow-cidr/-deny-cidr. Only trusted on connections from -trusted-proxies")
+	resolverAddr    = flag.String("resolver", "", "IP[:port] of a DNS server to resolve backend host names with instead of the system resolver, e.g. 10.0.0.53:53")
+	upstreamProxy   = flag.String("upstream-proxy", "", "connect to backends through this proxy, e.g. socks5://127.0.0.1:1080 or http://proxy:3128. Hosts in $NO_PROXY are connected to directly")
+	backendHTTP2    = flag.Bool("backend-http2", false, "speak cleartext HTTP/2 (h2c) to plaintext backends instead of HTTP/1.1. Does not affect the client-facing TLS listener")
+	setReqHeaders   = stringsFlag("set-request-header", "\"Name: Value\" header to set on requests sent to the backend, may be repeated. ${VAR} in the value is replaced by the environment variable VAR")
+	rmReqHeaders    = stringsFlag("remove-request-header", "name of a header to remove from requests sent to the backend, may be repeated")
+	setRespHeaders  = stringsFlag("set-response-header", "\"Name: Value\" header to set on responses sent to clients, may be repeated. ${VAR} in the value is replaced by the environment variable VAR")
+	stripHeaders    = stringsFlag("strip-header", "deprecated alias of -remove-request-header, which should be used instead")
+	rmRespHeaders   = stringsFlag("remove-response-header", "name of a header to remove from responses sent to clients, may be repeated")
+	rewriteBody     = stringsFlag("rewrite-body", "\"old=new\" replacement to make in text/html and application/json response bodies, e.g. http://example.com=https://example.com, may be repeated. Gzipped bodies are decompressed first")
+	basicAuth       = stringsFlag("basic-auth", "user:password allowed through HTTP basic auth, may be repeated. Requests without valid credentials get a 401")
+	basicAuthFile   = flag.String("basic-auth-file", "", "htpasswd file of users allowed through HTTP basic auth, with bcrypt hashed passwords (htpasswd -B)")
+	corsOrigins     = flag.String("cors-allow-origin", "", "comma separated origins (e.g. https://app.example.com) allowed to make cross-origin requests, or * for any. Enables CORS handling, answering preflight requests without forwarding them")
+	corsMethods     = flag.String("cors-allow-methods", "GET,HEAD,POST,PUT,PATCH,DELETE", "comma separated methods allowed in cross-origin requests, for -cors-allow-origin")
+	corsHeaders     = flag.String("cors-allow-headers", "", "comma separated request headers allowed in cross-origin requests beyond the CORS-safelisted ones, e.g. Authorization,Content-Type, for -cors-allow-origin")
+	corsCredentials = flag.Bool("cors-allow-credentials", false, "allow cross-origin requests to include cookies and credentials, for -cors-allow-origin. Requires explicit origins rather than *")
+	rateLimit       = flag.Float64("rate-limit", 0, "if set, the average number of requests per second each client IP may send. Clients over the limit get a 429 (0 disable)")
+	rateBurst       = flag.Int("rate-burst", 10, "how many requests a client IP may send at once before -rate-limit applies")
+	backendCA       = flag.String("backend-ca", "", "PEM bundle of CA certificates to verify https:// backends with instead of the system's")
+	backendSNI      = flag.String("backend-server-name", "", "the host name to send as SNI to https:// backends and verify their certificates against, instead of the one in -to")
+	backendInsec    = flag.Bool("backend-insecure", false, "don't verify the certificates of https:// backends at all. Prefer -backend-ca and -backend-server-name")
+	dialTimeout     = flag.Duration("dial-timeout", 30*time.Second, "how long connecting to a backend may take before the next backend is tried")
+	respHdrTimeout  = flag.Duration("response-header-timeout", 60*time.Second, "how long a backend may take to start responding before the client gets a 504 (0 no limit)")
+	retryCount      = flag.Int("retry-count", 0, "how many times to retry GET, HEAD and OPTIONS requests when a backend fails after connecting, preferring a different backend each time")
+	breakerFailures = flag.Int("breaker-threshold", 0, "open a backend's circuit breaker after this many consecutive failed requests, sending it nothing until -breaker-cooldown has passed (0 disables)")
+	breakerCooldown = flag.Duration("breaker-cooldown", 30*time.Second, "how long an open circuit breaker stops requests to its backend before letting a trial request through")
+	canary          = flag.String("canary", "", "comma separated backends, in the same syntax as -to, to send -canary-percent of requests to instead of the -to backends")
+	canaryPercent   = flag.Float64("canary-percent", 5, "the percentage of requests to send to the -canary backends")
+	canaryPin       = flag.String("canary-pin", "cookie", "how clients are kept on the same side of the canary: cookie to pin each one with a cookie, ip to hash their IP, or none to choose for every request")
+	stickyCookie    = flag.String("sticky-cookie", "", "if set, the name of a cookie pinning each client to the backend that served its first request while that backend is healthy")
+	flushInterval   = flushFlag("flush-interval", 0, "how often to flush response bodies to the client while streaming them from the backend, e.g. 100ms, or -1 to flush after every write. Server-sent events and responses without a Content-Length always flush immediately")
+	bufferSize      = sizeFlag("proxy-buffer-size", 32*1024, "size of the buffers response bodies are copied to clients through, e.g. 32KB or 1MB for large downloads. Each request being proxied holds one")
+	keepAliveProbe  = flag.Duration("backend-keepalive-probe", 30*time.Second, "how often to send TCP keep-alive probes on idle connections to backends, so those dropped by a firewall are noticed before being reused (negative disables them)")
+	idleConnTimeout = flag.Duration("idle-conn-timeout", 90*time.Second, "how long idle keep-alive connections to backends are kept open")
+	maxIdleConns    = flag.Int("max-idle-conns", 100, "how many idle keep-alive connections to keep open to all backends together")
+	maxIdlePerHost  = flag.Int("max-idle-conns-per-host", 100, "how many idle keep-alive connections to keep open to each backend. Raise it if a busy backend sees many new connections")
+	maxConnsPerHost = flag.Int("max-conns-per-host", 0, "the most connections to open to each backend at once, with further requests waiting for one to free up (0 no limit)")
+	readHdrTimeout  = flag.Duration("read-header-timeout", 10*time.Second, "how long clients may take to send request headers, which guards against Slowloris-style attacks")
+	readTimeout     = flag.Duration("read-timeout", 60*time.Second, "how long clients may take to send a whole request including its body (0 no limit)")
+	writeTimeout    = flag.Duration("write-timeout", 0, "how long writing a response may take, from the end of the request headers. Off by default since it also cuts off long downloads. WebSockets and server-sent events are exempt (0 no limit)")
+	streamIdle      = flag.Duration("stream-idle-timeout", 0, "close WebSockets, server-sent events streams and -grpc-streams calls once nothing has been sent either way for this long. They aren't subject to -read-timeout or -write-timeout (0 no limit)")
+	grpcStreams     = flag.Bool("grpc-streams", false, "exempt gRPC calls from -read-timeout and -write-timeout, so long-lived streams stay open. Any client can mark its requests as gRPC, so combine it with -stream-idle-timeout")
+	tcpKeepAlive    = flag.Duration("tcp-keepalive", 15*time.Second, "how often to send TCP keep-alive probes on idle client connections, so that dead peers are dropped (negative disables them)")
+	maxConns        = flag.Int("max-conns", 0, "the most client connections each -from address accepts at once, or 0 for no limit")
+	maxConnsMode    = flag.String("max-conns-behavior", "wait", "what happens to connections over -max-conns: wait to accept them once others close, or reject to close them straight away")
+	disableHTTP2    = flag.Bool("disable-http2", false, "only offer HTTP/1.1 to clients of the TLS listener, not HTTP/2, e.g. for client libraries with broken HTTP/2 support. gRPC needs HTTP/2")
+	reusePort       = flag.Bool("reuseport", false, "set SO_REUSEPORT on the -from listeners, including the -http3 UDP sockets, so that several ssl-proxy processes can serve the same address with the kernel balancing connections across them")
+	noKeepAlive     = flag.Bool("disable-keepalive", false, "close every client connection after its response instead of keeping it open for further requests, e.g. for debugging")
+	idleTimeout     = flag.Duration("idle-timeout", 120*time.Second, "how long idle keep-alive client connections are kept open")
+	minTLSVersion   = flag.String("min-tls-version", "1.2", "minimum TLS version to accept from clients: 1.2 or 1.3")
+	clientCA        = flag.String("client-ca", "", "PEM bundle of CA certificates to verify client certificates with, requiring clients to authenticate with one (see -client-auth-mode)")
+	clientAuthMode  = flag.String("client-auth-mode", "", "how clients authenticate with certificates: none, request, require, verify-if-given or require-and-verify (default require-and-verify with -client-ca, none without)")
+	certSubjectHdr  = flag.String("client-cert-header", "", "header to send the subject of verified client certificates to backends in, e.g. X-Client-Cert-Subject")
+	certSerialHdr   = flag.String("client-cert-serial-header", "", "header to send the hex serial number of verified client certificates to backends in, e.g. X-Client-Cert-Serial")
+	certPEMHdr      = flag.String("client-cert-pem-header", "", "header to send verified client certificates to backends in, as base64 encoded PEM, e.g. X-Client-Cert-PEM")
+	ticketRotation  = flag.Duration("ticket-rotation", time.Hour, "how often to replace the key TLS session tickets are encrypted with. Tickets stay valid for resumption for up to twice as long (0 rotates daily, as Go does by default)")
+	noTickets       = flag.Bool("disable-session-tickets", false, "disable TLS session tickets, so that sessions can't be resumed, for maximum forward secrecy")
+	cipherSuites    = flag.String("cipher-suites", "", "comma separated TLS 1.2 cipher suites to allow, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 (default Go's secure defaults). TLS 1.3 suites are not configurable")
+	serveHTTP3      = flag.Bool("http3", false, "also serve HTTP/3 over QUIC on the UDP ports of -from, advertising it to clients with an Alt-Svc header")
+	proxyProtocol   = flag.Bool("proxy-protocol", false, "require a PROXY protocol (v1 or v2) header on every connection to -from, e.g. from an AWS NLB, and use the client address it carries")
+	maintenanceFile = flag.String("maintenance-file", "", "while this file exists, answer every request with a 503 and the file's contents as the page (or a built-in page if it is empty) instead of proxying, e.g. /etc/ssl-proxy/maintenance.html")
+	cleanPath       = flag.Bool("clean-path", false, "normalize request paths before routing and forwarding them, collapsing duplicate slashes and resolving . and .. elements, instead of redirecting clients to the cleaned path")
+	staticDir       = flag.String("static-dir", "", "if set, serve the files in this directory for requests under -static-prefix instead of proxying them")
+	staticPrefix    = flag.String("static-prefix", "/static/", "the path prefix of requests served from -static-dir, which is removed to find the file")
+	errorFormat     = flag.String("error-format", "html", "the format of the error responses the proxy sends itself, e.g. when no backend can be reached: html, text or json (a JSON object with the status, an error code and a message, for API clients)")
+	errorPage502    = flag.String("error-page-502", "", "path to an HTML page to serve when no backend can be reached, instead of the built-in page")
+	errorPage504    = flag.String("error-page-504", "", "path to an HTML page to serve when a backend times out, instead of the built-in page")
+	dryRunFlag      = flag.Bool("dry-run", false, "validate the flags and config file, the cert and key files and that every backend accepts connections, print a summary and exit without serving. Exits non-zero if any check fails")
+	minCertLifetime = durationFlag("min-cert-lifetime", 14*24*time.Hour, "warn on startup if the -cert file expires sooner than this, e.g. 14d (0 disables the check)")
+	failOnExpiring  = flag.Bool("fail-on-expiring-cert", false, "refuse to start, rather than warn, if the -cert file expires sooner than -min-cert-lifetime")
+	renewSelfSigned = durationFlag("self-signed-renew-before", 30*24*time.Hour, "regenerate the default self-signed cert in ~/.ssl-proxy/ on startup once it expires within this long, e.g. 30d")
+	acmeCacheDir    = flag.String("acme-cache-dir", filepath.Join(userHomeDir, ".ssl-proxy", "acme-cache"), "directory to cache LetsEncrypt account keys and certificates in, created if needed")
+	acmeDirectory   = flag.String("acme-directory", autocert.DefaultACMEDirectory, "ACME directory URL to obtain -domain certificates from, e.g. https://acme-staging-v02.api.letsencrypt.org/directory for LetsEncrypt staging. Accounts and certificates from each directory are cached separately")
+	exportCerts     = flag.String("export-certs-dir", "", "directory to write the -domain certificates to whenever they are obtained or renewed, as <domain>/fullchain.pem and <domain>/privkey.pem, for other services to use")
+	acmeEmail       = flag.String("acme-email", "", "contact email registered with the ACME CA, which may be used to warn about expiring certificates")
+	certEnv         = flag.String("cert-env", "", "name of an environment variable holding the PEM encoded tls certificate, instead of -cert. Requires -key-env")
+	keyEnv          = flag.String("key-env", "", "name of an environment variable holding the PEM encoded private key, instead of -key. Requires -cert-env")
+	watchCerts      = flag.Bool("watch-certs", false, "reload the -cert and -key files automatically whenever they change, as well as on SIGHUP")
+	printVersion    = flag.Bool("version", false, "print the version, commit and build date of ssl-proxy and exit")
+	compress        = flag.Bool("compress", false, "gzip compressible responses (text, JSON, JavaScript, etc.) for clients that accept it, unless the backend already encoded them")
+	compressMinSize = flag.Int("compress-min-size", 1024, "responses shorter than this many bytes are not compressed by -compress")
+	reqBufferSize   = sizeFlag("request-buffer-size", 0, "read request bodies with a Content-Length up to this size into memory before sending the request to the backend, e.g. 1MB, so slow uploads don't hold backend connections. Chunked bodies and gRPC calls are always streamed (0 streams bodies as they arrive)")
+	maxBodySize     = sizeFlag("max-body-size", 0, "reject requests with bodies larger than this with a 413, e.g. 10MB (0 no limit)")
+	accessRules     = aclFlags(
+		"allow-cidr", "comma separated CIDRs (or IPs) of clients to allow, may be repeated. Rules from -allow-cidr and -deny-cidr are checked in the order given and the first match wins; if there are any allow rules, clients matching no rule get a 403",
+		"deny-cidr", "comma separated CIDRs (or IPs) of clients to deny with a 403, may be repeated. See -allow-cidr")
+	ocspStapling    = flag.Bool("ocsp-stapling", false, "staple an OCSP response from the issuer to the -cert certificate, refreshing it in the background. -cert must include the issuer certificate after the leaf")
+	certFileMode    = modeFlag("cert-file-mode", 0644, "permission bits of generated and exported cert files, in octal")
+	keyFileMode     = modeFlag("key-file-mode", 0600, "permission bits of generated and exported key files, in octal")
+	fileOwner       = flag.String("file-owner", "", "user[:group] to own generated and exported cert and key files and any directories created for them, by name or ID, e.g. ssl-proxy:ssl-proxy")
+	noOverwrite     = flag.Bool("no-overwrite", false, "refuse to start instead of replacing an existing default self-signed cert or key, e.g. one that is expiring or whose pair is missing")
+	ephemeralCert   = flag.Bool("ephemeral-cert", false, "generate the self-signed cert in memory on every start instead of writing it to ~/.ssl-proxy, so its fingerprint changes each time")
+	altnames        = flag.String("altnames", "localhost", "comma separated altnames for generated certificates. IP addresses become IP SANs, anything else a DNS SAN")
 	userHomeDir, _  = os.UserHomeDir()
 	defaultCertFile = userHomeDir + "/.ssl-proxy/cert.pem"
 	defaultKeyFile  = userHomeDir + "/.ssl-proxy/key.pem"
@@ -34,133 +175,967 @@ var (
 const (
 	HTTPSPrefix = "https://"
 	HTTPPrefix  = "http://"
+	UnixPrefix  = "unix://"
 )
 
+// maxCertLifetime is the longest certificate lifetime that clients such as Apple's platforms accept
+const maxCertLifetime = 825 * 24 * time.Hour
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "gencert" {
+		if err := gencert(os.Args[2:], os.Stdout); err != nil {
+			if err == flag.ErrHelp {
+				return
+			}
+			log.Fatal(err)
+		}
+		return
+	}
+
 	flag.Parse()
+	cmdline := config.Explicit(flag.CommandLine)
+	fromEnv, err := config.ApplyEnv(flag.CommandLine, envPrefix, os.Environ())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *printVersion {
+		fmt.Println(versionString())
+		return
+	}
+
+	var cfg *config.File
+	if *configFile != "" {
+		var err error
+		cfg, err = config.Load(*configFile)
+		if err != nil {
+			log.Fatal("Unable to load config file: ", err)
+		}
+		if err := cfg.Apply(flag.CommandLine, config.Explicit(flag.CommandLine), "config"); err != nil {
+			log.Fatal(err)
+		}
+	}
 
-	validCertFile := *certFile != ""
-	validKeyFile := *keyFile != ""
-	validDomain := *domain != ""
+	if level, err := logging.ParseLevel(*logLevel); err != nil {
+		log.Fatalf("Invalid -log-level: %v", err)
+	} else {
+		logging.SetLevel(level)
+	}
+	warnUnknownEnv(os.Environ(), *certEnv, *keyEnv)
+	logEffectiveConfig(cmdline, fromEnv, cfg)
+	if *logFormat != "text" && *logFormat != "json" {
+		log.Fatalf("Invalid -log-format %q, must be one of text or json", *logFormat)
+	}
+	var accessLogTmpl *template.Template
+	if *logTemplate != "" {
+		if *logFormat == "json" {
+			log.Fatal("-log-template cannot be combined with -log-format json")
+		}
+		var err error
+		if accessLogTmpl, err = middleware.ParseLogTemplate(*logTemplate); err != nil {
+			log.Fatalf("Invalid -log-template: %v", err)
+		}
+	}
+	genKeyType, err := gen.ParseKeyType(*keyType)
+	if err != nil {
+		log.Fatal("Invalid -key-type: ", err)
+	}
+	perms := filePerms{certMode: *certFileMode, keyMode: *keyFileMode}
+	if perms.uid, perms.gid, err = parseOwner(*fileOwner); err != nil {
+		log.Fatal("Invalid -file-owner: ", err)
+	}
+	if *bufferSize <= 0 || *bufferSize > 64<<20 {
+		log.Fatalf("Invalid -proxy-buffer-size %d, must be positive and at most 64MB", *bufferSize)
+	}
+	if *reqBufferSize < 0 {
+		log.Fatalf("Invalid -request-buffer-size %d, must not be negative", *reqBufferSize)
+	}
+	if *certValidity <= 0 {
+		log.Fatalf("Invalid -cert-validity %s, must be positive", *certValidity)
+	}
+	if *certValidity > maxCertLifetime {
+		logging.Warnf("-cert-validity %s is longer than 825 days, many clients will reject the generated certificate", *certValidity)
+	}
+	tlsPolicy, err := newTLSConfig(*minTLSVersion, *cipherSuites)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if tlsPolicy.MinVersion == tls.VersionTLS13 && len(tlsPolicy.CipherSuites) > 0 {
+		logging.Warnf("-cipher-suites has no effect with -min-tls-version 1.3")
+	}
+	if err := setClientAuth(tlsPolicy, *clientCA, *clientAuthMode); err != nil {
+		log.Fatal(err)
+	}
+
+	// Certs from the environment are served from memory so that secrets never touch the disk
+	var memCert *tls.Certificate
+	var memCertSource string
+	if *certEnv != "" || *keyEnv != "" {
+		if *certEnv == "" || *keyEnv == "" {
+			log.Fatal("-cert-env and -key-env must be given together")
+		}
+		cert, err := tls.X509KeyPair([]byte(os.Getenv(*certEnv)), []byte(os.Getenv(*keyEnv)))
+		if err != nil {
+			log.Fatalf("Unable to load cert and key from $%s and $%s: %v", *certEnv, *keyEnv, err)
+		}
+		memCert, memCertSource = &cert, "from $"+*certEnv
+	}
+
+	var certFile, keyFile string
+	if len(*certFiles) > 0 && len(*keyFiles) > 0 {
+		if len(*certFiles) != len(*keyFiles) {
+			log.Fatalf("-cert and -key must be given the same number of times, got %d certs and %d keys", len(*certFiles), len(*keyFiles))
+		}
+		certFile, keyFile = (*certFiles)[0], (*keyFiles)[0]
+	}
+	validCertFile := certFile != ""
+	validKeyFile := keyFile != ""
+	froms := splitList(*fromURL)
+	if len(froms) == 0 {
+		log.Fatal("-from must list at least one address to listen on")
+	}
+	if *network != "tcp" && *network != "tcp4" && *network != "tcp6" {
+		log.Fatalf("Invalid -network %q, must be tcp, tcp4 or tcp6", *network)
+	}
+	switch *redirectStatus {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		log.Fatalf("Invalid -redirect-status %d, must be 301, 302, 307 or 308", *redirectStatus)
+	}
+	if *maxConnsMode != "wait" && *maxConnsMode != "reject" {
+		log.Fatalf("Invalid -max-conns-behavior %q, must be wait or reject", *maxConnsMode)
+	}
+	domains := splitList(*domain)
+	validDomain := len(domains) > 0
+
+	// Ephemeral self-signed certs are generated in memory on every start
+	if (!validCertFile || !validKeyFile) && !validDomain && memCert == nil && *ephemeralCert {
+		cert, err := gen.KeyPair(*certValidity, splitList(*altnames), genKeyType)
+		if err != nil {
+			log.Fatal("Error generating ephemeral keys: ", err)
+		}
+		memCert, memCertSource = &cert, "generated in memory"
+		certFile, keyFile = "", ""
+	}
 
 	// Determine if we need to generate self-signed certs
-	if (!validCertFile || !validKeyFile) && !validDomain {
+	if (!validCertFile || !validKeyFile) && !validDomain && memCert == nil {
 		// Use default file paths
-		*certFile = defaultCertFile
-		*keyFile = defaultKeyFile
+		certFile = defaultCertFile
+		keyFile = defaultKeyFile
 
-		needCreate := false
-		if _, err := os.Stat(*certFile); os.IsNotExist(err) {
-			needCreate = true
-		} else if _, err := os.Stat(*keyFile); os.IsNotExist(err) {
-			needCreate = true
-		}
+		needCreate, certAltnames := needSelfSigned(certFile, keyFile, splitList(*altnames), *renewSelfSigned)
 
-		if needCreate {
-			log.Printf("No existing cert or key specified, generating some self-signed certs for use (%s, %s)\n", *certFile, *keyFile)
+		if needCreate && *noOverwrite {
+			if err := checkNotExist(certFile, keyFile); err != nil {
+				log.Fatalf("Refusing to generate self-signed certs with -no-overwrite: %v", err)
+			}
+		}
+		if needCreate && *dryRunFlag {
+			logging.Infof("No existing cert or key specified, self-signed certs would be generated (%s, %s)", certFile, keyFile)
+			certFile, keyFile = "", ""
+		} else if needCreate {
+			logging.Infof("No existing cert or key specified, generating some self-signed certs for use (%s, %s)", certFile, keyFile)
 
 			// Generate new keys
-			certBuf, keyBuf, fingerprint, err := gen.Keys(365*24*time.Hour, strings.Split(*altnames, ","))
+			certBuf, keyBuf, fingerprint, err := gen.Keys(*certValidity, certAltnames, genKeyType)
 			if err != nil {
 				log.Fatal("Error generating default keys", err)
 			}
 
-			certOut, err := create(*certFile)
-			if err != nil {
-				log.Fatal("Unable to create cert file", err)
+			if err := saveKeyPair(certFile, keyFile, certBuf.Bytes(), keyBuf.Bytes(), perms, !*noOverwrite); err != nil {
+				log.Fatal(err)
 			}
-			certOut.Write(certBuf.Bytes())
 
-			keyOut, err := os.OpenFile(*keyFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
-			if err != nil {
-				log.Fatal("Unable to create the key file", err)
-			}
-			keyOut.Write(keyBuf.Bytes())
-
-			log.Printf("SHA256 Fingerprint: % X", fingerprint)
+			logging.Infof("SHA256 Fingerprint: % X", fingerprint)
 		} else {
-			log.Printf("Found default cert/key files: using...")
+			logging.Infof("Found default cert/key files: using...")
 		}
 	}
 
-	// Ensure the to URL is in the right form
-	if !strings.HasPrefix(*to, HTTPPrefix) && !strings.HasPrefix(*to, HTTPSPrefix) {
-		*to = HTTPPrefix + *to
-		log.Println("Assuming -to URL is using http://")
+	// Every -cert and -key pair is served, or otherwise the default self-signed pair, if any
+	certPaths, keyPaths := *certFiles, *keyFiles
+	if !validCertFile || !validKeyFile {
+		certPaths, keyPaths = nil, nil
+		if certFile != "" {
+			certPaths, keyPaths = []string{certFile}, []string{keyFile}
+		}
 	}
 
-	// Parse toURL as a URL
-	toURL, err := url.Parse(*to)
+	trusted, err := parseCIDRs(*trustedProxies)
 	if err != nil {
-		log.Fatal("Unable to parse 'to' url: ", err)
+		log.Fatal("Invalid -trusted-proxies: ", err)
+	}
+
+	if *realIPHeader != "" && len(trusted) == 0 {
+		log.Fatal("-real-ip-header requires -trusted-proxies, the addresses of the proxies setting it")
+	}
+
+	setRequest, err := parseHeaders(*setReqHeaders)
+	if err != nil {
+		log.Fatal("Invalid -set-request-header: ", err)
+	}
+	setResponse, err := parseHeaders(*setRespHeaders)
+	if err != nil {
+		log.Fatal("Invalid -set-response-header: ", err)
+	}
+	rewrites, err := parseRewrites(*rewriteBody)
+	if err != nil {
+		log.Fatal("Invalid -rewrite-body: ", err)
+	}
+
+	switch reverseproxy.ErrorFormat(*errorFormat) {
+	case reverseproxy.ErrorHTML, reverseproxy.ErrorText, reverseproxy.ErrorJSON:
+	default:
+		log.Fatalf("Invalid -error-format %q, must be html, text or json", *errorFormat)
+	}
+	if *errorFormat != string(reverseproxy.ErrorHTML) && (*errorPage502 != "" || *errorPage504 != "") {
+		logging.Warnf("-error-page-502 and -error-page-504 are only served with -error-format html")
+	}
+	errorPages := make(map[int][]byte)
+	for status, path := range map[int]string{http.StatusBadGateway: *errorPage502, http.StatusGatewayTimeout: *errorPage504} {
+		if path == "" {
+			continue
+		}
+		page, err := os.ReadFile(path)
+		if err != nil {
+			log.Fatalf("Unable to read %d error page: %v", status, err)
+		}
+		errorPages[status] = page
+	}
+
+	var upstream *url.URL
+	if *upstreamProxy != "" {
+		if upstream, err = url.Parse(*upstreamProxy); err != nil {
+			log.Fatal("Invalid -upstream-proxy: ", err)
+		}
+		switch upstream.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			log.Fatalf("Invalid -upstream-proxy %s, must start with http://, https:// or socks5://", *upstreamProxy)
+		}
+		if *backendHTTP2 {
+			logging.Warnf("-upstream-proxy is not used for -backend-http2 connections to plaintext backends")
+		}
+		if (*upstreamHost != "" || !*preserveHost) && (upstream.Scheme == "http" || upstream.Scheme == "https") {
+			// The proxy fetches whichever host the request names, so the Host header has to be the backend's own
+			logging.Warnf("-upstream-host and -preserve-host=false don't apply to http:// backends reached through -upstream-proxy %s, which are sent their own host as the Host header", *upstreamProxy)
+		}
+	}
+
+	var resolver *net.Resolver
+	if *resolverAddr != "" {
+		if resolver, err = newResolver(*resolverAddr); err != nil {
+			log.Fatal("Invalid -resolver: ", err)
+		}
+		logging.Infof("Resolving backend host names using the nameserver at %s", *resolverAddr)
+	}
+
+	var backendCAs *x509.CertPool
+	if *backendCA != "" {
+		pem, err := os.ReadFile(*backendCA)
+		if err != nil {
+			log.Fatal("Unable to read -backend-ca: ", err)
+		}
+		backendCAs = x509.NewCertPool()
+		if !backendCAs.AppendCertsFromPEM(pem) {
+			log.Fatalf("No certificates found in -backend-ca %s", *backendCA)
+		}
+	}
+	if *backendInsec {
+		logging.Warnf("-backend-insecure is set, so the certificates of https:// backends are not verified")
 	}
 
 	// Setup reverse proxy ServeMux
-	p := reverseproxy.Build(toURL)
-	mux := http.NewServeMux()
-	mux.Handle("/", p)
+	if len(*stripHeaders) > 0 {
+		logging.Warnf("-strip-header is deprecated, use -remove-request-header instead")
+	}
+	opts := reverseproxy.Options{
+		HealthCheckPath:       *healthPath,
+		HealthCheckInterval:   *healthInterval,
+		UnixSocketHost:        *unixSocketHost,
+		BackendHost:           !*preserveHost,
+		UpstreamHost:          *upstreamHost,
+		TrustedProxies:        trusted,
+		MaxForwardedFor:       *xffMaxHops,
+		BackendHTTP2:          *backendHTTP2,
+		DialTimeout:           *dialTimeout,
+		ResponseHeaderTimeout: *respHdrTimeout,
+		IdleConnTimeout:       *idleConnTimeout,
+		BackendKeepAlive:      *keepAliveProbe,
+		MaxIdleConns:          *maxIdleConns,
+		MaxIdleConnsPerHost:   *maxIdlePerHost,
+		MaxConnsPerHost:       *maxConnsPerHost,
+		ErrorPages:            errorPages,
+		ErrorFormat:           reverseproxy.ErrorFormat(*errorFormat),
+		RetryCount:            *retryCount,
+		BreakerThreshold:      *breakerFailures,
+		BreakerCooldown:       *breakerCooldown,
+		StickyCookie:          *stickyCookie,
+		CanaryPercent:         *canaryPercent,
+		UpstreamProxy:         upstream,
+		Resolver:              resolver,
+		BodyRewrites:          rewrites,
+		FlushInterval:         *flushInterval,
+		StreamIdleTimeout:     *streamIdle,
+		GRPCStreams:           *grpcStreams,
+		Upgrades:              reverseproxy.NewUpgrades(),
+		BufferSize:            int(*bufferSize),
+		RequestBufferSize:     *reqBufferSize,
+		BackendRootCAs:        backendCAs,
+		BackendServerName:     *backendSNI,
+		BackendInsecure:       *backendInsec,
+		HeaderRules: reverseproxy.HeaderRules{
+			SetRequest:     setRequest,
+			RemoveRequest:  append(*rmReqHeaders, *stripHeaders...),
+			SetResponse:    setResponse,
+			RemoveResponse: *rmRespHeaders,
+		},
+	}
+	if *canary != "" {
+		if opts.Canary, err = parseTargets(*canary, *strictToURL); err != nil {
+			log.Fatal("Invalid -canary: ", err)
+		}
+		if *canaryPercent < 0 || *canaryPercent > 100 {
+			log.Fatalf("Invalid -canary-percent %v, must be between 0 and 100", *canaryPercent)
+		}
+		switch *canaryPin {
+		case "cookie":
+			opts.CanaryCookie = "ssl_proxy_canary"
+		case "ip":
+			opts.CanaryKey = middleware.ClientIP
+		case "none":
+		default:
+			log.Fatalf("Invalid -canary-pin %q, must be cookie, ip or none", *canaryPin)
+		}
+		logging.Infof("Sending %v%% of requests to canary %s", *canaryPercent, *canary)
+	}
+	var m *metrics.Metrics
+	if *metricsAddr != "" {
+		m = metrics.New(prometheus.DefaultRegisterer, prometheus.DefaultGatherer)
+		opts.Observer = m
+	}
+	handler, proxies, err := buildRoutes(*to, cfg, opts, *strictToURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	rt := newRouter(*configFile, opts, handler, proxies)
+	handler = rt
+	if *staticDir != "" {
+		if handler, err = serveStatic(handler, *staticDir, *staticPrefix); err != nil {
+			log.Fatal("Invalid -static-dir: ", err)
+		}
+		logging.Infof("Serving files from %s under %s", *staticDir, *staticPrefix)
+	}
+	if *cleanPath {
+		handler = middleware.CleanPath(handler)
+	}
+	if *dryRunFlag {
+		for _, p := range proxies {
+			p.Close()
+		}
+		if validDomain {
+			logging.Infof("Certificates for %s would be obtained from LetsEncrypt", strings.Join(domains, ", "))
+			certPaths, keyPaths = nil, nil
+		}
+		if err := dryRun(os.Stdout, froms, certPaths, keyPaths, proxies, &net.Dialer{Timeout: *dialTimeout, Resolver: resolver}); err != nil {
+			log.Fatal("Dry run failed: ", err)
+		}
+		logging.Infof("Dry run succeeded")
+		return
+	}
+	if *certSubjectHdr != "" || *certSerialHdr != "" || *certPEMHdr != "" {
+		handler = middleware.ClientCert(handler, middleware.ClientCertHeaders{
+			Subject: *certSubjectHdr,
+			Serial:  *certSerialHdr,
+			PEM:     *certPEMHdr,
+		})
+	}
+	if *maxBodySize > 0 {
+		handler = middleware.MaxBodySize(handler, *maxBodySize)
+	}
+	if *compress {
+		handler = middleware.Compress(handler, *compressMinSize)
+	}
+	users, err := loadUsers(*basicAuth, *basicAuthFile)
+	if err != nil {
+		log.Fatal("Unable to load basic auth users: ", err)
+	}
+	if len(users) > 0 {
+		handler = middleware.BasicAuth(handler, "ssl-proxy", users)
+	}
+	// Outside of basic auth, since browsers send preflight requests without credentials
+	if *corsOrigins != "" {
+		origins := splitList(*corsOrigins)
+		if *corsCredentials && slices.Contains(origins, "*") {
+			log.Fatal("-cors-allow-credentials requires -cors-allow-origin to list origins explicitly rather than *")
+		}
+		handler = middleware.CORS(handler, middleware.CORSOptions{
+			AllowOrigins:     origins,
+			AllowMethods:     splitList(*corsMethods),
+			AllowHeaders:     splitList(*corsHeaders),
+			AllowCredentials: *corsCredentials,
+		})
+	}
+	if *rateLimit > 0 {
+		if *rateBurst < 1 {
+			log.Fatal("-rate-burst must be at least 1")
+		}
+		handler = middleware.RateLimit(handler, *rateLimit, *rateBurst)
+	}
+	if len(*accessRules) > 0 {
+		handler = middleware.ACL(handler, *accessRules, trusted)
+	}
+	var maint *maintenance
+	if *maintenanceFile != "" {
+		maint = newMaintenance(*maintenanceFile, reverseproxy.ErrorFormat(*errorFormat))
+		ready, failed := make(chan struct{}), make(chan error, 1)
+		go func() { failed <- maint.watch(nil, ready) }()
+		select {
+		case <-ready:
+		case err := <-failed:
+			log.Fatal("Unable to watch -maintenance-file: ", err)
+		}
+		handler = maint.wrap(handler)
+	}
+	if *slowThreshold > 0 {
+		handler = logSlow(handler, *slowThreshold)
+	}
+	if *logFormat == "json" {
+		handler = middleware.JSONAccessLog(handler, os.Stdout)
+	}
+	if accessLogTmpl != nil {
+		handler = middleware.TemplateAccessLog(handler, os.Stdout, accessLogTmpl)
+	}
+	if *realIPHeader != "" {
+		handler = middleware.RealIPHeader(handler, *realIPHeader, trusted)
+	}
+	if *requestIDHeader != "" {
+		handler = middleware.RequestID(handler, *requestIDHeader)
+	}
+	if *hstsMaxAge > 0 {
+		if *hstsPreload && (!*hstsSubdomains || *hstsMaxAge < 365*24*time.Hour) {
+			logging.Warnf("-hsts-preload needs -hsts-include-subdomains and an -hsts-max-age of at least 365d to be accepted by preload lists")
+		}
+		handler = middleware.HSTS(handler, *hstsMaxAge, *hstsSubdomains, *hstsPreload)
+	}
+	if m != nil {
+		handler = m.Instrument(handler)
+	}
+
+	if *systemdSocket {
+		logging.Infof(green("Proxying calls from the sockets passed by systemd (SSL/TLS) to %s"), *to)
+	} else {
+		logging.Infof(green("Proxying calls from https://%s (SSL/TLS) to %s"), strings.Join(froms, ", https://"), *to)
+	}
+	switch {
+	case *upstreamHost != "":
+		logging.Infof("Sending backends the Host header %s, with the client's in X-Forwarded-Host", *upstreamHost)
+	case !*preserveHost:
+		logging.Infof("Sending backends the host of their own address as the Host header, with the client's in X-Forwarded-Host")
+	default:
+		logging.Infof("Passing the client's Host header through to backends")
+	}
+
+	var servers []server
+
+	// Serve metrics on their own plain HTTP listener so that scrapers don't need to speak TLS
+	if m != nil {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", m.Handler())
+		metricsServer := newServer(*metricsAddr, metricsMux)
+		servers = append(servers, metricsServer)
+		go func() {
+			logging.Infof("Serving Prometheus metrics on http://%s/metrics", *metricsAddr)
+			err := metricsServer.ListenAndServe()
+			if err != nil && err != http.ErrServerClosed {
+				logging.Errorf("Metrics server failure: %v", err)
+			}
+		}()
+	}
+
+	// Profiles expose sensitive runtime details, so they get their own listener that is local unless asked otherwise
+	if *pprofAddr != "" {
+		addr := pprofListenAddr(*pprofAddr)
+		pprofServer := newServer(addr, pprofHandler())
+		// Profiles and traces take a while to collect
+		pprofServer.WriteTimeout = 0
+		servers = append(servers, pprofServer)
+		go func() {
+			logging.Warnf("serving pprof on http://%s/debug/pprof/, never expose it publicly", addr)
+			err := pprofServer.ListenAndServe()
+			if err != nil && err != http.ErrServerClosed {
+				logging.Errorf("pprof server failure: %v", err)
+			}
+		}()
+	}
+
+	// Load the cert and key files before binding, so that a bad pair is reported rather than failing handshakes
+	var certs certSet
+	if !validDomain && memCert == nil {
+		if certs, err = newCertSet(certPaths, keyPaths, *ocspStapling); err != nil {
+			log.Fatal("Unable to load cert and key: ", err)
+		}
+	}
+
+	// Bind every -from address up front, so that one failing doesn't leave the proxy serving on the others. Sockets
+	// passed by systemd are already bound and take the place of -from.
+	var bound []net.Listener
+	if *systemdSocket {
+		if *serveHTTP3 {
+			log.Fatal("-http3 can't be used with -systemd-socket, which only adopts TCP sockets")
+		}
+		if *reusePort {
+			logging.Warnf("-reuseport has no effect with -systemd-socket, set ReusePort=yes in the socket unit instead")
+		}
+		if bound, err = systemdListeners(); err != nil {
+			log.Fatal("Unable to use systemd sockets: ", err)
+		}
+		froms = nil
+		for _, ln := range bound {
+			froms = append(froms, ln.Addr().String())
+			logging.Infof("Listening on %s (passed by systemd)", ln.Addr())
+		}
+	} else {
+		for _, addr := range froms {
+			ln, err := listen(addr)
+			if err != nil {
+				for _, l := range bound {
+					l.Close()
+				}
+				log.Fatalf("Unable to listen on %s: %v", addr, err)
+			}
+			logging.Infof("Listening on %s (%s)", ln.Addr(), listenNetwork("tcp", addr))
+			bound = append(bound, ln)
+		}
+	}
+	var listeners []net.Listener
+	for _, ln := range bound {
+		ln = withProxyProtocol(ln)
+		if *maxConns > 0 {
+			ln = limitConns(ln, *maxConns, *maxConnsMode == "reject", func() {
+				if m != nil {
+					m.ConnectionRejected()
+				}
+			})
+		}
+		if m != nil {
+			ln = countConns(ln, m.ConnectionOpened, m.ConnectionClosed)
+		}
+		listeners = append(listeners, ln)
+	}
+	var packetConns []net.PacketConn
+	if *serveHTTP3 {
+		if *proxyProtocol {
+			logging.Warnf("-proxy-protocol does not apply to HTTP/3, which sees the address of the load balancer")
+		}
+		for _, addr := range froms {
+			pc, err := listenPacket(addr)
+			if err != nil {
+				log.Fatalf("Unable to listen for HTTP/3 on %s: %v", addr, err)
+			}
+			packetConns = append(packetConns, pc)
+		}
+	}
+
+	// Determine if we should serve over TLS with autogenerated LetsEncrypt certificates or not
+	var tlsConfig *tls.Config
+	var acmeHTTP *autocert.Manager // set when HTTP-01 challenges should be answered on the -redirectHTTP port
+	// servedCert returns the cert being served for the readiness probe, where it is known up front
+	servedCert := func() *x509.Certificate { return nil }
+	if validDomain {
+		// Domain is present, use autocert
+		// TODO: validate domain (though, autocert may do this)
+		logging.Infof("Domain specified, using LetsEncrypt to autogenerate and serve certs for %s", strings.Join(domains, ", "))
+		cacheDir := acmeDirCache(*acmeCacheDir, *acmeDirectory)
+		if *acmeDirectory != autocert.DefaultACMEDirectory {
+			logging.Infof("Using ACME directory %s, caching its account and certificates in %s", *acmeDirectory, cacheDir)
+		}
+		if err := prepareCacheDir(cacheDir); err != nil {
+			log.Fatal("Unusable -acme-cache-dir: ", err)
+		}
+		var cache autocert.Cache = autocert.DirCache(cacheDir)
+		if *exportCerts != "" {
+			if err := prepareCacheDir(*exportCerts); err != nil {
+				log.Fatal("Unusable -export-certs-dir: ", err)
+			}
+			cache = exportCache{Cache: cache, dir: *exportCerts, perms: perms}
+		}
+		if !servesPort(froms, "443") && *dnsProvider == "" && *redirectHTTP != 80 {
+			logging.Warnf("LetsEncrypt verifies -domain by connecting to port 443 (TLS-ALPN-01), or to port 80 with -redirectHTTP 80 (HTTP-01). Make sure one of them is forwarded to ssl-proxy, or certificates can't be obtained")
+		}
+		if *dnsProvider != "" {
+			// Wildcards can only be issued via DNS-01, which autocert doesn't support
+			provider, err := newDNSProvider(*dnsProvider)
+			if err != nil {
+				log.Fatal(err)
+			}
+			m := &acmedns.Manager{
+				Domains:  domains,
+				Provider: provider,
+				Cache:    cache,
+				Client:   &acme.Client{DirectoryURL: *acmeDirectory},
+				Email:    *acmeEmail,
+			}
+			logging.Infof("Using the DNS-01 challenge via %s", *dnsProvider)
+			if err := m.Start(context.Background()); err != nil {
+				log.Fatal("Unable to obtain certificate: ", err)
+			}
+			servedCert = func() *x509.Certificate {
+				if cert, err := m.GetCertificate(nil); err == nil {
+					return cert.Leaf
+				}
+				return nil
+			}
+			if cert, err := m.GetCertificate(nil); err == nil && cert.Leaf != nil {
+				logging.Infof("Serving certificate: %s", gen.DescribeCertificate(cert.Leaf))
+			}
+			tlsConfig = withTLSPolicy(m.TLSConfig(), tlsPolicy)
+		} else {
+			for _, d := range domains {
+				if strings.HasPrefix(d, "*.") {
+					log.Fatal("Wildcard domains can only be issued using the DNS-01 challenge, set -dns-provider")
+				}
+			}
+			m := &autocert.Manager{
+				Cache:      cache,
+				Prompt:     autocert.AcceptTOS,
+				HostPolicy: autocert.HostWhitelist(domains...),
+				Client:     &acme.Client{DirectoryURL: *acmeDirectory},
+				Email:      *acmeEmail,
+			}
+			// autocert obtains certificates on the first request for each domain, so only cached ones can be described
+			for _, d := range domains {
+				if info, err := gen.Describe(filepath.Join(cacheDir, d)); err == nil {
+					logging.Infof("Cached certificate for %s: %s", d, info)
+				}
+				// Export cached certificates straight away rather than on the first request for them
+				if *exportCerts != "" {
+					cache.Get(context.Background(), d)
+				}
+			}
+			// The TLS config answers TLS-ALPN-01 challenges on the TLS listener itself
+			tlsConfig = withTLSPolicy(m.TLSConfig(), tlsPolicy)
+			if *redirectHTTP != 80 && (tlsConfig.ClientAuth == tls.RequireAnyClientCert || tlsConfig.ClientAuth == tls.RequireAndVerifyClientCert) {
+				logging.Warnf("requiring client certificates breaks TLS-ALPN-01 challenges, set -redirectHTTP 80 to obtain certificates over HTTP-01 instead")
+			}
+			acmeHTTP = m
+		}
+	} else if memCert != nil {
+		// Serve the cert and key from the environment or generated in memory
+		tlsConfig = tlsPolicy.Clone()
+		tlsConfig.Certificates = []tls.Certificate{*memCert}
+		servedCert = func() *x509.Certificate { return memCert.Leaf }
+		info := gen.DescribeCertificate(memCert.Leaf)
+		logging.Infof("Serving certificate %s: %s", memCertSource, info)
+		checkExpiry(memCertSource, info)
+		if w := chainWarning(memCert, nil); w != "" {
+			logging.Warnf("Certificate %s: %s", memCertSource, w)
+		}
+	} else {
+		// Domain is not provided, serve TLS using provided/generated certificate files, reloading them on SIGHUP
+		tlsConfig = tlsPolicy.Clone()
+		tlsConfig.GetCertificate = certs.GetCertificate
+		servedCert = func() *x509.Certificate { return certs[0].cert.Load().Leaf }
+		for _, c := range certs {
+			info := gen.DescribeCertificate(c.cert.Load().Leaf)
+			logging.Infof("Serving certificate: %s", info)
+			checkExpiry(c.certFile, info)
+			if w := chainWarning(c.cert.Load(), nil); w != "" {
+				logging.Warnf("%s: %s", c.certFile, w)
+			}
+			if *ocspStapling {
+				go c.refreshOCSP(nil)
+			}
+			if *watchCerts {
+				go func(c *certReloader) {
+					if err := c.watch(time.Second, nil, nil); err != nil {
+						logging.Errorf("Unable to watch cert and key files for changes: %v", err)
+					}
+				}(c)
+			}
+		}
+		go reloadOnSIGHUP(certs)
+	}
 
-	log.Printf(green("Proxying calls from https://%s (SSL/TLS) to %s"), *fromURL, toURL)
+	if *noTickets {
+		tlsConfig.SessionTicketsDisabled = true
+	}
+
+	// Serve TLS on every listener, sharing the handler. Each server gets its own copy of the TLS config, which is used
+	// as is rather than copied again by ServeTLS so that session ticket keys can be rotated.
+	serveErr := make(chan error, len(listeners)+len(packetConns))
+	tickets := &ticketKeys{}
+	for i, ln := range listeners {
+		s := newServer(froms[i], handler)
+		s.SetKeepAlivesEnabled(!*noKeepAlive)
+		if *serveHTTP3 {
+			// quic-go copies h3.TLSConfig when serving, so the keys are rotated on the config it hands out instead
+			h3Config := tlsConfig.Clone()
+			h3 := newHTTP3Server(handler, h3Config)
+			tickets.configs = append(tickets.configs, h3Config)
+			s.Handler = altSvc(handler, h3)
+			servers = append(servers, h3)
+			go func(pc net.PacketConn) { serveErr <- h3.Serve(pc) }(packetConns[i])
+		}
+		s.TLSConfig = tlsConfig.Clone()
+		s.TLSConfig.NextProtos = nextProtos(s.TLSConfig.NextProtos, !*disableHTTP2)
+		if *disableHTTP2 {
+			s.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+		}
+		tickets.configs = append(tickets.configs, s.TLSConfig)
+		servers = append(servers, s)
+		go func(ln net.Listener) { serveErr <- s.Serve(tls.NewListener(ln, s.TLSConfig)) }(ln)
+	}
+	if !*noTickets && *ticketRotation > 0 {
+		tickets.rotate()
+		go tickets.rotateEvery(*ticketRotation, nil)
+	}
+
+	// Probes get their own plain HTTP listener, started once the TLS listeners are serving
+	if *adminAddr != "" {
+		adminServer := newServer(*adminAddr, adminHandler(rt, servedCert, maint, *adminToken))
+		servers = append(servers, adminServer)
+		go func() {
+			logging.Infof("Serving liveness and readiness probes on http://%s/live and http://%s/ready", *adminAddr, *adminAddr)
+			err := adminServer.ListenAndServe()
+			if err != nil && err != http.ErrServerClosed {
+				logging.Errorf("Admin server failure: %v", err)
+			}
+		}()
+	}
 
 	// Redirect http requests on port 80 to TLS port using https
 	if *redirectHTTP > 0 {
 		// Redirect to caller host, unless a domain is specified--in that case, redirect using the public facing
 		// domain
-		redirectURL := *fromURL
+		redirectURL := strings.Join(froms, ", ")
 		redirectPort := fmt.Sprintf(":%v", *redirectHTTP)
 
+		// Redirect to the port of the first TLS listener, keeping the host the client asked for
+		_, tlsPort, _ := net.SplitHostPort(froms[0])
 		redirectTLS := func(w http.ResponseWriter, r *http.Request) {
+			target := redirectHost(r, froms[0])
 			if validDomain {
-				redirectURL = *domain
-			} else {
-				redirectURL = r.URL.Hostname()
-				if len(redirectURL) <= 0 {
-					host, _, err := net.SplitHostPort(r.Host)
-					if err == nil {
-						redirectURL = host
-					} else {
-						redirectURL = *fromURL
-					}
-				}
+				target = redirectDomain(domains, requestHost(r))
 			}
-			http.Redirect(w, r, "https://"+redirectURL+r.RequestURI, http.StatusTemporaryRedirect)
+			http.Redirect(w, r, httpsURL(target, tlsPort, r.RequestURI), *redirectStatus)
 		}
+		var redirectHandler http.Handler = http.HandlerFunc(redirectTLS)
+		if acmeHTTP != nil {
+			// Answer LetsEncrypt HTTP-01 challenges, redirecting everything else
+			redirectHandler = acmeHTTP.HTTPHandler(redirectHandler)
+		}
+		redirectServer := newServer(redirectPort, redirectHandler)
+		servers = append(servers, redirectServer)
 		go func() {
-			log.Println(
-				fmt.Sprintf("Also redirecting https requests on port %s to https requests on %s", redirectPort, redirectURL))
-			err := http.ListenAndServe(redirectPort, http.HandlerFunc(redirectTLS))
-			if err != nil {
-				log.Println("HTTP redirection server failure")
-				log.Println(err)
+			logging.Infof("Also redirecting https requests on port %s to https requests on %s", redirectPort, redirectURL)
+			err := redirectServer.ListenAndServe()
+			if err != nil && err != http.ErrServerClosed {
+				logging.Errorf("HTTP redirection server failure: %v", err)
 			}
 		}()
 	}
 
-	// Determine if we should serve over TLS with autogenerated LetsEncrypt certificates or not
-	if validDomain {
-		// Domain is present, use autocert
-		// TODO: validate domain (though, autocert may do this)
-		// TODO: for some reason this seems to only work on :443
-		log.Printf("Domain specified, using LetsEncrypt to autogenerate and serve certs for %s\n", *domain)
-		if !strings.HasSuffix(*fromURL, ":443") {
-			log.Println("WARN: Right now, you must serve on port :443 to use autogenerated LetsEncrypt certs using the -domain flag, this may NOT WORK")
-		}
-		m := &autocert.Manager{
-			Cache:      autocert.DirCache("certs"),
-			Prompt:     autocert.AcceptTOS,
-			HostPolicy: autocert.HostWhitelist(*domain),
-		}
-		s := &http.Server{
-			Addr:      *fromURL,
-			TLSConfig: m.TLSConfig(),
-		}
-		s.Handler = mux
-		log.Fatal(s.ListenAndServeTLS("", ""))
-	} else {
-		// Domain is not provided, serve TLS using provided/generated certificate files
-		log.Fatal(http.ListenAndServeTLS(*fromURL, *certFile, *keyFile, mux))
+	// Every listener is bound and every cert loaded, so tell systemd we're ready if it's waiting for that
+	if err := sdNotify("READY=1"); err != nil {
+		logging.Warnf("%v", err)
+	}
+
+	// Serve until the TLS server fails or we are asked to stop, then give in-flight requests a chance to finish
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	select {
+	case err := <-serveErr:
+		log.Fatal(err)
+	case sig := <-stop:
+		logging.Infof("Received %s, shutting down (waiting up to %s for in-flight requests)", sig, *shutdownTimeout)
+	}
+	if err := sdNotify("STOPPING=1"); err != nil {
+		logging.Warnf("%v", err)
 	}
 
+	// Upgraded connections have been handed over by the servers, which no longer wait for them, so drain them alongside
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	wsCtx, wsCancel := context.WithTimeout(context.Background(), *wsDrainTimeout)
+	defer wsCancel()
+	upgradesClosed := make(chan int, 1)
+	go func() { upgradesClosed <- opts.Upgrades.Close(wsCtx) }()
+	if err := shutdown(ctx, servers); err != nil {
+		logging.Errorf("Shutdown did not complete cleanly: %v", err)
+	}
+	if n := <-upgradesClosed; n > 0 {
+		logging.Infof("Closed %d WebSocket and other upgraded connections still open after -ws-drain-timeout %s", n, *wsDrainTimeout)
+	}
+	for _, p := range rt.Proxies() {
+		p.Close()
+	}
+	logging.Infof("Shutdown complete")
+}
+
+// listen opens the TCP listener for the TLS server on addr, with the TCP keep-alive period of -tcp-keepalive and
+// SO_REUSEPORT if -reuseport is set
+func listen(addr string) (net.Listener, error) {
+	lc := net.ListenConfig{KeepAlive: *tcpKeepAlive}
+	if *reusePort {
+		lc.Control = reusePortControl
+	}
+	return lc.Listen(context.Background(), listenNetwork("tcp", addr), addr)
+}
+
+// listenPacket opens the UDP socket for the HTTP/3 server on addr, with SO_REUSEPORT if -reuseport is set
+func listenPacket(addr string) (net.PacketConn, error) {
+	var lc net.ListenConfig
+	if *reusePort {
+		lc.Control = reusePortControl
+	}
+	return lc.ListenPacket(context.Background(), listenNetwork("udp", addr), addr)
+}
+
+// withProxyProtocol wraps ln to expect a PROXY protocol header before the TLS handshake on every connection if
+// -proxy-protocol is set
+func withProxyProtocol(ln net.Listener) net.Listener {
+	if !*proxyProtocol {
+		return ln
+	}
+	return &proxyproto.Listener{
+		Listener:          ln,
+		ReadHeaderTimeout: *readHdrTimeout,
+		ConnPolicy: func(proxyproto.ConnPolicyOptions) (proxyproto.Policy, error) {
+			return proxyproto.REQUIRE, nil
+		},
+	}
+}
+
+// listenNetwork returns the network, proto being tcp or udp, to listen on addr with. That is the IP family chosen by
+// -network, or else the family of addr's IP, so that an IPv6 address such as [::]:443 isn't also bound for IPv4 and
+// an IPv4 one such as 0.0.0.0:443 isn't bound for IPv6. Addresses without an IP, such as :443, listen on both.
+func listenNetwork(proto, addr string) string {
+	switch *network {
+	case "tcp4":
+		return proto + "4"
+	case "tcp6":
+		return proto + "6"
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return proto
+	}
+	ip, err := netip.ParseAddr(host)
+	switch {
+	case err != nil:
+		return proto
+	case ip.Is4():
+		return proto + "4"
+	default:
+		return proto + "6"
+	}
+}
+
+// servesPort reports whether any of addrs listens on port
+func servesPort(addrs []string, port string) bool {
+	for _, addr := range addrs {
+		if _, p, err := net.SplitHostPort(addr); err == nil && p == port {
+			return true
+		}
+	}
+	return false
+}
+
+// nextProtos returns the ALPN protocols to offer clients of the TLS listener: protos, such as the acme-tls/1 protocol
+// of LetsEncrypt challenges, along with HTTP/1.1 and, if http2 is set, HTTP/2. Without http2, h2 is removed from protos
+// so that every client falls back to HTTP/1.1.
+func nextProtos(protos []string, http2 bool) []string {
+	protos = slices.Clone(protos)
+	if !http2 {
+		protos = slices.DeleteFunc(protos, func(proto string) bool { return proto == "h2" })
+	}
+	for _, proto := range []string{"h2", "http/1.1"} {
+		if (proto != "h2" || http2) && !slices.Contains(protos, proto) {
+			protos = append(protos, proto)
+		}
+	}
+	return protos
+}
+
+// newServer creates a server for handler on addr with the timeouts given by the -*-timeout flags
+func newServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: *readHdrTimeout,
+		ReadTimeout:       *readTimeout,
+		WriteTimeout:      *writeTimeout,
+		IdleTimeout:       *idleTimeout,
+		ErrorLog:          logging.NewLogger(logging.Warn),
+	}
+}
+
+// reloadOnSIGHUP reloads the cert and key files of certs whenever the process receives SIGHUP
+func reloadOnSIGHUP(certs certSet) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		logging.Debugf("Received SIGHUP, reloading certs")
+		certs.reloadAndLog()
+	}
+}
+
+// needSelfSigned reports whether the default self-signed cert and key need generating, because either file is missing or
+// the cert expires within renewBefore, and which names to generate the cert for: altnames, or the names of the cert it
+// replaces so that renewing it keeps serving the same ones
+func needSelfSigned(certFile, keyFile string, altnames []string, renewBefore time.Duration) (bool, []string) {
+	if _, err := os.Stat(certFile); os.IsNotExist(err) {
+		return true, altnames
+	}
+	if _, err := os.Stat(keyFile); os.IsNotExist(err) {
+		return true, altnames
+	}
+	info, err := gen.Describe(certFile)
+	if err != nil || time.Until(info.NotAfter) >= renewBefore {
+		return false, altnames
+	}
+	logging.Infof("Default self-signed cert %s expires at %s, regenerating it", certFile, info.NotAfter.Format(time.RFC3339))
+	names := info.DNSNames
+	for _, ip := range info.IPAddresses {
+		names = append(names, ip.String())
+	}
+	return true, names
+}
+
+// checkExpiry warns, or exits if -fail-on-expiring-cert is set, when the certificate described by info and loaded
+// from source expires within -min-cert-lifetime. A -min-cert-lifetime of 0 disables the check.
+func checkExpiry(source string, info gen.CertInfo) {
+	remaining := time.Until(info.NotAfter)
+	if *minCertLifetime <= 0 || remaining >= *minCertLifetime {
+		return
+	}
+	msg := fmt.Sprintf("certificate %s expires in %s (at %s), less than -min-cert-lifetime %s", source,
+		remaining.Round(time.Minute), info.NotAfter.Format(time.RFC3339), *minCertLifetime)
+	if *failOnExpiring {
+		log.Fatal("Refusing to start: ", msg)
+	}
+	logging.Warnf("%s", msg)
+}
+
+// server is a server that can be shut down gracefully, e.g. an *http.Server
+type server interface {
+	Shutdown(ctx context.Context) error
+}
+
+// shutdown gracefully shuts down all servers concurrently, returning the first error encountered
+func shutdown(ctx context.Context, servers []server) error {
+	errs := make(chan error, len(servers))
+	for _, s := range servers {
+		go func(s server) { errs <- s.Shutdown(ctx) }(s)
+	}
+	var firstErr error
+	for range servers {
+		if err := <-errs; err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
 }
 
 // green takes an input string and returns it with the proper ANSI escape codes to render it green-colored
@@ -170,9 +1145,263 @@ func green(in string) string {
 	return fmt.Sprintf("\033[0;32m%s\033[0;0m", in)
 }
 
-func create(p string) (*os.File, error) {
-	if err := os.MkdirAll(filepath.Dir(p), 0770); err != nil {
-		return nil, err
+// parseTargets splits a comma separated list of backend addresses and parses each into a Target, assuming http:// for
+// any address without a scheme unless strict is set, as with -strict-to-url. Each address may be suffixed with =N to give
+// it an integer weight, which defaults to 1, unless it has a query string or fragment that the =N would be part of.
+func parseTargets(list string, strict bool) ([]reverseproxy.Target, error) {
+	var targets []reverseproxy.Target
+	usable := false
+	for _, t := range strings.Split(list, ",") {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+
+		weight := 1
+		if i := strings.LastIndex(t, "="); i >= 0 && !strings.ContainsAny(t[:i], "?#") {
+			if w, err := strconv.Atoi(t[i+1:]); err == nil {
+				if w < 0 {
+					return nil, fmt.Errorf("invalid weight %d for %s", w, t[:i])
+				}
+				weight = w
+				t = t[:i]
+			}
+		}
+
+		// Ensure the to URL is in the right form
+		if !strings.HasPrefix(t, HTTPPrefix) && !strings.HasPrefix(t, HTTPSPrefix) && !strings.HasPrefix(t, UnixPrefix) {
+			if strict {
+				return nil, fmt.Errorf("backend %s must start with %s, %s or %s", t, HTTPPrefix, HTTPSPrefix, UnixPrefix)
+			}
+			logging.Infof("Assuming -to URL %s is using http://", t)
+			t = HTTPPrefix + t
+		}
+
+		u, err := url.Parse(t)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, reverseproxy.Target{URL: u, Weight: weight})
+		usable = usable || weight > 0
+	}
+	if !usable {
+		return nil, fmt.Errorf("no backends with a non-zero weight provided")
+	}
+	return targets, nil
+}
+
+// redirectDomain picks which of the configured domains to redirect a plain HTTP request for host to: host itself if it
+// is one of them (or matches a wildcard), otherwise the first
+func redirectDomain(domains []string, host string) string {
+	host = strings.ToLower(host)
+	for _, d := range domains {
+		d = strings.ToLower(d)
+		if d == host {
+			return host
+		}
+		if strings.HasPrefix(d, "*.") && strings.HasSuffix(host, d[1:]) && !strings.Contains(strings.TrimSuffix(host, d[1:]), ".") {
+			return host
+		}
+	}
+	return domains[0]
+}
+
+// httpsURL returns the https:// URL for uri on host and port, leaving out the port if it is the default of 443
+func httpsURL(host, port, uri string) string {
+	if port == "" || port == "443" {
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		return "https://" + host + uri
+	}
+	return "https://" + net.JoinHostPort(host, port) + uri
+}
+
+// redirectHost returns the host to redirect a plain HTTP request to the TLS listener on from with: the host the client
+// asked for, or if it didn't send one, the host from names, falling back to localhost if from only gives a port or an
+// unspecified address such as 0.0.0.0
+func redirectHost(r *http.Request, from string) string {
+	if host := requestHost(r); host != "" {
+		return host
+	}
+	host, _, err := net.SplitHostPort(from)
+	if ip := net.ParseIP(host); err != nil || host == "" || (ip != nil && ip.IsUnspecified()) {
+		return "localhost"
+	}
+	return host
+}
+
+// requestHost returns the host name the client asked for, without any port or the brackets around an IPv6 address
+func requestHost(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.Host); err == nil {
+		return host
+	}
+	if strings.HasPrefix(r.Host, "[") && strings.HasSuffix(r.Host, "]") {
+		return r.Host[1 : len(r.Host)-1]
+	}
+	return r.Host
+}
+
+// splitList splits a comma separated flag value, trimming whitespace and dropping empty entries
+func splitList(list string) []string {
+	var out []string
+	for _, v := range strings.Split(list, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// newDNSProvider returns the DNS-01 challenge provider named by -dns-provider, configured from its flags
+func newDNSProvider(name string) (acmedns.Provider, error) {
+	switch name {
+	case "cloudflare":
+		token := *cfToken
+		if token == "" {
+			token = os.Getenv("CLOUDFLARE_API_TOKEN")
+		}
+		if token == "" {
+			return nil, fmt.Errorf("-dns-provider cloudflare requires -cloudflare-api-token or $CLOUDFLARE_API_TOKEN")
+		}
+		return &acmedns.Cloudflare{APIToken: token}, nil
+	case "route53":
+		return &acmedns.Route53{HostedZoneID: *route53Zone}, nil
+	}
+	return nil, fmt.Errorf("unknown -dns-provider %q, must be one of cloudflare or route53", name)
+}
+
+// loadUsers collects basic auth users from user:password pairs and, if path is set, an htpasswd file
+func loadUsers(pairs []string, path string) (map[string]string, error) {
+	users := make(map[string]string)
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if users, err = middleware.ParseHtpasswd(f); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	for _, pair := range pairs {
+		i := strings.Index(pair, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("-basic-auth %q is not of the form user:password", pair)
+		}
+		users[pair[:i]] = pair[i+1:]
+	}
+	return users, nil
+}
+
+// envVar matches a ${VAR} reference in a header value
+var envVar = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// parseHeaders parses "Name: Value" pairs into a header, replacing ${VAR} references in values with the value of the
+// environment variable VAR
+func parseHeaders(pairs []string) (http.Header, error) {
+	header := make(http.Header)
+	for _, pair := range pairs {
+		i := strings.Index(pair, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("%q is not of the form \"Name: Value\"", pair)
+		}
+		value := envVar.ReplaceAllStringFunc(strings.TrimSpace(pair[i+1:]), func(ref string) string {
+			return os.Getenv(ref[2 : len(ref)-1])
+		})
+		header.Add(strings.TrimSpace(pair[:i]), value)
+	}
+	return header, nil
+}
+
+// parseRewrites parses "old=new" pairs into body rewrites, splitting each at its first =
+func parseRewrites(pairs []string) ([]reverseproxy.BodyRewrite, error) {
+	var rewrites []reverseproxy.BodyRewrite
+	for _, pair := range pairs {
+		i := strings.Index(pair, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("%q is not of the form \"old=new\"", pair)
+		}
+		rewrites = append(rewrites, reverseproxy.BodyRewrite{Old: pair[:i], New: pair[i+1:]})
+	}
+	return rewrites, nil
+}
+
+// newResolver returns a resolver sending every DNS query to the nameserver at addr, on port 53 unless addr gives one
+func newResolver(addr string) (*net.Resolver, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = strings.Trim(addr, "[]"), "53"
+	}
+	if net.ParseIP(host) == nil {
+		return nil, fmt.Errorf("%q is not an IP address", host)
+	}
+	addr = net.JoinHostPort(host, port)
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}, nil
+}
+
+// parseCIDRs parses a comma separated list of CIDRs, treating a bare IP address as a network containing only itself
+func parseCIDRs(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, c := range strings.Split(list, ",") {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		if !strings.Contains(c, "/") {
+			ip := net.ParseIP(c)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", c)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// acmeDirCache returns the directory under cacheDir to cache the account key and certificates from the ACME directory
+// at directoryURL in, so that switching CAs doesn't reuse another CA's account. LetsEncrypt's production directory
+// uses cacheDir itself, where older versions cached everything.
+func acmeDirCache(cacheDir, directoryURL string) string {
+	if directoryURL == autocert.DefaultACMEDirectory {
+		return cacheDir
+	}
+	name := strings.TrimPrefix(strings.TrimPrefix(directoryURL, "https://"), "http://")
+	name = strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' {
+			return r
+		}
+		return '_'
+	}, strings.TrimSuffix(name, "/"))
+	return filepath.Join(cacheDir, name)
+}
+
+// prepareCacheDir creates dir if needed, readable only by the current user since it holds private keys, and checks that
+// it is writable so that a misconfigured directory fails at startup rather than when a certificate is first obtained
+func prepareCacheDir(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".write-test-")
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %v", dir, err)
 	}
-	return os.Create(p)
+	f.Close()
+	return os.Remove(f.Name())
 }
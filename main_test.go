@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pires/go-proxyproto"
+	"github.com/snewstv/ssl-proxy/gen"
+	"github.com/snewstv/ssl-proxy/reverseproxy"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// TestListen_KeepAlive tests that client connections are reused by default, and closed after each response once keep-
+// alives are disabled
+func TestListen_KeepAlive(t *testing.T) {
+	for _, disabled := range []bool{false, true} {
+		ln, err := listen("127.0.0.1:0")
+		if !assert.Nil(t, err, "error should be nil") {
+			return
+		}
+		s := newServer(ln.Addr().String(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		s.SetKeepAlivesEnabled(!disabled)
+		go s.Serve(ln)
+
+		client := &http.Client{Transport: &http.Transport{}}
+		var reused []bool
+		for i := 0; i < 2; i++ {
+			req, _ := http.NewRequest("GET", "http://"+ln.Addr().String()+"/", nil)
+			req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+				GotConn: func(info httptrace.GotConnInfo) { reused = append(reused, info.Reused) },
+			}))
+			resp, err := client.Do(req)
+			if assert.Nil(t, err, "error should be nil") {
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+			}
+		}
+		assert.Equal(t, []bool{false, !disabled}, reused, "unexpected connection reuse with keep-alives disabled=%v", disabled)
+		s.Close()
+	}
+}
+
+// TestListenNetwork tests that listeners bound to an IPv4 or IPv6 address keep to that family, unless -network picks
+// one
+func TestListenNetwork(t *testing.T) {
+	defer func(old string) { *network = old }(*network)
+	tests := []struct {
+		network, addr, want string
+	}{
+		{"tcp", "0.0.0.0:443", "tcp4"},
+		{"tcp", "[::]:443", "tcp6"},
+		{"tcp", "[fe80::1%eth0]:443", "tcp6"},
+		{"tcp", ":443", "tcp"},
+		{"tcp", "localhost:443", "tcp"},
+		{"tcp6", ":443", "tcp6"},
+		{"tcp4", "localhost:443", "tcp4"},
+	}
+	for _, tt := range tests {
+		*network = tt.network
+		assert.Equal(t, tt.want, listenNetwork("tcp", tt.addr), "unexpected network for %s with -network %s", tt.addr, tt.network)
+	}
+	*network = "tcp"
+	assert.Equal(t, "udp6", listenNetwork("udp", "[::]:443"), "HTTP/3 should listen with the same IP family")
+}
+
+// TestHTTPSURL tests that redirect URLs only carry the port when it isn't 443, with IPv6 hosts bracketed
+func TestHTTPSURL(t *testing.T) {
+	tests := []struct {
+		host, port, want string
+	}{
+		{"example.com", "443", "https://example.com/path?q=1"},
+		{"example.com", "8443", "https://example.com:8443/path?q=1"},
+		{"::1", "443", "https://[::1]/path?q=1"},
+		{"::1", "8443", "https://[::1]:8443/path?q=1"},
+		{"example.com", "", "https://example.com/path?q=1"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, httpsURL(tt.host, tt.port, "/path?q=1"), "unexpected URL for %s on port %q", tt.host, tt.port)
+	}
+}
+
+// TestParseTargets tests that backends are parsed with their weights, that an = in a query string isn't taken for one,
+// and that addresses without a scheme are only accepted unless strict
+func TestParseTargets(t *testing.T) {
+	targets, err := parseTargets("http://10.0.0.1:80=3, 10.0.0.2:80,https://10.0.0.3/?page=2,http://10.0.0.4/#a=1,http://10.0.0.5=0", false)
+	if !assert.Nil(t, err, "error should be nil") {
+		return
+	}
+	var got []string
+	for _, target := range targets {
+		got = append(got, fmt.Sprintf("%s=%d", target.URL, target.Weight))
+	}
+	assert.Equal(t, []string{
+		"http://10.0.0.1:80=3",
+		"http://10.0.0.2:80=1",
+		"https://10.0.0.3/?page=2=1",
+		"http://10.0.0.4/#a=1=1",
+		"http://10.0.0.5=0",
+	}, got, "each backend should have its weight")
+
+	_, err = parseTargets("http://10.0.0.1=-1", false)
+	assert.NotNil(t, err, "a negative weight should be rejected")
+	_, err = parseTargets("http://10.0.0.1=0", false)
+	assert.NotNil(t, err, "backends all weighted 0 should be rejected")
+
+	_, err = parseTargets("https://10.0.0.1,unix:///run/app.sock", true)
+	assert.Nil(t, err, "backends with a scheme should be accepted when strict")
+	_, err = parseTargets("https://10.0.0.1,10.0.0.2:80", true)
+	assert.NotNil(t, err, "a backend without a scheme should be rejected when strict")
+}
+
+// TestRedirectHost tests that plain HTTP requests are redirected to the host the client asked for, or to the host of
+// the TLS listener or localhost if it didn't send one
+func TestRedirectHost(t *testing.T) {
+	for _, c := range []struct{ host, from, expected string }{
+		{"example.com", ":8443", "example.com"},
+		{"example.com:8080", "127.0.0.1:8443", "example.com"},
+		{"", "proxy.example.com:8443", "proxy.example.com"},
+		{"", ":8443", "localhost"},
+		{"", "0.0.0.0:8443", "localhost"},
+		{"", "[::]:8443", "localhost"},
+	} {
+		r := httptest.NewRequest("GET", "/path", nil)
+		r.Host = c.host
+		assert.Equal(t, c.expected, redirectHost(r, c.from), "unexpected host for a request for %q to %s", c.host, c.from)
+	}
+	r := httptest.NewRequest("GET", "/path", nil)
+	r.Host = ""
+	assert.Equal(t, "https://localhost:8443/path", httpsURL(redirectHost(r, ":8443"), "8443", r.RequestURI), "a listener given only a port should redirect to localhost")
+}
+
+// TestNextProtos tests that the TLS listener negotiates HTTP/2 via ALPN unless it is disabled, and that other protocols
+// such as acme-tls/1 are kept either way
+func TestNextProtos(t *testing.T) {
+	assert.Equal(t, []string{"acme-tls/1", "h2", "http/1.1"}, nextProtos([]string{"acme-tls/1"}, true), "h2 should be offered")
+	assert.Equal(t, []string{"http/1.1", "acme-tls/1"}, nextProtos([]string{"h2", "http/1.1", "acme-tls/1"}, false), "h2 should not be offered")
+
+	cert, err := gen.KeyPair(time.Hour, []string{"localhost"}, gen.ECDSAP256)
+	assert.Nil(t, err, "error should be nil")
+	for _, http2 := range []bool{true, false} {
+		ln, err := listen("127.0.0.1:0")
+		if !assert.Nil(t, err, "error should be nil") {
+			return
+		}
+		s := newServer(ln.Addr().String(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		s.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: nextProtos(nil, http2)}
+		go s.Serve(tls.NewListener(ln, s.TLSConfig))
+
+		conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2", "http/1.1"}})
+		if assert.Nil(t, err, "error should be nil") {
+			want := "h2"
+			if !http2 {
+				want = "http/1.1"
+			}
+			assert.Equal(t, want, conn.ConnectionState().NegotiatedProtocol, "the negotiated protocol should match")
+			conn.Close()
+		}
+		s.Close()
+	}
+}
+
+// TestNewResolver tests that backend host names are resolved by the nameserver given to -resolver
+func TestNewResolver(t *testing.T) {
+	// A nameserver answering every A query with 127.0.0.1
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if !assert.Nil(t, err, "error should be nil") {
+		return
+	}
+	defer pc.Close()
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var msg dnsmessage.Message
+			if msg.Unpack(buf[:n]) != nil || len(msg.Questions) != 1 {
+				continue
+			}
+			msg.Header.Response, msg.Header.Authoritative = true, true
+			if q := msg.Questions[0]; q.Type == dnsmessage.TypeA {
+				msg.Answers = []dnsmessage.Resource{{
+					Header: dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: 60},
+					Body:   &dnsmessage.AResource{A: [4]byte{127, 0, 0, 1}},
+				}}
+			}
+			if b, err := msg.Pack(); err == nil {
+				pc.WriteTo(b, addr)
+			}
+		}
+	}()
+
+	_, err = newResolver("backend.internal")
+	assert.NotNil(t, err, "a resolver given by name should be rejected")
+	resolver, err := newResolver(pc.LocalAddr().String())
+	if !assert.Nil(t, err, "error should be nil") {
+		return
+	}
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "resolved")
+	}))
+	defer backend.Close()
+	_, port, _ := net.SplitHostPort(backend.Listener.Addr().String())
+	u, _ := url.Parse("http://backend.internal:" + port)
+	proxy := reverseproxy.Build([]reverseproxy.Target{{URL: u, Weight: 1}}, reverseproxy.Options{Resolver: resolver})
+	defer proxy.Close()
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, "resolved", rec.Body.String(), "the backend should be reached at the address the resolver gave")
+}
+
+// TestAcmeDirCache tests that each ACME directory gets its own cache, with LetsEncrypt's production directory keeping
+// the top level cache directory that older versions used
+func TestAcmeDirCache(t *testing.T) {
+	dir := filepath.Join("cache", "acme")
+	assert.Equal(t, dir, acmeDirCache(dir, autocert.DefaultACMEDirectory), "production should use the cache dir itself")
+	staging := acmeDirCache(dir, "https://acme-staging-v02.api.letsencrypt.org/directory")
+	assert.Equal(t, filepath.Join(dir, "acme-staging-v02.api.letsencrypt.org_directory"), staging, "staging should be cached separately")
+	other := acmeDirCache(dir, "https://ca.internal:14000/dir?x=../..")
+	assert.Equal(t, dir, filepath.Dir(other), "the directory URL shouldn't escape the cache dir")
+	assert.NotEqual(t, staging, other, "different directories should be cached separately")
+}
+
+// TestRequestHost tests that the host a request asked for is returned without its port or IPv6 brackets
+func TestRequestHost(t *testing.T) {
+	for host, want := range map[string]string{
+		"example.com":      "example.com",
+		"example.com:8080": "example.com",
+		"10.0.0.1:80":      "10.0.0.1",
+		"[::1]:8080":       "::1",
+		"[::1]":            "::1",
+		"":                 "",
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Host = host
+		assert.Equal(t, want, requestHost(r), "unexpected host for %q", host)
+	}
+}
+
+// TestRedirectDomain tests that plain HTTP requests are redirected to the domain they asked for when it is one of the
+// configured domains or matches a wildcard one, and to the first domain otherwise
+func TestRedirectDomain(t *testing.T) {
+	domains := []string{"example.com", "www.example.com", "*.apps.example.com"}
+	for host, want := range map[string]string{
+		"www.example.com":         "www.example.com",
+		"WWW.Example.com":         "www.example.com",
+		"api.apps.example.com":    "api.apps.example.com",
+		"a.b.apps.example.com":    "example.com",
+		"apps.example.com":        "example.com",
+		"other.com":               "example.com",
+		"::1":                     "example.com",
+		"":                        "example.com",
+		"www.example.com.evil.io": "example.com",
+	} {
+		assert.Equal(t, want, redirectDomain(domains, host), "unexpected redirect for %q", host)
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Host = "www.example.com:8080"
+	assert.Equal(t, "www.example.com", redirectDomain(domains, requestHost(r)), "the port shouldn't stop the host matching")
+}
+
+// TestWithProxyProtocol tests that with -proxy-protocol requests are seen as coming from the client address in a v1 or
+// v2 PROXY protocol header, and that connections without a header are refused
+func TestWithProxyProtocol(t *testing.T) {
+	defer func(old bool) { *proxyProtocol = old }(*proxyProtocol)
+	*proxyProtocol = true
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.Nil(t, err, "error should be nil") {
+		return
+	}
+	s := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.RemoteAddr)
+	})}
+	go s.Serve(withProxyProtocol(inner))
+	defer s.Close()
+
+	get := func(header *proxyproto.Header) (string, error) {
+		c, err := net.Dial("tcp", inner.Addr().String())
+		if err != nil {
+			return "", err
+		}
+		defer c.Close()
+		if header != nil {
+			if _, err := header.WriteTo(c); err != nil {
+				return "", err
+			}
+		}
+		if _, err := io.WriteString(c, "GET / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n"); err != nil {
+			return "", err
+		}
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	addr, err := get(&proxyproto.Header{
+		Version:           1,
+		Command:           proxyproto.PROXY,
+		TransportProtocol: proxyproto.TCPv4,
+		SourceAddr:        &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 56324},
+		DestinationAddr:   &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 443},
+	})
+	assert.Nil(t, err, "error should be nil")
+	assert.Equal(t, "203.0.113.7:56324", addr, "the client address should come from the v1 header")
+
+	addr, err = get(&proxyproto.Header{
+		Version:           2,
+		Command:           proxyproto.PROXY,
+		TransportProtocol: proxyproto.TCPv6,
+		SourceAddr:        &net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 40000},
+		DestinationAddr:   &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443},
+	})
+	assert.Nil(t, err, "error should be nil")
+	assert.Equal(t, "[2001:db8::7]:40000", addr, "the client address should come from the v2 header")
+
+	_, err = get(nil)
+	assert.NotNil(t, err, "a connection without a PROXY header should be refused")
+}
+
+// TestNeedSelfSigned tests that the default self-signed cert is generated when it or its key is missing, and renewed
+// for the names it already had once it expires within the renewal window
+func TestNeedSelfSigned(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	altnames := []string{"localhost"}
+
+	need, names := needSelfSigned(certFile, keyFile, altnames, 30*24*time.Hour)
+	assert.True(t, need, "a missing cert should be generated")
+	assert.Equal(t, altnames, names, "a new cert should be generated for -altnames")
+
+	cert, key, _, err := gen.Keys(time.Hour, []string{"proxy.internal", "10.0.0.1"}, gen.ECDSAP256)
+	if !assert.Nil(t, err, "error should be nil") {
+		return
+	}
+	assert.Nil(t, os.WriteFile(certFile, cert.Bytes(), 0644), "error should be nil")
+	need, _ = needSelfSigned(certFile, keyFile, altnames, 30*24*time.Hour)
+	assert.True(t, need, "a cert without its key should be generated")
+
+	assert.Nil(t, os.WriteFile(keyFile, key.Bytes(), 0600), "error should be nil")
+	need, names = needSelfSigned(certFile, keyFile, altnames, 30*24*time.Hour)
+	assert.True(t, need, "a cert expiring within the renewal window should be renewed")
+	assert.Equal(t, []string{"proxy.internal", "10.0.0.1"}, names, "the renewed cert should keep the names of the old one")
+
+	need, _ = needSelfSigned(certFile, keyFile, altnames, time.Minute)
+	assert.False(t, need, "a cert expiring after the renewal window should be kept")
+}
+
+// TestPrepareCacheDir tests that the cache dir is created readable only by the current user, and that a path that
+// can't be a directory or isn't writable is rejected
+func TestPrepareCacheDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "acme", "cache")
+	if !assert.Nil(t, prepareCacheDir(dir), "a missing cache dir should be created") {
+		return
+	}
+	info, err := os.Stat(dir)
+	if assert.Nil(t, err, "error should be nil") {
+		assert.Equal(t, os.FileMode(0700), info.Mode().Perm(), "the cache dir should only be accessible by its owner")
+	}
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err, "error should be nil")
+	assert.Empty(t, entries, "the write test should leave nothing behind")
+	assert.Nil(t, prepareCacheDir(dir), "an existing cache dir should be accepted")
+
+	file := filepath.Join(dir, "file")
+	assert.Nil(t, os.WriteFile(file, nil, 0600), "error should be nil")
+	assert.NotNil(t, prepareCacheDir(file), "a file should be rejected")
+	assert.NotNil(t, prepareCacheDir(filepath.Join(file, "cache")), "a dir under a file should be rejected")
+
+	if os.Geteuid() == 0 {
+		t.Log("skipping the read-only dir check as root, who can write anywhere")
+		return
+	}
+	readOnly := filepath.Join(dir, "read-only")
+	assert.Nil(t, os.Mkdir(readOnly, 0500), "error should be nil")
+	assert.ErrorContains(t, prepareCacheDir(readOnly), "is not writable", "a read-only dir should be rejected")
+}
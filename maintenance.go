@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/snewstv/ssl-proxy/logging"
+	"github.com/snewstv/ssl-proxy/reverseproxy"
+)
+
+// maintenanceMessage describes the 503 responses sent during maintenance
+const maintenanceMessage = "Down for maintenance, please try again later."
+
+// maintenance turns maintenance mode on while a file exists, answering every request with a 503 in format instead of
+// proxying it. In the HTML format the page served is the contents of the file, or the built-in error page if it is
+// empty.
+type maintenance struct {
+	file   string
+	format reverseproxy.ErrorFormat
+	page   atomic.Pointer[[]byte] // nil while maintenance mode is off
+}
+
+// newMaintenance returns the maintenance mode controlled by file, checking it once up front
+func newMaintenance(file string, format reverseproxy.ErrorFormat) *maintenance {
+	m := &maintenance{file: file, format: format}
+	m.check()
+	return m
+}
+
+// check turns maintenance mode on or off depending on whether the file exists, logging any change
+func (m *maintenance) check() {
+	page, err := os.ReadFile(m.file)
+	if err != nil {
+		if m.page.Swap(nil) != nil {
+			logging.Infof("Maintenance mode off, %s is gone", m.file)
+		}
+		return
+	}
+	if m.page.Swap(&page) == nil {
+		logging.Infof("Maintenance mode on while %s exists", m.file)
+	}
+}
+
+// watch checks the file again whenever it is created, changed or removed, until stop is closed. ready, if non-nil, is
+// closed once the file is being watched.
+func (m *maintenance) watch(stop <-chan struct{}, ready chan<- struct{}) error {
+	return watchFiles([]string{m.file}, 100*time.Millisecond, m.check, stop, ready)
+}
+
+// On reports whether maintenance mode is on. A nil maintenance is always off.
+func (m *maintenance) On() bool {
+	return m != nil && m.page.Load() != nil
+}
+
+// wrap returns a handler answering with a 503 while maintenance mode is on, and passing requests to
+// next otherwise
+func (m *maintenance) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page := m.page.Load()
+		if page == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		var pages map[int][]byte
+		if len(*page) > 0 {
+			pages = map[int][]byte{http.StatusServiceUnavailable: *page}
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Retry-After", "60")
+		reverseproxy.WriteError(w, m.format, pages, http.StatusServiceUnavailable, "maintenance", maintenanceMessage)
+	})
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/snewstv/ssl-proxy/reverseproxy"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestMaintenance tests that requests get a 503 with the file's contents as the page while the file exists, or a
+// built-in page if it is empty, and are proxied otherwise
+func TestMaintenance(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "maintenance.html")
+	m := newMaintenance(file, reverseproxy.ErrorHTML)
+	handler := m.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("proxied"))
+	}))
+	get := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		return rec
+	}
+
+	assert.False(t, m.On(), "maintenance mode should be off without the file")
+	assert.Equal(t, "proxied", get().Body.String(), "requests should be proxied")
+
+	assert.Nil(t, os.WriteFile(file, []byte("<h1>Back soon</h1>"), 0644), "error should be nil")
+	m.check()
+	rec := get()
+	assert.True(t, m.On(), "maintenance mode should be on while the file exists")
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code, "requests should get a 503")
+	assert.Equal(t, "<h1>Back soon</h1>", rec.Body.String(), "the file should be served as the page")
+
+	assert.Nil(t, os.WriteFile(file, nil, 0644), "error should be nil")
+	m.check()
+	assert.Contains(t, get().Body.String(), "maintenance", "an empty file should serve the built-in page")
+
+	assert.Nil(t, os.Remove(file), "error should be nil")
+	m.check()
+	assert.Equal(t, "proxied", get().Body.String(), "requests should be proxied again once the file is gone")
+}
+
+// TestMaintenance_ErrorFormat tests that the maintenance response follows -error-format, with the file only served as
+// an HTML page
+func TestMaintenance_ErrorFormat(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "maintenance.html")
+	assert.Nil(t, os.WriteFile(file, []byte("<h1>Back soon</h1>"), 0644), "error should be nil")
+	for format, want := range map[reverseproxy.ErrorFormat]string{
+		reverseproxy.ErrorHTML: "<h1>Back soon</h1>",
+		reverseproxy.ErrorText: maintenanceMessage + "\n",
+		reverseproxy.ErrorJSON: `{"error":{"status":503,"code":"maintenance","message":"` + maintenanceMessage + `"}}` + "\n",
+	} {
+		rec := httptest.NewRecorder()
+		newMaintenance(file, format).wrap(http.NotFoundHandler()).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		assert.Equal(t, http.StatusServiceUnavailable, rec.Code, "requests should get a 503 in format %s", format)
+		assert.Equal(t, want, rec.Body.String(), "unexpected maintenance response in format %s", format)
+		assert.Equal(t, "60", rec.Header().Get("Retry-After"), "clients should be told when to retry in format %s", format)
+	}
+}
+
+// TestMaintenance_Watch tests that maintenance mode follows the file being created and removed without polling
+func TestMaintenance_Watch(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "maintenance.html")
+	m := newMaintenance(file, reverseproxy.ErrorHTML)
+	stop, ready, failed := make(chan struct{}), make(chan struct{}), make(chan error, 1)
+	defer close(stop)
+	go func() { failed <- m.watch(stop, ready) }()
+	select {
+	case <-ready:
+	case err := <-failed:
+		t.Fatalf("watching the file should succeed: %v", err)
+	}
+
+	assert.Nil(t, os.WriteFile(file, []byte("<h1>Back soon</h1>"), 0644), "error should be nil")
+	assert.Eventually(t, m.On, 2*time.Second, 10*time.Millisecond, "maintenance mode should turn on once the file is created")
+	assert.Nil(t, os.Remove(file), "error should be nil")
+	assert.Eventually(t, func() bool { return !m.On() }, 2*time.Second, 10*time.Millisecond, "maintenance mode should turn off once the file is removed")
+
+	err := newMaintenance(filepath.Join(t.TempDir(), "missing", "maintenance.html"), reverseproxy.ErrorHTML).watch(stop, nil)
+	assert.NotNil(t, err, "a file in a missing directory can't be watched")
+}
@@ -0,0 +1,113 @@
+package metrics
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/snewstv/ssl-proxy/middleware"
+	"github.com/snewstv/ssl-proxy/reverseproxy"
+)
+
+// Metrics holds the Prometheus collectors describing proxied traffic
+type Metrics struct {
+	gatherer        prometheus.Gatherer
+	requests        prometheus.Counter
+	responses       *prometheus.CounterVec
+	duration        prometheus.Histogram
+	backendRequests *prometheus.CounterVec
+	breakerState    *prometheus.GaugeVec
+	connections     prometheus.Gauge
+	rejectedConns   prometheus.Counter
+}
+
+// New creates the proxy's collectors and registers them with reg, which is usually prometheus.DefaultRegisterer. The
+// metrics are exposed by Handler using gatherer.
+func New(reg prometheus.Registerer, gatherer prometheus.Gatherer) *Metrics {
+	m := &Metrics{
+		gatherer: gatherer,
+		requests: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "ssl_proxy_requests_total",
+			Help: "Total number of requests received by the proxy.",
+		}),
+		responses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ssl_proxy_responses_total",
+			Help: "Total number of responses sent by the proxy, by status code.",
+		}, []string{"code"}),
+		duration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "ssl_proxy_request_duration_seconds",
+			Help:    "Time taken to serve proxied requests.",
+			Buckets: prometheus.DefBuckets,
+		}),
+		backendRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ssl_proxy_backend_requests_total",
+			Help: "Total number of requests sent to each backend, including failed attempts.",
+		}, []string{"backend"}),
+		breakerState: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "ssl_proxy_backend_breaker_state",
+			Help: "State of the circuit breaker of each backend, 1 for the current state and 0 for the others.",
+		}, []string{"backend", "state"}),
+		connections: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "ssl_proxy_client_connections",
+			Help: "Number of open client connections.",
+		}),
+		rejectedConns: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "ssl_proxy_client_connections_rejected_total",
+			Help: "Total number of client connections closed because too many were open.",
+		}),
+	}
+	reg.MustRegister(m.requests, m.responses, m.duration, m.backendRequests, m.breakerState, m.connections,
+		m.rejectedConns)
+	return m
+}
+
+// Handler returns an http.Handler serving the metrics in the Prometheus exposition format
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.gatherer, promhttp.HandlerOpts{})
+}
+
+// Instrument wraps next so that every request it serves updates the request, response and duration metrics
+func (m *Metrics) Instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		m.requests.Inc()
+		rw := middleware.NewResponseWriter(w)
+		next.ServeHTTP(rw, r)
+		m.responses.WithLabelValues(strconv.Itoa(rw.StatusCode())).Inc()
+		m.duration.Observe(time.Since(start).Seconds())
+	})
+}
+
+// BackendRequest counts a request sent to the given backend. It satisfies reverseproxy.Observer.
+func (m *Metrics) BackendRequest(backend *url.URL) {
+	m.backendRequests.WithLabelValues(backend.String()).Inc()
+}
+
+// BreakerStateChanged records the state of the given backend's circuit breaker. It satisfies reverseproxy.Observer.
+func (m *Metrics) BreakerStateChanged(backend *url.URL, state reverseproxy.BreakerState) {
+	for _, s := range []reverseproxy.BreakerState{reverseproxy.BreakerClosed, reverseproxy.BreakerOpen, reverseproxy.BreakerHalfOpen} {
+		value := 0.0
+		if s == state {
+			value = 1
+		}
+		m.breakerState.WithLabelValues(backend.String(), string(s)).Set(value)
+	}
+}
+
+// ConnectionOpened counts a client connection as open until ConnectionClosed is called for it
+func (m *Metrics) ConnectionOpened() {
+	m.connections.Inc()
+}
+
+// ConnectionClosed stops counting a client connection counted by ConnectionOpened
+func (m *Metrics) ConnectionClosed() {
+	m.connections.Dec()
+}
+
+// ConnectionRejected counts a client connection closed for being over the connection limit
+func (m *Metrics) ConnectionRejected() {
+	m.rejectedConns.Inc()
+}
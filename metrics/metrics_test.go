@@ -0,0 +1,61 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/snewstv/ssl-proxy/reverseproxy"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestInstrument tests that every request is counted, along with its response by status code and how long it took
+func TestInstrument(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m := New(reg, reg)
+	handler := m.Instrument(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+		}
+	}))
+	for _, path := range []string{"/", "/", "/missing"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	assert.Equal(t, 3.0, testutil.ToFloat64(m.requests), "every request should be counted")
+	assert.Equal(t, 2.0, testutil.ToFloat64(m.responses.WithLabelValues("200")), "responses should be counted by status code")
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.responses.WithLabelValues("404")), "responses should be counted by status code")
+	assert.Equal(t, 1, testutil.CollectAndCount(m.duration), "request durations should be recorded")
+
+	u, err := url.Parse("http://127.0.0.1:8000")
+	assert.Nil(t, err, "error should be nil")
+	m.BackendRequest(u)
+	m.BreakerStateChanged(u, reverseproxy.BreakerOpen)
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.backendRequests.WithLabelValues(u.String())), "backend requests should be counted by backend")
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.breakerState.WithLabelValues(u.String(), "open")), "the current breaker state should be 1")
+	assert.Equal(t, 0.0, testutil.ToFloat64(m.breakerState.WithLabelValues(u.String(), "closed")), "other breaker states should be 0")
+
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Contains(t, rec.Body.String(), `ssl_proxy_responses_total{code="404"} 1`, "the metrics should be served")
+}
+
+// TestConnections tests that client connections are counted as open until they are closed, and rejected ones counted
+// separately
+func TestConnections(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m := New(reg, reg)
+	m.ConnectionOpened()
+	m.ConnectionOpened()
+	assert.Equal(t, 2.0, testutil.ToFloat64(m.connections), "open connections should be counted")
+	m.ConnectionClosed()
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.connections), "a closed connection should stop being counted")
+	m.ConnectionClosed()
+	assert.Equal(t, 0.0, testutil.ToFloat64(m.connections), "no connections should be counted once all are closed")
+
+	m.ConnectionRejected()
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.rejectedConns), "rejected connections should be counted")
+}
@@ -0,0 +1,70 @@
+package middleware
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/snewstv/ssl-proxy/logging"
+)
+
+// AccessLogEntry describes a single request served by the proxy
+type AccessLogEntry struct {
+	Timestamp  time.Time `json:"timestamp"`
+	ClientIP   string    `json:"client_ip"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Host       string    `json:"host"`
+	Status     int       `json:"status"`
+	BytesSent  int64     `json:"bytes_sent"`
+	DurationMs float64   `json:"duration_ms"`
+	RequestID  string    `json:"request_id,omitempty"`
+}
+
+// JSONAccessLog wraps next so that every request it serves is written to out as a single line JSON object
+func JSONAccessLog(next http.Handler, out io.Writer) http.Handler {
+	var mu sync.Mutex
+	enc := json.NewEncoder(out)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rw := NewResponseWriter(w)
+		next.ServeHTTP(rw, r)
+
+		entry := AccessLogEntry{
+			Timestamp:  start,
+			ClientIP:   ClientIP(r),
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			Host:       r.Host,
+			Status:     rw.StatusCode(),
+			BytesSent:  rw.Written,
+			DurationMs: float64(time.Since(start)) / float64(time.Millisecond),
+			RequestID:  RequestIDFrom(r),
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if err := enc.Encode(entry); err != nil {
+			logging.Errorf("Unable to write access log entry: %v", err)
+		}
+	})
+}
+
+// ClientIP returns the IP address of the client that sent r, or the one in the header trusted by RealIPHeader
+func ClientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(realIPKey{}).(string); ok {
+		return ip
+	}
+	return remoteIP(r)
+}
+
+// remoteIP returns the IP address r was received from
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
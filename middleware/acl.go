@@ -0,0 +1,43 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+)
+
+// ACLRule allows or denies requests from the clients in a network
+type ACLRule struct {
+	Allow bool
+	Net   *net.IPNet
+}
+
+// ACL wraps next so that requests are allowed or denied with a 403 by the first of rules matching the client IP, as
+// found by RealClientIP using the trusted proxies. Clients matching no rule are denied if there are any allow rules,
+// and allowed otherwise.
+func ACL(next http.Handler, rules []ACLRule, trusted []*net.IPNet) http.Handler {
+	allowByDefault := true
+	for _, rule := range rules {
+		if rule.Allow {
+			allowByDefault = false
+		}
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !allowed(rules, net.ParseIP(RealClientIP(r, trusted)), allowByDefault) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func allowed(rules []ACLRule, ip net.IP, allowByDefault bool) bool {
+	if ip == nil {
+		return false
+	}
+	for _, rule := range rules {
+		if rule.Net.Contains(ip) {
+			return rule.Allow
+		}
+	}
+	return allowByDefault
+}
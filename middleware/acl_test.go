@@ -0,0 +1,50 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func cidr(t *testing.T, s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	assert.Nil(t, err, "error should be nil")
+	return n
+}
+
+// TestACL tests that the first matching rule decides, with the client IP only taken from X-Forwarded-For behind trusted
+// proxies
+func TestACL(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	trusted := []*net.IPNet{cidr(t, "10.0.0.0/8")}
+	cases := []struct {
+		name       string
+		rules      []ACLRule
+		remoteAddr string
+		xff        string
+		expected   int
+	}{
+		{"no rules", nil, "192.0.2.1:1", "", http.StatusOK},
+		{"allowed", []ACLRule{{true, cidr(t, "192.0.2.0/24")}}, "192.0.2.1:1", "", http.StatusOK},
+		{"not allowed", []ACLRule{{true, cidr(t, "192.0.2.0/24")}}, "198.51.100.1:1", "", http.StatusForbidden},
+		{"denied", []ACLRule{{false, cidr(t, "192.0.2.0/24")}}, "192.0.2.1:1", "", http.StatusForbidden},
+		{"not denied", []ACLRule{{false, cidr(t, "192.0.2.0/24")}}, "198.51.100.1:1", "", http.StatusOK},
+		{"first match wins", []ACLRule{{false, cidr(t, "192.0.2.1/32")}, {true, cidr(t, "192.0.2.0/24")}}, "192.0.2.1:1", "", http.StatusForbidden},
+		{"behind trusted proxy", []ACLRule{{true, cidr(t, "192.0.2.0/24")}}, "10.0.0.1:1", "192.0.2.1, 10.0.0.2", http.StatusOK},
+		{"spoofed behind trusted proxy", []ACLRule{{true, cidr(t, "192.0.2.0/24")}}, "10.0.0.1:1", "192.0.2.1, 198.51.100.1", http.StatusForbidden},
+		{"spoofed from untrusted client", []ACLRule{{true, cidr(t, "192.0.2.0/24")}}, "198.51.100.1:1", "192.0.2.1", http.StatusForbidden},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = c.remoteAddr
+		if c.xff != "" {
+			req.Header.Set("X-Forwarded-For", c.xff)
+		}
+		rec := httptest.NewRecorder()
+		ACL(next, c.rules, trusted).ServeHTTP(rec, req)
+		assert.Equal(t, c.expected, rec.Code, "unexpected status for %s", c.name)
+	}
+}
@@ -0,0 +1,78 @@
+package middleware
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// BasicAuth wraps next so that only requests carrying the credentials of one of users are served, answering any other
+// request with a 401 and a Basic challenge for realm. Each password in users is either plaintext or a bcrypt hash.
+func BasicAuth(next http.Handler, realm string, users map[string]string) http.Handler {
+	// Unknown users are checked against a dummy password of the same kind so that they take as long to reject as
+	// known ones, and can't be told apart by timing
+	dummy := ""
+	for _, password := range users {
+		if isBcrypt(password) {
+			hash, _ := bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+			dummy = string(hash)
+			break
+		}
+	}
+	challenge := fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", realm)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if ok {
+			stored, known := users[user]
+			if !known {
+				stored = dummy
+			}
+			if checkPassword(stored, password) && known {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		w.Header().Set("WWW-Authenticate", challenge)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	})
+}
+
+// checkPassword reports whether password matches stored, which is either plaintext or a bcrypt hash, in constant time
+func checkPassword(stored, password string) bool {
+	if isBcrypt(stored) {
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil
+	}
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+}
+
+func isBcrypt(password string) bool {
+	return strings.HasPrefix(password, "$2a$") || strings.HasPrefix(password, "$2b$") || strings.HasPrefix(password, "$2y$")
+}
+
+// ParseHtpasswd reads users and their bcrypt password hashes from an htpasswd file, as written by `htpasswd -B`.
+// Blank lines and lines starting with # are ignored.
+func ParseHtpasswd(r io.Reader) (map[string]string, error) {
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("line %d: expected user:hash", n)
+		}
+		if !isBcrypt(line[i+1:]) {
+			return nil, fmt.Errorf("line %d: password for %s is not a bcrypt hash (create it with htpasswd -B)", n, line[:i])
+		}
+		users[line[:i]] = line[i+1:]
+	}
+	return users, scanner.Err()
+}
@@ -0,0 +1,56 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// TestBasicAuth tests that only known users with the right plaintext or bcrypt password get through, and others are
+// challenged
+func TestBasicAuth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("s3cret"), bcrypt.MinCost)
+	assert.Nil(t, err, "error should be nil")
+	users := map[string]string{"alice": "hunter2", "bob": string(hash)}
+	handler := BasicAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), "ssl-proxy", users)
+
+	cases := []struct {
+		user, password string
+		set            bool
+		expected       int
+	}{
+		{"alice", "hunter2", true, http.StatusOK},
+		{"bob", "s3cret", true, http.StatusOK},
+		{"alice", "wrong", true, http.StatusUnauthorized},
+		{"bob", "wrong", true, http.StatusUnauthorized},
+		{"mallory", "hunter2", true, http.StatusUnauthorized},
+		{"", "", false, http.StatusUnauthorized},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "/", nil)
+		if c.set {
+			req.SetBasicAuth(c.user, c.password)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		assert.Equal(t, c.expected, rec.Code, "unexpected status for %s:%s", c.user, c.password)
+		if c.expected == http.StatusUnauthorized {
+			assert.Contains(t, rec.Header().Get("WWW-Authenticate"), `Basic realm="ssl-proxy"`, "401 should carry a Basic challenge")
+		}
+	}
+}
+
+// TestParseHtpasswd tests that bcrypt entries are read from an htpasswd file, skipping comments, and other hashes are
+// rejected
+func TestParseHtpasswd(t *testing.T) {
+	users, err := ParseHtpasswd(strings.NewReader("# comment\n\nbob:$2y$05$abcdefghijklmnopqrstuuu\n"))
+	assert.Nil(t, err, "error should be nil")
+	assert.Equal(t, map[string]string{"bob": "$2y$05$abcdefghijklmnopqrstuuu"}, users, "bcrypt entries should be parsed")
+
+	_, err = ParseHtpasswd(strings.NewReader("bob:$apr1$abc$def\n"))
+	assert.NotNil(t, err, "non-bcrypt hashes should be rejected")
+}
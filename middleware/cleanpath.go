@@ -0,0 +1,51 @@
+package middleware
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// CleanPath wraps next so that request paths are normalized with path.Clean before they are routed and forwarded:
+// duplicate slashes are collapsed and . and .. elements resolved, never climbing above the root. A trailing slash is
+// kept if the path had one, and the query string is left as it is.
+func CleanPath(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cleaned := cleanPath(r.URL.Path)
+		if cleaned == r.URL.Path {
+			next.ServeHTTP(w, r)
+			return
+		}
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.URL = new(url.URL)
+		*r2.URL = *r.URL
+		r2.URL.Path = cleaned
+		// Keep the client's escaping, e.g. of %2F, where it still matches the cleaned path
+		r2.URL.RawPath = ""
+		if r.URL.RawPath != "" {
+			if raw := cleanPath(r.URL.RawPath); unescaped(raw) == cleaned {
+				r2.URL.RawPath = raw
+			}
+		}
+		next.ServeHTTP(w, r2)
+	})
+}
+
+// cleanPath returns p cleaned by path.Clean as an absolute path, keeping any trailing slash
+func cleanPath(p string) string {
+	cleaned := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+func unescaped(p string) string {
+	u, err := url.PathUnescape(p)
+	if err != nil {
+		return ""
+	}
+	return u
+}
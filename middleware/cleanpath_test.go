@@ -0,0 +1,36 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestCleanPath tests that duplicate slashes and dot segments, even encoded ones, are removed from the path while the
+// query is kept
+func TestCleanPath(t *testing.T) {
+	var got string
+	handler := CleanPath(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.URL.RequestURI()
+	}))
+
+	cases := []struct{ uri, expected string }{
+		{"/a/b?x=1", "/a/b?x=1"},
+		{"//double//slashes", "/double/slashes"},
+		{"/a/./b/../c/?x=//../y", "/a/c/?x=//../y"},
+		{"/../../etc/passwd", "/etc/passwd"},
+		{"/a/%2e%2e/%2e%2e/etc/passwd", "/etc/passwd"},
+		{"/a//b%2Fc/", "/a/b%2Fc/"},
+		{"/", "/"},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		req.RequestURI = c.uri
+		req.URL, _ = url.ParseRequestURI(c.uri)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		assert.Equal(t, c.expected, got, "unexpected path for %s", c.uri)
+	}
+}
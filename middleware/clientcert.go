@@ -0,0 +1,51 @@
+package middleware
+
+import (
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+)
+
+// ClientCertHeaders names the headers that details of a client's certificate are passed on in. Empty names are
+// skipped.
+type ClientCertHeaders struct {
+	// Subject is the certificate's subject, e.g. CN=alice,O=acme
+	Subject string
+	// Serial is the certificate's serial number in upper case hex
+	Serial string
+	// PEM is the whole PEM encoded certificate, base64 encoded again to fit in a header
+	PEM string
+}
+
+// ClientCert wraps next so that details of the certificate a client authenticated with are passed on in headers. Any
+// copies of those headers sent by the client itself are removed so that they can't be spoofed, and they are left
+// unset for clients without a verified certificate.
+func ClientCert(next http.Handler, headers ClientCertHeaders) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		set := func(name, value string) {
+			if name == "" {
+				return
+			}
+			r.Header.Del(name)
+			if value != "" {
+				r.Header.Set(name, value)
+			}
+		}
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			set(headers.Subject, "")
+			set(headers.Serial, "")
+			set(headers.PEM, "")
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cert := r.TLS.PeerCertificates[0]
+		set(headers.Subject, cert.Subject.String())
+		set(headers.Serial, fmt.Sprintf("%X", cert.SerialNumber))
+		if headers.PEM != "" {
+			set(headers.PEM, base64.StdEncoding.EncodeToString(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
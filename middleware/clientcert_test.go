@@ -0,0 +1,69 @@
+package middleware
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/snewstv/ssl-proxy/internal/testcert"
+	"github.com/stretchr/testify/assert"
+)
+
+// clientCert returns a CA and a client certificate signed by it
+func clientCert(t *testing.T) (*x509.CertPool, tls.Certificate) {
+	cert, ca, _ := testcert.Chain(t, &x509.Certificate{
+		SerialNumber: big.NewInt(0xBEEF),
+		Subject:      pkix.Name{CommonName: "alice", Organization: []string{"acme"}},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	return pool, cert
+}
+
+// TestClientCert tests that a verified client cert's subject, serial and PEM are passed on, and spoofed headers are
+// removed without one
+func TestClientCert(t *testing.T) {
+	pool, cert := clientCert(t)
+	headers := ClientCertHeaders{Subject: "X-Client-Cert-Subject", Serial: "X-Client-Cert-Serial", PEM: "X-Client-Cert-PEM"}
+	var got http.Header
+	server := httptest.NewUnstartedServer(ClientCert(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+	}), headers))
+	server.TLS = &tls.Config{ClientCAs: pool, ClientAuth: tls.VerifyClientCertIfGiven}
+	server.StartTLS()
+	defer server.Close()
+
+	get := func(client *http.Client) {
+		req, err := http.NewRequest("GET", server.URL, nil)
+		assert.Nil(t, err, "error should be nil")
+		req.Header.Set("X-Client-Cert-Subject", "CN=mallory")
+		req.Header.Set("X-Client-Cert-Serial", "1")
+		resp, err := client.Do(req)
+		assert.Nil(t, err, "error should be nil")
+		resp.Body.Close()
+	}
+
+	get(server.Client())
+	assert.Empty(t, got.Values("X-Client-Cert-Subject"), "spoofed headers should be removed without a client cert")
+	assert.Empty(t, got.Values("X-Client-Cert-Serial"), "spoofed headers should be removed without a client cert")
+	assert.Empty(t, got.Values("X-Client-Cert-PEM"), "no cert should be passed on without a client cert")
+
+	transport := server.Client().Transport.(*http.Transport).Clone()
+	transport.TLSClientConfig.Certificates = []tls.Certificate{cert}
+	get(&http.Client{Transport: transport})
+	assert.Equal(t, []string{"CN=alice,O=acme"}, got.Values("X-Client-Cert-Subject"), "the client cert's subject should be passed on")
+	assert.Equal(t, []string{"BEEF"}, got.Values("X-Client-Cert-Serial"), "the client cert's serial should be passed on")
+	decoded, err := base64.StdEncoding.DecodeString(got.Get("X-Client-Cert-PEM"))
+	assert.Nil(t, err, "the cert should be base64 encoded")
+	block, _ := pem.Decode(decoded)
+	if assert.NotNil(t, block, "the cert should be PEM encoded") {
+		assert.Equal(t, cert.Certificate[0], block.Bytes, "the client cert should be passed on")
+	}
+}
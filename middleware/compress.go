@@ -0,0 +1,186 @@
+package middleware
+
+import (
+	"compress/gzip"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var gzipWriters = sync.Pool{New: func() interface{} { return gzip.NewWriter(nil) }}
+
+// Compress wraps next so that responses with a compressible content type are gzipped for clients accepting it.
+// Responses that are already encoded, partial, or shorter than minSize bytes are sent unchanged. Up to minSize bytes
+// of each response are buffered to decide, unless the handler flushes first.
+func Compress(next http.Handler, minSize int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead || r.Header.Get("Upgrade") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, minSize: minSize, acceptsGzip: acceptsGzip(r)}
+		defer cw.close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// compressWriter buffers the start of a response until it can decide whether to compress it
+type compressWriter struct {
+	http.ResponseWriter
+	minSize     int
+	acceptsGzip bool
+
+	status  int
+	buf     []byte
+	decided bool
+	gz      *gzip.Writer
+}
+
+func (c *compressWriter) WriteHeader(code int) {
+	if c.decided {
+		c.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if code >= 100 && code < 200 {
+		// Informational responses don't end the header
+		c.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if c.status == 0 {
+		c.status = code
+	}
+}
+
+func (c *compressWriter) Write(b []byte) (int, error) {
+	if c.decided {
+		if c.gz != nil {
+			return c.gz.Write(b)
+		}
+		return c.ResponseWriter.Write(b)
+	}
+	c.buf = append(c.buf, b...)
+	if len(c.buf) >= c.minSize {
+		if err := c.decide(false); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// Flush sends everything written so far, deciding whether to compress the response if that hasn't happened yet
+func (c *compressWriter) Flush() {
+	if !c.decided {
+		c.decide(true)
+	}
+	if c.gz != nil {
+		c.gz.Flush()
+	}
+	http.NewResponseController(c.ResponseWriter).Flush()
+}
+
+// Unwrap returns the wrapped http.ResponseWriter, for http.ResponseController
+func (c *compressWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+// decide writes the header, compressing the response if it is compressible and long enough. A response being
+// flushed early is assumed to be long enough unless its Content-Length says otherwise.
+func (c *compressWriter) decide(flushing bool) error {
+	c.decided = true
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	h := c.Header()
+	if h.Get("Content-Type") == "" && len(c.buf) > 0 {
+		// The server doesn't sniff the type of encoded responses, so sniff it from the plain body here
+		h.Set("Content-Type", http.DetectContentType(c.buf))
+	}
+
+	long := len(c.buf) >= c.minSize
+	if flushing && !long {
+		n, err := strconv.Atoi(h.Get("Content-Length"))
+		long = err != nil || n >= c.minSize
+	}
+	compressible := c.compressible()
+	if compressible {
+		h.Add("Vary", "Accept-Encoding")
+	}
+	if compressible && c.acceptsGzip && long {
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+		if etag := h.Get("ETag"); strings.HasPrefix(etag, `"`) {
+			// The compressed body is no longer byte for byte identical
+			h.Set("ETag", "W/"+etag)
+		}
+		c.gz = gzipWriters.Get().(*gzip.Writer)
+		c.gz.Reset(c.ResponseWriter)
+	}
+	c.ResponseWriter.WriteHeader(c.status)
+
+	buf := c.buf
+	c.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	_, err := c.Write(buf)
+	return err
+}
+
+// compressible reports whether the response could be gzipped for a client that accepts it
+func (c *compressWriter) compressible() bool {
+	switch c.status {
+	case http.StatusNoContent, http.StatusNotModified, http.StatusPartialContent:
+		return false
+	}
+	h := c.Header()
+	if h.Get("Content-Encoding") != "" || h.Get("Content-Range") != "" {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	switch {
+	case mediaType == "text/event-stream":
+		// Server-sent events must reach the client as soon as they're written
+		return false
+	case strings.HasPrefix(mediaType, "text/"),
+		strings.HasSuffix(mediaType, "+json"), strings.HasSuffix(mediaType, "+xml"):
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/javascript", "application/xml", "application/wasm",
+		"application/x-javascript", "image/svg+xml", "image/x-icon":
+		return true
+	}
+	return false
+}
+
+// close finishes the response once the handler has returned
+func (c *compressWriter) close() {
+	if !c.decided {
+		c.decide(false)
+	}
+	if c.gz != nil {
+		c.gz.Close()
+		c.gz.Reset(nil)
+		gzipWriters.Put(c.gz)
+		c.gz = nil
+	}
+}
+
+// acceptsGzip reports whether the client sent an Accept-Encoding header allowing gzip
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.TrimSpace(name)
+		if name != "gzip" && name != "*" {
+			continue
+		}
+		q, err := strconv.ParseFloat(strings.TrimPrefix(strings.TrimSpace(params), "q="), 64)
+		return err != nil || q > 0
+	}
+	return false
+}
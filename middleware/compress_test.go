@@ -0,0 +1,88 @@
+package middleware
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestCompress tests that only compressible responses long enough to be worth it are gzipped, and only for clients
+// accepting gzip
+func TestCompress(t *testing.T) {
+	long := strings.Repeat(`{"hello":"world"}`, 100)
+	cases := []struct {
+		name           string
+		acceptEncoding string
+		contentType    string
+		encoding       string
+		body           string
+		expectGzip     bool
+		expectVary     bool
+	}{
+		{"compressible", "gzip, deflate", "application/json", "", long, true, true},
+		{"sniffed", "gzip", "", "", "<html>" + long, true, true},
+		{"not accepted", "", "application/json", "", long, false, true},
+		{"refused", "gzip;q=0", "application/json", "", long, false, true},
+		{"too short", "gzip", "application/json", "", `{"hello":"world"}`, false, true},
+		{"already encoded", "gzip", "application/json", "br", long, false, false},
+		{"incompressible", "gzip", "image/png", "", long, false, false},
+	}
+	for _, c := range cases {
+		handler := Compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if c.contentType != "" {
+				w.Header().Set("Content-Type", c.contentType)
+			}
+			if c.encoding != "" {
+				w.Header().Set("Content-Encoding", c.encoding)
+			}
+			io.WriteString(w, c.body[:len(c.body)/2])
+			io.WriteString(w, c.body[len(c.body)/2:])
+		}), 1024)
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Encoding", c.acceptEncoding)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		assert.Equal(t, c.expectVary, rec.Header().Get("Vary") == "Accept-Encoding", "unexpected Vary for %s", c.name)
+		if !c.expectGzip {
+			assert.NotEqual(t, "gzip", rec.Header().Get("Content-Encoding"), "%s should not be gzipped", c.name)
+			assert.Equal(t, c.body, rec.Body.String(), "%s body should be unchanged", c.name)
+			continue
+		}
+		assert.Equal(t, "gzip", rec.Header().Get("Content-Encoding"), "%s should be gzipped", c.name)
+		assert.Less(t, rec.Body.Len(), len(c.body), "%s should be smaller once compressed", c.name)
+		gz, err := gzip.NewReader(rec.Body)
+		assert.Nil(t, err, "error should be nil")
+		body, err := io.ReadAll(gz)
+		assert.Nil(t, err, "error should be nil")
+		assert.Equal(t, c.body, string(body), "%s should decompress to the original body", c.name)
+	}
+}
+
+// TestCompress_Flush tests that flushes pass through the gzip writer, so streamed responses still reach the client as
+// they're written
+func TestCompress_Flush(t *testing.T) {
+	handler := Compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, "first")
+		http.NewResponseController(w).Flush()
+		io.WriteString(w, "second")
+	}), 1024)
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	assert.True(t, rec.Flushed, "flushes should reach the underlying writer")
+	assert.Equal(t, "gzip", rec.Header().Get("Content-Encoding"), "a streamed response of unknown length should be gzipped")
+	gz, err := gzip.NewReader(rec.Body)
+	assert.Nil(t, err, "error should be nil")
+	body, err := io.ReadAll(gz)
+	assert.Nil(t, err, "error should be nil")
+	assert.Equal(t, "firstsecond", string(body), "the flushed response should decompress to the whole body")
+}
@@ -0,0 +1,94 @@
+package middleware
+
+import (
+	"net/http"
+	"strings"
+)
+
+// CORSOptions configures the CORS middleware
+type CORSOptions struct {
+	// AllowOrigins are the origins, e.g. https://app.example.com, allowed to make cross-origin requests, or * for any
+	AllowOrigins []string
+	// AllowMethods and AllowHeaders are the methods and request headers preflight requests are told are allowed
+	AllowMethods []string
+	AllowHeaders []string
+	// AllowCredentials lets browsers send cookies and credentials with cross-origin requests and read the responses.
+	// It requires explicit AllowOrigins, since browsers ignore it with *.
+	AllowCredentials bool
+}
+
+// CORS wraps next so that cross-origin requests from allowed origins get Access-Control-* headers. Preflight requests
+// are answered directly with a 204, or a 403 if their origin isn't allowed, and never reach next. Any Access-Control-*
+// headers next sets on cross-origin responses are replaced, so that a backend's own CORS headers can't conflict with
+// these or allow other origins.
+func CORS(next http.Handler, opts CORSOptions) http.Handler {
+	anyOrigin := false
+	allowed := make(map[string]bool)
+	for _, origin := range opts.AllowOrigins {
+		if origin == "*" {
+			anyOrigin = true
+		}
+		allowed[strings.ToLower(strings.TrimSuffix(origin, "/"))] = true
+	}
+	methods := strings.Join(opts.AllowMethods, ", ")
+	headers := strings.Join(opts.AllowHeaders, ", ")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		preflight := r.Method == http.MethodOptions && origin != "" && r.Header.Get("Access-Control-Request-Method") != ""
+		if preflight {
+			w.Header().Add("Vary", "Origin, Access-Control-Request-Method, Access-Control-Request-Headers")
+		} else {
+			w.Header().Add("Vary", "Origin")
+		}
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ok := anyOrigin || allowed[strings.ToLower(origin)]
+		if preflight {
+			if !ok {
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+			setCORSHeaders(w.Header(), origin, anyOrigin, opts.AllowCredentials)
+			if methods != "" {
+				w.Header().Set("Access-Control-Allow-Methods", methods)
+			}
+			if headers != "" {
+				w.Header().Set("Access-Control-Allow-Headers", headers)
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if !ok {
+			origin = ""
+		}
+		hw := beforeHeader(w, func(h http.Header) {
+			setCORSHeaders(h, origin, anyOrigin, opts.AllowCredentials)
+		})
+		defer hw.finish()
+		next.ServeHTTP(hw, r)
+	})
+}
+
+// setCORSHeaders replaces any Access-Control-* headers in h with those allowing origin, or removes them if origin
+// is empty
+func setCORSHeaders(h http.Header, origin string, anyOrigin, credentials bool) {
+	for name := range h {
+		if strings.HasPrefix(name, "Access-Control-") {
+			delete(h, name)
+		}
+	}
+	if origin == "" {
+		return
+	}
+	if anyOrigin && !credentials {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Set("Access-Control-Allow-Origin", origin)
+	}
+	if credentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
@@ -0,0 +1,69 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestCORS tests that preflights from allowed origins are answered by the proxy, others are refused, and the backend's
+// CORS headers are replaced
+func TestCORS(t *testing.T) {
+	var reached int
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached++
+		// A backend's own CORS headers must not leak through
+		w.Header().Set("Access-Control-Allow-Origin", "https://backend.example")
+		w.Write([]byte("ok"))
+	})
+	opts := CORSOptions{
+		AllowOrigins:     []string{"https://app.example"},
+		AllowMethods:     []string{"GET", "PUT"},
+		AllowHeaders:     []string{"Authorization"},
+		AllowCredentials: true,
+	}
+	handler := CORS(backend, opts)
+	do := func(method, origin string, preflight bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/", nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		if preflight {
+			req.Header.Set("Access-Control-Request-Method", "PUT")
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do("OPTIONS", "https://app.example", true)
+	assert.Equal(t, http.StatusNoContent, rec.Code, "an allowed preflight should get a 204")
+	assert.Equal(t, "https://app.example", rec.Header().Get("Access-Control-Allow-Origin"), "the origin should be allowed")
+	assert.Equal(t, "GET, PUT", rec.Header().Get("Access-Control-Allow-Methods"), "the methods should be listed")
+	assert.Equal(t, "Authorization", rec.Header().Get("Access-Control-Allow-Headers"), "the headers should be listed")
+	assert.Equal(t, "true", rec.Header().Get("Access-Control-Allow-Credentials"), "credentials should be allowed")
+
+	rec = do("OPTIONS", "https://evil.example", true)
+	assert.Equal(t, http.StatusForbidden, rec.Code, "a preflight from another origin should be refused")
+	assert.Empty(t, rec.Header().Get("Access-Control-Allow-Origin"), "another origin should not be allowed")
+	assert.Equal(t, 0, reached, "preflight requests should not reach the backend")
+
+	rec = do("GET", "https://app.example", false)
+	assert.Equal(t, "ok", rec.Body.String(), "actual requests should reach the backend")
+	assert.Equal(t, []string{"https://app.example"}, rec.Header().Values("Access-Control-Allow-Origin"), "the proxy's CORS headers should replace the backend's")
+	assert.Contains(t, rec.Header().Values("Vary"), "Origin", "responses should vary by origin")
+
+	rec = do("GET", "https://evil.example", false)
+	assert.Empty(t, rec.Header().Get("Access-Control-Allow-Origin"), "responses to other origins should not allow them")
+
+	rec = do("OPTIONS", "", false)
+	assert.Equal(t, "https://backend.example", rec.Header().Get("Access-Control-Allow-Origin"), "same-origin requests should be passed through untouched")
+
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Origin", "https://any.example")
+	CORS(backend, CORSOptions{AllowOrigins: []string{"*"}}).ServeHTTP(rec, req)
+	assert.Equal(t, "*", rec.Header().Get("Access-Control-Allow-Origin"), "* should allow any origin")
+}
@@ -0,0 +1,25 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// HSTS wraps next so that every response tells browsers, with a Strict-Transport-Security header, to only use HTTPS
+// for the host for maxAge, and for its subdomains too if includeSubDomains is set. preload asks for the host to be
+// included in browsers' preload lists. Any Strict-Transport-Security header set by next is replaced.
+func HSTS(next http.Handler, maxAge time.Duration, includeSubDomains, preload bool) http.Handler {
+	value := fmt.Sprintf("max-age=%d", int64(maxAge/time.Second))
+	if includeSubDomains {
+		value += "; includeSubDomains"
+	}
+	if preload {
+		value += "; preload"
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hw := beforeHeader(w, func(h http.Header) { h.Set("Strict-Transport-Security", value) })
+		defer hw.finish()
+		next.ServeHTTP(hw, r)
+	})
+}
@@ -0,0 +1,31 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestHSTS tests that every response gets the Strict-Transport-Security header with the requested directives, replacing
+// the backend's
+func TestHSTS(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/backend" {
+			w.Header().Set("Strict-Transport-Security", "max-age=0")
+			w.Write([]byte("ok"))
+		}
+	})
+
+	rec := httptest.NewRecorder()
+	HSTS(next, 365*24*time.Hour, false, false).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, "max-age=31536000", rec.Header().Get("Strict-Transport-Security"),
+		"responses without a body should get the header")
+
+	rec = httptest.NewRecorder()
+	HSTS(next, time.Hour, true, true).ServeHTTP(rec, httptest.NewRequest("GET", "/backend", nil))
+	assert.Equal(t, []string{"max-age=3600; includeSubDomains; preload"}, rec.Header().Values("Strict-Transport-Security"),
+		"the header should replace the backend's")
+}
@@ -0,0 +1,112 @@
+package middleware
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/snewstv/ssl-proxy/logging"
+)
+
+// LogFields are the fields of a request that access log templates can use
+type LogFields struct {
+	Time      time.Time // when the request was received
+	RemoteIP  string    // the client's IP, taken from the header trusted by RealIPHeader if there is one
+	Method    string
+	URI       string // the request target as the client sent it, including the query string
+	Path      string
+	Proto     string // e.g. HTTP/1.1
+	Host      string
+	Status    int
+	BytesSent int64
+	Duration  time.Duration
+	Referer   string
+	UserAgent string
+	User      string // the user name sent with HTTP basic auth, if any
+	RequestID string
+}
+
+// LogTemplates are the named access log templates: the Common and Combined Log Formats of Apache and nginx
+var LogTemplates = map[string]string{
+	"common":   `{{.RemoteIP}} - {{or .User "-"}} [{{.Time.Format "02/Jan/2006:15:04:05 -0700"}}] "{{.Method}} {{escape .URI}} {{.Proto}}" {{.Status}} {{.BytesSent}}`,
+	"combined": `{{.RemoteIP}} - {{or .User "-"}} [{{.Time.Format "02/Jan/2006:15:04:05 -0700"}}] "{{.Method}} {{escape .URI}} {{.Proto}}" {{.Status}} {{.BytesSent}} "{{escape (or .Referer "-")}}" "{{escape (or .UserAgent "-")}}"`,
+}
+
+// ParseLogTemplate parses an access log template, either the name of one of LogTemplates or a text/template executed
+// with LogFields, e.g. {{.RemoteIP}} {{.Method}} {{.Status}} {{.Duration}}. Templates can use escape to quote values
+// such as the user agent, which the client controls, the way nginx does. The template is tried out so that mistakes
+// such as unknown fields are reported here rather than on the first request.
+func ParseLogTemplate(text string) (*template.Template, error) {
+	if preset, ok := LogTemplates[text]; ok {
+		text = preset
+	}
+	tmpl, err := template.New("access log").Funcs(template.FuncMap{"escape": escapeLogValue}).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	if err := tmpl.Execute(io.Discard, LogFields{}); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// escapeLogValue escapes quotes, backslashes and control and non-ASCII characters in s as \xHH, so that it can be
+// logged between quotes
+func escapeLogValue(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c == '"' || c == '\\' || c < 0x20 || c >= 0x7f {
+			fmt.Fprintf(&b, `\x%02X`, c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// TemplateAccessLog wraps next so that every request it serves is written to out as a line formatted by tmpl, which
+// is executed with the request's LogFields
+func TemplateAccessLog(next http.Handler, out io.Writer, tmpl *template.Template) http.Handler {
+	var mu sync.Mutex
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rw := NewResponseWriter(w)
+		next.ServeHTTP(rw, r)
+
+		user, _, _ := r.BasicAuth()
+		fields := LogFields{
+			Time:      start,
+			RemoteIP:  ClientIP(r),
+			Method:    r.Method,
+			URI:       r.RequestURI,
+			Path:      r.URL.Path,
+			Proto:     r.Proto,
+			Host:      r.Host,
+			Status:    rw.StatusCode(),
+			BytesSent: rw.Written,
+			Duration:  time.Since(start),
+			Referer:   r.Referer(),
+			UserAgent: r.UserAgent(),
+			User:      user,
+			RequestID: RequestIDFrom(r),
+		}
+		var line bytes.Buffer
+		if err := tmpl.Execute(&line, fields); err != nil {
+			logging.Errorf("Unable to write access log entry: %v", err)
+			return
+		}
+		if !bytes.HasSuffix(line.Bytes(), []byte("\n")) {
+			line.WriteByte('\n')
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if _, err := out.Write(line.Bytes()); err != nil {
+			logging.Errorf("Unable to write access log entry: %v", err)
+		}
+	})
+}
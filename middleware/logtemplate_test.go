@@ -0,0 +1,49 @@
+package middleware
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestParseLogTemplate tests that the presets and valid templates parse, while malformed templates or unknown fields
+// are rejected at startup
+func TestParseLogTemplate(t *testing.T) {
+	for _, text := range []string{"common", "combined", "{{.RemoteIP}} {{.Method}} {{.Status}} {{.Duration}}"} {
+		_, err := ParseLogTemplate(text)
+		assert.Nil(t, err, "%q should be a valid template", text)
+	}
+	for _, text := range []string{"{{.Method", "{{.Nope}}", "{{nope .Method}}"} {
+		_, err := ParseLogTemplate(text)
+		assert.NotNil(t, err, "%q should be rejected at startup", text)
+	}
+}
+
+// TestTemplateAccessLog tests that each request is logged as one line of the template, with the combined preset
+// escaping client supplied values
+func TestTemplateAccessLog(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte("teapot"))
+	})
+	var log bytes.Buffer
+	tmpl, err := ParseLogTemplate("{{.RemoteIP}} {{.Method}} {{.Path}} {{.Status}} {{.BytesSent}} {{.User}} {{.Duration}}")
+	if !assert.Nil(t, err, "error should be nil") {
+		return
+	}
+	req := httptest.NewRequest("POST", "/brew?cups=2", nil)
+	req.SetBasicAuth("alice", "secret")
+	TemplateAccessLog(next, &log, tmpl).ServeHTTP(httptest.NewRecorder(), req)
+	assert.Regexp(t, regexp.MustCompile(`^192\.0\.2\.1 POST /brew 418 6 alice \S+s\n$`), log.String(), "each request should be logged as one line")
+
+	log.Reset()
+	tmpl, _ = ParseLogTemplate("combined")
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("User-Agent", "evil\" agent\n")
+	TemplateAccessLog(next, &log, tmpl).ServeHTTP(httptest.NewRecorder(), req)
+	assert.Regexp(t, regexp.MustCompile(`^192\.0\.2\.1 - - \[\d\d/\w{3}/\d{4}:\d\d:\d\d:\d\d [+-]\d{4}\] "GET / HTTP/1\.1" 418 6 "-" "evil\\x22 agent\\x0A"\n$`), log.String(), "the combined preset should match the Apache format, with quotes and newlines escaped")
+}
@@ -0,0 +1,21 @@
+package middleware
+
+import (
+	"net/http"
+)
+
+// MaxBodySize wraps next so that request bodies longer than limit bytes are rejected with a 413. Requests declaring a
+// longer Content-Length are rejected before next is called; for chunked requests, reading the body fails with an
+// *http.MaxBytesError once the limit is passed.
+func MaxBodySize(next http.Handler, limit int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > limit {
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,49 @@
+package middleware
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestMaxBodySize tests that bodies over the limit are rejected with a 413 up front if their length is declared, and
+// otherwise fail to be read with an *http.MaxBytesError once the limit is passed
+func TestMaxBodySize(t *testing.T) {
+	var readErr error
+	called := false
+	handler := MaxBodySize(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		_, readErr = io.Copy(io.Discard, r.Body)
+	}), 1024)
+
+	for _, size := range []int{1024, 4096} {
+		for _, chunked := range []bool{false, true} {
+			called, readErr = false, nil
+			var body io.Reader = strings.NewReader(strings.Repeat("a", size))
+			req := httptest.NewRequest("POST", "/", body)
+			if chunked {
+				req.ContentLength = -1
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			var tooLarge *http.MaxBytesError
+			switch {
+			case size <= 1024:
+				assert.True(t, called, "a body within the limit should be passed on (chunked %v)", chunked)
+				assert.Nil(t, readErr, "a body within the limit should be read in full (chunked %v)", chunked)
+			case chunked:
+				assert.True(t, called, "a chunked body should be passed on")
+				assert.True(t, errors.As(readErr, &tooLarge), "reading a chunked body over the limit should fail")
+			default:
+				assert.False(t, called, "a body declared over the limit should not be passed on")
+				assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code, "a body declared over the limit should get a 413")
+			}
+		}
+	}
+}
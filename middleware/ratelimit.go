@@ -0,0 +1,87 @@
+package middleware
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// RateLimit wraps next so that each client IP may send perSecond requests per second on average, with bursts of up to
+// burst requests. Requests over the limit get a 429 with a Retry-After header saying when to try again.
+func RateLimit(next http.Handler, perSecond float64, burst int) http.Handler {
+	return newRateLimiter(next, rate.Limit(perSecond), burst, time.Now)
+}
+
+// rateLimiter keeps a token bucket per client IP. Buckets idle for longer than it takes them to refill completely are
+// indistinguishable from new ones, so they are swept away periodically to keep one-off clients from using up memory.
+type rateLimiter struct {
+	next    http.Handler
+	limit   rate.Limit
+	burst   int
+	now     func() time.Time
+	idleTTL time.Duration
+
+	mu        sync.Mutex
+	clients   map[string]*client
+	lastSweep time.Time
+}
+
+type client struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newRateLimiter(next http.Handler, limit rate.Limit, burst int, now func() time.Time) *rateLimiter {
+	idleTTL := time.Duration(float64(burst) / float64(limit) * float64(time.Second))
+	if idleTTL < time.Minute {
+		idleTTL = time.Minute
+	}
+	return &rateLimiter{
+		next:      next,
+		limit:     limit,
+		burst:     burst,
+		now:       now,
+		idleTTL:   idleTTL,
+		clients:   make(map[string]*client),
+		lastSweep: now(),
+	}
+}
+
+func (l *rateLimiter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	now := l.now()
+	reservation := l.limiter(ClientIP(r), now).ReserveN(now, 1)
+	if delay := reservation.DelayFrom(now); !reservation.OK() || delay > 0 {
+		reservation.CancelAt(now)
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return
+	}
+	l.next.ServeHTTP(w, r)
+}
+
+// limiter returns the bucket for ip, creating it if needed and sweeping idle buckets at most once every idleTTL
+func (l *rateLimiter) limiter(ip string, now time.Time) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) >= l.idleTTL {
+		for key, c := range l.clients {
+			if now.Sub(c.lastSeen) >= l.idleTTL {
+				delete(l.clients, key)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	c, ok := l.clients[ip]
+	if !ok {
+		c = &client{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.clients[ip] = c
+	}
+	c.lastSeen = now
+	return c.limiter
+}
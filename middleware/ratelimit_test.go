@@ -0,0 +1,58 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestRateLimit tests that each client can burst up to the limit, and is then throttled to the rate with a Retry-After
+func TestRateLimit(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := newRateLimiter(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), 2, 5, func() time.Time { return now })
+	send := func(remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		l.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, http.StatusOK, send("192.0.2.1:1234").Code, "requests within the burst should be allowed")
+	}
+	rec := send("192.0.2.1:1234")
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code, "requests beyond the burst should be throttled")
+	assert.Equal(t, "1", rec.Header().Get("Retry-After"), "Retry-After should say when a token is available")
+	assert.Equal(t, http.StatusOK, send("192.0.2.2:1234").Code, "other clients should have their own limit")
+
+	// Sending steadily at twice the limit, only every other request gets through
+	allowed := 0
+	for i := 0; i < 20; i++ {
+		now = now.Add(250 * time.Millisecond)
+		if send("192.0.2.1:1234").Code == http.StatusOK {
+			allowed++
+		}
+	}
+	assert.Equal(t, 10, allowed, "steady over-limit traffic should be throttled to the limit")
+}
+
+// TestRateLimit_EvictsIdleClients tests that limiters of clients that have gone idle are dropped, so memory doesn't
+// grow with every client seen
+func TestRateLimit_EvictsIdleClients(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := newRateLimiter(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), 1, 1, func() time.Time { return now })
+	for _, addr := range []string{"192.0.2.1:1", "192.0.2.2:1", "192.0.2.3:1"} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = addr
+		l.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	assert.Len(t, l.clients, 3, "a limiter should be kept per client")
+
+	now = now.Add(2 * time.Minute)
+	l.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	assert.Len(t, l.clients, 1, "idle clients should be evicted")
+}
@@ -0,0 +1,65 @@
+package middleware
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// RealClientIP returns the IP address of the client that originally sent r. If r came from one of the trusted
+// proxies, the X-Forwarded-For chain is followed back past every trusted proxy, and the first address that isn't one
+// is returned. Otherwise, or without any trusted proxies, it is the address r was received from. An address taken from
+// the header trusted by RealIPHeader takes precedence over all of these.
+func RealClientIP(r *http.Request, trusted []*net.IPNet) string {
+	if ip, ok := r.Context().Value(realIPKey{}).(string); ok {
+		return ip
+	}
+	ip := remoteIP(r)
+	if !contains(trusted, ip) {
+		return ip
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			// Anything before a malformed entry can't be trusted
+			break
+		}
+		ip = hop
+		if !contains(trusted, ip) {
+			break
+		}
+	}
+	return ip
+}
+
+// contains reports whether ip falls within any of nets
+func contains(nets []*net.IPNet, ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+type realIPKey struct{}
+
+// RealIPHeader wraps next so that ClientIP and RealClientIP return the IP address in header, e.g. CF-Connecting-IP, for
+// requests received from one of the trusted proxies. Anyone else could set the header to spoof their IP, so it is
+// ignored and removed on requests from other clients.
+func RealIPHeader(next http.Handler, header string, trusted []*net.IPNet) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !contains(trusted, remoteIP(r)) {
+			r.Header.Del(header)
+		} else if ip := strings.TrimSpace(r.Header.Get(header)); net.ParseIP(ip) != nil {
+			r = r.WithContext(context.WithValue(r.Context(), realIPKey{}, ip))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
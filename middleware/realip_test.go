@@ -0,0 +1,39 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestRealIPHeader tests that the client IP is taken from the header only when set by a trusted proxy, and is removed
+// otherwise
+func TestRealIPHeader(t *testing.T) {
+	trusted := []*net.IPNet{cidr(t, "173.245.48.0/20")}
+	var clientIP, realIP, forwarded string
+	handler := RealIPHeader(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientIP, realIP, forwarded = ClientIP(r), RealClientIP(r, trusted), r.Header.Get("CF-Connecting-IP")
+	}), "CF-Connecting-IP", trusted)
+	cases := []struct {
+		name, remoteAddr, header, expected, forwarded string
+	}{
+		{"trusted proxy", "173.245.48.1:1", "192.0.2.1", "192.0.2.1", "192.0.2.1"},
+		{"trusted proxy without header", "173.245.48.1:1", "", "173.245.48.1", ""},
+		{"malformed header", "173.245.48.1:1", "not an ip", "173.245.48.1", "not an ip"},
+		{"spoofed by client", "198.51.100.1:1", "192.0.2.1", "198.51.100.1", ""},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = c.remoteAddr
+		if c.header != "" {
+			req.Header.Set("CF-Connecting-IP", c.header)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		assert.Equal(t, c.expected, clientIP, "unexpected ClientIP for %s", c.name)
+		assert.Equal(t, c.expected, realIP, "unexpected RealClientIP for %s", c.name)
+		assert.Equal(t, c.forwarded, forwarded, "unexpected header forwarded for %s", c.name)
+	}
+}
@@ -0,0 +1,42 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+)
+
+type requestIDKey struct{}
+
+// RequestID wraps next so that every request carries an ID in header, e.g. X-Request-ID, which is forwarded to the
+// backend, echoed in the response and recorded in the access log. An ID sent by the client is kept, and otherwise a
+// random UUID is generated.
+func RequestID(next http.Handler, header string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(header)
+		if id == "" {
+			id = newUUID()
+			r.Header.Set(header, id)
+		}
+		// Set just before the header is sent, so that a backend echoing the ID doesn't duplicate it
+		hw := beforeHeader(w, func(h http.Header) { h.Set(header, id) })
+		defer hw.finish()
+		next.ServeHTTP(hw, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// RequestIDFrom returns the ID RequestID gave r, or an empty string if it didn't
+func RequestIDFrom(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// newUUID returns a random (version 4) UUID
+func newUUID() string {
+	var b [16]byte
+	rand.Read(b[:]) // never fails
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
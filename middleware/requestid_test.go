@@ -0,0 +1,50 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestRequestID tests that each request gets a UUID that is forwarded, echoed and logged, while a client supplied ID is
+// kept
+func TestRequestID(t *testing.T) {
+	var forwarded string
+	var log bytes.Buffer
+	handler := RequestID(JSONAccessLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.Header.Get("X-Request-ID")
+		if r.URL.Path == "/echo" {
+			w.Header().Add("X-Request-ID", forwarded)
+			w.Write([]byte("echoed"))
+		}
+	}), &log), "X-Request-ID")
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	id := rec.Header().Get("X-Request-ID")
+	assert.Regexp(t, regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`), id, "a UUID should be generated")
+	assert.Equal(t, id, forwarded, "the generated ID should be forwarded")
+	var entry AccessLogEntry
+	assert.Nil(t, json.Unmarshal(log.Bytes(), &entry), "error should be nil")
+	assert.Equal(t, id, entry.RequestID, "the ID should be logged")
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	assert.NotEqual(t, id, rec.Header().Get("X-Request-ID"), "each request should get its own ID")
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Request-ID", "client-id")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, "client-id", forwarded, "a client supplied ID should be preserved")
+	assert.Equal(t, "client-id", rec.Header().Get("X-Request-ID"), "a client supplied ID should be echoed")
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/echo", nil))
+	assert.Len(t, rec.Header().Values("X-Request-ID"), 1, "an ID echoed by the backend should not be duplicated")
+}
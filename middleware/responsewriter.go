@@ -0,0 +1,109 @@
+package middleware
+
+import (
+	"net/http"
+)
+
+// ResponseWriter wraps an http.ResponseWriter to record the status code and number of body bytes written, so that
+// middleware can report on a response after the wrapped handler returns
+type ResponseWriter struct {
+	http.ResponseWriter
+	Status  int
+	Written int64
+}
+
+// NewResponseWriter returns a ResponseWriter wrapping w. If w is already a *ResponseWriter it is returned as is, so
+// stacking several middlewares doesn't stack several wrappers.
+func NewResponseWriter(w http.ResponseWriter) *ResponseWriter {
+	if rw, ok := w.(*ResponseWriter); ok {
+		return rw
+	}
+	return &ResponseWriter{ResponseWriter: w}
+}
+
+// WriteHeader records the final status code before passing it on. Informational 1xx responses other than 101 Switching
+// Protocols are passed on without being recorded.
+func (w *ResponseWriter) WriteHeader(status int) {
+	if w.Status == 0 && (status >= 200 || status == http.StatusSwitchingProtocols) {
+		w.Status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write records the number of bytes written, implicitly recording a 200 status if none was set
+func (w *ResponseWriter) Write(b []byte) (int, error) {
+	if w.Status == 0 {
+		w.Status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.Written += int64(n)
+	return n, err
+}
+
+// Flush sends any buffered data to the client, if the underlying writer supports it
+func (w *ResponseWriter) Flush() {
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// StatusCode returns the recorded status code, defaulting to 200 if the handler never wrote anything
+func (w *ResponseWriter) StatusCode() int {
+	if w.Status == 0 {
+		return http.StatusOK
+	}
+	return w.Status
+}
+
+// Unwrap returns the underlying http.ResponseWriter so that http.ResponseController can reach optional interfaces
+// like http.Flusher and http.Hijacker
+func (w *ResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// headerWriter calls before with the response header just before it is written, so that middleware can override
+// headers set by the handler it wraps. finish must be called once the handler returns, in case it wrote nothing.
+type headerWriter struct {
+	http.ResponseWriter
+	before      func(http.Header)
+	wroteHeader bool
+}
+
+func beforeHeader(w http.ResponseWriter, before func(http.Header)) *headerWriter {
+	return &headerWriter{ResponseWriter: w, before: before}
+}
+
+func (w *headerWriter) WriteHeader(code int) {
+	if !w.wroteHeader && (code >= 200 || code == http.StatusSwitchingProtocols) {
+		w.wroteHeader = true
+		w.before(w.Header())
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *headerWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush sends the header, if it hasn't been yet, and anything written so far
+func (w *headerWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// finish calls before if the handler returned without writing the header, which the server then writes
+func (w *headerWriter) finish() {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.before(w.Header())
+	}
+}
+
+// Unwrap returns the underlying http.ResponseWriter so that http.ResponseController can reach optional interfaces
+// like http.Flusher and http.Hijacker
+func (w *headerWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
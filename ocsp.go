@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/snewstv/ssl-proxy/logging"
+	"golang.org/x/crypto/ocsp"
+)
+
+// ocspRetry is how long to wait before trying again when an OCSP response can't be fetched
+const ocspRetry = time.Hour
+
+// staple fetches an OCSP response for cert and staples it, returning when it should be refreshed. If the response
+// can't be fetched cert is left as it is, to be served without a staple, and a retry is scheduled.
+func staple(cert *tls.Certificate) time.Time {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	resp, err := fetchOCSP(ctx, cert)
+	if err != nil {
+		logging.Warnf("Unable to staple OCSP response, serving the certificate without one: %v", err)
+		return time.Now().Add(ocspRetry)
+	}
+	cert.OCSPStaple = resp.Raw
+	logging.Debugf("Stapled OCSP response, status %s, next update %s", ocspStatus(resp.Status), resp.NextUpdate)
+
+	// Refresh halfway through the validity of the response, like most web servers do
+	if resp.NextUpdate.IsZero() {
+		return time.Now().Add(12 * time.Hour)
+	}
+	return resp.ThisUpdate.Add(resp.NextUpdate.Sub(resp.ThisUpdate) / 2)
+}
+
+// fetchOCSP requests the status of the leaf of cert from the OCSP responder named in it. The issuer must be the
+// second certificate in the chain.
+func fetchOCSP(ctx context.Context, cert *tls.Certificate) (*ocsp.Response, error) {
+	if len(cert.Certificate) < 2 {
+		return nil, errors.New("the cert file doesn't include the issuer certificate")
+	}
+	leaf := cert.Leaf
+	if leaf == nil {
+		var err error
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, err
+		}
+	}
+	if len(leaf.OCSPServer) == 0 {
+		return nil, errors.New("the certificate doesn't name an OCSP responder")
+	}
+	issuer, err := x509.ParseCertificate(cert.Certificate[1])
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, leaf.OCSPServer[0], bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/ocsp-request")
+	req.Header.Set("Accept", "application/ocsp-response")
+	httpResp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OCSP responder %s answered %s", leaf.OCSPServer[0], httpResp.Status)
+	}
+	raw, err := io.ReadAll(io.LimitReader(httpResp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := ocsp.ParseResponseForCert(raw, leaf, issuer)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Status != ocsp.Good {
+		return nil, fmt.Errorf("OCSP responder %s reports the certificate as %s", leaf.OCSPServer[0], ocspStatus(resp.Status))
+	}
+	return resp, nil
+}
+
+func ocspStatus(status int) string {
+	switch status {
+	case ocsp.Revoked:
+		return "revoked"
+	case ocsp.Unknown:
+		return "unknown"
+	}
+	return fmt.Sprintf("status %d", status)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/snewstv/ssl-proxy/internal/testcert"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ocsp"
+)
+
+// ocspChain returns a leaf cert, signed by a new CA, that names responderURL as its OCSP responder
+func ocspChain(t *testing.T, responderURL string) (cert tls.Certificate, issuer *x509.Certificate, issuerKey *ecdsa.PrivateKey) {
+	return testcert.Chain(t, &x509.Certificate{
+		DNSNames:   []string{"localhost"},
+		OCSPServer: []string{responderURL},
+	})
+}
+
+// TestStaple tests that good OCSP responses are stapled and refreshed halfway to their next update, while revoked or
+// unreachable ones aren't
+func TestStaple(t *testing.T) {
+	var issuer *x509.Certificate
+	var issuerKey *ecdsa.PrivateKey
+	status := ocsp.Good
+	thisUpdate := time.Now().Truncate(time.Second)
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		req, err := ocsp.ParseRequest(body)
+		assert.Nil(t, err, "the responder should get a valid OCSP request")
+		resp, err := ocsp.CreateResponse(issuer, issuer, ocsp.Response{
+			Status:       status,
+			SerialNumber: req.SerialNumber,
+			ThisUpdate:   thisUpdate,
+			NextUpdate:   thisUpdate.Add(4 * 24 * time.Hour),
+		}, issuerKey)
+		assert.Nil(t, err, "error should be nil")
+		w.Write(resp)
+	}))
+	defer responder.Close()
+
+	cert, issuer, issuerKey := ocspChain(t, responder.URL)
+	next := staple(&cert)
+	assert.NotEmpty(t, cert.OCSPStaple, "a good response should be stapled")
+	assert.True(t, thisUpdate.Add(2*24*time.Hour).Equal(next), "the staple should be refreshed halfway to its next update")
+
+	status = ocsp.Revoked
+	var revoked tls.Certificate
+	revoked, issuer, issuerKey = ocspChain(t, responder.URL)
+	staple(&revoked)
+	assert.Empty(t, revoked.OCSPStaple, "a revoked response should not be stapled")
+
+	unreachable, _, _ := ocspChain(t, "http://127.0.0.1:1")
+	next = staple(&unreachable)
+	assert.Empty(t, unreachable.OCSPStaple, "the cert should be served without a staple if the responder is unreachable")
+	assert.WithinDuration(t, time.Now().Add(ocspRetry), next, time.Minute, "an unreachable responder should be retried later")
+}
+
+// TestCertReloader_OCSP tests that loading a cert doesn't wait for its OCSP response, which is stapled to the served
+// cert once it arrives
+func TestCertReloader_OCSP(t *testing.T) {
+	var issuer *x509.Certificate
+	var issuerKey *ecdsa.PrivateKey
+	release := make(chan struct{})
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		body, _ := io.ReadAll(r.Body)
+		req, err := ocsp.ParseRequest(body)
+		assert.Nil(t, err, "the responder should get a valid OCSP request")
+		resp, err := ocsp.CreateResponse(issuer, issuer, ocsp.Response{
+			Status:       ocsp.Good,
+			SerialNumber: req.SerialNumber,
+			ThisUpdate:   time.Now(),
+			NextUpdate:   time.Now().Add(24 * time.Hour),
+		}, issuerKey)
+		assert.Nil(t, err, "error should be nil")
+		w.Write(resp)
+	}))
+	defer responder.Close()
+	defer close(release)
+
+	cert, issuer, issuerKey := ocspChain(t, responder.URL)
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	var chain []byte
+	for _, der := range cert.Certificate {
+		chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	assert.Nil(t, err, "error should be nil")
+	assert.Nil(t, os.WriteFile(certFile, chain, 0644), "error should be nil")
+	assert.Nil(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0600), "error should be nil")
+
+	c, err := newCertReloader(certFile, keyFile, true)
+	if !assert.Nil(t, err, "error should be nil") {
+		return
+	}
+	served, _ := c.GetCertificate(nil)
+	assert.Empty(t, served.OCSPStaple, "the cert should be served before the responder answers")
+
+	release <- struct{}{}
+	assert.Eventually(t, func() bool {
+		served, _ := c.GetCertificate(nil)
+		return len(served.OCSPStaple) > 0
+	}, 5*time.Second, 10*time.Millisecond, "the response should be stapled once it arrives")
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestPprofListenAddr tests that pprof listens on localhost unless the address names a host, and that its profiles
+// are served
+func TestPprofListenAddr(t *testing.T) {
+	for addr, want := range map[string]string{
+		":6060":          "localhost:6060",
+		"localhost:6060": "localhost:6060",
+		"0.0.0.0:6060":   "0.0.0.0:6060",
+		"[::]:6060":      "[::]:6060",
+		"[::1]:6060":     "[::1]:6060",
+		"10.0.0.1:6060":  "10.0.0.1:6060",
+		"6060":           "6060",
+	} {
+		assert.Equal(t, want, pprofListenAddr(addr), "unexpected listen address for %q", addr)
+	}
+
+	rec := httptest.NewRecorder()
+	pprofHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/debug/pprof/", nil))
+	assert.Equal(t, http.StatusOK, rec.Code, "the pprof index should be served")
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"net/http"
+	"reflect"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"github.com/snewstv/ssl-proxy/config"
+	"github.com/snewstv/ssl-proxy/logging"
+	"github.com/snewstv/ssl-proxy/middleware"
+	"github.com/snewstv/ssl-proxy/reverseproxy"
+)
+
+// router serves every proxied request with the routes built from -to and the config file, which can be rebuilt from
+// the file while the proxy keeps running
+type router struct {
+	file    string
+	opts    reverseproxy.Options
+	mu      sync.Mutex // serializes reloads
+	current atomic.Pointer[routes]
+}
+
+// routes is a handler built by buildRoutes along with the proxies behind it
+type routes struct {
+	handler http.Handler
+	proxies []*reverseproxy.Proxy
+}
+
+// newRouter returns a router serving handler, which was built from the config file at file, if any, and opts
+func newRouter(file string, opts reverseproxy.Options, handler http.Handler, proxies []*reverseproxy.Proxy) *router {
+	rt := &router{file: file, opts: opts}
+	rt.current.Store(&routes{handler: handler, proxies: proxies})
+	return rt
+}
+
+func (rt *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rt.current.Load().handler.ServeHTTP(w, r)
+}
+
+// Proxies returns the proxies currently serving requests
+func (rt *router) Proxies() []*reverseproxy.Proxy {
+	return rt.current.Load().proxies
+}
+
+// reload re-reads the config file and switches to the routes, backends and header rules it now gives. Flags given on
+// the command line still take precedence, and changes to any other flag only apply on restart, though their values
+// must still be valid. If the file is invalid the current routes are kept and the error is returned. Backends that
+// remain keep their drain, health and circuit breaker state, and requests already being proxied complete on the old
+// routes.
+func (rt *router) reload() error {
+	if rt.file == "" {
+		return errors.New("no -config file to reload")
+	}
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	cfg, err := config.Load(rt.file)
+	if err != nil {
+		return err
+	}
+	// Apply the file to fresh copies of the flags it may change, starting from their command line values or defaults
+	explicit := config.Explicit(flag.CommandLine)
+	fs := flag.NewFlagSet("reload", flag.ContinueOnError)
+	backends := flag.Lookup("to").DefValue
+	if explicit["to"] {
+		backends = *to
+	}
+	fs.StringVar(&backends, "to", backends, "")
+	var setReq, rmReq, setResp, rmResp []string
+	for name, v := range map[string]struct{ value, current *[]string }{
+		"set-request-header":     {&setReq, setReqHeaders},
+		"remove-request-header":  {&rmReq, rmReqHeaders},
+		"set-response-header":    {&setResp, setRespHeaders},
+		"remove-response-header": {&rmResp, rmRespHeaders},
+	} {
+		if explicit[name] {
+			*v.value = slices.Clone(*v.current)
+		}
+		fs.Var((*stringsValue)(v.value), name, "")
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		if fs.Lookup(f.Name) == nil {
+			fs.Var(discardedValue(f.Value), f.Name, "")
+		}
+	})
+	if err := cfg.Apply(fs, explicit, "config"); err != nil {
+		return err
+	}
+
+	opts := rt.opts
+	if opts.HeaderRules.SetRequest, err = parseHeaders(setReq); err != nil {
+		return errors.New("invalid set-request-header: " + err.Error())
+	}
+	if opts.HeaderRules.SetResponse, err = parseHeaders(setResp); err != nil {
+		return errors.New("invalid set-response-header: " + err.Error())
+	}
+	opts.HeaderRules.RemoveRequest = append(rmReq, *stripHeaders...)
+	opts.HeaderRules.RemoveResponse = rmResp
+	handler, proxies, err := buildRoutes(backends, cfg, opts, *strictToURL)
+	if err != nil {
+		return err
+	}
+
+	kept := make(map[string]*reverseproxy.Backend)
+	for _, p := range rt.Proxies() {
+		for _, b := range p.Backends() {
+			kept[b.URL.String()] = b
+		}
+	}
+	for _, p := range proxies {
+		for _, b := range p.Backends() {
+			if old, ok := kept[b.URL.String()]; ok {
+				b.Inherit(old)
+			}
+		}
+	}
+
+	old := rt.current.Swap(&routes{handler: handler, proxies: proxies})
+	for _, p := range old.proxies {
+		p.Close()
+	}
+	logging.Infof("Reloaded config file %s, proxying to %s", rt.file, backends)
+	return nil
+}
+
+// discardedValue returns a copy of v for the flags that a reload leaves as they are, so that their values in the file
+// are still parsed and rejected if invalid, but are discarded rather than changing the flags
+func discardedValue(v flag.Value) flag.Value {
+	if acl, ok := v.(aclValue); ok {
+		// Copies of an aclValue share its rules
+		return aclValue{rules: new([]middleware.ACLRule), allow: acl.allow}
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return ignoredValue{}
+	}
+	c := reflect.New(rv.Type().Elem())
+	c.Elem().Set(rv.Elem())
+	return c.Interface().(flag.Value)
+}
+
+// ignoredValue is a flag.Value accepting and discarding any value, for flags whose values can't be copied
+type ignoredValue struct{}
+
+func (ignoredValue) Set(string) error { return nil }
+func (ignoredValue) String() string   { return "" }
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/snewstv/ssl-proxy/reverseproxy"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestRouter_Reload tests that reloading switches to the backends and header rules of the new config file, and keeps
+// the current ones if it is invalid
+func TestRouter_Reload(t *testing.T) {
+	var backends []*httptest.Server
+	for _, name := range []string{"old", "new"} {
+		name := name
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, name)
+		}))
+		defer backend.Close()
+		backends = append(backends, backend)
+	}
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	handler, proxies, err := buildRoutes(backends[0].URL, nil, reverseproxy.Options{}, false)
+	if !assert.Nil(t, err, "error should be nil") {
+		return
+	}
+	rt := newRouter(file, reverseproxy.Options{}, handler, proxies)
+	admin := adminHandler(rt, func() *x509.Certificate { return nil }, nil, "")
+	get := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		rt.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		return rec
+	}
+	reload := func() (int, map[string]interface{}) {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/reload", nil)
+		req.RemoteAddr = "127.0.0.1:1234"
+		admin.ServeHTTP(rec, req)
+		var body map[string]interface{}
+		assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &body), "the reload endpoint should answer JSON")
+		return rec.Code, body
+	}
+	assert.Equal(t, "old", get().Body.String(), "requests should go to the initial backend")
+
+	config := fmt.Sprintf("to: %s\nset-response-header: \"X-Version: 2\"\nfrom: 127.0.0.1:1\n", backends[1].URL)
+	assert.Nil(t, os.WriteFile(file, []byte(config), 0644), "error should be nil")
+	code, _ := reload()
+	assert.Equal(t, http.StatusOK, code, "a valid config file should be reloaded")
+	rec := get()
+	assert.Equal(t, "new", rec.Body.String(), "requests should go to the reloaded backend")
+	assert.Equal(t, "2", rec.Header().Get("X-Version"), "the reloaded header rules should apply")
+	assert.Len(t, rt.Proxies(), 1, "the reloaded proxies should be listed")
+	assert.Equal(t, backends[1].URL, rt.Proxies()[0].Backends()[0].URL.String(), "the reloaded proxies should be listed")
+
+	rt.Proxies()[0].Backends()[0].Drain()
+	config += "flush-interval: 100ms\n"
+	assert.Nil(t, os.WriteFile(file, []byte(config), 0644), "error should be nil")
+	code, _ = reload()
+	assert.Equal(t, http.StatusOK, code, "a valid config file should be reloaded")
+	assert.True(t, rt.Proxies()[0].Backends()[0].Draining(), "a drained backend should stay drained across a reload")
+	rt.Proxies()[0].Backends()[0].Undrain()
+
+	assert.Nil(t, os.WriteFile(file, []byte(config+"read-timeout: soon\n"), 0644), "error should be nil")
+	code, body := reload()
+	assert.Equal(t, http.StatusBadRequest, code, "an invalid value for a flag only applied on restart should be rejected")
+	assert.Contains(t, body["error"], "read-timeout", "the error should be reported")
+	assert.Nil(t, os.WriteFile(file, []byte(config+"allow-cidr: [10.0.0.0/8, 1.2.3.4/33]\n"), 0644), "error should be nil")
+	code, _ = reload()
+	assert.Equal(t, http.StatusBadRequest, code, "an invalid value for a flag only applied on restart should be rejected")
+	assert.Empty(t, *accessRules, "flags only applied on restart should not change on reload")
+
+	assert.Nil(t, os.WriteFile(file, []byte("bogus: 1\n"), 0644), "error should be nil")
+	code, body = reload()
+	assert.Equal(t, http.StatusBadRequest, code, "an invalid config file should be rejected")
+	assert.Contains(t, body["error"], "bogus", "the error should be reported")
+	assert.Equal(t, "new", get().Body.String(), "the current config should be kept when a reload fails")
+
+	assert.Nil(t, os.WriteFile(file, []byte("to: \"http://%zz\"\n"), 0644), "error should be nil")
+	code, _ = reload()
+	assert.Equal(t, http.StatusBadRequest, code, "a config file with invalid backends should be rejected")
+	assert.Equal(t, "new", get().Body.String(), "the current config should be kept when a reload fails")
+}
@@ -0,0 +1,14 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+)
+
+// reusePortControl fails, since SO_REUSEPORT isn't available on this platform
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return fmt.Errorf("-reuseport is not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,47 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestListen_ReusePort tests that a second listener can only bind the address of the first with -reuseport
+func TestListen_ReusePort(t *testing.T) {
+	defer func(v bool) { *reusePort = v }(*reusePort)
+	*reusePort = true
+	first, err := listen("127.0.0.1:0")
+	if !assert.Nil(t, err, "error should be nil") {
+		return
+	}
+	defer first.Close()
+	second, err := listen(first.Addr().String())
+	if assert.Nil(t, err, "a second listener should share the address with -reuseport") {
+		second.Close()
+	}
+
+	*reusePort = false
+	_, err = listen(first.Addr().String())
+	assert.NotNil(t, err, "the address should be in use without -reuseport")
+}
+
+// TestListenPacket_ReusePort tests that a second HTTP/3 socket can only bind the address of the first with -reuseport
+func TestListenPacket_ReusePort(t *testing.T) {
+	defer func(v bool) { *reusePort = v }(*reusePort)
+	*reusePort = true
+	first, err := listenPacket("127.0.0.1:0")
+	if !assert.Nil(t, err, "error should be nil") {
+		return
+	}
+	defer first.Close()
+	second, err := listenPacket(first.LocalAddr().String())
+	if assert.Nil(t, err, "a second socket should share the address with -reuseport") {
+		second.Close()
+	}
+
+	*reusePort = false
+	_, err = listenPacket(first.LocalAddr().String())
+	assert.NotNil(t, err, "the address should be in use without -reuseport")
+}
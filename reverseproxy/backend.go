@@ -0,0 +1,168 @@
+package reverseproxy
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/snewstv/ssl-proxy/logging"
+)
+
+// downDuration is how long a backend that refused a connection is skipped before it is tried again
+const downDuration = 10 * time.Second
+
+// Backend is a single upstream server that a Proxy forwards requests to
+type Backend struct {
+	URL    *url.URL
+	Weight int
+
+	endpoint  *url.URL // where requests are actually sent, which differs from URL for unix:// backends
+	director  func(*http.Request)
+	transport http.RoundTripper
+	current   int // smooth weighted round-robin state, guarded by the owning Proxy's mutex
+	mu        sync.Mutex
+	down      bool // set by active health checks
+	downUntil time.Time
+	breaker   *breaker
+	draining  atomic.Bool
+	stickyID  string // identifies the backend in sticky cookies without revealing its URL
+}
+
+// newBackend creates the Backend for target, sending its requests with a transport derived from base
+func newBackend(target Target, opts Options, base *http.Transport, extraDirector func(*http.Request)) *Backend {
+	b := &Backend{
+		URL:       target.URL,
+		Weight:    target.Weight,
+		endpoint:  target.URL,
+		stickyID:  fmt.Sprintf("%x", sha256.Sum256([]byte(target.URL.String())))[:16],
+		transport: newTransport(base, "", opts.BackendHTTP2 && target.URL.Scheme == "http"),
+	}
+
+	if target.URL.Scheme == "unix" {
+		host := opts.UnixSocketHost
+		if host == "" {
+			host = "localhost"
+		}
+		b.endpoint = &url.URL{Scheme: "http", Host: host}
+		b.transport = newTransport(base, target.URL.Path, opts.BackendHTTP2)
+
+		decorate := extraDirector
+		extraDirector = func(req *http.Request) {
+			if decorate != nil {
+				decorate(req)
+			}
+			req.Host = host
+		}
+	}
+
+	if opts.UpstreamHost != "" || opts.BackendHost {
+		host := opts.UpstreamHost
+		if host == "" {
+			host = b.endpoint.Host
+		}
+		decorate := extraDirector
+		extraDirector = func(req *http.Request) {
+			if decorate != nil {
+				decorate(req)
+			}
+			req.Host = host
+		}
+	}
+
+	if viaForwardProxy(base, target.URL) {
+		// A forward proxy fetches whatever host the request line names, which is taken from the Host header
+		decorate := extraDirector
+		extraDirector = func(req *http.Request) {
+			if decorate != nil {
+				decorate(req)
+			}
+			req.Host = ""
+		}
+	}
+
+	b.director = newDirector(b.endpoint, extraDirector)
+	b.breaker = newBreaker(opts.BreakerThreshold, opts.BreakerCooldown, func(state BreakerState) {
+		logging.Warnf("Circuit breaker for backend %s is %s", b.URL, state)
+		if opts.Observer != nil {
+			opts.Observer.BreakerStateChanged(b.URL, state)
+		}
+	})
+	if b.breaker != nil && opts.Observer != nil {
+		opts.Observer.BreakerStateChanged(b.URL, BreakerClosed)
+	}
+	return b
+}
+
+// BreakerState returns the state of the backend's circuit breaker, which is always closed if it has none
+func (b *Backend) BreakerState() BreakerState {
+	return b.breaker.State()
+}
+
+// Healthy reports whether the backend should currently receive requests
+func (b *Backend) Healthy() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.down && time.Now().After(b.downUntil)
+}
+
+// Drain stops the backend receiving new requests, including from clients pinned to it by a sticky cookie, while
+// requests already in flight complete. It reports whether the backend wasn't already draining.
+func (b *Backend) Drain() bool {
+	return !b.draining.Swap(true)
+}
+
+// Undrain puts a draining backend back into rotation, reporting whether it was draining
+func (b *Backend) Undrain() bool {
+	return b.draining.Swap(false)
+}
+
+// Draining reports whether the backend has been drained
+func (b *Backend) Draining() bool {
+	return b.draining.Load()
+}
+
+// Inherit takes over the drain, health and circuit breaker state of old, typically the backend with the same URL in a
+// Proxy being replaced, so that rebuilding a Proxy doesn't put drained or failing backends back into rotation
+func (b *Backend) Inherit(old *Backend) {
+	b.draining.Store(old.draining.Load())
+	old.mu.Lock()
+	down, downUntil := old.down, old.downUntil
+	old.mu.Unlock()
+	b.mu.Lock()
+	b.down, b.downUntil = down, downUntil
+	b.mu.Unlock()
+	b.breaker.inherit(old.breaker)
+}
+
+// setUp records the result of an active health check, reporting whether the state changed
+func (b *Backend) setUp(up bool) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	changed := b.down == up
+	b.down = !up
+	if up {
+		b.downUntil = time.Time{}
+	}
+	return changed
+}
+
+// markDown takes the backend out of rotation for downDuration
+func (b *Backend) markDown() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.downUntil = time.Now().Add(downDuration)
+}
+
+// viaForwardProxy reports whether plain HTTP requests to target are sent through an HTTP proxy by base, rather than
+// tunneled through one
+func viaForwardProxy(base *http.Transport, target *url.URL) bool {
+	if base.Proxy == nil || target.Scheme != "http" {
+		return false
+	}
+	proxy, err := base.Proxy(&http.Request{URL: target})
+	return err == nil && proxy != nil && (proxy.Scheme == "http" || proxy.Scheme == "https")
+}
@@ -0,0 +1,132 @@
+package reverseproxy
+
+import (
+	"sync"
+	"time"
+)
+
+// BreakerState is the state of a backend's circuit breaker
+type BreakerState string
+
+// The states of a circuit breaker. A closed breaker lets requests through, an open one stops them, and a half-open
+// one lets a single trial request through to decide whether to close again.
+const (
+	BreakerClosed   BreakerState = "closed"
+	BreakerOpen     BreakerState = "open"
+	BreakerHalfOpen BreakerState = "half-open"
+)
+
+// outcome is how an attempt at a backend went, as far as its circuit breaker is concerned
+type outcome int
+
+const (
+	succeeded outcome = iota
+	failed
+	// abandoned attempts, e.g. because the client went away, say nothing about the backend
+	abandoned
+)
+
+// breaker is a circuit breaker that opens after threshold consecutive failures, stopping requests to its backend until
+// cooldown has passed and a trial request has succeeded. A nil breaker is always closed.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+	onChange  func(BreakerState)
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time // zero while closed
+	trial    bool      // set while the trial request of a half-open breaker is in flight
+}
+
+func newBreaker(threshold int, cooldown time.Duration, onChange func(BreakerState)) *breaker {
+	if threshold <= 0 {
+		return nil
+	}
+	return &breaker{threshold: threshold, cooldown: cooldown, onChange: onChange}
+}
+
+// ready reports whether a request may be sent to the backend now
+func (c *breaker) ready(now time.Time) bool {
+	if c == nil {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.openedAt.IsZero() || (!c.trial && now.Sub(c.openedAt) >= c.cooldown)
+}
+
+// begin records that a request the breaker was ready for is being sent, making it the trial request if the cooldown
+// is over
+func (c *breaker) begin(now time.Time) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.openedAt.IsZero() && !c.trial && now.Sub(c.openedAt) >= c.cooldown {
+		c.trial = true
+		c.onChange(BreakerHalfOpen)
+	}
+}
+
+// done records the outcome of a request started with begin
+func (c *breaker) done(o outcome, now time.Time) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	trial := c.trial
+	c.trial = false
+	switch o {
+	case succeeded:
+		c.failures = 0
+		if !c.openedAt.IsZero() {
+			c.openedAt = time.Time{}
+			c.onChange(BreakerClosed)
+		}
+	case failed:
+		c.failures++
+		if trial || (c.openedAt.IsZero() && c.failures >= c.threshold) {
+			c.openedAt = now
+			c.onChange(BreakerOpen)
+		}
+	case abandoned:
+		if trial {
+			c.onChange(BreakerOpen)
+		}
+	}
+}
+
+// inherit takes over the failures counted by old, and whether it is open, without any trial request in flight
+func (c *breaker) inherit(old *breaker) {
+	if c == nil || old == nil {
+		return
+	}
+	old.mu.Lock()
+	failures, openedAt := old.failures, old.openedAt
+	old.mu.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.failures, c.openedAt = failures, openedAt
+	if !openedAt.IsZero() {
+		c.onChange(BreakerOpen)
+	}
+}
+
+// State returns the current state of the breaker
+func (c *breaker) State() BreakerState {
+	if c == nil {
+		return BreakerClosed
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case c.openedAt.IsZero():
+		return BreakerClosed
+	case c.trial:
+		return BreakerHalfOpen
+	}
+	return BreakerOpen
+}
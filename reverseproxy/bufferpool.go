@@ -0,0 +1,36 @@
+package reverseproxy
+
+import "sync"
+
+// defaultBufferSize is the size of the buffers response bodies are copied through, the same as httputil.ReverseProxy
+// allocates for every request without a BufferPool
+const defaultBufferSize = 32 * 1024
+
+// bufferPool is an httputil.BufferPool reusing buffers of a single size across requests
+type bufferPool struct {
+	size int
+	pool sync.Pool
+}
+
+func newBufferPool(size int) *bufferPool {
+	if size <= 0 {
+		size = defaultBufferSize
+	}
+	return &bufferPool{size: size}
+}
+
+func (p *bufferPool) Get() []byte {
+	if b, ok := p.pool.Get().(*[]byte); ok {
+		return *b
+	}
+	return make([]byte, p.size)
+}
+
+func (p *bufferPool) Put(b []byte) {
+	// Only buffers of the pool's own size are kept
+	if cap(b) < p.size {
+		return
+	}
+	b = b[:p.size]
+	p.pool.Put(&b)
+}
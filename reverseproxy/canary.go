@@ -0,0 +1,59 @@
+package reverseproxy
+
+import (
+	"hash/fnv"
+	"math/rand/v2"
+	"net/http"
+)
+
+// Values of the Options.CanaryCookie cookie
+const (
+	canaryValue = "canary"
+	stableValue = "stable"
+)
+
+// toCanary reports whether r should be sent to the canary backends rather than the stable ones. Requests are only sent
+// to the canary while at least one of its backends can take them, so that a broken canary falls back to the stable
+// version rather than failing.
+func (p *Proxy) toCanary(w http.ResponseWriter, r *http.Request) bool {
+	if p.canary == nil || !p.canary.available() {
+		return false
+	}
+	if p.opts.CanaryKey != nil {
+		h := fnv.New32a()
+		h.Write([]byte(p.opts.CanaryKey(r)))
+		return float64(h.Sum32()%10000) < p.opts.CanaryPercent*100
+	}
+	if p.opts.CanaryCookie != "" {
+		if c, err := r.Cookie(p.opts.CanaryCookie); err == nil && (c.Value == canaryValue || c.Value == stableValue) {
+			return c.Value == canaryValue
+		}
+	}
+	canary := rand.Float64()*100 < p.opts.CanaryPercent
+	if p.opts.CanaryCookie != "" {
+		value := stableValue
+		if canary {
+			value = canaryValue
+		}
+		cookie := &http.Cookie{
+			Name:     p.opts.CanaryCookie,
+			Value:    value,
+			Path:     "/",
+			HttpOnly: true,
+			Secure:   true,
+			SameSite: http.SameSiteLaxMode,
+		}
+		w.Header().Add("Set-Cookie", cookie.String())
+	}
+	return canary
+}
+
+// available reports whether any backend is currently able to take requests
+func (p *Proxy) available() bool {
+	for _, b := range p.backends {
+		if b.Healthy() && !b.Draining() && b.BreakerState() != BreakerOpen {
+			return true
+		}
+	}
+	return false
+}
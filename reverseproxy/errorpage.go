@@ -0,0 +1,103 @@
+package reverseproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"strconv"
+)
+
+// ErrorFormat is the format of the error responses the proxy itself sends
+type ErrorFormat string
+
+const (
+	// ErrorHTML responds with an HTML page, the one in Options.ErrorPages if there is one
+	ErrorHTML ErrorFormat = "html"
+	// ErrorText responds with the error message as plain text
+	ErrorText ErrorFormat = "text"
+	// ErrorJSON responds with a JSON object such as {"error":{"status":502,"code":"backend_unavailable","message":"..."}},
+	// where code names the failure so that API clients can tell failures with the same status apart
+	ErrorJSON ErrorFormat = "json"
+)
+
+// Codes of the errors in ErrorJSON responses
+const (
+	codeBackendUnavailable = "backend_unavailable"
+	codeBackendTimeout     = "backend_timeout"
+	codeNoBackends         = "no_backends"
+	codeNoHealthyBackends  = "no_healthy_backends"
+	codeRequestTooLarge    = "request_too_large"
+)
+
+// jsonError is the body of an ErrorJSON response
+type jsonError struct {
+	Error struct {
+		Status  int    `json:"status"`
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// defaultErrorPage is the page served for proxy errors without a page in Options.ErrorPages. It is formatted with the
+// status code, the status text and a message explaining the error.
+const defaultErrorPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>%[1]d %[2]s</title>
+<style>
+body { margin: 0; padding: 15vh 1em; font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Helvetica, Arial, sans-serif; background: #f6f7f9; color: #333; text-align: center; }
+h1 { margin: 0 0 .3em; font-size: 4em; font-weight: 300; color: #999; }
+p { margin: 0; font-size: 1.2em; }
+</style>
+</head>
+<body>
+<h1>%[1]d</h1>
+<p>%[3]s</p>
+</body>
+</html>
+`
+
+// ErrorPage returns the built-in error page for status, showing message if set and the status text otherwise
+func ErrorPage(status int, message string) []byte {
+	if message == "" {
+		message = http.StatusText(status)
+	}
+	return []byte(fmt.Sprintf(defaultErrorPage, status, http.StatusText(status), html.EscapeString(message)))
+}
+
+// writeError responds with status in the configured ErrorFormat, using WriteError
+func (p *Proxy) writeError(w http.ResponseWriter, status int, code, message string) {
+	WriteError(w, p.opts.ErrorFormat, p.opts.ErrorPages, status, code, message)
+}
+
+// WriteError responds with status in format, describing the error with code and with message if set or the status text
+// otherwise. HTML responses use the page for status in pages if there is one, and the built-in page otherwise.
+func WriteError(w http.ResponseWriter, format ErrorFormat, pages map[int][]byte, status int, code, message string) {
+	if message == "" {
+		message = http.StatusText(status)
+	}
+	var body []byte
+	switch format {
+	case ErrorText:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		body = []byte(message + "\n")
+	case ErrorJSON:
+		var e jsonError
+		e.Error.Status, e.Error.Code, e.Error.Message = status, code, message
+		w.Header().Set("Content-Type", "application/json")
+		body, _ = json.Marshal(e)
+		body = append(body, '\n')
+	default:
+		var ok bool
+		if body, ok = pages[status]; !ok {
+			body = ErrorPage(status, message)
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(body)
+}
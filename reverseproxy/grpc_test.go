@@ -0,0 +1,136 @@
+package reverseproxy
+
+import (
+	"context"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// echoService is a gRPC service echoing strings back, without needing generated code. Unary echoes its message and
+// sets a trailer, failing with InvalidArgument for an empty message, while Stream echoes every message it receives as
+// soon as it arrives.
+var echoService = grpc.ServiceDesc{
+	ServiceName: "echo.Echo",
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{{
+		MethodName: "Unary",
+		Handler: func(_ interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+			in := new(wrapperspb.StringValue)
+			if err := dec(in); err != nil {
+				return nil, err
+			}
+			if in.Value == "" {
+				return nil, status.Error(codes.InvalidArgument, "empty message")
+			}
+			grpc.SetTrailer(ctx, metadata.Pairs("echoed", in.Value))
+			return in, nil
+		},
+	}},
+	Streams: []grpc.StreamDesc{{
+		StreamName:    "Stream",
+		ServerStreams: true,
+		ClientStreams: true,
+		Handler: func(_ interface{}, stream grpc.ServerStream) error {
+			for {
+				in := new(wrapperspb.StringValue)
+				if err := stream.RecvMsg(in); err == io.EOF {
+					return nil
+				} else if err != nil {
+					return err
+				}
+				if err := stream.SendMsg(in); err != nil {
+					return err
+				}
+			}
+		},
+	}},
+}
+
+// TestBuild_GRPC tests that unary and streaming gRPC calls work through the proxy, with trailers and status codes
+// passed back to the client, and that with GRPCStreams streams outlive the server's read timeout until they go idle
+func TestBuild_GRPC(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.Nil(t, err, "error should be nil") {
+		return
+	}
+	backend := grpc.NewServer()
+	backend.RegisterService(&echoService, nil)
+	go backend.Serve(ln)
+	defer backend.Stop()
+
+	target := []Target{{URL: &url.URL{Scheme: "http", Host: ln.Addr().String()}, Weight: 1}}
+	dial := func(opts Options) *grpc.ClientConn {
+		opts.BackendHTTP2 = true
+		front := httptest.NewUnstartedServer(Build(target, opts))
+		front.EnableHTTP2 = true
+		front.Config.ReadTimeout = 100 * time.Millisecond
+		front.StartTLS()
+		t.Cleanup(front.Close)
+		roots := x509.NewCertPool()
+		roots.AddCert(front.Certificate())
+		u, err := url.Parse(front.URL)
+		assert.Nil(t, err, "error should be nil")
+		conn, err := grpc.NewClient(u.Host, grpc.WithTransportCredentials(credentials.NewClientTLSFromCert(roots, "example.com")))
+		assert.Nil(t, err, "error should be nil")
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	conn := dial(Options{GRPCStreams: true, StreamIdleTimeout: 150 * time.Millisecond})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	out := new(wrapperspb.StringValue)
+	var trailer metadata.MD
+	err = conn.Invoke(ctx, "/echo.Echo/Unary", wrapperspb.String("hello"), out, grpc.Trailer(&trailer))
+	assert.Nil(t, err, "a unary call through the proxy should succeed")
+	assert.Equal(t, "hello", out.Value, "the message should be echoed")
+	assert.Equal(t, []string{"hello"}, trailer.Get("echoed"), "trailers should reach the client")
+
+	err = conn.Invoke(ctx, "/echo.Echo/Unary", wrapperspb.String(""), out)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), "the grpc-status of a failed call should reach the client")
+	assert.Equal(t, "empty message", status.Convert(err).Message(), "the grpc-message of a failed call should reach the client")
+
+	stream, err := conn.NewStream(ctx, &echoService.Streams[0], "/echo.Echo/Stream")
+	if assert.Nil(t, err, "error should be nil") {
+		for _, msg := range []string{"one", "two", "three", "four", "five"} {
+			assert.Nil(t, stream.SendMsg(wrapperspb.String(msg)), "error should be nil")
+			assert.Nil(t, stream.RecvMsg(out), "each message should be echoed back before the stream ends, despite the read timeout")
+			assert.Equal(t, msg, out.Value, "the message should be echoed")
+			time.Sleep(75 * time.Millisecond)
+		}
+		assert.Nil(t, stream.CloseSend(), "error should be nil")
+		assert.Equal(t, io.EOF, stream.RecvMsg(out), "the stream should end cleanly with an OK grpc-status")
+	}
+
+	stream, err = conn.NewStream(ctx, &echoService.Streams[0], "/echo.Echo/Stream")
+	if assert.Nil(t, err, "error should be nil") {
+		assert.Nil(t, stream.SendMsg(wrapperspb.String("one")), "error should be nil")
+		assert.Nil(t, stream.RecvMsg(out), "error should be nil")
+		start := time.Now()
+		assert.NotNil(t, stream.RecvMsg(out), "an idle stream should be closed")
+		assert.Less(t, time.Since(start), time.Second, "an idle stream should be closed after StreamIdleTimeout")
+	}
+
+	// Without GRPCStreams, gRPC calls are ordinary requests
+	stream, err = dial(Options{}).NewStream(ctx, &echoService.Streams[0], "/echo.Echo/Stream")
+	if assert.Nil(t, err, "error should be nil") {
+		assert.Nil(t, stream.SendMsg(wrapperspb.String("one")), "error should be nil")
+		assert.Nil(t, stream.RecvMsg(out), "error should be nil")
+		time.Sleep(150 * time.Millisecond)
+		stream.SendMsg(wrapperspb.String("two"))
+		assert.NotNil(t, stream.RecvMsg(out), "the stream should be cut off by the read timeout")
+	}
+}
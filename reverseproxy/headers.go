@@ -0,0 +1,111 @@
+package reverseproxy
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// forwardedHeaders returns a director that sets the X-Forwarded-* headers describing the original request. The
+// X-Forwarded-For chain and X-Forwarded-Host sent by the client are only kept if the client is one of the trusted
+// proxies; otherwise they are reset, so that clients can't spoof them. Either way httputil.ReverseProxy then appends
+// the client's IP to X-Forwarded-For. If maxHops is set, the chain is kept to that many addresses with the client's.
+func forwardedHeaders(trusted []*net.IPNet, maxHops int) func(*http.Request) {
+	return func(req *http.Request) {
+		if !isTrusted(req.RemoteAddr, trusted) {
+			req.Header.Del("X-Forwarded-For")
+			req.Header.Del("X-Forwarded-Host")
+		} else if maxHops > 0 {
+			if chain := limitForwardedFor(req.Header.Values("X-Forwarded-For"), trusted, maxHops-1); len(chain) > 0 {
+				req.Header.Set("X-Forwarded-For", strings.Join(chain, ", "))
+			} else {
+				req.Header.Del("X-Forwarded-For")
+			}
+		}
+		if req.Header.Get("X-Forwarded-Host") == "" {
+			req.Header.Set("X-Forwarded-Host", req.Host)
+		}
+		req.Header.Set(http.CanonicalHeaderKey("X-Forwarded-Proto"), "https")
+		req.Header.Set(http.CanonicalHeaderKey("X-Forwarded-Port"), forwardedPort(req))
+	}
+}
+
+// forwardedPort returns the port the client connected to, that of the listener the request came in on, or 443 if
+// that isn't known. Behind PROXY protocol, that is the port the client connected to on the load balancer.
+func forwardedPort(req *http.Request) string {
+	if addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		if _, port, err := net.SplitHostPort(addr.String()); err == nil {
+			return port
+		}
+	}
+	return "443"
+}
+
+// limitForwardedFor returns the addresses of the X-Forwarded-For chain in values worth keeping, at most limit of them.
+// Walking back from the most recent hop, those are the trusted proxies and the address they were connected to by;
+// anything before that was sent by the client and may be made up. The oldest addresses are then dropped to fit.
+func limitForwardedFor(values []string, trusted []*net.IPNet, limit int) []string {
+	var chain []string
+	for _, v := range values {
+		for _, addr := range strings.Split(v, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				chain = append(chain, addr)
+			}
+		}
+	}
+	start := len(chain) - 1
+	for start > 0 && isTrusted(chain[start], trusted) {
+		start--
+	}
+	chain = chain[max(start, 0):]
+	return chain[max(len(chain)-limit, 0):]
+}
+
+// isTrusted reports whether the IP in remoteAddr falls within any of the trusted networks
+func isTrusted(remoteAddr string, trusted []*net.IPNet) bool {
+	if len(trusted) == 0 {
+		return false
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// HeaderRules rewrite the headers of requests on their way to a backend and of responses on their way back
+type HeaderRules struct {
+	SetRequest     http.Header
+	RemoveRequest  []string
+	SetResponse    http.Header
+	RemoveResponse []string
+}
+
+// modifyRequest applies the request rules, removing headers before setting them
+func (h HeaderRules) modifyRequest(req *http.Request) {
+	apply(req.Header, h.RemoveRequest, h.SetRequest)
+}
+
+// modifyResponse applies the response rules, for use as ReverseProxy.ModifyResponse
+func (h HeaderRules) modifyResponse(resp *http.Response) error {
+	apply(resp.Header, h.RemoveResponse, h.SetResponse)
+	return nil
+}
+
+func apply(header http.Header, remove []string, set http.Header) {
+	for _, name := range remove {
+		header.Del(name)
+	}
+	for name, values := range set {
+		header[http.CanonicalHeaderKey(name)] = append([]string(nil), values...)
+	}
+}
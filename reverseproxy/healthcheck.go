@@ -0,0 +1,65 @@
+package reverseproxy
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/snewstv/ssl-proxy/logging"
+)
+
+// activeHealthChecks reports whether backends are periodically probed rather than only marked down on failure
+func (p *Proxy) activeHealthChecks() bool {
+	return p.opts.HealthCheckPath != "" && p.opts.HealthCheckInterval > 0
+}
+
+// startHealthChecks launches one goroutine per backend that probes it every HealthCheckInterval until Close is called
+func (p *Proxy) startHealthChecks() {
+	for _, b := range p.backends {
+		client := &http.Client{
+			Transport: b.transport,
+			Timeout:   p.opts.HealthCheckInterval,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+		go p.healthCheckLoop(client, b)
+	}
+}
+
+func (p *Proxy) healthCheckLoop(client *http.Client, b *Backend) {
+	ticker := time.NewTicker(p.opts.HealthCheckInterval)
+	defer ticker.Stop()
+	for {
+		p.checkHealth(client, b)
+		select {
+		case <-ticker.C:
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// checkHealth issues a single GET to the backend's health check path and marks it up or down based on whether the
+// response has a 2xx status
+func (p *Proxy) checkHealth(client *http.Client, b *Backend) {
+	u := *b.endpoint
+	u.Path = singleJoiningSlash(u.Path, p.opts.HealthCheckPath)
+	u.RawPath = ""
+
+	up := false
+	resp, err := client.Get(u.String())
+	if err == nil {
+		resp.Body.Close()
+		up = resp.StatusCode >= 200 && resp.StatusCode < 300
+	}
+
+	if b.setUp(up) {
+		if up {
+			logging.Infof("Backend %s is healthy", b.URL)
+		} else if err != nil {
+			logging.Warnf("Backend %s failed health check: %v", b.URL, err)
+		} else {
+			logging.Warnf("Backend %s failed health check: %s", b.URL, resp.Status)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+//go:build linux
+
+package reverseproxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+// TestBuild_BackendKeepAlive tests that connections to backends get TCP keep-alive probes at the configured period, or
+// none if it is negative
+func TestBuild_BackendKeepAlive(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	u, err := url.Parse(backend.URL)
+	assert.Nil(t, err, "error should be nil")
+
+	for _, period := range []time.Duration{7 * time.Second, -1} {
+		proxy := Build([]Target{{URL: u, Weight: 1}}, Options{BackendKeepAlive: period})
+		var conn net.Conn
+		trace := &httptrace.ClientTrace{GotConn: func(info httptrace.GotConnInfo) { conn = info.Conn }}
+		req := httptest.NewRequest("GET", "/", nil)
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+		proxy.ServeHTTP(httptest.NewRecorder(), req)
+		if !assert.IsType(t, &net.TCPConn{}, conn, "the backend connection should be traced") {
+			return
+		}
+		raw, err := conn.(*net.TCPConn).SyscallConn()
+		assert.Nil(t, err, "error should be nil")
+		var enabled, idle, interval int
+		raw.Control(func(fd uintptr) {
+			enabled, _ = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_KEEPALIVE)
+			idle, _ = unix.GetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_KEEPIDLE)
+			interval, _ = unix.GetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_KEEPINTVL)
+		})
+		if period > 0 {
+			assert.Equal(t, 1, enabled, "keep-alive probes should be enabled")
+			assert.Equal(t, 7, idle, "probes should start once the connection has been idle for the period")
+			assert.Equal(t, 7, interval, "probes should be repeated at the period")
+		} else {
+			assert.Equal(t, 0, enabled, "keep-alive probes should be disabled")
+		}
+		proxy.Close()
+	}
+}
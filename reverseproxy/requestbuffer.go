@@ -0,0 +1,26 @@
+package reverseproxy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+)
+
+// bufferBody reads the body of r, which has a known Content-Length, into memory before it is proxied, so that a backend
+// receives it in one go rather than at the pace of a slow client, holding a connection meanwhile. Bodies without a
+// Content-Length aren't buffered since the client may be streaming, waiting on the response to what it has sent so far.
+func bufferBody(r *http.Request) {
+	buf := bytes.NewBuffer(make([]byte, 0, r.ContentLength))
+	if _, err := buf.ReadFrom(r.Body); err != nil {
+		// The error is read again where the buffer ends, and reported as if the body had been streamed
+		r.Body = bodyReader{io.MultiReader(buf, r.Body), r.Body}
+		return
+	}
+	r.Body = bodyReader{buf, r.Body}
+}
+
+// bodyReader reads a request body from Reader, closing the original body on Close
+type bodyReader struct {
+	io.Reader
+	io.Closer
+}
@@ -1,22 +1,612 @@
 package reverseproxy
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"slices"
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/snewstv/ssl-proxy/logging"
+	"golang.org/x/net/http/httpproxy"
 )
 
-// Build initializes and returns a new ReverseProxy instance suitable for SSL proxying
-func Build(toURL *url.URL) *httputil.ReverseProxy {
-	localProxy := &httputil.ReverseProxy{}
+// Target is a backend URL along with its relative weight for load balancing
+type Target struct {
+	URL    *url.URL
+	Weight int
+}
+
+// Options configures the behavior of a Proxy beyond its set of targets
+type Options struct {
+	// HealthCheckPath, if set, is requested from every backend each HealthCheckInterval, and only backends answering
+	// with a 2xx status are sent traffic
+	HealthCheckPath     string
+	HealthCheckInterval time.Duration
+
+	// Observer, if set, is notified of every request sent to a backend
+	Observer Observer
+
+	// UnixSocketHost is the Host header sent to unix:// backends, which have no host name of their own. It defaults
+	// to localhost.
+	UnixSocketHost string
+
+	// Requests are sent to backends with the Host header the client sent, unless BackendHost is set to send each
+	// backend's own host from its URL instead, or UpstreamHost to send that fixed value, e.g. for backends doing name-
+	// based virtual hosting. Either way the client's Host is kept in X-Forwarded-Host. For unix:// backends
+	// UpstreamHost takes precedence over UnixSocketHost. Neither BackendHost nor UpstreamHost applies to http://
+	// backends reached through an HTTP UpstreamProxy, which fetches whichever host the Host header names.
+	BackendHost  bool
+	UpstreamHost string
+
+	// TrustedProxies are the networks whose incoming X-Forwarded-For and X-Forwarded-Host headers are trusted and
+	// extended. Those headers are reset for requests from any other client.
+	TrustedProxies []*net.IPNet
+
+	// MaxForwardedFor, if set, caps the number of addresses in the X-Forwarded-For chain sent to backends, including
+	// the client's own, so that clients can't bloat it. The chain from a trusted proxy is first trimmed to the addresses
+	// of trusted proxies and the one before them, as anything further back may be made up, then the oldest addresses
+	// are dropped to fit.
+	MaxForwardedFor int
+
+	// BackendHTTP2 sends requests to plaintext http:// and unix:// backends using cleartext HTTP/2 (h2c) instead of
+	// HTTP/1.1. https:// backends negotiate HTTP/2 via ALPN regardless.
+	BackendHTTP2 bool
+
+	// HeaderRules add and remove headers on requests sent to backends and on the responses they send back. Hop-by-hop
+	// headers (RFC 7230 section 6.1), and any the client lists in Connection, are always removed by
+	// httputil.ReverseProxy, except for the Connection and Upgrade headers of protocol upgrades and TE: trailers.
+	HeaderRules HeaderRules
+
+	// StripPrefix is removed from the start of request paths before they are forwarded, e.g. so that /api/users
+	// reaches the backend as /users. A trailing slash on the prefix is ignored.
+	StripPrefix string
+
+	// DialTimeout limits how long connecting to a backend may take, ResponseHeaderTimeout how long a backend may take
+	// to start responding once the request is sent, and IdleConnTimeout how long idle keep-alive connections to
+	// backends are kept open. Zero keeps the defaults of http.DefaultTransport. A client whose request times out gets a
+	// 504. ResponseHeaderTimeout doesn't apply to BackendHTTP2 backends.
+	DialTimeout           time.Duration
+	ResponseHeaderTimeout time.Duration
+	IdleConnTimeout       time.Duration
+
+	// BackendKeepAlive is how often TCP keep-alive probes are sent on idle connections to backends, so that pooled
+	// connections dropped by a firewall or a backend that went away are noticed before a request is sent on them, and
+	// firewalls keep them open in the first place. Zero keeps the 30s of http.DefaultTransport, negative disables them.
+	BackendKeepAlive time.Duration
+
+	// MaxIdleConns caps the idle keep-alive connections kept open to all backends together, MaxIdleConnsPerHost those
+	// kept open to each backend, and MaxConnsPerHost every connection to each backend, with further requests waiting
+	// for one to free up. Zero keeps the defaults of http.DefaultTransport: 100 idle connections, only 2 of them per
+	// backend, and no limit per backend. They don't apply to BackendHTTP2 backends, which share one connection.
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	MaxConnsPerHost     int
+
+	// ErrorPages are served instead of the built-in HTML page when the proxy itself responds with an error status,
+	// keyed by that status, e.g. 502 when no backend could be reached
+	ErrorPages map[int][]byte
+
+	// ErrorFormat is the format of the error responses the proxy itself sends, ErrorHTML if empty. ErrorPages are
+	// only used with ErrorHTML.
+	ErrorFormat ErrorFormat
+
+	// RetryCount is how many times a GET, HEAD or OPTIONS request without a body is retried when the backend fails
+	// after the connection was made, e.g. by resetting it, as long as nothing has been sent to the client yet. Each
+	// retry goes to a backend that hasn't been tried yet if there is one. Requests that couldn't connect at all are
+	// always retried against every backend, whatever their method.
+	RetryCount int
+
+	// BreakerThreshold, if set, opens a backend's circuit breaker after that many consecutive failed requests, so that
+	// it is sent no requests for BreakerCooldown. A single trial request is then let through, closing the breaker
+	// again if it succeeds. Failures are errors connecting to or reading from the backend, not error statuses.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+
+	// StickyCookie, if set, is the name of a cookie pinning each client to the backend that served its first request.
+	// Requests carrying the cookie go to that backend while it is healthy, and are otherwise balanced as usual and
+	// pinned to their new backend.
+	StickyCookie string
+
+	// UpstreamProxy, if set, is an http://, https:// or socks5:// proxy that connections to backends are made through,
+	// except for hosts excluded by the NO_PROXY environment variable, loopback addresses and unix:// backends. It
+	// doesn't apply to BackendHTTP2 backends. Without it the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables
+	// are respected as usual.
+	UpstreamProxy *url.URL
+
+	// Resolver, if set, resolves the host names of backends, and of UpstreamProxy, instead of the system resolver.
+	// Backends reached through UpstreamProxy are resolved by that proxy.
+	Resolver *net.Resolver
+
+	// BodyRewrites are string replacements made, in a single pass, in the bodies of text/html and application/json
+	// responses, e.g. to turn absolute http:// links into https:// ones. Gzipped bodies are decompressed first and
+	// compressed again afterwards; bodies in any other encoding, and bodies over 16MB, are left as they are.
+	BodyRewrites []BodyRewrite
+
+	// FlushInterval is how often response bodies are flushed to the client while they are copied from the backend,
+	// with a negative value flushing after every write. Zero flushes only once the copy buffer is full. Server-sent
+	// events and responses without a Content-Length are always flushed after every write.
+	FlushInterval time.Duration
+
+	// StreamIdleTimeout, if set, closes WebSockets and other upgraded connections, server-sent events responses and
+	// GRPCStreams calls once nothing has been sent either way for that long. These streams are exempt from the
+	// server's read and write timeouts, so without it they stay open as long as the client and backend keep them open.
+	StreamIdleTimeout time.Duration
+
+	// GRPCStreams exempts gRPC calls, HTTP/2 requests with an application/grpc Content-Type, from the server's read
+	// and write timeouts like other streams. Clients choose their Content-Type, so this lets any client hold a request
+	// open past those timeouts; StreamIdleTimeout still closes calls that go quiet.
+	GRPCStreams bool
+
+	// Upgrades, if set, tracks the client connections of WebSockets and other upgraded requests, so that they can be
+	// closed on shutdown
+	Upgrades *Upgrades
+
+	// BufferSize is the size of the buffers response bodies are copied to the client through, 32KB if zero. Buffers
+	// are reused across requests. Larger buffers copy large responses in fewer writes at the cost of memory per request
+	// in flight.
+	BufferSize int
+
+	// RequestBufferSize, if positive, is the largest Content-Length of request bodies read into memory before the
+	// request is sent to a backend, so that backends aren't kept waiting on slow uploads. Larger bodies, those without
+	// a Content-Length and gRPC calls, whose clients may wait on a response before sending more, and all bodies if it is
+	// zero, are streamed to the backend as the client sends them.
+	RequestBufferSize int64
+
+	// BackendRootCAs, if set, are the CAs trusted to verify the certificates of https:// backends instead of the
+	// system's. BackendServerName, if set, is sent as SNI and verified against their certificates instead of the host
+	// of the backend URL. BackendInsecure skips verifying them at all, which should be a last resort. BackendRootCAs and
+	// BackendInsecure also apply to an https:// UpstreamProxy, whose certificate is always verified against its own host.
+	BackendRootCAs    *x509.CertPool
+	BackendServerName string
+	BackendInsecure   bool
+
+	// Canary, if set, are backends sent CanaryPercent percent of requests, e.g. 5 for a new version being tried out,
+	// while the rest are balanced across the other backends as usual. With CanaryKey, each client is consistently
+	// assigned by a hash of the key it returns for their requests, such as their IP. With CanaryCookie, each client is
+	// assigned at random on their first request and pinned there by a cookie of that name. Otherwise each request is
+	// assigned at random. While no canary backend is able to take requests they all go to the other backends.
+	Canary        []Target
+	CanaryPercent float64
+	CanaryKey     func(*http.Request) string
+	CanaryCookie  string
+}
+
+// Observer receives notifications about the requests a Proxy sends to its backends, e.g. to record metrics
+type Observer interface {
+	BackendRequest(backend *url.URL)
+	// BreakerStateChanged is called with the initial state of each backend's circuit breaker, if they have one, and
+	// whenever it changes
+	BreakerStateChanged(backend *url.URL, state BreakerState)
+}
+
+// Proxy is an http.Handler that proxies requests to a set of backends, rotating between the healthy ones in
+// weighted round-robin order. Requests asking to switch protocols (e.g. WebSockets) are passed through with their
+// Upgrade and Connection headers intact, and once the backend answers 101 Switching Protocols the client connection is
+// hijacked and bytes are copied in both directions. Any ResponseWriter wrapping the one from the server must therefore
+// implement Unwrap so that http.ResponseController can reach the underlying http.Hijacker.
+type Proxy struct {
+	backends []*Backend
+	proxy    *httputil.ReverseProxy
+	opts     Options
+	rewriter *strings.Replacer
+	canary   *Proxy
+	mu       sync.Mutex
+	done     chan struct{}
+}
+
+// Build initializes and returns a new Proxy suitable for SSL proxying to the provided targets. Targets with a weight of
+// 0 or less are excluded entirely.
+func Build(targets []Target, opts Options) *Proxy {
+	p := &Proxy{opts: opts, done: make(chan struct{})}
+	if len(opts.BodyRewrites) > 0 {
+		var oldnew []string
+		for _, r := range opts.BodyRewrites {
+			oldnew = append(oldnew, r.Old, r.New)
+		}
+		p.rewriter = strings.NewReplacer(oldnew...)
+	}
+	forwarded := forwardedHeaders(opts.TrustedProxies, opts.MaxForwardedFor)
 	addProxyHeaders := func(req *http.Request) {
-		req.Header.Set(http.CanonicalHeaderKey("X-Forwarded-Proto"), "https")
-		req.Header.Set(http.CanonicalHeaderKey("X-Forwarded-Port"), "443") // TODO: inherit another port if needed
+		forwarded(req)
+		opts.HeaderRules.modifyRequest(req)
+	}
+	base := http.DefaultTransport.(*http.Transport).Clone()
+	if opts.DialTimeout > 0 || opts.Resolver != nil || opts.BackendKeepAlive != 0 {
+		dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Resolver: opts.Resolver}
+		if opts.DialTimeout > 0 {
+			dialer.Timeout = opts.DialTimeout
+		}
+		if opts.BackendKeepAlive > 0 {
+			// Probe after the connection has been idle for the period, and again at that period
+			dialer.KeepAliveConfig = net.KeepAliveConfig{Enable: true, Idle: opts.BackendKeepAlive, Interval: opts.BackendKeepAlive, Count: -1}
+		} else if opts.BackendKeepAlive < 0 {
+			dialer.KeepAlive = -1
+		}
+		base.DialContext = dialer.DialContext
+	}
+	base.DialContext = logDial(base.DialContext)
+	if opts.ResponseHeaderTimeout > 0 {
+		base.ResponseHeaderTimeout = opts.ResponseHeaderTimeout
+	}
+	if opts.IdleConnTimeout > 0 {
+		base.IdleConnTimeout = opts.IdleConnTimeout
+	}
+	if opts.MaxIdleConns > 0 {
+		base.MaxIdleConns = opts.MaxIdleConns
+	}
+	if opts.MaxIdleConnsPerHost > 0 {
+		base.MaxIdleConnsPerHost = opts.MaxIdleConnsPerHost
+	}
+	if opts.MaxConnsPerHost > 0 {
+		base.MaxConnsPerHost = opts.MaxConnsPerHost
+	}
+	if opts.BackendRootCAs != nil || opts.BackendServerName != "" || opts.BackendInsecure {
+		base.TLSClientConfig = &tls.Config{
+			RootCAs:            opts.BackendRootCAs,
+			ServerName:         opts.BackendServerName,
+			InsecureSkipVerify: opts.BackendInsecure,
+		}
+	}
+	if opts.UpstreamProxy != nil {
+		upstream := opts.UpstreamProxy
+		if upstream.Scheme == "https" && opts.BackendServerName != "" {
+			upstream = dialTLSProxy(base, upstream)
+		}
+		proxy := (&httpproxy.Config{
+			HTTPProxy:  upstream.String(),
+			HTTPSProxy: upstream.String(),
+			NoProxy:    httpproxy.FromEnvironment().NoProxy,
+		}).ProxyFunc()
+		base.Proxy = func(req *http.Request) (*url.URL, error) { return proxy(req.URL) }
+	}
+	for _, target := range targets {
+		if target.Weight <= 0 {
+			continue
+		}
+		p.backends = append(p.backends, newBackend(target, opts, base, addProxyHeaders))
+	}
+	p.proxy = &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			if opts.StripPrefix != "" {
+				stripPrefix(req.URL, opts.StripPrefix)
+			}
+			attemptFrom(req.Context()).backend.director(req)
+		},
+		Transport:      backendTransport{},
+		FlushInterval:  opts.FlushInterval,
+		BufferPool:     newBufferPool(opts.BufferSize),
+		ModifyResponse: p.modifyResponse,
+		ErrorHandler:   p.handleError,
+		ErrorLog:       logging.NewLogger(logging.Error),
+	}
+	if p.activeHealthChecks() {
+		p.startHealthChecks()
+	}
+	if len(opts.Canary) > 0 {
+		canaryOpts := opts
+		canaryOpts.Canary = nil
+		p.canary = Build(opts.Canary, canaryOpts)
+	}
+
+	return p
+}
+
+// Close stops any background health checks
+func (p *Proxy) Close() {
+	close(p.done)
+	if p.canary != nil {
+		p.canary.Close()
+	}
+}
+
+// Backends returns the backends this Proxy balances requests across, followed by any canary backends
+func (p *Proxy) Backends() []*Backend {
+	if p.canary != nil {
+		return append(slices.Clip(p.backends), p.canary.backends...)
+	}
+	return p.backends
+}
+
+// ServeHTTP proxies the request to the next healthy backend. Backends that refuse the connection are marked down
+// and the request is retried against the next one, so the client only sees a 502 once every backend has failed.
+// Idempotent requests are also retried up to RetryCount times if the backend fails later on. WebSockets, server-sent
+// events and, with GRPCStreams, gRPC calls are exempt from the server's read and write timeouts, so that long-lived
+// streams aren't cut off.
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if p.toCanary(w, r) {
+		logging.Debugf("Sending %s %s to the canary", r.Method, r.URL.Path)
+		p.canary.ServeHTTP(w, r)
+		return
+	}
+	sw := &streamWriter{ResponseWriter: w, idle: p.opts.StreamIdleTimeout, upgrades: p.opts.Upgrades, websocket: isWebSocket(r)}
+	if sw.idle > 0 {
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		r, sw.cancel = r.WithContext(ctx), cancel
+	}
+	defer sw.stop()
+	if p.opts.GRPCStreams && isGRPC(r) {
+		// gRPC streams can stay open far longer than the server's read and write timeouts allow for ordinary requests
+		sw.startStream()
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = activeBody{r.Body, sw}
+		}
+	}
+	w = sw
+	if r.ContentLength > 0 && r.ContentLength <= p.opts.RequestBufferSize && !isGRPC(r) {
+		bufferBody(r)
+	}
+	retryable := p.opts.RetryCount > 0 && isIdempotent(r.Method) && (r.Body == nil || r.Body == http.NoBody)
+
+	// The transport closes the request body when a dial fails; keep it open so the request can be retried
+	body := r.Body
+	if body != nil {
+		r.Body = io.NopCloser(body)
+		defer body.Close()
+	}
+
+	tried := make(map[*Backend]bool, len(p.backends))
+	var lastErr error
+	retries, retrying := 0, false
+	for {
+		b, how := p.pinned(r, tried), "pinned by sticky cookie"
+		if b == nil {
+			b, how = p.pick(tried), "picked by weighted round-robin"
+		}
+		if b == nil && retrying {
+			// Every backend has been tried, so retry one of them again
+			b, how = p.pick(nil), "retrying after every backend was tried"
+		}
+		if b == nil {
+			switch {
+			case isTimeout(lastErr):
+				p.writeError(w, http.StatusGatewayTimeout, codeBackendTimeout, "")
+			case lastErr != nil:
+				p.writeError(w, http.StatusBadGateway, codeBackendUnavailable, "")
+			case len(p.backends) == 0:
+				p.writeError(w, http.StatusBadGateway, codeNoBackends, "no backends configured")
+			default:
+				p.writeError(w, http.StatusServiceUnavailable, codeNoHealthyBackends, "no healthy backends available")
+			}
+			return
+		}
+		tried[b] = true
+		logging.Debugf("Proxying %s %s to backend %s, %s", r.Method, r.URL.Path, b.URL, how)
+		if last, ok := r.Context().Value(backendKey{}).(**url.URL); ok {
+			*last = b.URL
+		}
+
+		if p.opts.Observer != nil {
+			p.opts.Observer.BackendRequest(b.URL)
+		}
+		a := &attempt{backend: b}
+		rw := w
+		if retryable && retries < p.opts.RetryCount {
+			a.retry = &retryWriter{ResponseWriter: w}
+			rw = a.retry
+		}
+		p.serveAttempt(rw, r, a)
+		if a.err == nil {
+			return
+		}
+		logging.Warnf("http: proxy error: %v", a.err)
+		lastErr = a.err
+		retrying = a.retried
+		if retrying {
+			retries++
+		}
 	}
-	localProxy.Director = newDirector(toURL, addProxyHeaders)
+}
 
-	return localProxy
+// serveAttempt proxies r to the backend of a, recording the outcome with its circuit breaker
+func (p *Proxy) serveAttempt(w http.ResponseWriter, r *http.Request, a *attempt) {
+	// The outcome is recorded even if ReverseProxy panics to abort a response the backend broke off
+	defer func() { a.backend.breaker.done(a.outcome, time.Now()) }()
+	p.proxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), attemptKey{}, a)))
+}
+
+// pinned returns the backend that the sticky cookie of r pins it to, if it is untried and can take the request
+func (p *Proxy) pinned(r *http.Request, tried map[*Backend]bool) *Backend {
+	if p.opts.StickyCookie == "" {
+		return nil
+	}
+	c, err := r.Cookie(p.opts.StickyCookie)
+	if err != nil {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	for _, b := range p.backends {
+		if b.stickyID == c.Value && !tried[b] && !b.Draining() && b.Healthy() && b.breaker.ready(now) {
+			b.breaker.begin(now)
+			return b
+		}
+	}
+	return nil
+}
+
+// modifyResponse is the ReverseProxy ModifyResponse hook, pinning the client to the backend with a sticky cookie if
+// it isn't already and applying the response header rules
+func (p *Proxy) modifyResponse(resp *http.Response) error {
+	if p.opts.StickyCookie != "" {
+		b := attemptFrom(resp.Request.Context()).backend
+		if c, err := resp.Request.Cookie(p.opts.StickyCookie); err != nil || c.Value != b.stickyID {
+			cookie := &http.Cookie{
+				Name:     p.opts.StickyCookie,
+				Value:    b.stickyID,
+				Path:     "/",
+				HttpOnly: true,
+				Secure:   true,
+				SameSite: http.SameSiteLaxMode,
+			}
+			resp.Header.Add("Set-Cookie", cookie.String())
+		}
+	}
+	if p.rewriter != nil {
+		if err := rewriteBody(resp, p.rewriter); err != nil {
+			return err
+		}
+	}
+	return p.opts.HeaderRules.modifyResponse(resp)
+}
+
+// pick returns the next healthy backend that has not already been tried, using smooth weighted round-robin so that
+// over time each backend receives requests in proportion to its weight. Without active health checks, if every untried
+// backend is marked down the heaviest untried one is returned anyway so that a recovered backend can still be reached.
+// Backends whose circuit breaker is open and draining backends are never returned.
+func (p *Proxy) pick(tried map[*Backend]bool) *Backend {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	b := p.pickFrom(tried, true, now)
+	if b == nil && !p.activeHealthChecks() {
+		b = p.pickFrom(tried, false, now)
+	}
+	if b != nil {
+		b.breaker.begin(now)
+	}
+	return b
+}
+
+// pickFrom runs a single round of smooth weighted round-robin over the untried, undrained backends whose circuit
+// breaker is ready, considering only healthy ones if healthyOnly is set. The caller must hold p.mu.
+func (p *Proxy) pickFrom(tried map[*Backend]bool, healthyOnly bool, now time.Time) *Backend {
+	var best *Backend
+	total := 0
+	for _, b := range p.backends {
+		if tried[b] || b.Draining() || !b.breaker.ready(now) || (healthyOnly && !b.Healthy()) {
+			continue
+		}
+		b.current += b.Weight
+		total += b.Weight
+		if best == nil || b.current > best.current {
+			best = b
+		}
+	}
+	if best != nil {
+		best.current -= total
+	}
+	return best
+}
+
+// handleError is the ReverseProxy ErrorHandler. Connection failures mark the backend down and record the error on the
+// attempt without writing a response, so that ServeHTTP can retry against another backend, and so do other failures
+// of attempts that may be retried; anything else is reported to the client as a 502, a 504 if the backend timed out,
+// or a 413 if the request body was over the size limit.
+func (p *Proxy) handleError(w http.ResponseWriter, r *http.Request, err error) {
+	a := attemptFrom(r.Context())
+	a.outcome = failed
+	if isDialError(err) {
+		a.backend.markDown()
+		a.err = err
+		return
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		a.outcome = abandoned
+		p.writeError(w, http.StatusRequestEntityTooLarge, codeRequestTooLarge, "")
+		return
+	}
+	if r.Context().Err() != nil {
+		a.outcome = abandoned
+	}
+	if a.retry != nil && !a.retry.wrote && r.Context().Err() == nil {
+		a.err = err
+		a.retried = true
+		return
+	}
+	logging.Errorf("http: proxy error: %v", err)
+	if isTimeout(err) {
+		p.writeError(w, http.StatusGatewayTimeout, codeBackendTimeout, "")
+		return
+	}
+	p.writeError(w, http.StatusBadGateway, codeBackendUnavailable, "")
+}
+
+// attempt tracks a single try at proxying a request to a backend
+type attempt struct {
+	backend *Backend
+	err     error
+	outcome outcome
+
+	// retry is set if the request may be retried after failing once connected, and retried once it is to be
+	retry   *retryWriter
+	retried bool
+}
+
+// retryWriter records whether anything has been sent to the client, after which a request can't be retried
+type retryWriter struct {
+	http.ResponseWriter
+	wrote bool
+}
+
+func (w *retryWriter) WriteHeader(code int) {
+	w.wrote = true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *retryWriter) Write(b []byte) (int, error) {
+	w.wrote = true
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap returns the wrapped http.ResponseWriter, for http.ResponseController
+func (w *retryWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// isIdempotent reports whether requests with method may safely be sent again
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return false
+}
+
+type attemptKey struct{}
+
+type backendKey struct{}
+
+// TrackBackend returns a copy of r whose context records which backend a Proxy sends it to. Once the Proxy has served
+// the request, backend returns the URL of the last backend tried, or nil if none was.
+func TrackBackend(r *http.Request) (_ *http.Request, backend func() *url.URL) {
+	var last *url.URL
+	return r.WithContext(context.WithValue(r.Context(), backendKey{}, &last)), func() *url.URL { return last }
+}
+
+func attemptFrom(ctx context.Context) *attempt {
+	return ctx.Value(attemptKey{}).(*attempt)
+}
+
+// isGRPC reports whether r is a gRPC call
+func isGRPC(r *http.Request) bool {
+	return r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// isDialError reports whether err was caused by failing to connect to the backend, in which case nothing was sent
+// and the request can safely be sent elsewhere
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// isTimeout reports whether err was caused by a backend taking too long to connect or respond
+func isTimeout(err error) bool {
+	var timeout interface{ Timeout() bool }
+	return errors.As(err, &timeout) && timeout.Timeout()
 }
 
 // newDirector creates a base director that should be exactly what http.NewSingleHostReverseProxy() creates, but allows
@@ -28,14 +618,10 @@ func newDirector(target *url.URL, extraDirector func(*http.Request)) func(*http.
 		req.URL.Host = target.Host
 		req.URL.Path = singleJoiningSlash(target.Path, req.URL.Path)
 		if targetQuery == "" || req.URL.RawQuery == "" {
-			req.URL.RawQuery = targetQuery + req.URL.RawQuery 
+			req.URL.RawQuery = targetQuery + req.URL.RawQuery
 		} else {
 			req.URL.RawQuery = targetQuery + "&" + req.URL.RawQuery
 		}
-		if _, ok := req.Header["User-Agent"]; !ok {
-			// explicitly disable User-Agent so it's not set to default value
-			req.Header.Set("User-Agent", "")
-		}
 
 		if extraDirector != nil {
 			extraDirector(req)
@@ -43,6 +629,23 @@ func newDirector(target *url.URL, extraDirector func(*http.Request)) func(*http.
 	}
 }
 
+// stripPrefix removes prefix (ignoring any trailing slash) from the path of u, leaving at least "/". The query string
+// and any trailing slash on the path are preserved.
+func stripPrefix(u *url.URL, prefix string) {
+	prefix = strings.TrimSuffix(prefix, "/")
+	trim := func(p string) string {
+		p = strings.TrimPrefix(p, prefix)
+		if !strings.HasPrefix(p, "/") {
+			p = "/" + p
+		}
+		return p
+	}
+	u.Path = trim(u.Path)
+	if u.RawPath != "" {
+		u.RawPath = trim(u.RawPath)
+	}
+}
+
 // singleJoiningSlash is a utility function that adds a single slash to a URL where appropriate, copied from
 // the httputil package
 // TODO: add test to ensure behavior does not diverge from httputil's implementation, as per Rob Pike's proverbs
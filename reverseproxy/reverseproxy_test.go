@@ -1,24 +1,43 @@
 package reverseproxy
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/http/httputil"
 	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/snewstv/ssl-proxy/middleware"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"golang.org/x/net/websocket"
 )
 
 // TestBuild_AddHeaders tests that Build's returned ReverseProxy Director adds the proper request headers
 func TestBuild_AddHeaders(t *testing.T) {
 	u, err := url.Parse("http://127.0.0.1")
 	assert.Nil(t, err, "error should be nil")
-	proxy := Build(u)
+	proxy := Build([]Target{{URL: u, Weight: 1}}, Options{})
 	assert.NotNil(t, proxy, "Build should not return nil")
 
 	req := httptest.NewRequest("GET", "/test", nil)
-	proxy.Director(req)
+	proxy.Backends()[0].director(req)
 
 	// Check that headers were added to req
 	assert.Equal(t, req.Header.Get(http.CanonicalHeaderKey("X-Forwarded-Proto")), "https",
@@ -46,3 +65,1228 @@ func TestNewDirector(t *testing.T) {
 		"default proxy and package directors should modify the request in the same way")
 	// TODO: add more test cases
 }
+
+// TestBuild_RoundRobin tests that requests are spread evenly across all backends
+func TestBuild_RoundRobin(t *testing.T) {
+	var targets []Target
+	hits := make([]int, 3)
+	for i := range hits {
+		i := i
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits[i]++
+		}))
+		defer backend.Close()
+		u, err := url.Parse(backend.URL)
+		assert.Nil(t, err, "error should be nil")
+		targets = append(targets, Target{URL: u, Weight: 1})
+	}
+	proxy := Build(targets, Options{})
+
+	for i := 0; i < 9; i++ {
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, httptest.NewRequest("GET", "/test", nil))
+		assert.Equal(t, http.StatusOK, rec.Code, "request should be proxied")
+	}
+	assert.Equal(t, []int{3, 3, 3}, hits, "each backend should receive the same number of requests")
+}
+
+// TestBuild_SkipsRefusedBackend tests that a backend refusing connections is skipped instead of returning a 502
+func TestBuild_SkipsRefusedBackend(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer up.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	down.Close()
+
+	upURL, err := url.Parse(up.URL)
+	assert.Nil(t, err, "error should be nil")
+	downURL, err := url.Parse(down.URL)
+	assert.Nil(t, err, "error should be nil")
+	proxy := Build([]Target{{URL: downURL, Weight: 1}, {URL: upURL, Weight: 1}}, Options{})
+
+	for i := 0; i < 4; i++ {
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, httptest.NewRequest("GET", "/test", nil))
+		assert.Equal(t, http.StatusOK, rec.Code, "request should be served by the healthy backend")
+	}
+	assert.False(t, proxy.Backends()[0].Healthy(), "refusing backend should be marked down")
+}
+
+// TestBuild_RetryCount tests that idempotent requests are retried against another backend when one resets the
+// connection, and that other requests are not
+func TestBuild_RetryCount(t *testing.T) {
+	var resets atomic.Int32
+	reset := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resets.Add(1)
+		conn, _, _ := http.NewResponseController(w).Hijack()
+		conn.(*net.TCPConn).SetLinger(0)
+		conn.Close()
+	}))
+	defer reset.Close()
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer up.Close()
+	resetURL, err := url.Parse(reset.URL)
+	assert.Nil(t, err, "error should be nil")
+	upURL, err := url.Parse(up.URL)
+	assert.Nil(t, err, "error should be nil")
+	targets := []Target{{URL: resetURL, Weight: 1}, {URL: upURL, Weight: 1}}
+
+	proxy := Build(targets, Options{RetryCount: 1})
+	for i := 0; i < 4; i++ {
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		assert.Equal(t, http.StatusOK, rec.Code, "a reset GET should be retried against the other backend")
+	}
+	assert.Equal(t, int32(2), resets.Load(), "the resetting backend should be tried in turn")
+	assert.True(t, proxy.Backends()[0].Healthy(), "a backend that reset a connection should not be marked down")
+
+	failed := 0
+	for i := 0; i < 4; i++ {
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, httptest.NewRequest("POST", "/", strings.NewReader("body")))
+		if rec.Code == http.StatusBadGateway {
+			failed++
+		}
+	}
+	assert.Equal(t, 2, failed, "a reset POST should never be retried")
+
+	resets.Store(0)
+	proxy = Build(targets[:1], Options{RetryCount: 2})
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusBadGateway, rec.Code, "the client should get a 502 once the retries run out")
+	assert.Equal(t, int32(3), resets.Load(), "a lone backend should be retried RetryCount times")
+}
+
+// TestBuild_CircuitBreaker tests that a backend failing repeatedly is sent no requests while its breaker is open, and
+// that a successful trial request closes the breaker again
+func TestBuild_CircuitBreaker(t *testing.T) {
+	var hits atomic.Int32
+	var broken atomic.Bool
+	broken.Store(true)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if broken.Load() {
+			conn, _, _ := http.NewResponseController(w).Hijack()
+			conn.Close()
+		}
+	}))
+	defer backend.Close()
+	u, err := url.Parse(backend.URL)
+	assert.Nil(t, err, "error should be nil")
+	proxy := Build([]Target{{URL: u, Weight: 1}}, Options{BreakerThreshold: 2, BreakerCooldown: 100 * time.Millisecond})
+	get := func() int {
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusBadGateway, get(), "a failing backend should give a 502")
+	assert.Equal(t, BreakerClosed, proxy.Backends()[0].BreakerState(), "one failure should not open the breaker")
+	assert.Equal(t, http.StatusBadGateway, get(), "a failing backend should give a 502")
+	assert.Equal(t, BreakerOpen, proxy.Backends()[0].BreakerState(), "consecutive failures should open the breaker")
+	assert.Equal(t, http.StatusServiceUnavailable, get(), "requests should fail fast while the breaker is open")
+	assert.Equal(t, int32(2), hits.Load(), "the backend should get no requests while the breaker is open")
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, http.StatusBadGateway, get(), "a failed trial request should give a 502")
+	assert.Equal(t, BreakerOpen, proxy.Backends()[0].BreakerState(), "a failed trial request should reopen the breaker")
+	assert.Equal(t, http.StatusServiceUnavailable, get(), "requests should fail fast while the breaker is open")
+
+	broken.Store(false)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, http.StatusOK, get(), "the trial request should reach the backend")
+	assert.Equal(t, BreakerClosed, proxy.Backends()[0].BreakerState(), "a successful trial request should close the breaker")
+	assert.Equal(t, int32(4), hits.Load(), "only trial requests should reach the backend after the breaker opens")
+}
+
+// TestBackend_Inherit tests that a rebuilt backend takes over the drain, health and circuit breaker state of the one it
+// replaces
+func TestBackend_Inherit(t *testing.T) {
+	u, err := url.Parse("http://127.0.0.1:1")
+	assert.Nil(t, err, "error should be nil")
+	opts := Options{BreakerThreshold: 1, BreakerCooldown: time.Minute}
+	old := Build([]Target{{URL: u, Weight: 1}}, opts)
+	old.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	old.Backends()[0].Drain()
+	assert.Equal(t, BreakerOpen, old.Backends()[0].BreakerState(), "a refused connection should open the breaker")
+
+	rebuilt := Build([]Target{{URL: u, Weight: 1}}, opts)
+	rebuilt.Backends()[0].Inherit(old.Backends()[0])
+	assert.True(t, rebuilt.Backends()[0].Draining(), "the drain should be inherited")
+	assert.False(t, rebuilt.Backends()[0].Healthy(), "the backend should still be marked down")
+	assert.Equal(t, BreakerOpen, rebuilt.Backends()[0].BreakerState(), "the open breaker should be inherited")
+}
+
+// TestBuild_StickyCookie tests that clients with a sticky cookie keep reaching the same backend until it goes down,
+// when they are pinned to another one
+func TestBuild_StickyCookie(t *testing.T) {
+	var servers []*httptest.Server
+	var targets []Target
+	for i := 0; i < 3; i++ {
+		i := i
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, i)
+		}))
+		defer server.Close()
+		servers = append(servers, server)
+		u, err := url.Parse(server.URL)
+		assert.Nil(t, err, "error should be nil")
+		targets = append(targets, Target{URL: u, Weight: 1})
+	}
+	proxy := Build(targets, Options{StickyCookie: "backend"})
+	get := func(cookie *http.Cookie) (string, *http.Cookie) {
+		req := httptest.NewRequest("GET", "/", nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, req)
+		cookies := rec.Result().Cookies()
+		if len(cookies) == 0 {
+			return rec.Body.String(), nil
+		}
+		return rec.Body.String(), cookies[0]
+	}
+
+	first, cookie := get(nil)
+	if !assert.NotNil(t, cookie, "the first response should pin the client") {
+		return
+	}
+	assert.True(t, cookie.HttpOnly && cookie.Secure, "the sticky cookie should be HttpOnly and Secure")
+	assert.NotContains(t, cookie.Value, "127.0.0.1", "the sticky cookie should not reveal the backend")
+	for i := 0; i < 5; i++ {
+		got, again := get(cookie)
+		assert.Equal(t, first, got, "a pinned client should keep reaching the same backend")
+		assert.Nil(t, again, "a pinned client should not be pinned again")
+	}
+
+	n, _ := strconv.Atoi(first)
+	servers[n].Close()
+	moved, repinned := get(cookie)
+	assert.NotEqual(t, first, moved, "a client pinned to a down backend should be sent elsewhere")
+	if assert.NotNil(t, repinned, "a client pinned to a down backend should be pinned again") {
+		got, _ := get(repinned)
+		assert.Equal(t, moved, got, "a repinned client should reach its new backend")
+	}
+}
+
+// TestBuild_Drain tests that a draining backend gets no new requests, even from clients pinned to it, until it is
+// undrained
+func TestBuild_Drain(t *testing.T) {
+	var targets []Target
+	for i := 0; i < 2; i++ {
+		i := i
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, i)
+		}))
+		defer server.Close()
+		u, err := url.Parse(server.URL)
+		assert.Nil(t, err, "error should be nil")
+		targets = append(targets, Target{URL: u, Weight: 1})
+	}
+	proxy := Build(targets, Options{StickyCookie: "backend"})
+	get := func(cookie *http.Cookie) (string, *http.Cookie) {
+		req := httptest.NewRequest("GET", "/", nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, req)
+		if cookies := rec.Result().Cookies(); len(cookies) > 0 {
+			cookie = cookies[0]
+		}
+		return rec.Body.String(), cookie
+	}
+
+	first, cookie := get(nil)
+	n, _ := strconv.Atoi(first)
+	assert.True(t, proxy.Backends()[n].Drain(), "the backend should start draining")
+	assert.False(t, proxy.Backends()[n].Drain(), "draining twice should be reported")
+	for i := 0; i < 4; i++ {
+		got, _ := get(cookie)
+		assert.NotEqual(t, first, got, "a draining backend should get no requests")
+	}
+
+	proxy.Backends()[1-n].Drain()
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code, "there should be no backend when all are draining")
+
+	assert.True(t, proxy.Backends()[n].Undrain(), "the backend should stop draining")
+	got, _ := get(cookie)
+	assert.Equal(t, first, got, "an undrained backend should get requests again")
+}
+
+// TestBuild_UpstreamProxy tests that requests to backends go through the upstream proxy unless NO_PROXY excludes them
+func TestBuild_UpstreamProxy(t *testing.T) {
+	t.Setenv("NO_PROXY", "excluded.invalid")
+	var proxied []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.URL.String())
+	}))
+	defer upstream.Close()
+	upstreamURL, err := url.Parse(upstream.URL)
+	assert.Nil(t, err, "error should be nil")
+
+	for _, c := range []struct {
+		backend string
+		code    int
+	}{
+		{"http://backend.invalid:8080", http.StatusOK},
+		{"http://excluded.invalid:8080", http.StatusBadGateway},
+	} {
+		u, err := url.Parse(c.backend)
+		assert.Nil(t, err, "error should be nil")
+		proxy := Build([]Target{{URL: u, Weight: 1}}, Options{UpstreamProxy: upstreamURL})
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, httptest.NewRequest("GET", "/test", nil))
+		assert.Equal(t, c.code, rec.Code, "unexpected status for %s", c.backend)
+	}
+	assert.Equal(t, []string{"http://backend.invalid:8080/test"}, proxied, "only the backend not excluded should be proxied")
+}
+
+// TestBuild_UpstreamProxyServerName tests that the certificate of an https:// upstream proxy is verified against the
+// proxy's own host, with BackendServerName only applying to the backends behind it
+func TestBuild_UpstreamProxyServerName(t *testing.T) {
+	var proxied []string
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.URL.String())
+	}))
+	defer upstream.Close()
+	upstreamURL, err := url.Parse(upstream.URL)
+	assert.Nil(t, err, "error should be nil")
+	roots := x509.NewCertPool()
+	roots.AddCert(upstream.Certificate())
+
+	u, err := url.Parse("http://backend.invalid:8080")
+	assert.Nil(t, err, "error should be nil")
+	proxy := Build([]Target{{URL: u, Weight: 1}}, Options{
+		UpstreamProxy:     upstreamURL,
+		BackendRootCAs:    roots,
+		BackendServerName: "app.internal",
+	})
+	defer proxy.Close()
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, httptest.NewRequest("GET", "/test", nil))
+	assert.Equal(t, http.StatusOK, rec.Code, "the proxy's certificate should be verified against its own host")
+	assert.Equal(t, []string{"http://backend.invalid:8080/test"}, proxied, "the request should go through the proxy")
+}
+
+// TestBuild_Weighted tests that backends are selected in proportion to their weights and that a weight of 0 excludes
+// a backend entirely
+func TestBuild_Weighted(t *testing.T) {
+	var targets []Target
+	for i, weight := range []int{3, 1, 0} {
+		u, err := url.Parse(fmt.Sprintf("http://10.0.0.%d", i+1))
+		assert.Nil(t, err, "error should be nil")
+		targets = append(targets, Target{URL: u, Weight: weight})
+	}
+	proxy := Build(targets, Options{})
+	assert.Len(t, proxy.Backends(), 2, "zero weight backend should be excluded")
+
+	counts := make(map[string]int)
+	for i := 0; i < 4000; i++ {
+		counts[proxy.pick(nil).URL.Host]++
+	}
+	assert.Equal(t, 3000, counts["10.0.0.1"], "weight 3 backend should receive 3/4 of requests")
+	assert.Equal(t, 1000, counts["10.0.0.2"], "weight 1 backend should receive 1/4 of requests")
+}
+
+// TestBuild_HealthChecks tests that backends failing active health checks stop receiving traffic, and that a 503 is
+// returned once every backend is down
+func TestBuild_HealthChecks(t *testing.T) {
+	healthy := true
+	var mu sync.Mutex
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.URL.Path == "/healthz" && !healthy {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer backend.Close()
+	u, err := url.Parse(backend.URL)
+	assert.Nil(t, err, "error should be nil")
+
+	proxy := Build([]Target{{URL: u, Weight: 1}}, Options{
+		HealthCheckPath:     "/healthz",
+		HealthCheckInterval: 10 * time.Millisecond,
+	})
+	defer proxy.Close()
+
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, httptest.NewRequest("GET", "/test", nil))
+	assert.Equal(t, http.StatusOK, rec.Code, "healthy backend should be proxied to")
+
+	mu.Lock()
+	healthy = false
+	mu.Unlock()
+	assert.Eventually(t, func() bool { return !proxy.Backends()[0].Healthy() }, time.Second, 10*time.Millisecond,
+		"backend should be marked down after failing a health check")
+
+	rec = httptest.NewRecorder()
+	proxy.ServeHTTP(rec, httptest.NewRequest("GET", "/test", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code, "no healthy backends should return a 503")
+	assert.Contains(t, rec.Body.String(), "no healthy backends", "503 body should explain the failure")
+}
+
+// TestBuild_UnixSocket tests that unix:// targets are dialed over the socket with the path and Host rewritten sensibly
+func TestBuild_UnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "app.sock")
+	l, err := net.Listen("unix", socket)
+	assert.Nil(t, err, "error should be nil")
+	var gotPath, gotHost string
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath, gotHost = r.URL.RequestURI(), r.Host
+	}))
+	defer l.Close()
+
+	u, err := url.Parse("unix://" + socket)
+	assert.Nil(t, err, "error should be nil")
+	proxy := Build([]Target{{URL: u, Weight: 1}}, Options{UnixSocketHost: "app.internal"})
+
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, httptest.NewRequest("GET", "/users?id=1", nil))
+	assert.Equal(t, http.StatusOK, rec.Code, "request should be proxied over the socket")
+	assert.Equal(t, "/users?id=1", gotPath, "request path and query should be kept intact")
+	assert.Equal(t, "app.internal", gotHost, "Host header should be the configured placeholder")
+}
+
+// TestBuild_WebSocket tests that WebSocket upgrades are proxied and messages round-trip in both directions, over both
+// ws:// and wss://, even when the ResponseWriter has been wrapped by middleware
+func TestBuild_WebSocket(t *testing.T) {
+	echo := websocket.Handler(func(ws *websocket.Conn) {
+		io.Copy(ws, ws)
+	})
+
+	for _, secure := range []bool{false, true} {
+		var backend *httptest.Server
+		if secure {
+			backend = httptest.NewTLSServer(echo)
+		} else {
+			backend = httptest.NewServer(echo)
+		}
+		defer backend.Close()
+
+		u, err := url.Parse(backend.URL)
+		assert.Nil(t, err, "error should be nil")
+		proxy := Build([]Target{{URL: u, Weight: 1}}, Options{})
+		if secure {
+			proxy.Backends()[0].transport.(*http.Transport).TLSClientConfig = backend.Client().Transport.(*http.Transport).TLSClientConfig
+		}
+
+		front := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			proxy.ServeHTTP(middleware.NewResponseWriter(w), r)
+		}))
+		defer front.Close()
+
+		config, err := websocket.NewConfig(strings.Replace(front.URL, "https://", "wss://", 1)+"/echo", front.URL)
+		assert.Nil(t, err, "error should be nil")
+		config.TlsConfig = &tls.Config{InsecureSkipVerify: true}
+		ws, err := websocket.DialConfig(config)
+		if !assert.Nil(t, err, "WebSocket handshake through the proxy should succeed") {
+			continue
+		}
+
+		for _, msg := range []string{"hello", "world"} {
+			assert.Nil(t, websocket.Message.Send(ws, msg), "error should be nil")
+			var reply string
+			assert.Nil(t, websocket.Message.Receive(ws, &reply), "error should be nil")
+			assert.Equal(t, msg, reply, "message should be echoed back through the proxy")
+		}
+		ws.Close()
+	}
+}
+
+// TestBuild_WebSocketOutlivesReadTimeout tests that a WebSocket keeps working through the proxy after the server's
+// read timeout has passed
+func TestBuild_WebSocketOutlivesReadTimeout(t *testing.T) {
+	backend := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		io.Copy(ws, ws)
+	}))
+	defer backend.Close()
+	u, err := url.Parse(backend.URL)
+	assert.Nil(t, err, "error should be nil")
+	proxy := Build([]Target{{URL: u, Weight: 1}}, Options{})
+
+	front := httptest.NewUnstartedServer(proxy)
+	front.Config.ReadTimeout = 50 * time.Millisecond
+	front.Start()
+	defer front.Close()
+
+	ws, err := websocket.Dial(strings.Replace(front.URL, "http://", "ws://", 1), "", front.URL)
+	if !assert.Nil(t, err, "WebSocket handshake through the proxy should succeed") {
+		return
+	}
+	defer ws.Close()
+	time.Sleep(100 * time.Millisecond)
+	assert.Nil(t, websocket.Message.Send(ws, "late"), "error should be nil")
+	var reply string
+	assert.Nil(t, websocket.Message.Receive(ws, &reply), "connection should outlive the server read timeout")
+	assert.Equal(t, "late", reply, "message should be echoed back through the proxy")
+}
+
+// TestBuild_StreamTimeouts tests that server-sent events outlive the server's write timeout, and that streams are
+// closed once idle for StreamIdleTimeout while ordinary requests keep the write timeout
+func TestBuild_StreamTimeouts(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/events" {
+			w.Header().Set("Content-Type", "text/event-stream")
+		}
+		// Events arrive steadily, then stop
+		for i := 0; i < 4; i++ {
+			fmt.Fprintf(w, "data: %d\n\n", i)
+			http.NewResponseController(w).Flush()
+			time.Sleep(20 * time.Millisecond)
+		}
+		select {
+		case <-r.Context().Done():
+		case <-time.After(400 * time.Millisecond):
+		}
+	}))
+	defer backend.Close()
+	u, err := url.Parse(backend.URL)
+	assert.Nil(t, err, "error should be nil")
+
+	for _, idle := range []time.Duration{0, 60 * time.Millisecond} {
+		front := httptest.NewUnstartedServer(Build([]Target{{URL: u, Weight: 1}}, Options{StreamIdleTimeout: idle}))
+		front.Config.WriteTimeout = 40 * time.Millisecond
+		front.Start()
+
+		start := time.Now()
+		resp, err := http.Get(front.URL + "/events")
+		if !assert.Nil(t, err, "error should be nil") {
+			front.Close()
+			continue
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, "data: 0\n\ndata: 1\n\ndata: 2\n\ndata: 3\n\n", string(body), "every event should arrive despite the write timeout")
+		if idle > 0 {
+			assert.Less(t, time.Since(start), 300*time.Millisecond, "the stream should be closed once idle")
+		} else {
+			assert.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond, "the stream should stay open without an idle timeout")
+		}
+
+		resp, err = http.Get(front.URL + "/plain")
+		if err == nil {
+			body, err = io.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		assert.NotNil(t, err, "ordinary responses should still be cut off by the write timeout")
+		front.Close()
+	}
+
+	echo := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		io.Copy(ws, ws)
+	}))
+	defer echo.Close()
+	u, err = url.Parse(echo.URL)
+	assert.Nil(t, err, "error should be nil")
+	front := httptest.NewUnstartedServer(Build([]Target{{URL: u, Weight: 1}}, Options{StreamIdleTimeout: 120 * time.Millisecond}))
+	front.Config.WriteTimeout = 30 * time.Millisecond
+	front.Start()
+	defer front.Close()
+	ws, err := websocket.Dial(strings.Replace(front.URL, "http://", "ws://", 1), "", front.URL)
+	if !assert.Nil(t, err, "WebSocket handshake through the proxy should succeed") {
+		return
+	}
+	defer ws.Close()
+	var reply string
+	for i := 0; i < 3; i++ {
+		time.Sleep(60 * time.Millisecond)
+		assert.Nil(t, websocket.Message.Send(ws, "ping"), "error should be nil")
+		assert.Nil(t, websocket.Message.Receive(ws, &reply), "an active WebSocket should outlive the write timeout")
+	}
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	assert.NotNil(t, websocket.Message.Receive(ws, &reply), "an idle WebSocket should be closed")
+}
+
+// TestBuild_ForwardedHeaders tests that X-Forwarded-* headers are set, with the port of the listener the request came in
+// on, and that an incoming X-Forwarded-For chain is only extended when the client is a trusted proxy
+func TestBuild_ForwardedHeaders(t *testing.T) {
+	var got http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+	}))
+	defer backend.Close()
+	u, err := url.Parse(backend.URL)
+	assert.Nil(t, err, "error should be nil")
+	_, trusted, err := net.ParseCIDR("10.0.0.0/8")
+	assert.Nil(t, err, "error should be nil")
+	proxy := Build([]Target{{URL: u, Weight: 1}}, Options{TrustedProxies: []*net.IPNet{trusted}})
+
+	cases := []struct {
+		remoteAddr  string
+		expectedXFF string
+	}{
+		{"10.1.2.3:1234", "203.0.113.7, 10.1.2.3"},
+		{"192.0.2.1:1234", "192.0.2.1"},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "/test", nil)
+		req.RemoteAddr = c.remoteAddr
+		req.Host = "app.example.com"
+		req.Header.Set("X-Forwarded-For", "203.0.113.7")
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, req)
+
+		assert.Equal(t, c.expectedXFF, got.Get("X-Forwarded-For"), "unexpected X-Forwarded-For for %s", c.remoteAddr)
+		assert.Equal(t, "https", got.Get("X-Forwarded-Proto"), "X-Forwarded-Proto should be https")
+		assert.Equal(t, "app.example.com", got.Get("X-Forwarded-Host"), "X-Forwarded-Host should be the original Host")
+		assert.Equal(t, "443", got.Get("X-Forwarded-Port"), "X-Forwarded-Port should default to 443")
+	}
+
+	req := httptest.NewRequest("GET", "/test", nil)
+	req = req.WithContext(context.WithValue(req.Context(), http.LocalAddrContextKey, &net.TCPAddr{IP: net.IPv6loopback, Port: 8443}))
+	proxy.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, "8443", got.Get("X-Forwarded-Port"), "X-Forwarded-Port should be the port of the listener")
+}
+
+// TestBuild_HostHeader tests that backends get the client's Host by default, or their own or a fixed one if asked to,
+// with the client's kept in X-Forwarded-Host
+func TestBuild_HostHeader(t *testing.T) {
+	var host, forwardedHost string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, forwardedHost = r.Host, r.Header.Get("X-Forwarded-Host")
+	}))
+	defer backend.Close()
+	u, err := url.Parse(backend.URL)
+	assert.Nil(t, err, "error should be nil")
+
+	cases := []struct {
+		opts     Options
+		expected string
+	}{
+		{Options{}, "app.example.com"},
+		{Options{BackendHost: true}, u.Host},
+		{Options{UpstreamHost: "internal.example.com"}, "internal.example.com"},
+		{Options{BackendHost: true, UpstreamHost: "internal.example.com"}, "internal.example.com"},
+	}
+	for _, c := range cases {
+		proxy := Build([]Target{{URL: u, Weight: 1}}, c.opts)
+		req := httptest.NewRequest("GET", "/test", nil)
+		req.Host = "app.example.com"
+		proxy.ServeHTTP(httptest.NewRecorder(), req)
+		proxy.Close()
+		assert.Equal(t, c.expected, host, "unexpected Host with %+v", c.opts)
+		assert.Equal(t, "app.example.com", forwardedHost, "X-Forwarded-Host should be the client's Host")
+	}
+}
+
+// TestBuild_MaxForwardedFor tests that X-Forwarded-For chains from trusted proxies are trimmed to the trusted hops
+// and capped, while those from untrusted clients are replaced by the client's IP however long they are
+func TestBuild_MaxForwardedFor(t *testing.T) {
+	var got http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+	}))
+	defer backend.Close()
+	u, err := url.Parse(backend.URL)
+	assert.Nil(t, err, "error should be nil")
+	_, trusted, err := net.ParseCIDR("10.0.0.0/8")
+	assert.Nil(t, err, "error should be nil")
+	proxy := Build([]Target{{URL: u, Weight: 1}}, Options{TrustedProxies: []*net.IPNet{trusted}, MaxForwardedFor: 3})
+
+	long := strings.TrimSuffix(strings.Repeat("198.51.100.1, ", 1000), ", ")
+	cases := []struct {
+		remoteAddr  string
+		xff         []string
+		expectedXFF string
+	}{
+		{"10.1.2.3:1234", []string{"203.0.113.7"}, "203.0.113.7, 10.1.2.3"},
+		{"10.1.2.3:1234", []string{"198.51.100.1, 203.0.113.7, 10.9.9.9"}, "203.0.113.7, 10.9.9.9, 10.1.2.3"},
+		{"10.1.2.3:1234", []string{"198.51.100.1", "203.0.113.7, 10.9.9.9"}, "203.0.113.7, 10.9.9.9, 10.1.2.3"},
+		{"10.1.2.3:1234", []string{"203.0.113.7, 10.8.8.8, 10.9.9.9"}, "10.8.8.8, 10.9.9.9, 10.1.2.3"},
+		{"10.1.2.3:1234", []string{long}, "198.51.100.1, 10.1.2.3"},
+		{"192.0.2.1:1234", []string{long}, "192.0.2.1"},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "/test", nil)
+		req.RemoteAddr = c.remoteAddr
+		req.Header["X-Forwarded-For"] = c.xff
+		proxy.ServeHTTP(httptest.NewRecorder(), req)
+		assert.Equal(t, c.expectedXFF, got.Get("X-Forwarded-For"), "unexpected X-Forwarded-For for %s from %s", c.xff, c.remoteAddr)
+	}
+}
+
+// TestBuild_HeaderRules tests that the header rules set and remove request headers before they reach the backend and
+// response headers before they reach the client, overriding any the client or backend sent
+func TestBuild_HeaderRules(t *testing.T) {
+	var got http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		w.Header().Set("Server", "app/1.0")
+		w.Header().Set("X-Powered-By", "php")
+	}))
+	defer backend.Close()
+	u, err := url.Parse(backend.URL)
+	assert.Nil(t, err, "error should be nil")
+	proxy := Build([]Target{{URL: u, Weight: 1}}, Options{HeaderRules: HeaderRules{
+		SetRequest:     http.Header{"X-Api-Key": {"secret"}},
+		RemoveRequest:  []string{"Cookie"},
+		SetResponse:    http.Header{"Server": {"ssl-proxy"}},
+		RemoveResponse: []string{"X-Powered-By"},
+	}})
+
+	req := httptest.NewRequest("GET", "/test", nil)
+	req.Header.Set("Cookie", "session=1")
+	req.Header.Set("X-Api-Key", "client-supplied")
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, req)
+
+	assert.Equal(t, []string{"secret"}, got.Values("X-Api-Key"), "X-Api-Key should be replaced")
+	assert.Empty(t, got.Get("Cookie"), "Cookie should be removed")
+	assert.Equal(t, "ssl-proxy", rec.Header().Get("Server"), "Server should be replaced")
+	assert.Empty(t, rec.Header().Get("X-Powered-By"), "X-Powered-By should be removed")
+}
+
+// TestBuild_HopByHopHeaders tests that hop-by-hop headers, and any header the client names in Connection, aren't
+// forwarded to the backend, while TE: trailers and the headers of protocol upgrades are
+func TestBuild_HopByHopHeaders(t *testing.T) {
+	var got http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		w.Header().Set("Keep-Alive", "timeout=5")
+	}))
+	defer backend.Close()
+	u, err := url.Parse(backend.URL)
+	assert.Nil(t, err, "error should be nil")
+	proxy := Build([]Target{{URL: u, Weight: 1}}, Options{HeaderRules: HeaderRules{RemoveRequest: []string{"X-Internal-Token"}}})
+
+	req := httptest.NewRequest("GET", "/", nil)
+	for name, value := range map[string]string{
+		"Connection":          "keep-alive, X-Hop",
+		"Keep-Alive":          "timeout=5",
+		"Proxy-Authorization": "Basic Zm9vOmJhcg==",
+		"Proxy-Connection":    "keep-alive",
+		"Te":                  "trailers, deflate",
+		"Trailer":             "X-Checksum",
+		"Upgrade":             "h2c",
+		"X-Hop":               "1",
+		"X-Internal-Token":    "secret",
+	} {
+		req.Header.Set(name, value)
+	}
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, req)
+	for _, name := range []string{"Connection", "Keep-Alive", "Proxy-Authorization", "Proxy-Connection", "Trailer", "Upgrade", "X-Hop", "X-Internal-Token"} {
+		assert.Empty(t, got.Get(name), "%s should not reach the backend", name)
+	}
+	assert.Equal(t, "trailers", got.Get("Te"), "TE: trailers should still reach the backend")
+	assert.Empty(t, rec.Header().Get("Keep-Alive"), "hop-by-hop headers should not reach the client")
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	proxy.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, "websocket", got.Get("Upgrade"), "the Upgrade header of an upgrade should reach the backend")
+	assert.Equal(t, "Upgrade", got.Get("Connection"), "the Connection header of an upgrade should reach the backend")
+}
+
+// TestBuild_StripPrefix tests that the prefix is removed from the path sent to the backend, keeping the query and
+// escaped slashes
+func TestBuild_StripPrefix(t *testing.T) {
+	var got *url.URL
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.URL
+	}))
+	defer backend.Close()
+	u, err := url.Parse(backend.URL)
+	assert.Nil(t, err, "error should be nil")
+	proxy := Build([]Target{{URL: u, Weight: 1}}, Options{StripPrefix: "/api/"})
+
+	cases := []struct {
+		path     string
+		expected string
+	}{
+		{"/api/users?page=2", "/users?page=2"},
+		{"/api/users/", "/users/"},
+		{"/api/", "/"},
+		{"/api", "/"},
+		{"/api/a%2Fb", "/a%2Fb"},
+	}
+	for _, c := range cases {
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, httptest.NewRequest("GET", c.path, nil))
+		assert.Equal(t, c.expected, got.RequestURI(), "unexpected backend path for %s", c.path)
+	}
+}
+
+// TestBuild_ResponseHeaderTimeout tests that a backend that doesn't send its response headers within
+// ResponseHeaderTimeout gives a 504
+func TestBuild_ResponseHeaderTimeout(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer backend.Close()
+	defer close(release)
+	u, err := url.Parse(backend.URL)
+	assert.Nil(t, err, "error should be nil")
+	proxy := Build([]Target{{URL: u, Weight: 1}}, Options{ResponseHeaderTimeout: 50 * time.Millisecond})
+
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusGatewayTimeout, rec.Code, "a backend that doesn't respond in time should give a 504")
+}
+
+// TestBuild_ErrorPages tests that proxy errors are answered with the built-in or custom page, or as plain text or JSON
+// in the ErrorFormat
+func TestBuild_ErrorPages(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	u, err := url.Parse(backend.URL)
+	assert.Nil(t, err, "error should be nil")
+	backend.Close()
+
+	proxy := Build([]Target{{URL: u, Weight: 1}}, Options{})
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusBadGateway, rec.Code, "an unreachable backend should give a 502")
+	assert.Equal(t, "text/html; charset=utf-8", rec.Header().Get("Content-Type"), "error page should be HTML")
+	assert.Contains(t, rec.Body.String(), "Bad Gateway", "built-in page should show the status")
+
+	custom := []byte("<h1>Back soon</h1>")
+	proxy = Build([]Target{{URL: u, Weight: 1}}, Options{ErrorPages: map[int][]byte{http.StatusBadGateway: custom}})
+	rec = httptest.NewRecorder()
+	proxy.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusBadGateway, rec.Code, "a custom page should keep the status")
+	assert.Equal(t, string(custom), rec.Body.String(), "the custom page should be served")
+
+	proxy = Build([]Target{{URL: u, Weight: 1}}, Options{ErrorFormat: ErrorText})
+	rec = httptest.NewRecorder()
+	proxy.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, "text/plain; charset=utf-8", rec.Header().Get("Content-Type"), "the error should be plain text")
+	assert.Equal(t, "Bad Gateway\n", rec.Body.String(), "the error should show the status text")
+
+	proxy = Build(nil, Options{ErrorFormat: ErrorJSON, ErrorPages: map[int][]byte{http.StatusBadGateway: custom}})
+	rec = httptest.NewRecorder()
+	proxy.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusBadGateway, rec.Code, "a JSON error should keep the status")
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"), "the error should be JSON")
+	assert.JSONEq(t, `{"error":{"status":502,"code":"no_backends","message":"no backends configured"}}`, rec.Body.String(),
+		"the error should have a code and message instead of the custom page")
+}
+
+// TestBuild_BodyTooLarge tests that a request body cut off by http.MaxBytesReader, as with middleware.MaxBodySize, is
+// answered with a 413 rather than a 502
+func TestBuild_BodyTooLarge(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+	}))
+	defer backend.Close()
+	u, err := url.Parse(backend.URL)
+	assert.Nil(t, err, "error should be nil")
+	proxy := Build([]Target{{URL: u, Weight: 1}}, Options{})
+
+	for _, size := range []int{1024, 4096} {
+		// Hide the length so that the body is sent with chunked transfer encoding
+		req := httptest.NewRequest("POST", "/", io.MultiReader(strings.NewReader(strings.Repeat("a", size))))
+		req.ContentLength = -1
+		rec := httptest.NewRecorder()
+		req.Body = http.MaxBytesReader(rec, req.Body, 1024)
+		proxy.ServeHTTP(rec, req)
+
+		expected := http.StatusOK
+		if size > 1024 {
+			expected = http.StatusRequestEntityTooLarge
+		}
+		assert.Equal(t, expected, rec.Code, "unexpected status for a %d byte body", size)
+	}
+}
+
+// TestBuild_BackendHTTP2 tests that plaintext backends are spoken to using h2c when BackendHTTP2 is set
+func TestBuild_BackendHTTP2(t *testing.T) {
+	var proto string
+	backend := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proto = r.Proto
+	}), &http2.Server{}))
+	defer backend.Close()
+	u, err := url.Parse(backend.URL)
+	assert.Nil(t, err, "error should be nil")
+
+	for _, enabled := range []bool{false, true} {
+		proxy := Build([]Target{{URL: u, Weight: 1}}, Options{BackendHTTP2: enabled})
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, httptest.NewRequest("GET", "/test", nil))
+		assert.Equal(t, http.StatusOK, rec.Code, "request should be proxied")
+		if enabled {
+			assert.Equal(t, "HTTP/2.0", proto, "backend should receive HTTP/2 when enabled")
+		} else {
+			assert.Equal(t, "HTTP/1.1", proto, "backend should receive HTTP/1.1 by default")
+		}
+	}
+}
+
+// TestBuild_BodyRewrites tests that text responses are rewritten, gzipped or not, with a matching Content-Length, and
+// that other content types are left alone
+func TestBuild_BodyRewrites(t *testing.T) {
+	const page = `<a href="http://example.com/">home</a>`
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", r.URL.Query().Get("type"))
+		if r.URL.Query().Get("gzip") != "" {
+			w.Header().Set("Content-Encoding", "gzip")
+			zw := gzip.NewWriter(w)
+			fmt.Fprint(zw, page)
+			zw.Close()
+			return
+		}
+		fmt.Fprint(w, page)
+	}))
+	defer backend.Close()
+	u, err := url.Parse(backend.URL)
+	assert.Nil(t, err, "error should be nil")
+	proxy := Build([]Target{{URL: u, Weight: 1}}, Options{BodyRewrites: []BodyRewrite{{Old: "http://", New: "https://"}}})
+
+	for _, tc := range []struct {
+		query, want string
+	}{
+		{"type=text/html%3B+charset=utf-8", `<a href="https://example.com/">home</a>`},
+		{"type=application/json&gzip=1", `<a href="https://example.com/">home</a>`},
+		{"type=application/octet-stream", page},
+	} {
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, httptest.NewRequest("GET", "/?"+tc.query, nil))
+		body := rec.Body.Bytes()
+		if rec.Header().Get("Content-Encoding") == "gzip" {
+			zr, err := gzip.NewReader(bytes.NewReader(body))
+			if assert.Nil(t, err, "a gzipped response should stay valid gzip") {
+				body, _ = io.ReadAll(zr)
+			}
+			assert.Equal(t, strconv.Itoa(rec.Body.Len()), rec.Header().Get("Content-Length"), "Content-Length should match the rewritten body")
+		} else if tc.want != page {
+			assert.Equal(t, strconv.Itoa(len(tc.want)), rec.Header().Get("Content-Length"), "Content-Length should match the rewritten body")
+		}
+		assert.Equal(t, tc.want, string(body), tc.query)
+	}
+}
+
+// TestBuild_FlushInterval tests that streamed responses reach the client event by event rather than once the backend
+// has finished, both for server-sent events and, with a negative FlushInterval, for responses of a known length
+func TestBuild_FlushInterval(t *testing.T) {
+	next := map[string]chan struct{}{"/events": make(chan struct{}), "/fixed": make(chan struct{})}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/events" {
+			w.Header().Set("Content-Type", "text/event-stream")
+		} else {
+			w.Header().Set("Content-Length", strconv.Itoa(2*len("data: x\n\n")))
+		}
+		fmt.Fprint(w, "data: 1\n\n")
+		http.NewResponseController(w).Flush()
+		<-next[r.URL.Path]
+		fmt.Fprint(w, "data: 2\n\n")
+	}))
+	defer backend.Close()
+	u, err := url.Parse(backend.URL)
+	assert.Nil(t, err, "error should be nil")
+	server := httptest.NewServer(Build([]Target{{URL: u, Weight: 1}}, Options{FlushInterval: -1}))
+	defer server.Close()
+
+	for path, next := range next {
+		first := make(chan string, 1)
+		go func() {
+			resp, err := http.Get(server.URL + path)
+			if err != nil {
+				first <- err.Error()
+				return
+			}
+			defer resp.Body.Close()
+			line, _ := bufio.NewReader(resp.Body).ReadString('\n')
+			first <- line
+		}()
+		select {
+		case line := <-first:
+			assert.Equal(t, "data: 1\n", line, "the first event should arrive first")
+		case <-time.After(2 * time.Second):
+			t.Errorf("the first event of %s should arrive before the backend finishes", path)
+		}
+		close(next)
+	}
+}
+
+// TestBuild_BackendTLS tests that https:// backends are verified strictly unless told which CA and name to trust
+func TestBuild_BackendTLS(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(backend.Certificate())
+	u, err := url.Parse(backend.URL)
+	assert.Nil(t, err, "error should be nil")
+	// The test certificate is valid for 127.0.0.1 and example.com, but not localhost
+	mismatched := &url.URL{Scheme: "https", Host: "localhost:" + u.Port()}
+
+	tests := []struct {
+		name   string
+		target *url.URL
+		opts   Options
+		want   int
+	}{
+		{"untrusted CA", u, Options{}, http.StatusBadGateway},
+		{"custom CA", u, Options{BackendRootCAs: roots}, http.StatusOK},
+		{"name mismatch", mismatched, Options{BackendRootCAs: roots}, http.StatusBadGateway},
+		{"server name", mismatched, Options{BackendRootCAs: roots, BackendServerName: "example.com"}, http.StatusOK},
+		{"insecure", mismatched, Options{BackendInsecure: true}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		proxy := Build([]Target{{URL: tt.target, Weight: 1}}, tt.opts)
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		assert.Equal(t, tt.want, rec.Code, "unexpected status with %s", tt.name)
+	}
+}
+
+// TestBuild_Canary tests that the canary gets its share of requests, that clients can be kept on one side of it, and
+// that requests go to the stable backends once the canary is down
+func TestBuild_Canary(t *testing.T) {
+	var targets [2][]Target
+	var servers [2]*httptest.Server
+	for i, name := range []string{"stable", "canary"} {
+		name := name
+		servers[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, name)
+		}))
+		defer servers[i].Close()
+		u, err := url.Parse(servers[i].URL)
+		assert.Nil(t, err, "error should be nil")
+		targets[i] = []Target{{URL: u, Weight: 1}}
+	}
+	get := func(proxy *Proxy, req *http.Request) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, req)
+		return rec
+	}
+
+	proxy := Build(targets[0], Options{Canary: targets[1], CanaryPercent: 20})
+	assert.Len(t, proxy.Backends(), 2, "the canary backend should be listed")
+	canaries := 0
+	for i := 0; i < 1000; i++ {
+		if get(proxy, httptest.NewRequest("GET", "/", nil)).Body.String() == "canary" {
+			canaries++
+		}
+	}
+	assert.InDelta(t, 200, canaries, 80, "about 20%% of requests should go to the canary")
+
+	proxy = Build(targets[0], Options{Canary: targets[1], CanaryPercent: 50, CanaryKey: func(r *http.Request) string {
+		return r.Header.Get("X-Client")
+	}})
+	seen := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Client", strconv.Itoa(i))
+		first := get(proxy, req).Body.String()
+		seen[first] = true
+		for j := 0; j < 3; j++ {
+			assert.Equal(t, first, get(proxy, req).Body.String(), "a client should stay on the same side of the canary")
+		}
+	}
+	assert.Len(t, seen, 2, "clients should be split between the canary and the stable backends")
+
+	proxy = Build(targets[0], Options{Canary: targets[1], CanaryPercent: 50, CanaryCookie: "canary"})
+	for i := 0; i < 10; i++ {
+		rec := get(proxy, httptest.NewRequest("GET", "/", nil))
+		cookies := rec.Result().Cookies()
+		if !assert.Len(t, cookies, 1, "the first response should pin the client") {
+			return
+		}
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(cookies[0])
+		for j := 0; j < 3; j++ {
+			again := get(proxy, req)
+			assert.Equal(t, rec.Body.String(), again.Body.String(), "a pinned client should stay on the same side of the canary")
+			assert.Empty(t, again.Result().Cookies(), "a pinned client should not be pinned again")
+		}
+	}
+
+	proxy = Build(targets[0], Options{Canary: targets[1], CanaryPercent: 100})
+	servers[1].Close()
+	get(proxy, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, "stable", get(proxy, httptest.NewRequest("GET", "/", nil)).Body.String(),
+		"requests should go to the stable backends while the canary is down")
+}
+
+// TestBuild_ConnectionPool tests that up to MaxIdleConnsPerHost connections to a backend are kept for reuse and that
+// MaxConnsPerHost caps the connections open to it
+func TestBuild_ConnectionPool(t *testing.T) {
+	var conns, inFlight, peak atomic.Int32
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+		}
+		time.Sleep(20 * time.Millisecond)
+	}))
+	backend.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	backend.Start()
+	defer backend.Close()
+	u, err := url.Parse(backend.URL)
+	assert.Nil(t, err, "error should be nil")
+
+	send := func(proxy *Proxy, n int) {
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				rec := httptest.NewRecorder()
+				proxy.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+				assert.Equal(t, http.StatusOK, rec.Code, "request should be proxied")
+			}()
+		}
+		wg.Wait()
+	}
+	proxy := Build([]Target{{URL: u, Weight: 1}}, Options{MaxIdleConnsPerHost: 8})
+	defer proxy.Close()
+	send(proxy, 8)
+	send(proxy, 8)
+	assert.Equal(t, int32(8), conns.Load(), "the connections of the first requests should be reused")
+
+	limited := Build([]Target{{URL: u, Weight: 1}}, Options{MaxConnsPerHost: 2})
+	defer limited.Close()
+	peak.Store(0)
+	send(limited, 8)
+	assert.Equal(t, int32(2), peak.Load(), "no more than MaxConnsPerHost requests should reach the backend at once")
+}
+
+// BenchmarkBuild_SingleBackend measures the throughput of concurrent requests to a single backend, with Go's default
+// of 2 idle connections per host and with a pool large enough for every concurrent request. It also reports how many
+// connections were opened to the backend per request.
+func BenchmarkBuild_SingleBackend(b *testing.B) {
+	var conns atomic.Int64
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Millisecond)
+		w.Write([]byte("ok"))
+	}))
+	backend.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	backend.Start()
+	defer backend.Close()
+	u, err := url.Parse(backend.URL)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, perHost := range []int{0, 64} {
+		b.Run(fmt.Sprintf("max-idle-conns-per-host=%d", perHost), func(b *testing.B) {
+			proxy := Build([]Target{{URL: u, Weight: 1}}, Options{MaxIdleConnsPerHost: perHost})
+			defer proxy.Close()
+			conns.Store(0)
+			b.SetParallelism(32)
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					rec := httptest.NewRecorder()
+					proxy.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+					if rec.Code != http.StatusOK {
+						b.Errorf("got status %d", rec.Code)
+						return
+					}
+				}
+			})
+			b.ReportMetric(float64(conns.Load())/float64(b.N), "conns/op")
+		})
+	}
+}
+
+// BenchmarkBuild_BufferPool measures the allocations made proxying a 1MB response, with the buffer pool and with a
+// new copy buffer for every request as httputil.ReverseProxy does without one
+func BenchmarkBuild_BufferPool(b *testing.B) {
+	body := bytes.Repeat([]byte("a"), 1<<20)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+	defer backend.Close()
+	u, err := url.Parse(backend.URL)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, pooled := range []bool{false, true} {
+		b.Run(fmt.Sprintf("pooled=%t", pooled), func(b *testing.B) {
+			proxy := Build([]Target{{URL: u, Weight: 1}}, Options{})
+			defer proxy.Close()
+			if !pooled {
+				proxy.proxy.BufferPool = nil
+			}
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					rec := httptest.NewRecorder()
+					rec.Body = nil // discard the body
+					proxy.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+					if rec.Code != http.StatusOK {
+						b.Errorf("got status %d", rec.Code)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+// TestBuild_RequestBufferSize tests that request bodies with a Content-Length up to RequestBufferSize reach the backend
+// whole, while larger ones, chunked ones and gRPC calls are streamed to it before the client has finished sending them
+func TestBuild_RequestBufferSize(t *testing.T) {
+	type received struct {
+		contentLength int64
+		body          string
+	}
+	arrived := make(chan struct{}, 1)
+	got := make(chan received, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+		body, _ := io.ReadAll(r.Body)
+		got <- received{r.ContentLength, string(body)}
+	}))
+	defer backend.Close()
+	u, err := url.Parse(backend.URL)
+	assert.Nil(t, err, "error should be nil")
+	proxy := Build([]Target{{URL: u, Weight: 1}}, Options{RequestBufferSize: 8})
+
+	cases := []struct {
+		first, rest   string
+		contentLength int64
+		grpc          bool
+		buffered      bool
+	}{
+		{"abc", "def", 6, false, true},
+		{"abcdefgh", "ijkl", 12, false, false},
+		// Clients that send part of a body, then wait for a response before sending more
+		{"abc", "def", -1, false, false},
+		{"abc", "def", 6, true, false},
+	}
+	for _, c := range cases {
+		pr, pw := io.Pipe()
+		req := httptest.NewRequest("POST", "/upload", pr)
+		req.ContentLength = c.contentLength
+		if c.grpc {
+			req.ProtoMajor, req.ProtoMinor = 2, 0
+			req.Header.Set("Content-Type", "application/grpc")
+		}
+		done := make(chan struct{})
+		go func() {
+			proxy.ServeHTTP(httptest.NewRecorder(), req)
+			close(done)
+		}()
+		pw.Write([]byte(c.first))
+		early := false
+		select {
+		case <-arrived:
+			early = true
+		case <-time.After(100 * time.Millisecond):
+		}
+		assert.Equal(t, !c.buffered, early, "only a buffered body should reach the backend once it is complete")
+		pw.Write([]byte(c.rest))
+		pw.Close()
+		if !early {
+			<-arrived
+		}
+		r := <-got
+		<-done
+		assert.Equal(t, c.first+c.rest, r.body, "the body should reach the backend intact")
+		assert.Equal(t, c.contentLength, r.contentLength, "the body should be sent with the client's Content-Length, if any")
+	}
+}
@@ -0,0 +1,88 @@
+package reverseproxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// maxRewriteSize is the largest response body rewritten by BodyRewrites. Larger bodies are buffered up to this size
+// and then passed through unchanged, so that a huge response can't exhaust memory.
+const maxRewriteSize = 16 << 20
+
+// BodyRewrite replaces every occurrence of Old in a response body with New
+type BodyRewrite struct {
+	Old, New string
+}
+
+// rewritableTypes are the content types whose bodies BodyRewrites apply to. Anything else, in particular binary
+// content, is never touched.
+var rewritableTypes = map[string]bool{
+	"text/html":        true,
+	"application/json": true,
+}
+
+// rewriteBody applies r to the body of resp if it is a complete text/html or application/json response that is either
+// unencoded or gzipped. Gzipped bodies are decompressed, rewritten and compressed again. Content-Length is updated to
+// match and any ETag, which no longer describes the body, is removed.
+func rewriteBody(resp *http.Response, r *strings.Replacer) error {
+	switch {
+	case resp.Request.Method == http.MethodHead, resp.StatusCode < 200, resp.StatusCode == http.StatusNoContent,
+		resp.StatusCode == http.StatusPartialContent, resp.StatusCode == http.StatusNotModified:
+		return nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if !rewritableTypes[mediaType] {
+		return nil
+	}
+	encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	if encoding != "" && encoding != "identity" && encoding != "gzip" {
+		return nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxRewriteSize+1))
+	if err != nil {
+		return err
+	}
+	if len(body) > maxRewriteSize {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return nil
+	}
+	resp.Body.Close()
+
+	text := body
+	if encoding == "gzip" {
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		if text, err = io.ReadAll(io.LimitReader(zr, maxRewriteSize+1)); err != nil {
+			return err
+		}
+		if len(text) > maxRewriteSize {
+			resp.Body = io.NopCloser(bytes.NewReader(body))
+			return nil
+		}
+	}
+	body = []byte(r.Replace(string(text)))
+	if encoding == "gzip" {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(body)
+		zw.Close()
+		body = buf.Bytes()
+	}
+
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	resp.Header.Del("Etag")
+	return nil
+}
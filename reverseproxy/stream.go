@@ -0,0 +1,144 @@
+package reverseproxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// streamWriter watches a response for turning into a long-lived stream: an upgraded connection such as a WebSocket,
+// a server-sent events response, or a gRPC call once exempted with startStream. Streams are exempt from the server's
+// read and write timeouts, which are meant for ordinary requests, and are instead closed once nothing has been sent
+// either way for idle, if it is set.
+type streamWriter struct {
+	http.ResponseWriter
+	idle   time.Duration
+	cancel context.CancelFunc // aborts the request, ending an idle server-sent events stream or gRPC call
+
+	upgrades  *Upgrades // tracks the connection if the request is upgraded, if set
+	websocket bool      // whether the request asks to upgrade to a WebSocket
+
+	wroteHeader bool
+	mu          sync.Mutex
+	streaming   bool
+	timer       *time.Timer // set once the response is a stream with an idle timeout
+}
+
+// startStream exempts the request from the server's read and write timeouts, starting the idle timeout instead
+func (w *streamWriter) startStream() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.streaming {
+		return
+	}
+	w.streaming = true
+	rc := http.NewResponseController(w.ResponseWriter)
+	rc.SetReadDeadline(time.Time{})
+	if w.idle > 0 {
+		rc.SetWriteDeadline(time.Now().Add(w.idle))
+		w.timer = time.AfterFunc(w.idle, w.cancel)
+	} else {
+		rc.SetWriteDeadline(time.Time{})
+	}
+}
+
+// active pushes back the idle timeout of a stream that has just sent data either way
+func (w *streamWriter) active() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timer != nil {
+		w.timer.Reset(w.idle)
+		http.NewResponseController(w.ResponseWriter).SetWriteDeadline(time.Now().Add(w.idle))
+	}
+}
+
+func (w *streamWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if isEventStream(w.Header()) {
+			w.startStream()
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *streamWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.active()
+	return w.ResponseWriter.Write(b)
+}
+
+// Hijack takes over the client connection for an upgraded protocol, replacing the server's deadlines on it
+func (w *streamWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	if w.upgrades != nil {
+		conn = w.upgrades.track(conn, w.websocket)
+	}
+	if w.idle <= 0 {
+		conn.SetDeadline(time.Time{})
+		return conn, brw, nil
+	}
+	conn.SetDeadline(time.Now().Add(w.idle))
+	return idleConn{conn, w.idle}, brw, nil
+}
+
+// Unwrap returns the wrapped http.ResponseWriter, for http.ResponseController
+func (w *streamWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// stop stops the idle timer of a stream once the response is complete
+func (w *streamWriter) stop() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+}
+
+// idleConn is a connection that times out once nothing has been read or written for idle. Reading or writing pushes
+// back the deadline for both, so a stream sending data in only one direction stays open.
+type idleConn struct {
+	net.Conn
+	idle time.Duration
+}
+
+func (c idleConn) Read(b []byte) (int, error) {
+	c.SetDeadline(time.Now().Add(c.idle))
+	return c.Conn.Read(b)
+}
+
+func (c idleConn) Write(b []byte) (int, error) {
+	c.SetDeadline(time.Now().Add(c.idle))
+	return c.Conn.Write(b)
+}
+
+// activeBody is the body of a streaming request, pushing back the stream's idle timeout whenever the client sends data
+type activeBody struct {
+	io.ReadCloser
+	w *streamWriter
+}
+
+func (b activeBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.w.active()
+	}
+	return n, err
+}
+
+// isEventStream reports whether header describes a server-sent events response
+func isEventStream(header http.Header) bool {
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	return mediaType == "text/event-stream"
+}
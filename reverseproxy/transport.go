@@ -0,0 +1,99 @@
+package reverseproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/snewstv/ssl-proxy/logging"
+	"golang.org/x/net/http2"
+)
+
+// backendTransport sends each request using the transport of the backend it is being proxied to
+type backendTransport struct{}
+
+func (backendTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return attemptFrom(req.Context()).backend.transport.RoundTrip(req)
+}
+
+// logDial wraps dial to log every connection made to a backend at debug level
+func logDial(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		start := time.Now()
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			logging.Debugf("Unable to connect to backend %s after %s: %v", addr, time.Since(start), err)
+			return nil, err
+		}
+		logging.Debugf("Connected to backend %s (%s) from %s in %s", addr, conn.RemoteAddr(), conn.LocalAddr(), time.Since(start))
+		return conn, nil
+	}
+}
+
+// dialTLSProxy makes base connect to the https:// upstream proxy at proxy over TLS itself, verifying the proxy's
+// certificate against its own host name, and returns the http:// URL to give base's Proxy for it. Left to base, the
+// proxy would be verified against the ServerName of base.TLSClientConfig, which is meant for backends only.
+func dialTLSProxy(base *http.Transport, proxy *url.URL) *url.URL {
+	port := proxy.Port()
+	if port == "" {
+		port = "443"
+	}
+	addr := net.JoinHostPort(proxy.Hostname(), port)
+	config := base.TLSClientConfig.Clone()
+	config.ServerName = proxy.Hostname()
+	dial := base.DialContext
+	base.DialContext = func(ctx context.Context, network, a string) (net.Conn, error) {
+		conn, err := dial(ctx, network, a)
+		if err != nil || a != addr {
+			return conn, err
+		}
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+	plain := *proxy
+	plain.Scheme = "http"
+	plain.Host = addr
+	return &plain
+}
+
+// newTransport derives the transport for a single backend from base. If socket is set, connections are made to that
+// unix socket rather than the request's host. If h2c is set, requests are sent as cleartext HTTP/2 rather than
+// HTTP/1.1; this only affects the connection to the backend.
+func newTransport(base *http.Transport, socket string, h2c bool) http.RoundTripper {
+	dial := base.DialContext
+	if dial == nil {
+		var d net.Dialer
+		dial = d.DialContext
+	}
+	if socket != "" {
+		tcpDial := dial
+		dial = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return tcpDial(ctx, "unix", socket)
+		}
+	}
+
+	if h2c {
+		return &http2.Transport{
+			AllowHTTP:       true,
+			IdleConnTimeout: base.IdleConnTimeout,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return dial(ctx, network, addr)
+			},
+		}
+	}
+	if socket == "" {
+		return base
+	}
+	t := base.Clone()
+	t.DialContext = dial
+	// Requests to a unix socket must never be sent to a proxy instead
+	t.Proxy = nil
+	return t
+}
@@ -0,0 +1,200 @@
+package reverseproxy
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Upgrades tracks the client connections of upgraded requests, such as WebSockets, which the server hands over to the
+// proxy and so no longer waits for on shutdown. One Upgrades can be shared by several proxies, including those that
+// replace each other on a reload.
+type Upgrades struct {
+	mu    sync.Mutex
+	conns map[*upgradedConn]struct{}
+}
+
+// NewUpgrades returns an empty Upgrades
+func NewUpgrades() *Upgrades {
+	return &Upgrades{conns: make(map[*upgradedConn]struct{})}
+}
+
+// Len returns the number of upgraded connections currently open
+func (u *Upgrades) Len() int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return len(u.conns)
+}
+
+// Close waits until ctx is done for the upgraded connections to be closed by either end, then closes any still open,
+// first sending WebSocket clients a close frame saying that the server is going away where that can be done between
+// two frames from the backend. It returns the number of connections it closed.
+func (u *Upgrades) Close(ctx context.Context) int {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+wait:
+	for u.Len() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			break wait
+		}
+	}
+
+	u.mu.Lock()
+	conns := make([]*upgradedConn, 0, len(u.conns))
+	for c := range u.conns {
+		conns = append(conns, c)
+	}
+	u.mu.Unlock()
+	var wg sync.WaitGroup
+	for _, c := range conns {
+		wg.Go(c.goAway)
+	}
+	wg.Wait()
+	return len(conns)
+}
+
+// track returns conn, the client connection of an upgraded request, wrapped to be closed by Close. If websocket is
+// set the connection carries a WebSocket, to which a close frame can be sent.
+func (u *Upgrades) track(conn net.Conn, websocket bool) net.Conn {
+	c := &upgradedConn{Conn: conn, upgrades: u, websocket: websocket}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.conns[c] = struct{}{}
+	return c
+}
+
+// goAwayTimeout is how long writing the close frame to a WebSocket client may take on shutdown
+const goAwayTimeout = time.Second
+
+// closeGoingAway is an unmasked WebSocket close frame with status 1001, going away
+var closeGoingAway = append([]byte{0x88, 2 + byte(len("server shutting down")), 0x03, 0xe9}, "server shutting down"...)
+
+// upgradedConn is the client connection of an upgraded request, tracked by Upgrades until it is closed. For a
+// WebSocket it follows the frames the backend sends through it, so that a close frame can be sent between them.
+type upgradedConn struct {
+	net.Conn
+	upgrades  *Upgrades
+	websocket bool
+	closing   atomic.Bool
+
+	mu     sync.Mutex // held while writing, so that a close frame isn't written in the middle of another
+	frames frameTracker
+}
+
+func (c *upgradedConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closing.Load() {
+		return 0, net.ErrClosed
+	}
+	n, err := c.Conn.Write(b)
+	if c.websocket {
+		c.frames.advance(b[:n])
+	}
+	return n, err
+}
+
+func (c *upgradedConn) Close() error {
+	c.upgrades.mu.Lock()
+	delete(c.upgrades.conns, c)
+	c.upgrades.mu.Unlock()
+	return c.Conn.Close()
+}
+
+// The proxy's deadlines are ignored once the connection is closing, so that they can't hold off goAway
+
+func (c *upgradedConn) SetDeadline(t time.Time) error {
+	if c.closing.Load() {
+		return nil
+	}
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *upgradedConn) SetWriteDeadline(t time.Time) error {
+	if c.closing.Load() {
+		return nil
+	}
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// goAway closes the connection, sending a WebSocket client a close frame first if the backend isn't part way through
+// sending a frame. A write that is blocked on a client that isn't reading is given until goAwayTimeout to complete.
+func (c *upgradedConn) goAway() {
+	c.closing.Store(true)
+	c.Conn.SetWriteDeadline(time.Now().Add(goAwayTimeout))
+	c.mu.Lock()
+	if c.websocket && c.frames.atBoundary() {
+		c.Conn.Write(closeGoingAway)
+	}
+	c.mu.Unlock()
+	c.Close()
+}
+
+// frameTracker follows the WebSocket frames written to a connection, to tell when one is complete
+type frameTracker struct {
+	header    []byte // the part of the current frame's header written so far
+	remaining uint64 // the bytes of the current frame's payload not yet written
+}
+
+// advance records that b has been written
+func (f *frameTracker) advance(b []byte) {
+	for len(b) > 0 {
+		if f.remaining > 0 {
+			n := min(f.remaining, uint64(len(b)))
+			f.remaining -= n
+			b = b[n:]
+			continue
+		}
+		f.header = append(f.header, b[0])
+		b = b[1:]
+		if size, ok := payloadSize(f.header); ok {
+			f.remaining = size
+			f.header = f.header[:0]
+		}
+	}
+}
+
+// atBoundary reports whether every frame written so far is complete
+func (f *frameTracker) atBoundary() bool {
+	return len(f.header) == 0 && f.remaining == 0
+}
+
+// payloadSize returns the payload length given in a frame header, if header holds all of it. Servers don't mask their
+// frames, but a masking key is skipped if there is one.
+func payloadSize(header []byte) (uint64, bool) {
+	if len(header) < 2 {
+		return 0, false
+	}
+	size, n := uint64(header[1]&0x7f), 2
+	switch size {
+	case 126:
+		n += 2
+	case 127:
+		n += 8
+	}
+	if header[1]&0x80 != 0 {
+		n += 4
+	}
+	if len(header) < n {
+		return 0, false
+	}
+	switch size {
+	case 126:
+		size = uint64(binary.BigEndian.Uint16(header[2:]))
+	case 127:
+		size = binary.BigEndian.Uint64(header[2:])
+	}
+	return size, true
+}
+
+// isWebSocket reports whether r asks to upgrade to a WebSocket
+func isWebSocket(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
@@ -0,0 +1,90 @@
+package reverseproxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/websocket"
+)
+
+// TestUpgrades_Close tests that WebSockets still open on shutdown are closed, with a close frame sent to the client
+func TestUpgrades_Close(t *testing.T) {
+	backend := httptest.NewServer(websocket.Server{
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(ws *websocket.Conn) {
+			websocket.Message.Send(ws, "hello")
+			io.Copy(io.Discard, ws)
+		},
+	})
+	defer backend.Close()
+	u, err := url.Parse(backend.URL)
+	assert.Nil(t, err, "error should be nil")
+	upgrades := NewUpgrades()
+	front := httptest.NewServer(Build([]Target{{URL: u, Weight: 1}}, Options{Upgrades: upgrades}))
+	defer front.Close()
+
+	conn, err := net.Dial("tcp", front.Listener.Addr().String())
+	if !assert.Nil(t, err, "error should be nil") {
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	req, _ := http.NewRequest("GET", front.URL+"/ws", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	assert.Nil(t, req.Write(conn), "error should be nil")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if !assert.Nil(t, err, "error should be nil") {
+		return
+	}
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode, "the WebSocket should be upgraded")
+	msg := make([]byte, 7)
+	_, err = io.ReadFull(br, msg)
+	assert.Nil(t, err, "error should be nil")
+	assert.Equal(t, "\x81\x05hello", string(msg), "the backend's message should be passed on")
+	assert.Equal(t, 1, upgrades.Len(), "the WebSocket should be tracked")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, 1, upgrades.Close(ctx), "the WebSocket should be closed once the drain timeout passes")
+	rest, err := io.ReadAll(br)
+	assert.Nil(t, err, "the connection should be closed cleanly")
+	assert.Equal(t, closeGoingAway, rest, "the client should be sent a going away close frame before the connection is closed")
+	assert.Equal(t, 0, upgrades.Len(), "closed connections should no longer be tracked")
+}
+
+// TestFrameTracker tests that WebSocket frame boundaries are tracked across writes split anywhere in a frame's header
+// or payload
+func TestFrameTracker(t *testing.T) {
+	cases := []struct {
+		writes   []string
+		boundary bool
+	}{
+		{[]string{"\x81\x05hello"}, true},
+		{[]string{"\x81", "\x05hel", "lo"}, true},
+		{[]string{"\x81\x05hel"}, false},
+		{[]string{"\x81"}, false},
+		{[]string{"\x89\x00", "\x82\x7e\x00\x03abc"}, true},
+		{[]string{"\x82\x7e\x01\x00abc"}, false},
+		{[]string{"\x82\x7f\x00\x00\x00\x00\x00\x00\x00\x02", "ab", "\x81\x01"}, false},
+		{[]string{"\x81\x85mask", "hello"}, true},
+	}
+	for _, c := range cases {
+		var f frameTracker
+		for _, w := range c.writes {
+			f.advance([]byte(w))
+		}
+		assert.Equal(t, c.boundary, f.atBoundary(), "unexpected frame boundary after %q", c.writes)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/snewstv/ssl-proxy/config"
+	"github.com/snewstv/ssl-proxy/logging"
+	"github.com/snewstv/ssl-proxy/reverseproxy"
+)
+
+// buildRoutes builds the handler serving every proxied request, along with the proxies behind it so that they can be
+// closed on shutdown. Requests go to the -to backends, unless the config file routes their host, path pattern or path
+// prefix elsewhere. Backend addresses are parsed by parseTargets, with strict.
+func buildRoutes(to string, cfg *config.File, opts reverseproxy.Options, strict bool) (http.Handler, []*reverseproxy.Proxy, error) {
+	var proxies []*reverseproxy.Proxy
+	build := func(list string, opts reverseproxy.Options) (*reverseproxy.Proxy, error) {
+		targets, err := parseTargets(list, strict)
+		if err != nil {
+			return nil, err
+		}
+		p := reverseproxy.Build(targets, opts)
+		proxies = append(proxies, p)
+		return p, nil
+	}
+	closeAll := func() {
+		for _, p := range proxies {
+			p.Close()
+		}
+	}
+
+	mux := http.NewServeMux()
+	if to != "" {
+		p, err := build(to, opts)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to parse 'to' url: %v", err)
+		}
+		mux.Handle("/", p)
+	} else {
+		mux.Handle("/", http.NotFoundHandler())
+	}
+
+	if cfg != nil {
+		// The canary only stands in for the -to backends
+		opts.Canary = nil
+		hosts := make([]string, 0, len(cfg.Hosts))
+		for host := range cfg.Hosts {
+			hosts = append(hosts, host)
+		}
+		sort.Strings(hosts)
+		for _, host := range hosts {
+			p, err := build(cfg.Hosts[host].String(), opts)
+			if err != nil {
+				closeAll()
+				return nil, nil, fmt.Errorf("unable to parse backends for host %s: %v", host, err)
+			}
+			mux.Handle(host+"/", p)
+			logging.Infof("Proxying requests for host %s to %s", host, cfg.Hosts[host])
+		}
+
+		prefixes := make([]string, 0, len(cfg.Paths))
+		for prefix := range cfg.Paths {
+			prefixes = append(prefixes, prefix)
+		}
+		sort.Strings(prefixes)
+		for _, prefix := range prefixes {
+			route := cfg.Paths[prefix]
+			if !strings.HasPrefix(prefix, "/") {
+				closeAll()
+				return nil, nil, fmt.Errorf("path prefix %q must start with /", prefix)
+			}
+			// A trailing slash makes the ServeMux pattern match the whole subtree
+			pattern := strings.TrimSuffix(prefix, "/") + "/"
+			pathOpts := opts
+			if route.StripPrefix {
+				pathOpts.StripPrefix = pattern
+			}
+			p, err := build(route.To.String(), pathOpts)
+			if err != nil {
+				closeAll()
+				return nil, nil, fmt.Errorf("unable to parse backends for path %s: %v", prefix, err)
+			}
+			mux.Handle(pattern, p)
+			logging.Infof("Proxying requests under %s to %s", pattern, route.To)
+		}
+
+		if len(cfg.Patterns) > 0 {
+			pr := patternRouter{mux: mux}
+			for _, route := range cfg.Patterns {
+				p, err := build(route.To.String(), opts)
+				if err != nil {
+					closeAll()
+					return nil, nil, fmt.Errorf("unable to parse backends for pattern %s: %v", route.Match, err)
+				}
+				pr.routes = append(pr.routes, patternRoute{re: route.Regexp, rewrite: route.Rewrite, proxy: p})
+				logging.Infof("Proxying requests matching %s to %s", route.Match, route.To)
+			}
+			return pr, proxies, nil
+		}
+	}
+	return mux, proxies, nil
+}
+
+// patternRoute is a pattern route of the config file along with the proxy serving it
+type patternRoute struct {
+	re      *regexp.Regexp
+	rewrite string
+	proxy   http.Handler
+}
+
+// patternRouter sends requests whose path matches one of routes to the proxy of the first that does, rewriting the
+// path if that route says to, and every other request to mux. Requests for a host routed by mux are left to it, since
+// host routes take precedence.
+type patternRouter struct {
+	mux    *http.ServeMux
+	routes []patternRoute
+}
+
+func (pr patternRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if _, pattern := pr.mux.Handler(r); strings.HasPrefix(pattern, "/") {
+		for _, route := range pr.routes {
+			match := route.re.FindStringSubmatchIndex(r.URL.Path)
+			if match == nil {
+				continue
+			}
+			if route.rewrite != "" {
+				r2 := new(http.Request)
+				*r2 = *r
+				r2.URL = new(url.URL)
+				*r2.URL = *r.URL
+				// Only the first match is rewritten, as with a route that matches a prefix
+				path := route.re.ExpandString(nil, route.rewrite, r.URL.Path, match)
+				r2.URL.Path = r.URL.Path[:match[0]] + string(path) + r.URL.Path[match[1]:]
+				if !strings.HasPrefix(r2.URL.Path, "/") {
+					r2.URL.Path = "/" + r2.URL.Path
+				}
+				r2.URL.RawPath = ""
+				r = r2
+			}
+			route.proxy.ServeHTTP(w, r)
+			return
+		}
+	}
+	pr.mux.ServeHTTP(w, r)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/snewstv/ssl-proxy/config"
+	"github.com/snewstv/ssl-proxy/reverseproxy"
+	"github.com/stretchr/testify/assert"
+)
+
+// namedBackend starts a backend answering every request with name and the URI it was sent, returning its URL
+func namedBackend(t *testing.T, name string) string {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", name, r.URL.RequestURI())
+	}))
+	t.Cleanup(s.Close)
+	return s.URL
+}
+
+// TestBuildRoutes_Prefixes tests that requests go to the backends of the longest path prefix they are under, with the
+// prefix stripped if the route says to, that host routes take precedence over prefixes, and that everything else
+// goes to the default backends
+func TestBuildRoutes_Prefixes(t *testing.T) {
+	cfg, err := config.Parse([]byte(fmt.Sprintf(`
+hosts:
+  admin.example.com: %s
+paths:
+  /api/: %s
+  /api/v2:
+    to: %s
+    strip-prefix: true
+  /static/: %s
+`, namedBackend(t, "host"), namedBackend(t, "api"), namedBackend(t, "v2"), namedBackend(t, "static"))))
+	if !assert.Nil(t, err, "error should be nil") {
+		return
+	}
+	handler, proxies, err := buildRoutes(namedBackend(t, "default"), cfg, reverseproxy.Options{}, false)
+	if !assert.Nil(t, err, "error should be nil") {
+		return
+	}
+	defer func() {
+		for _, p := range proxies {
+			p.Close()
+		}
+	}()
+
+	for _, c := range []struct{ host, path, expected string }{
+		{"example.com", "/api/users?a=b", "api /api/users?a=b"},
+		{"example.com", "/api/v2/users", "v2 /users"},
+		{"example.com", "/api/v22/users", "api /api/v22/users"},
+		{"example.com", "/static/app.css", "static /static/app.css"},
+		{"example.com", "/staticfiles", "default /staticfiles"},
+		{"example.com", "/", "default /"},
+		{"admin.example.com", "/api/users", "host /api/users"},
+		{"admin.example.com:8443", "/static/app.css", "host /static/app.css"},
+	} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", c.path, nil)
+		req.Host = c.host
+		handler.ServeHTTP(rec, req)
+		assert.Equal(t, c.expected, rec.Body.String(), "unexpected route for %s%s", c.host, c.path)
+	}
+
+	// Without -to, only routed requests are proxied
+	routed, routedProxies, err := buildRoutes("", cfg, reverseproxy.Options{}, false)
+	if assert.Nil(t, err, "error should be nil") {
+		defer func() {
+			for _, p := range routedProxies {
+				p.Close()
+			}
+		}()
+		rec := httptest.NewRecorder()
+		routed.ServeHTTP(rec, httptest.NewRequest("GET", "/other", nil))
+		assert.Equal(t, http.StatusNotFound, rec.Code, "unrouted requests should get a 404 without -to")
+	}
+
+	cfg, err = config.Parse([]byte("paths:\n  api/: http://127.0.0.1\n"))
+	if assert.Nil(t, err, "error should be nil") {
+		_, _, err = buildRoutes("", cfg, reverseproxy.Options{}, false)
+		assert.NotNil(t, err, "a prefix not starting with / should be rejected")
+	}
+}
+
+// TestBuildRoutes_Patterns tests that the first pattern matching a request's path wins, ahead of path prefixes but
+// not host routes, and that matched paths are rewritten
+func TestBuildRoutes_Patterns(t *testing.T) {
+	cfg, err := config.Parse([]byte(fmt.Sprintf(`
+hosts:
+  admin.example.com: %s
+paths:
+  /legacy/: %s
+patterns:
+  - match: ^/v(\d+)/users
+    to: %s
+    rewrite: /users/v$1
+  - match: ^/v\d+/
+    to: %s
+  - match: foo
+    to: %s
+    rewrite: bar
+`, namedBackend(t, "host"), namedBackend(t, "prefix"), namedBackend(t, "users"), namedBackend(t, "versioned"), namedBackend(t, "foo"))))
+	if !assert.Nil(t, err, "error should be nil") {
+		return
+	}
+	handler, proxies, err := buildRoutes(namedBackend(t, "default"), cfg, reverseproxy.Options{}, false)
+	if !assert.Nil(t, err, "error should be nil") {
+		return
+	}
+	defer func() {
+		for _, p := range proxies {
+			p.Close()
+		}
+	}()
+
+	for _, c := range []struct{ host, path, expected string }{
+		{"example.com", "/v2/users/42?a=b", "users /users/v2/42?a=b"},
+		{"example.com", "/v1/items", "versioned /v1/items"},
+		{"example.com", "/legacy/v1/users", "prefix /legacy/v1/users"},
+		{"admin.example.com", "/v2/users", "host /v2/users"},
+		{"example.com", "/other", "default /other"},
+		{"example.com", "/foo/foo", "foo /bar/foo"},
+	} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", c.path, nil)
+		req.Host = c.host
+		handler.ServeHTTP(rec, req)
+		assert.Equal(t, c.expected, rec.Body.String(), "unexpected route for %s%s", c.host, c.path)
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/snewstv/ssl-proxy/logging"
+	"github.com/snewstv/ssl-proxy/reverseproxy"
+)
+
+// logSlow wraps next so that requests taking longer than threshold to serve, including waiting for the backend, are
+// logged with a warning naming the backend they were sent to
+func logSlow(next http.Handler, threshold time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		r, backend := reverseproxy.TrackBackend(r)
+		next.ServeHTTP(w, r)
+		if took := time.Since(start); took > threshold {
+			to := "none"
+			if u := backend(); u != nil {
+				to = u.String()
+			}
+			logging.Warnf("Slow request %s %s to backend %s took %s", r.Method, r.URL.Path, to, took.Round(time.Millisecond))
+		}
+	})
+}
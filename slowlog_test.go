@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/snewstv/ssl-proxy/reverseproxy"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestLogSlow tests that only requests over the threshold are logged, along with the backend that served them
+func TestLogSlow(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+	}))
+	defer backend.Close()
+	u, err := url.Parse(backend.URL)
+	assert.Nil(t, err, "error should be nil")
+	proxy := reverseproxy.Build([]reverseproxy.Target{{URL: u, Weight: 1}}, reverseproxy.Options{})
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	logSlow(proxy, time.Second).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/fast", nil))
+	assert.Empty(t, buf.String(), "requests under the threshold should not be logged")
+
+	logSlow(proxy, 10*time.Millisecond).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/slow", nil))
+	assert.Contains(t, buf.String(), "WARN: Slow request POST /slow to backend "+backend.URL+" took ",
+		"requests over the threshold should be logged with their backend")
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// serveStatic wraps next so that requests under prefix are served from the files in dir instead, with index.html
+// served for directories, and everything else goes to next. Files outside dir can't be reached, not even through
+// symlinks, and directories without an index.html aren't listed.
+func serveStatic(next http.Handler, dir, prefix string) (http.Handler, error) {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, err
+	}
+	fsys := root.FS()
+	prefix = strings.TrimSuffix("/"+strings.Trim(prefix, "/"), "/")
+	files := http.StripPrefix(prefix, http.FileServerFS(fsys))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != prefix && !strings.HasPrefix(r.URL.Path, prefix+"/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		name := strings.TrimPrefix(path.Clean("/"+strings.TrimPrefix(r.URL.Path, prefix)), "/")
+		if name == "" {
+			name = "."
+		}
+		if info, err := fs.Stat(fsys, name); err == nil && info.IsDir() {
+			if _, err := fs.Stat(fsys, path.Join(name, "index.html")); err != nil {
+				http.NotFound(w, r)
+				return
+			}
+		}
+		files.ServeHTTP(w, r)
+	}), nil
+}
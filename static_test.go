@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestServeStatic tests that files under the prefix are served from the directory without listings or escaping it, and
+// everything else is proxied
+func TestServeStatic(t *testing.T) {
+	dir := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "app.css"), []byte("body {}"), 0644), "error should be nil")
+	assert.Nil(t, os.MkdirAll(filepath.Join(dir, "docs", "empty"), 0755), "error should be nil")
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "docs", "index.html"), []byte("<p>docs</p>"), 0644), "error should be nil")
+	outside := filepath.Join(t.TempDir(), "secret")
+	assert.Nil(t, os.WriteFile(outside, []byte("secret"), 0644), "error should be nil")
+	assert.Nil(t, os.Symlink(outside, filepath.Join(dir, "link")), "error should be nil")
+
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("proxied")) })
+	handler, err := serveStatic(backend, dir, "/static/")
+	if !assert.Nil(t, err, "error should be nil") {
+		return
+	}
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec
+	}
+
+	rec := get("/static/app.css")
+	assert.Equal(t, "body {}", rec.Body.String(), "files under the prefix should be served")
+	assert.Contains(t, rec.Header().Get("Content-Type"), "text/css", "files should be served with their content type")
+	assert.Equal(t, "<p>docs</p>", get("/static/docs/").Body.String(), "directories should serve their index.html")
+	assert.Equal(t, http.StatusNotFound, get("/static/docs/empty/").Code, "directories without an index should not be listed")
+	assert.Equal(t, http.StatusNotFound, get("/static/../static/missing").Code, "missing files should 404")
+	assert.NotEqual(t, "secret", get("/static/link").Body.String(), "symlinks should not escape the directory")
+	assert.NotEqual(t, http.StatusOK, get("/static/../../"+filepath.Base(filepath.Dir(outside))+"/secret").Code,
+		"paths should not escape the directory")
+	assert.Equal(t, "proxied", get("/api/users").Body.String(), "other requests should be proxied")
+	assert.Equal(t, "proxied", get("/staticfile").Body.String(), "the prefix should only match whole path segments")
+}
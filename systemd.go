@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd socket activation
+const listenFDsStart = 3
+
+// systemdListeners returns the listening sockets passed by systemd socket activation, as described in sd_listen_fds(3).
+// The environment variables describing them are unset so that they aren't passed on to child processes.
+func systemdListeners() ([]net.Listener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, errors.New("no sockets were passed to this process (LISTEN_PID is not its PID)")
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, errors.New("no sockets were passed (LISTEN_FDS is not set)")
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	var listeners []net.Listener
+	for i := 0; i < n; i++ {
+		fd := listenFDsStart + i
+		name := "fd " + strconv.Itoa(fd)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		// FileListener works on a duplicate of the descriptor, so the original can be closed
+		f := os.NewFile(uintptr(fd), name)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("socket %s is not a listening socket: %v", name, err)
+		}
+		if tcp, ok := ln.(*net.TCPListener); ok {
+			ln = keepAliveListener{tcp, *tcpKeepAlive}
+		}
+		listeners = append(listeners, ln)
+	}
+	return listeners, nil
+}
+
+// keepAliveListener sets the TCP keep-alive period of accepted connections, for listeners that weren't created with
+// one by a net.ListenConfig
+type keepAliveListener struct {
+	*net.TCPListener
+	period time.Duration
+}
+
+func (l keepAliveListener) Accept() (net.Conn, error) {
+	c, err := l.AcceptTCP()
+	if err != nil {
+		return nil, err
+	}
+	if l.period < 0 {
+		c.SetKeepAlive(false)
+	} else if l.period > 0 {
+		c.SetKeepAlive(true)
+		c.SetKeepAlivePeriod(l.period)
+	}
+	return c, nil
+}
+
+// sdNotify sends state, e.g. READY=1, to the systemd service manager as described in sd_notify(3). It does nothing
+// unless systemd gave the process a notification socket in NOTIFY_SOCKET, as it does for services with Type=notify.
+func sdNotify(state string) error {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if name == "" {
+		return nil
+	}
+	// Names starting with @ are sockets in the abstract namespace
+	if strings.HasPrefix(name, "@") {
+		name = "\x00" + name[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("unable to notify systemd: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("unable to notify systemd: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestSystemdListeners_NotActivated tests that sockets aren't adopted unless they were passed to this process, and that
+// the socket activation variables are unset either way
+func TestSystemdListeners_NotActivated(t *testing.T) {
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getppid()))
+	t.Setenv("LISTEN_FDS", "1")
+	_, err := systemdListeners()
+	assert.ErrorContains(t, err, "LISTEN_PID", "sockets passed to another process should not be adopted")
+	_, set := os.LookupEnv("LISTEN_FDS")
+	assert.False(t, set, "the socket activation variables should be unset")
+
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	_, err = systemdListeners()
+	assert.ErrorContains(t, err, "LISTEN_FDS", "a missing LISTEN_FDS should be reported")
+}
+
+// TestSystemdListeners_Adopt tests that a listening socket passed in as fd 3, as systemd does, is adopted and accepts
+// connections. The socket is handed to a child run of this test, since fd 3 of the test process may already be taken.
+func TestSystemdListeners_Adopt(t *testing.T) {
+	if os.Getenv("SSL_PROXY_TEST_SYSTEMD_CHILD") == "1" {
+		// Only the child knows its own PID
+		t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+		listeners, err := systemdListeners()
+		if err != nil || len(listeners) != 1 {
+			t.Fatalf("expected one adopted listener, got %d: %v", len(listeners), err)
+		}
+		conn, err := listeners[0].Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprint(conn, listeners[0].Addr())
+		conn.Close()
+		return
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.Nil(t, err, "error should be nil") {
+		return
+	}
+	defer ln.Close()
+	f, err := ln.(*net.TCPListener).File()
+	if !assert.Nil(t, err, "error should be nil") {
+		return
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestSystemdListeners_Adopt$")
+	cmd.Env = append(os.Environ(), "SSL_PROXY_TEST_SYSTEMD_CHILD=1", "LISTEN_FDS=1", "LISTEN_FDNAMES=https")
+	cmd.ExtraFiles = []*os.File{f}
+	var out bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &out
+	err = cmd.Start()
+	f.Close()
+	if !assert.Nil(t, err, "error should be nil") {
+		return
+	}
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if assert.Nil(t, err, "error should be nil") {
+		conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		addr, err := io.ReadAll(conn)
+		conn.Close()
+		assert.Nil(t, err, "error should be nil")
+		assert.Equal(t, ln.Addr().String(), string(addr), "the passed socket should be adopted and accept connections")
+	}
+	assert.Nil(t, cmd.Wait(), "the child should adopt the socket: %s", &out)
+}
+
+// TestSdNotify tests that the state is sent to the socket in NOTIFY_SOCKET, and that nothing is sent without one
+func TestSdNotify(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	assert.Nil(t, sdNotify("READY=1"), "notifying should do nothing outside systemd")
+
+	addr := &net.UnixAddr{Name: filepath.Join(t.TempDir(), "notify"), Net: "unixgram"}
+	conn, err := net.ListenUnixgram("unixgram", addr)
+	if !assert.Nil(t, err, "error should be nil") {
+		return
+	}
+	defer conn.Close()
+	t.Setenv("NOTIFY_SOCKET", addr.Name)
+	assert.Nil(t, sdNotify("READY=1"), "error should be nil")
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	assert.Nil(t, err, "error should be nil")
+	assert.Equal(t, "READY=1", string(buf[:n]), "the state should be sent to the notification socket")
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"time"
+)
+
+// ticketKeys rotates the session ticket keys of a set of TLS configs, keeping the previous key valid so that sessions
+// issued shortly before a rotation can still be resumed after it
+type ticketKeys struct {
+	configs []*tls.Config
+	keys    [][32]byte
+}
+
+// rotate generates a new random key to issue tickets with, keeping only the previous one for resuming sessions
+func (t *ticketKeys) rotate() {
+	var key [32]byte
+	rand.Read(key[:]) // never fails
+	t.keys = append([][32]byte{key}, t.keys...)
+	if len(t.keys) > 2 {
+		t.keys = t.keys[:2]
+	}
+	for _, c := range t.configs {
+		c.SetSessionTicketKeys(t.keys)
+	}
+}
+
+// rotateEvery rotates the keys each interval until stop is closed
+func (t *ticketKeys) rotateEvery(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		t.rotate()
+	}
+}
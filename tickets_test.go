@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/tls"
+	"testing"
+	"time"
+
+	"github.com/snewstv/ssl-proxy/gen"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestTicketKeys tests that sessions are resumed across one rotation of the ticket keys, but not two
+func TestTicketKeys(t *testing.T) {
+	cert, err := gen.KeyPair(time.Hour, []string{"localhost"}, gen.ECDSAP256)
+	assert.Nil(t, err, "error should be nil")
+	server := &tls.Config{Certificates: []tls.Certificate{cert}}
+	tickets := &ticketKeys{configs: []*tls.Config{server}}
+	tickets.rotate()
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", server)
+	assert.Nil(t, err, "error should be nil")
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	// TLS 1.2 tickets are sent during the handshake, so the session is cached as soon as it completes
+	client := &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12, ClientSessionCache: tls.NewLRUClientSessionCache(1)}
+	resumed := func() bool {
+		conn, err := tls.Dial("tcp", ln.Addr().String(), client)
+		if !assert.Nil(t, err, "error should be nil") {
+			return false
+		}
+		defer conn.Close()
+		return conn.ConnectionState().DidResume
+	}
+
+	assert.False(t, resumed(), "the first connection should be a new session")
+	assert.True(t, resumed(), "the session should be resumed")
+	tickets.rotate()
+	assert.True(t, resumed(), "a session from before a rotation should still be resumed")
+	tickets.rotate()
+	tickets.rotate()
+	assert.False(t, resumed(), "a session from two rotations ago should not be resumed")
+}
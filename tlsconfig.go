@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// newTLSConfig creates the TLS settings shared by every way of serving TLS from the -min-tls-version and
+// -cipher-suites flag values
+func newTLSConfig(minVersion string, cipherSuites string) (*tls.Config, error) {
+	c := &tls.Config{}
+	switch minVersion {
+	case "1.2":
+		c.MinVersion = tls.VersionTLS12
+	case "1.3":
+		c.MinVersion = tls.VersionTLS13
+	default:
+		return nil, fmt.Errorf("invalid -min-tls-version %q, must be 1.2 or 1.3", minVersion)
+	}
+
+	suites, err := parseCipherSuites(splitList(cipherSuites))
+	if err != nil {
+		return nil, err
+	}
+	c.CipherSuites = suites
+	return c, nil
+}
+
+// parseCipherSuites looks up TLS 1.2 cipher suites by name. TLS 1.3 suites can't be configured in Go, so they are
+// not accepted.
+func parseCipherSuites(names []string) ([]uint16, error) {
+	valid := make(map[string]uint16)
+	var validNames []string
+	for _, suite := range tls.CipherSuites() {
+		for _, v := range suite.SupportedVersions {
+			if v == tls.VersionTLS12 {
+				valid[suite.Name] = suite.ID
+				validNames = append(validNames, suite.Name)
+				break
+			}
+		}
+	}
+
+	var ids []uint16
+	for _, name := range names {
+		id, ok := valid[name]
+		if !ok {
+			return nil, fmt.Errorf("invalid cipher suite %q, must be one of: %s", name, strings.Join(validNames, ", "))
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// clientAuthModes are the accepted -client-auth-mode values
+var clientAuthModes = []struct {
+	name string
+	mode tls.ClientAuthType
+}{
+	{"none", tls.NoClientCert},
+	{"request", tls.RequestClientCert},
+	{"require", tls.RequireAnyClientCert},
+	{"verify-if-given", tls.VerifyClientCertIfGiven},
+	{"require-and-verify", tls.RequireAndVerifyClientCert},
+}
+
+// setClientAuth configures c to authenticate clients by certificate from the -client-ca and -client-auth-mode flag
+// values. The mode defaults to require-and-verify if a CA bundle is given, and none otherwise.
+func setClientAuth(c *tls.Config, caFile, mode string) error {
+	if mode == "" {
+		mode = "none"
+		if caFile != "" {
+			mode = "require-and-verify"
+		}
+	}
+	var names []string
+	found := false
+	for _, m := range clientAuthModes {
+		names = append(names, m.name)
+		if m.name == mode {
+			c.ClientAuth = m.mode
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("invalid -client-auth-mode %q, must be one of: %s", mode, strings.Join(names, ", "))
+	}
+
+	verifies := c.ClientAuth == tls.VerifyClientCertIfGiven || c.ClientAuth == tls.RequireAndVerifyClientCert
+	if caFile == "" {
+		if verifies {
+			return fmt.Errorf("-client-auth-mode %s needs a -client-ca to verify client certificates with", mode)
+		}
+		return nil
+	}
+	if !verifies {
+		return fmt.Errorf("-client-ca has no effect with -client-auth-mode %s, which doesn't verify client certificates", mode)
+	}
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return err
+	}
+	c.ClientCAs = x509.NewCertPool()
+	if !c.ClientCAs.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("no certificates found in -client-ca %s", caFile)
+	}
+	return nil
+}
+
+// withTLSPolicy copies the version, cipher suite and client authentication settings of policy onto c
+func withTLSPolicy(c *tls.Config, policy *tls.Config) *tls.Config {
+	c.MinVersion = policy.MinVersion
+	c.CipherSuites = policy.CipherSuites
+	c.ClientAuth = policy.ClientAuth
+	c.ClientCAs = policy.ClientCAs
+	return c
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/snewstv/ssl-proxy/internal/testcert"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestNewTLSConfig tests that the minimum TLS version and TLS 1.2 cipher suites are parsed, and that unknown versions
+// and suites, including the unconfigurable TLS 1.3 ones, are rejected
+func TestNewTLSConfig(t *testing.T) {
+	c, err := newTLSConfig("1.2", "")
+	if assert.Nil(t, err, "error should be nil") {
+		assert.Equal(t, uint16(tls.VersionTLS12), c.MinVersion, "1.2 should set TLS 1.2 as the minimum")
+		assert.Nil(t, c.CipherSuites, "Go's default suites should be used without -cipher-suites")
+	}
+	c, err = newTLSConfig("1.3", "")
+	if assert.Nil(t, err, "error should be nil") {
+		assert.Equal(t, uint16(tls.VersionTLS13), c.MinVersion, "1.3 should set TLS 1.3 as the minimum")
+	}
+	c, err = newTLSConfig("1.2", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256")
+	if assert.Nil(t, err, "error should be nil") {
+		assert.Equal(t, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256},
+			c.CipherSuites, "the listed suites should be allowed in order")
+	}
+
+	for _, v := range []string{"", "1.0", "1.1", "TLS1.2"} {
+		_, err = newTLSConfig(v, "")
+		assert.NotNil(t, err, "-min-tls-version %q should be rejected", v)
+	}
+	for _, suites := range []string{"TLS_FAKE_SUITE", "TLS_AES_128_GCM_SHA256", "tls_ecdhe_rsa_with_aes_128_gcm_sha256"} {
+		_, err = newTLSConfig("1.2", suites)
+		assert.NotNil(t, err, "-cipher-suites %q should be rejected", suites)
+	}
+}
+
+// TestSetClientAuth tests each -client-auth-mode with and without a -client-ca, that the mode defaults depending on
+// whether a CA is given, and that a mode which verifies needs a CA while one which doesn't refuses it
+func TestSetClientAuth(t *testing.T) {
+	_, ca, _ := testcert.Chain(t, &x509.Certificate{})
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	assert.Nil(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0644), "error should be nil")
+	notPEM := filepath.Join(dir, "ca.txt")
+	assert.Nil(t, os.WriteFile(notPEM, []byte("not a certificate"), 0644), "error should be nil")
+
+	for _, tt := range []struct {
+		mode, caFile string
+		want         tls.ClientAuthType
+		ok           bool
+	}{
+		{"", "", tls.NoClientCert, true},
+		{"", caFile, tls.RequireAndVerifyClientCert, true},
+		{"none", "", tls.NoClientCert, true},
+		{"request", "", tls.RequestClientCert, true},
+		{"require", "", tls.RequireAnyClientCert, true},
+		{"verify-if-given", "", 0, false},
+		{"require-and-verify", "", 0, false},
+		{"none", caFile, 0, false},
+		{"request", caFile, 0, false},
+		{"require", caFile, 0, false},
+		{"verify-if-given", caFile, tls.VerifyClientCertIfGiven, true},
+		{"require-and-verify", caFile, tls.RequireAndVerifyClientCert, true},
+		{"always", "", 0, false},
+		{"", notPEM, 0, false},
+		{"", filepath.Join(dir, "missing.pem"), 0, false},
+	} {
+		c := &tls.Config{}
+		err := setClientAuth(c, tt.caFile, tt.mode)
+		if !tt.ok {
+			assert.NotNil(t, err, "mode %q with CA %q should be rejected", tt.mode, tt.caFile)
+			continue
+		}
+		if assert.Nil(t, err, "mode %q with CA %q should be accepted", tt.mode, tt.caFile) {
+			assert.Equal(t, tt.want, c.ClientAuth, "unexpected client auth for mode %q with CA %q", tt.mode, tt.caFile)
+			if tt.caFile != "" {
+				_, err := ca.Verify(x509.VerifyOptions{Roots: c.ClientCAs})
+				assert.Nil(t, err, "the CA should be trusted to verify client certs")
+			} else {
+				assert.Nil(t, c.ClientCAs, "no CAs should be set without -client-ca")
+			}
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// Build information, set at build time with -ldflags "-X main.version=..." (see .goreleaser.yml and the Makefile)
+var (
+	version = ""
+	commit  = ""
+	date    = ""
+	builtBy = ""
+)
+
+// versionString describes this build, falling back to the module version and VCS information embedded by the go
+// command for anything not set with -ldflags
+func versionString() string {
+	v, c, d := version, commit, date
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if v == "" && info.Main.Version != "" && info.Main.Version != "(devel)" {
+			v = info.Main.Version
+		}
+		modified := false
+		for _, s := range info.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				if c == "" {
+					c = s.Value
+				}
+			case "vcs.time":
+				if d == "" {
+					d = s.Value
+				}
+			case "vcs.modified":
+				modified = s.Value == "true"
+			}
+		}
+		if modified && commit == "" {
+			c += " (modified)"
+		}
+	}
+
+	s := fmt.Sprintf("ssl-proxy %s\ncommit: %s\nbuilt: %s", orUnknown(v, "dev"), orUnknown(c, "unknown"), orUnknown(d, "unknown"))
+	if builtBy != "" {
+		s += " by " + builtBy
+	}
+	return s + fmt.Sprintf("\ngo: %s %s/%s", runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}
+
+func orUnknown(s, fallback string) string {
+	if s == "" {
+		return fallback
+	}
+	return s
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/snewstv/ssl-proxy/logging"
+)
+
+// watchFiles calls changed whenever any of files is created, written, removed or renamed, until stop is closed. It
+// waits until no change has been seen for debounce, so that several changes in a row, or a file still being written,
+// only call changed once. The directories holding the files are watched rather than the files themselves, so that
+// files that don't exist yet or are replaced by a rename or a symlink swap (as certbot does) are still noticed. ready,
+// if non-nil, is closed once the directories are being watched.
+func watchFiles(files []string, debounce time.Duration, changed func(), stop <-chan struct{}, ready chan<- struct{}) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	watched := make(map[string]bool)
+	for _, f := range files {
+		abs, err := filepath.Abs(f)
+		if err != nil {
+			return err
+		}
+		watched[abs] = true
+		if err := w.Add(filepath.Dir(abs)); err != nil {
+			return err
+		}
+	}
+
+	if ready != nil {
+		close(ready)
+	}
+
+	timer := time.NewTimer(debounce)
+	timer.Stop()
+	for {
+		select {
+		case ev, ok := <-w.Events:
+			if !ok {
+				return nil
+			}
+			if watched[filepath.Clean(ev.Name)] {
+				logging.Debugf("%s changed (%s), acting on it once unchanged for %s", ev.Name, ev.Op, debounce)
+				timer.Reset(debounce)
+			}
+		case err, ok := <-w.Errors:
+			if !ok {
+				return nil
+			}
+			logging.Errorf("Error watching %v for changes: %v", files, err)
+		case <-timer.C:
+			changed()
+		case <-stop:
+			return nil
+		}
+	}
+}